@@ -11,9 +11,11 @@ import (
 	"net/http"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
 
@@ -39,6 +41,13 @@ type Server struct {
 	neo4jDriver neo4j.DriverWithContext
 	embedder    embeddings.Embedder
 	llmClient   llm.Client
+	reranker    chat.Reranker
+	ingestOpts  []ingestion.Option
+
+	// spaceEmbedders holds the query embedders of spaces other than the
+	// configured one, created when chat first searches them.
+	spaceMu        sync.Mutex
+	spaceEmbedders map[string]embeddings.Embedder
 }
 
 // CleanupFunc is a function that cleans up server resources
@@ -73,17 +82,121 @@ type clearRequest struct {
 }
 
 type chatRequest struct {
-	Question string           `json:"question"`
-	Limit    int              `json:"limit"`
-	Sections []string         `json:"sections"`
-	Topics   []string         `json:"topics"`
-	History  []messagePayload `json:"history"`
+	Question         string             `json:"question"`
+	Limit            int                `json:"limit"`
+	Sections         []string           `json:"sections"`
+	Topics           []string           `json:"topics"`
+	Folders          []string           `json:"folders"`
+	Paths            []string           `json:"paths"`
+	DocumentIDs      []string           `json:"documentIds"`
+	History          []messagePayload   `json:"history"`
+	Agent            bool               `json:"agent"`
+	MaxSteps         int                `json:"maxSteps"`
+	Options          *generationPayload `json:"options,omitempty"`
+	NoCache          bool               `json:"noCache"`
+	Hybrid           bool               `json:"hybrid"`
+	Weights          *weightsPayload    `json:"weights,omitempty"`
+	Rerank           *bool              `json:"rerank,omitempty"`
+	RerankCandidates int                `json:"rerankCandidates"`
+	MMR              bool               `json:"mmr"`
+	MMRLambda        float64            `json:"mmrLambda"`
+	QueryExpansion   string             `json:"queryExpansion"`
+	QueryVariants    int                `json:"queryVariants"`
+	NoCondense       bool               `json:"noCondense"`
+	ContextExpansion string             `json:"contextExpansion"`
+	ContextRadius    int                `json:"contextRadius"`
+	Grounding        string             `json:"grounding"`
+	MinScore         *float64           `json:"minScore,omitempty"`
+}
+
+type weightsPayload struct {
+	Vector  float64 `json:"vector"`
+	Lexical float64 `json:"lexical"`
+}
+
+func (p *weightsPayload) toWeights() chat.FusionWeights {
+	if p == nil {
+		return chat.FusionWeights{}
+	}
+	return chat.FusionWeights{Vector: p.Vector, Lexical: p.Lexical}
+}
+
+type generationPayload struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"topP,omitempty"`
+	MaxTokens   int      `json:"maxTokens,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	NumCtx      int      `json:"numCtx,omitempty"`
 }
 
 type chatResponse struct {
-	Answer  string           `json:"answer"`
-	Sources []chatSource     `json:"sources"`
-	History []messagePayload `json:"history,omitempty"`
+	Answer      string           `json:"answer"`
+	SearchQuery string           `json:"searchQuery,omitempty"`
+	Grounded    bool             `json:"grounded"`
+	Sources     []chatSource     `json:"sources"`
+	Steps       []chatStep       `json:"steps,omitempty"`
+	Usage       chatUsage        `json:"usage"`
+	Timings     chatTimings      `json:"timings"`
+	Provider    string           `json:"provider,omitempty"`
+	History     []messagePayload `json:"history,omitempty"`
+}
+
+type extractRequest struct {
+	Instruction      string             `json:"instruction"`
+	Schema           json.RawMessage    `json:"schema"`
+	Limit            int                `json:"limit"`
+	Sections         []string           `json:"sections"`
+	Topics           []string           `json:"topics"`
+	Folders          []string           `json:"folders"`
+	Paths            []string           `json:"paths"`
+	DocumentIDs      []string           `json:"documentIds"`
+	MaxAttempts      int                `json:"maxAttempts"`
+	Options          *generationPayload `json:"options,omitempty"`
+	NoCache          bool               `json:"noCache"`
+	Hybrid           bool               `json:"hybrid"`
+	Weights          *weightsPayload    `json:"weights,omitempty"`
+	Rerank           *bool              `json:"rerank,omitempty"`
+	RerankCandidates int                `json:"rerankCandidates"`
+	MMR              bool               `json:"mmr"`
+	MMRLambda        float64            `json:"mmrLambda"`
+}
+
+type extractResponse struct {
+	Data     json.RawMessage `json:"data"`
+	Sources  []chatSource    `json:"sources"`
+	Attempts int             `json:"attempts"`
+	Usage    chatUsage       `json:"usage"`
+	Timings  chatTimings     `json:"timings"`
+	Provider string          `json:"provider,omitempty"`
+}
+
+type chatUsage struct {
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+	TotalTokens      int `json:"totalTokens"`
+}
+
+// chatTimings reports stage durations in milliseconds.
+type chatTimings struct {
+	CondenseMs         float64 `json:"condenseMs"`
+	QueryExpansionMs   float64 `json:"queryExpansionMs"`
+	EmbedMs            float64 `json:"embedMs"`
+	VectorSearchMs     float64 `json:"vectorSearchMs"`
+	LexicalSearchMs    float64 `json:"lexicalSearchMs"`
+	RerankMs           float64 `json:"rerankMs"`
+	ContextExpansionMs float64 `json:"contextExpansionMs"`
+	GraphInsightsMs    float64 `json:"graphInsightsMs"`
+	GenerationMs       float64 `json:"generationMs"`
+	TotalMs            float64 `json:"totalMs"`
+}
+
+type chatStep struct {
+	Step      int    `json:"step"`
+	Tool      string `json:"tool"`
+	Arguments string `json:"arguments"`
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
 }
 
 type messagePayload struct {
@@ -92,12 +205,13 @@ type messagePayload struct {
 }
 
 type chatSource struct {
-	DocumentID string              `json:"documentId"`
-	Title      string              `json:"title"`
-	Path       string              `json:"path"`
-	Snippet    string              `json:"snippet"`
-	Score      float64             `json:"score"`
-	Insight    chatDocumentInsight `json:"insight"`
+	DocumentID  string              `json:"documentId"`
+	Title       string              `json:"title"`
+	Path        string              `json:"path"`
+	Snippet     string              `json:"snippet"`
+	Score       float64             `json:"score"`
+	RerankScore float64             `json:"rerankScore,omitempty"`
+	Insight     chatDocumentInsight `json:"insight"`
 }
 
 type chatDocumentInsight struct {
@@ -162,13 +276,40 @@ func New(cfg config.Config, logger *log.Logger) (*Server, CleanupFunc, error) {
 		return nil, nil, fmt.Errorf("embedder setup: %w", err)
 	}
 
+	var ingestOpts []ingestion.Option
+	if cfg.Embeddings.Cache {
+		if err := database.EnsureEmbeddingCacheSchema(ctx, pgPool); err != nil {
+			neo4jDriver.Close(ctx)
+			pgPool.Close()
+			return nil, nil, fmt.Errorf("embedding cache schema: %w", err)
+		}
+		ingestOpts = append(ingestOpts, ingestion.WithEmbeddingCache(embeddings.NewPostgresCache(pgPool), embeddings.FingerprintFor(cfg.Embeddings)))
+	}
+
+	ingestOpts = append(ingestOpts, ingestion.WithEmbeddingSpace(database.SpaceFromConfig(cfg.Embeddings)), ingestion.WithVectorIndex(cfg.VectorIndex))
+
 	// Initialize LLM client
-	llmClient, err := llm.NewClient(cfg)
+	var llmOptions []llm.ClientOption
+	if cfg.LLM.Cache.Enabled {
+		if err := database.EnsureLLMCacheSchema(ctx, pgPool); err != nil {
+			neo4jDriver.Close(ctx)
+			pgPool.Close()
+			return nil, nil, fmt.Errorf("llm cache schema: %w", err)
+		}
+		llmOptions = append(llmOptions, llm.WithResponseCache(llm.NewPostgresResponseCache(pgPool)))
+	}
+	llmClient, err := llm.NewClient(cfg, llmOptions...)
 	if err != nil {
 		neo4jDriver.Close(ctx)
 		pgPool.Close()
 		return nil, nil, fmt.Errorf("llm setup: %w", err)
 	}
+	reranker, err := chat.NewReranker(cfg.Rerank, llmClient)
+	if err != nil {
+		neo4jDriver.Close(ctx)
+		pgPool.Close()
+		return nil, nil, fmt.Errorf("reranker setup: %w", err)
+	}
 
 	s := &Server{
 		cfg:         cfg,
@@ -177,8 +318,13 @@ func New(cfg config.Config, logger *log.Logger) (*Server, CleanupFunc, error) {
 		neo4jDriver: neo4jDriver,
 		embedder:    embedder,
 		llmClient:   llmClient,
+		reranker:    reranker,
+		ingestOpts:  ingestOpts,
+
+		spaceEmbedders: map[string]embeddings.Embedder{},
 	}
 	s.handler = s.routes()
+	s.checkVectorIndex(ctx)
 
 	cleanup := func() {
 		cleanupCtx := context.Background()
@@ -209,6 +355,7 @@ func (s *Server) routes() http.Handler {
 	mux.HandleFunc("/v1/ingest/upload", s.handleIngestUpload)
 	mux.HandleFunc("/v1/chat", s.handleChat)
 	mux.HandleFunc("/v1/chat/stream", s.handleChatStream)
+	mux.HandleFunc("/v1/extract", s.handleExtract)
 	mux.HandleFunc("/v1/clear", s.handleClear)
 	mux.HandleFunc("/", s.handleRoot)
 	mux.Handle("/assets/", s.staticHandler())
@@ -383,6 +530,30 @@ func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
 		s.writeError(w, http.StatusBadRequest, err)
 		return
 	}
+	if err := validateDocumentIDs(req.DocumentIDs); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateMMRLambda(req.MMRLambda); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := chat.ValidateFusionWeights(req.Weights.toWeights()); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := chat.ValidateQueryExpansion(req.QueryExpansion); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := chat.ValidateContextExpansion(req.ContextExpansion); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := chat.ValidateGrounding(req.Grounding); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	svc, cleanup, err := s.buildChatService(ctx)
 	if err != nil {
@@ -391,13 +562,13 @@ func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
 	}
 	defer cleanup()
 
-	resp, updatedHistory, err := svc.ChatStream(ctx, req.Question, chat.Config{
-		SimilarityLimit: s.resolveLimit(req.Limit),
-		SectionFilters:  req.Sections,
-		TopicFilters:    req.Topics,
-	}, history, nil)
+	resp, updatedHistory, err := svc.ChatStream(ctx, req.Question, s.chatConfig(req), history, nil)
 	if err != nil {
-		s.writeError(w, http.StatusInternalServerError, fmt.Errorf("chat failed: %w", err))
+		status := http.StatusInternalServerError
+		if errors.Is(err, chat.ErrNotGrounded) {
+			status = http.StatusUnprocessableEntity
+		}
+		s.writeError(w, status, fmt.Errorf("chat failed: %w", err))
 		return
 	}
 
@@ -433,6 +604,30 @@ func (s *Server) handleChatStream(w http.ResponseWriter, r *http.Request) {
 		s.writeError(w, http.StatusBadRequest, err)
 		return
 	}
+	if err := validateDocumentIDs(req.DocumentIDs); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateMMRLambda(req.MMRLambda); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := chat.ValidateFusionWeights(req.Weights.toWeights()); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := chat.ValidateQueryExpansion(req.QueryExpansion); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := chat.ValidateContextExpansion(req.ContextExpansion); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := chat.ValidateGrounding(req.Grounding); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	ctx := r.Context()
 	svc, cleanup, err := s.buildChatService(ctx)
@@ -446,11 +641,12 @@ func (s *Server) handleChatStream(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	resp, updatedHistory, err := svc.ChatStream(ctx, req.Question, chat.Config{
-		SimilarityLimit: s.resolveLimit(req.Limit),
-		SectionFilters:  req.Sections,
-		TopicFilters:    req.Topics,
-	}, history, func(chunk string) error {
+	cfg := s.chatConfig(req)
+	cfg.OnStep = func(step chat.AgentStep) error {
+		return s.sendSSE(w, flusher, "step", toChatStep(step))
+	}
+
+	resp, updatedHistory, err := svc.ChatStream(ctx, req.Question, cfg, history, func(chunk string) error {
 		return s.sendSSE(w, flusher, "chunk", chatStreamChunk{Content: chunk})
 	})
 	if err != nil {
@@ -470,6 +666,91 @@ func (s *Server) handleChatStream(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) handleExtract(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req extractRequest
+	if err := decodeJSON(r, &req); err != nil {
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("decode request: %w", err))
+		return
+	}
+
+	req.Instruction = strings.TrimSpace(req.Instruction)
+	if req.Instruction == "" {
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("instruction is required"))
+		return
+	}
+	if len(req.Schema) == 0 {
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("schema is required"))
+		return
+	}
+	if err := llm.ValidateSchema(req.Schema); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateDocumentIDs(req.DocumentIDs); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateMMRLambda(req.MMRLambda); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := chat.ValidateFusionWeights(req.Weights.toWeights()); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	svc, cleanup, err := s.buildChatService(ctx)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer cleanup()
+
+	cfg := chat.Config{
+		SimilarityLimit:        s.resolveLimit(req.Limit),
+		SectionFilters:         req.Sections,
+		TopicFilters:           req.Topics,
+		FolderFilters:          req.Folders,
+		PathFilters:            req.Paths,
+		DocumentIDs:            req.DocumentIDs,
+		Generation:             req.Options.toOptions(),
+		ExtractAttempts:        req.MaxAttempts,
+		BypassCache:            req.NoCache,
+		AllowEmbeddingMismatch: s.cfg.Embeddings.AllowMismatch,
+		Hybrid:                 req.Hybrid,
+		Weights:                req.Weights.toWeights(),
+		Rerank:                 s.rerankEnabled(req.Rerank),
+		RerankCandidates:       req.RerankCandidates,
+		MMR:                    req.MMR,
+		MMRLambda:              req.MMRLambda,
+	}
+	extraction, err := svc.Extract(ctx, req.Instruction, req.Schema, cfg)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, llm.ErrInvalidStructuredOutput) {
+			status = http.StatusUnprocessableEntity
+		}
+		s.writeError(w, status, fmt.Errorf("extract failed: %w", err))
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, extractResponse{
+		Data:     extraction.Data,
+		Sources:  buildSources(extraction.Sources),
+		Attempts: extraction.Attempts,
+		Usage:    toChatUsage(extraction.Usage),
+		Timings:  toChatTimings(extraction.Timings),
+		Provider: extraction.Provider,
+	})
+}
+
 func (s *Server) handleClear(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		s.methodNotAllowed(w, http.MethodPost)
@@ -495,7 +776,7 @@ func (s *Server) handleClear(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Use existing connection pool
-	if _, err := s.pgPool.Exec(ctx, "TRUNCATE rag_chunks, rag_documents"); err != nil {
+	if _, err := s.pgPool.Exec(ctx, "TRUNCATE rag_chunks, rag_documents CASCADE"); err != nil {
 		s.writeError(w, http.StatusInternalServerError, fmt.Errorf("truncate postgres tables: %w", err))
 		return
 	}
@@ -565,9 +846,67 @@ func (s *Server) resolveLimit(limit int) int {
 	return limit
 }
 
+func (s *Server) chatConfig(req chatRequest) chat.Config {
+	cfg := chat.Config{
+		SimilarityLimit:        s.resolveLimit(req.Limit),
+		SectionFilters:         req.Sections,
+		TopicFilters:           req.Topics,
+		FolderFilters:          req.Folders,
+		PathFilters:            req.Paths,
+		DocumentIDs:            req.DocumentIDs,
+		Agent:                  req.Agent,
+		MaxSteps:               req.MaxSteps,
+		BypassCache:            req.NoCache,
+		AllowEmbeddingMismatch: s.cfg.Embeddings.AllowMismatch,
+		Hybrid:                 req.Hybrid,
+		Weights:                req.Weights.toWeights(),
+		Rerank:                 s.rerankEnabled(req.Rerank),
+		RerankCandidates:       req.RerankCandidates,
+		MMR:                    req.MMR,
+		MMRLambda:              req.MMRLambda,
+		QueryExpansion:         req.QueryExpansion,
+		QueryVariants:          req.QueryVariants,
+		NoCondense:             req.NoCondense,
+		ContextExpansion:       req.ContextExpansion,
+		ContextRadius:          req.ContextRadius,
+		Grounding:              s.cfg.Grounding.Mode,
+		MinScore:               s.cfg.Grounding.MinScore,
+	}
+	if req.Grounding != "" {
+		cfg.Grounding = req.Grounding
+	}
+	if req.MinScore != nil {
+		cfg.MinScore = *req.MinScore
+	}
+	cfg.Generation = req.Options.toOptions()
+	return cfg
+}
+
+// rerankEnabled resolves a request's rerank flag against the configuration.
+func (s *Server) rerankEnabled(requested *bool) bool {
+	if requested != nil {
+		return *requested
+	}
+	return s.reranker != nil
+}
+
+func (p *generationPayload) toOptions() config.GenerationOptions {
+	if p == nil {
+		return config.GenerationOptions{}
+	}
+	return config.GenerationOptions{
+		Temperature: p.Temperature,
+		TopP:        p.TopP,
+		MaxTokens:   p.MaxTokens,
+		Stop:        p.Stop,
+		Seed:        p.Seed,
+		NumCtx:      p.NumCtx,
+	}
+}
+
 func (s *Server) buildIngestionService(_ context.Context) (*ingestion.Service, func(), error) {
 	// Reuse existing connections from the server
-	svc := ingestion.NewService(s.pgPool, s.neo4jDriver, s.embedder, s.logger, s.cfg.Embeddings.Dimension)
+	svc := ingestion.NewService(s.pgPool, s.neo4jDriver, s.embedder, s.logger, s.cfg.Embeddings.Dimension, s.ingestOpts...)
 
 	// No cleanup needed as connections are managed by the server
 	cleanup := func() {}
@@ -575,11 +914,22 @@ func (s *Server) buildIngestionService(_ context.Context) (*ingestion.Service, f
 	return svc, cleanup, nil
 }
 
-func (s *Server) buildChatService(_ context.Context) (*chat.Service, func(), error) {
+func (s *Server) buildChatService(ctx context.Context) (*chat.Service, func(), error) {
+	// The active space is resolved per request so that switching spaces
+	// takes effect without a restart.
+	space, err := database.QueryEmbeddingSpace(ctx, s.pgPool, s.cfg.Embeddings)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolve embedding space: %w", err)
+	}
+	embedder, err := s.spaceEmbedder(space)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Reuse existing connections from the server
-	vectorStore := chat.NewPostgresVectorStore(s.pgPool)
+	vectorStore := chat.NewPostgresVectorStore(s.pgPool, chat.WithSpace(space.Name), chat.WithVectorIndex(s.cfg.VectorIndex))
 	graphStore := chat.NewNeo4jGraphStore(s.neo4jDriver)
-	svc := chat.NewService(vectorStore, graphStore, s.embedder, s.llmClient, s.logger)
+	svc := chat.NewService(vectorStore, graphStore, embedder, s.llmClient, s.logger, chat.WithReranker(s.reranker))
 
 	// No cleanup needed as connections are managed by the server
 	cleanup := func() {}
@@ -587,6 +937,59 @@ func (s *Server) buildChatService(_ context.Context) (*chat.Service, func(), err
 	return svc, cleanup, nil
 }
 
+// checkVectorIndex warns when the searched space's vector index was built
+// with other settings than the configured ones.
+func (s *Server) checkVectorIndex(ctx context.Context) {
+	space, err := database.QueryEmbeddingSpace(ctx, s.pgPool, s.cfg.Embeddings)
+	if err == nil {
+		err = database.CheckVectorIndex(ctx, s.pgPool, space.Table(), s.cfg.VectorIndex)
+	}
+	if err != nil {
+		s.logger.Printf("warning: %v", err)
+	}
+}
+
+// spaceEmbedder returns an embedder producing query vectors for space.
+func (s *Server) spaceEmbedder(space database.EmbeddingSpace) (embeddings.Embedder, error) {
+	if space.Name == s.cfg.Embeddings.Space {
+		return s.embedder, nil
+	}
+
+	s.spaceMu.Lock()
+	defer s.spaceMu.Unlock()
+	if embedder, ok := s.spaceEmbedders[space.Name]; ok {
+		return embedder, nil
+	}
+	cfg := s.cfg
+	cfg.Embeddings = space.SearchConfig(cfg.Embeddings)
+	embedder, err := embeddings.NewEmbedder(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("embedder setup for space %s: %w", space.Name, err)
+	}
+	s.spaceEmbedders[space.Name] = embedder
+	return embedder, nil
+}
+
+// validateDocumentIDs rejects document id filters that are not UUIDs.
+func validateDocumentIDs(ids []string) error {
+	for _, id := range ids {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		if _, err := uuid.Parse(id); err != nil {
+			return fmt.Errorf("invalid document id %q: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func validateMMRLambda(lambda float64) error {
+	if lambda < 0 || lambda > 1 {
+		return fmt.Errorf("mmrLambda must be between 0 and 1")
+	}
+	return nil
+}
+
 func parseHistory(payloads []messagePayload) ([]llm.Message, error) {
 	if len(payloads) == 0 {
 		return nil, nil
@@ -620,14 +1023,56 @@ func toMessagePayloads(messages []llm.Message) []messagePayload {
 }
 
 func buildChatResponse(resp chat.Response, history []llm.Message) chatResponse {
-	converted := chatResponse{Answer: resp.Answer}
+	converted := chatResponse{Answer: resp.Answer, SearchQuery: resp.SearchQuery, Grounded: resp.Grounded, Provider: resp.Provider}
 	converted.Sources = buildSources(resp.Sources)
+	for _, step := range resp.Steps {
+		converted.Steps = append(converted.Steps, toChatStep(step))
+	}
+	converted.Usage = toChatUsage(resp.Usage)
+	converted.Timings = toChatTimings(resp.Timings)
 	if len(history) > 0 {
 		converted.History = toMessagePayloads(history)
 	}
 	return converted
 }
 
+func toChatStep(step chat.AgentStep) chatStep {
+	return chatStep{
+		Step:      step.Step,
+		Tool:      step.Tool,
+		Arguments: step.Arguments,
+		Result:    step.Result,
+		Error:     step.Error,
+	}
+}
+
+func toChatUsage(usage llm.Usage) chatUsage {
+	return chatUsage{
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+	}
+}
+
+func toChatTimings(timings chat.Timings) chatTimings {
+	return chatTimings{
+		CondenseMs:         milliseconds(timings.Condense),
+		QueryExpansionMs:   milliseconds(timings.QueryExpansion),
+		EmbedMs:            milliseconds(timings.Embed),
+		VectorSearchMs:     milliseconds(timings.VectorSearch),
+		LexicalSearchMs:    milliseconds(timings.LexicalSearch),
+		RerankMs:           milliseconds(timings.Rerank),
+		ContextExpansionMs: milliseconds(timings.ContextExpansion),
+		GraphInsightsMs:    milliseconds(timings.GraphInsights),
+		GenerationMs:       milliseconds(timings.Generation),
+		TotalMs:            milliseconds(timings.Total),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
 func buildSources(sources []chat.Source) []chatSource {
 	if len(sources) == 0 {
 		return nil
@@ -636,12 +1081,13 @@ func buildSources(sources []chat.Source) []chatSource {
 	for i := range sources {
 		src := sources[i]
 		converted[i] = chatSource{
-			DocumentID: src.DocumentID,
-			Title:      src.Title,
-			Path:       src.Path,
-			Snippet:    src.Snippet,
-			Score:      src.Score,
-			Insight:    transformInsight(src.Insight),
+			DocumentID:  src.DocumentID,
+			Title:       src.Title,
+			Path:        src.Path,
+			Snippet:     src.Snippet,
+			Score:       src.Score,
+			RerankScore: src.RerankScore,
+			Insight:     transformInsight(src.Insight),
 		}
 	}
 	return converted
@@ -0,0 +1,239 @@
+// Package cassette stores recorded provider interactions on disk so that they
+// can be replayed without network access.
+package cassette
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrNotRecorded is returned when a replayed request has no recording.
+var ErrNotRecorded = errors.New("interaction not recorded in cassette")
+
+// Interaction is a single recorded request and its response. Key is derived
+// from Request with Key.
+type Interaction struct {
+	Kind     string          `json:"kind"`
+	Key      string          `json:"key"`
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response"`
+}
+
+type file struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Cassette is a JSON file of interactions. Requests recorded more than once
+// are replayed in recording order, after which the last response repeats. It
+// is safe for concurrent use.
+//
+// Recordings are kept in memory until Flush or Close writes the file.
+type Cassette struct {
+	mu           sync.Mutex
+	path         string
+	interactions []Interaction
+	recorded     map[string]bool
+	played       map[string]int
+	dirty        bool
+}
+
+var (
+	openMu sync.Mutex
+	// opened holds the cassettes opened by absolute path.
+	opened = map[string]*Cassette{}
+)
+
+// Open loads the cassette at path, starting an empty one when the file does
+// not exist. New recordings are appended to it. Opening a path again returns
+// the same cassette, so that its users do not overwrite each other's
+// recordings. FlushAll writes every opened cassette.
+func Open(path string) (*Cassette, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("resolve cassette path: %w", err)
+	}
+	openMu.Lock()
+	defer openMu.Unlock()
+	if c, ok := opened[abs]; ok {
+		return c, nil
+	}
+
+	c := &Cassette{path: abs, recorded: map[string]bool{}, played: map[string]int{}}
+	data, err := os.ReadFile(abs)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read cassette: %w", err)
+	}
+	if err == nil {
+		var parsed file
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			return nil, fmt.Errorf("decode cassette %s: %w", path, err)
+		}
+		c.interactions = parsed.Interactions
+		for _, interaction := range c.interactions {
+			c.recorded[interaction.Key] = true
+		}
+	}
+
+	opened[abs] = c
+	return c, nil
+}
+
+// FlushAll writes the pending recordings of every opened cassette.
+func FlushAll() error {
+	openMu.Lock()
+	cassettes := make([]*Cassette, 0, len(opened))
+	for _, c := range opened {
+		cassettes = append(cassettes, c)
+	}
+	openMu.Unlock()
+
+	var errs []error
+	for _, c := range cassettes {
+		if err := c.Flush(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Load opens an existing cassette for replay.
+func Load(path string) (*Cassette, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("open cassette: %w", err)
+	}
+	return Open(path)
+}
+
+// Key fingerprints a request so that identical requests share a key.
+func Key(kind string, request any) (string, json.RawMessage, error) {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return "", nil, fmt.Errorf("marshal cassette request: %w", err)
+	}
+	sum := sha256.Sum256(append([]byte(kind+"\n"), encoded...))
+	return hex.EncodeToString(sum[:]), encoded, nil
+}
+
+// Record appends an interaction. It is written by the next Flush.
+func (c *Cassette) Record(kind string, request, response any) error {
+	return c.record(kind, request, response, false)
+}
+
+// RecordOnce appends an interaction unless the request was recorded before,
+// for deterministic providers whose repeated answers would only grow the
+// cassette.
+func (c *Cassette) RecordOnce(kind string, request, response any) error {
+	return c.record(kind, request, response, true)
+}
+
+func (c *Cassette) record(kind string, request, response any, once bool) error {
+	key, encodedRequest, err := Key(kind, request)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if once && c.recorded[key] {
+		return nil
+	}
+	encodedResponse, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("marshal cassette response: %w", err)
+	}
+	c.interactions = append(c.interactions, Interaction{
+		Kind:     kind,
+		Key:      key,
+		Request:  encodedRequest,
+		Response: encodedResponse,
+	})
+	c.recorded[key] = true
+	c.dirty = true
+	return nil
+}
+
+// Replay decodes the next recorded response for request into dst.
+func (c *Cassette) Replay(kind string, request, dst any) error {
+	key, _, err := Key(kind, request)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	var matches []Interaction
+	for _, interaction := range c.interactions {
+		if interaction.Key == key {
+			matches = append(matches, interaction)
+		}
+	}
+	if len(matches) == 0 {
+		c.mu.Unlock()
+		return fmt.Errorf("%s request %s: %w", kind, key[:12], ErrNotRecorded)
+	}
+	next := c.played[key]
+	if next >= len(matches) {
+		next = len(matches) - 1
+	}
+	c.played[key] = next + 1
+	c.mu.Unlock()
+
+	if err := json.Unmarshal(matches[next].Response, dst); err != nil {
+		return fmt.Errorf("decode cassette response: %w", err)
+	}
+	return nil
+}
+
+// Len returns the number of recorded interactions.
+func (c *Cassette) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.interactions)
+}
+
+// Flush writes the cassette file when interactions were recorded since the
+// last write.
+func (c *Cassette) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	if err := c.save(); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// Close flushes the cassette. It stays usable for replay.
+func (c *Cassette) Close() error {
+	return c.Flush()
+}
+
+// save writes the cassette through a temporary file so that an interrupted
+// write never leaves a truncated cassette behind.
+func (c *Cassette) save() error {
+	data, err := json.MarshalIndent(file{Interactions: c.interactions}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal cassette: %w", err)
+	}
+	if dir := filepath.Dir(c.path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("create cassette directory: %w", err)
+		}
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("write cassette: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("replace cassette: %w", err)
+	}
+	return nil
+}
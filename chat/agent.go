@@ -0,0 +1,433 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fabfab/go-agent/embeddings"
+	"github.com/fabfab/go-agent/llm"
+)
+
+const (
+	defaultAgentMaxSteps = 5
+	maxToolResultChars   = 4000
+	maxToolSnippetChars  = 800
+	// agentStreamHold is how much content a streamed turn may produce before
+	// it is taken for the answer and forwarded as it arrives.
+	agentStreamHold = 200
+)
+
+const (
+	toolSearchChunks         = "search_chunks"
+	toolDocumentInsights     = "get_document_insights"
+	toolReadSection          = "read_section"
+	toolListRelatedDocuments = "list_related_documents"
+)
+
+// agentRun holds the state accumulated across the tool-calling turns of a
+// single agent conversation.
+type agentRun struct {
+	cfg      Config
+	chunks   []ChunkResult
+	seen     map[string]struct{}
+	steps    []AgentStep
+	sections SectionReader
+	timings  Timings
+}
+
+func (r *agentRun) collect(chunks []ChunkResult) {
+	for i := range chunks {
+		if key := chunks[i].ChunkID; key != "" {
+			if _, ok := r.seen[key]; ok {
+				continue
+			}
+			r.seen[key] = struct{}{}
+		}
+		r.chunks = append(r.chunks, chunks[i])
+	}
+}
+
+// runAgent answers question by letting the model call retrieval tools until it
+// produces a final answer or the step budget runs out, at which point it is
+// asked to answer with the context gathered so far.
+func (s *Service) runAgent(
+	ctx context.Context,
+	question string,
+	cfg Config,
+	history []llm.Message,
+	streamFn func(string) error,
+) (Response, []llm.Message, error) {
+	toolClient, ok := s.llm.(llm.ToolClient)
+	if !ok {
+		return Response{}, nil, fmt.Errorf("agent mode: %w", llm.ErrToolsUnsupported)
+	}
+
+	maxSteps := cfg.MaxSteps
+	if maxSteps <= 0 {
+		maxSteps = defaultAgentMaxSteps
+	}
+
+	run := &agentRun{cfg: cfg, seen: make(map[string]struct{})}
+	if reader, ok := s.vectors.(SectionReader); ok {
+		run.sections = reader
+	}
+	tools := s.agentTools(run)
+
+	userMessage := llm.Message{Role: llm.RoleUser, Content: question}
+	messages := make([]llm.Message, 0, len(history)+2)
+	messages = append(messages, llm.Message{Role: llm.RoleSystem, Content: agentSystemPrompt(cfg.Grounding)})
+	messages = append(messages, history...)
+	messages = append(messages, userMessage)
+
+	// Tool calls search with ctx, so only the model turns see the
+	// per-request generation options.
+	genCtx := llm.WithGenerationOptions(ctx, cfg.Generation)
+	answer := ""
+	answered := false
+	for turn := 0; turn < maxSteps; turn++ {
+		stage := time.Now()
+		reply, err := s.generateWithTools(genCtx, toolClient, messages, tools, streamFn)
+		if err != nil {
+			return Response{}, nil, err
+		}
+		run.timings.Generation += time.Since(stage)
+		if len(reply.ToolCalls) == 0 {
+			answer = reply.Content
+			answered = true
+			break
+		}
+
+		messages = append(messages, reply)
+		for _, call := range reply.ToolCalls {
+			result, toolErr := s.runTool(ctx, run, call)
+			step := AgentStep{Step: len(run.steps) + 1, Tool: call.Name, Arguments: call.Arguments, Result: result}
+			if toolErr != nil {
+				if errors.Is(toolErr, context.Canceled) || errors.Is(toolErr, context.DeadlineExceeded) {
+					return Response{}, nil, toolErr
+				}
+				step.Error = toolErr.Error()
+				result = "error: " + toolErr.Error()
+			}
+			run.steps = append(run.steps, step)
+			if cfg.OnStep != nil {
+				if err := cfg.OnStep(step); err != nil {
+					return Response{}, nil, err
+				}
+			}
+			messages = append(messages, llm.Message{Role: llm.RoleTool, Name: call.Name, ToolCallID: call.ID, Content: result})
+		}
+	}
+
+	if !answered {
+		messages = append(messages, llm.Message{
+			Role:    llm.RoleUser,
+			Content: "The tool budget is exhausted. Answer the original question now using only the information gathered above.",
+		})
+		stage := time.Now()
+		generated, err := s.generate(genCtx, messages, streamFn)
+		if err != nil {
+			return Response{}, nil, err
+		}
+		run.timings.Generation += time.Since(stage)
+		answer = generated
+	}
+
+	stage := time.Now()
+	insights := s.documentInsights(ctx, run.chunks)
+	run.timings.GraphInsights += time.Since(stage)
+	sources := mergeSources(run.chunks, insights)
+
+	answer = strings.TrimSpace(answer)
+	updatedHistory := make([]llm.Message, 0, len(history)+2)
+	updatedHistory = append(updatedHistory, history...)
+	updatedHistory = append(updatedHistory, userMessage, llm.Message{Role: llm.RoleAssistant, Content: answer})
+
+	grounded := len(sources) > 0 && !(strictGrounding(cfg.Grounding) && answeredNotFound(answer))
+	return Response{Answer: answer, Sources: sources, Steps: run.steps, Timings: run.timings, Grounded: grounded}, updatedHistory, nil
+}
+
+func (s *Service) generateWithTools(
+	ctx context.Context,
+	client llm.ToolClient,
+	messages []llm.Message,
+	tools []llm.Tool,
+	streamFn func(string) error,
+) (llm.Message, error) {
+	if streamFn == nil {
+		reply, err := client.GenerateWithTools(ctx, messages, tools)
+		if err != nil {
+			return llm.Message{}, fmt.Errorf("llm generate with tools: %w", err)
+		}
+		return reply, nil
+	}
+
+	// Content of a turn that ends in tool calls is thinking aloud, not part of
+	// the answer. Such turns open with at most a short preamble, so content is
+	// held until it outgrows one and streamed from then on.
+	turn := &turnStream{streamFn: streamFn}
+	reply, err := client.GenerateWithToolsStream(ctx, messages, tools, turn.delta)
+	if err != nil {
+		return llm.Message{}, fmt.Errorf("llm stream generate with tools: %w", err)
+	}
+	if len(reply.ToolCalls) == 0 {
+		if err := turn.flush(); err != nil {
+			return llm.Message{}, err
+		}
+	}
+	return reply, nil
+}
+
+// turnStream forwards the content of one model turn to streamFn once the turn
+// looks like the answer, and drops it when the turn calls tools first.
+type turnStream struct {
+	streamFn  func(string) error
+	held      strings.Builder
+	streaming bool
+	toolCalls bool
+}
+
+func (t *turnStream) delta(delta llm.StreamDelta) error {
+	if len(delta.ToolCalls) > 0 {
+		t.toolCalls = true
+	}
+	if t.toolCalls || delta.Content == "" {
+		return nil
+	}
+	if t.streaming {
+		return t.streamFn(delta.Content)
+	}
+	t.held.WriteString(delta.Content)
+	if t.held.Len() < agentStreamHold {
+		return nil
+	}
+	t.streaming = true
+	return t.streamFn(t.held.String())
+}
+
+// flush forwards content still held when the turn ends without tool calls.
+func (t *turnStream) flush() error {
+	if t.streaming || t.held.Len() == 0 {
+		return nil
+	}
+	return t.streamFn(t.held.String())
+}
+
+// agentTools lists the tools available to the model. Tools backed by an
+// optional store are only offered when that store is configured.
+func (s *Service) agentTools(run *agentRun) []llm.Tool {
+	tools := []llm.Tool{{
+		Name:        toolSearchChunks,
+		Description: "Semantic search over the knowledge base. Returns matching chunks with their document_id and section_order.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"query":{"type":"string","description":"Search query"},"limit":{"type":"integer","description":"Maximum number of chunks to return"}},"required":["query"]}`),
+	}}
+	if s.graph != nil {
+		tools = append(tools,
+			llm.Tool{
+				Name:        toolDocumentInsights,
+				Description: "Return folders, sections, topics and chunk counts for documents.",
+				Parameters:  json.RawMessage(`{"type":"object","properties":{"document_ids":{"type":"array","items":{"type":"string"}}},"required":["document_ids"]}`),
+			},
+			llm.Tool{
+				Name:        toolListRelatedDocuments,
+				Description: "List documents related to a document through shared folders or topics.",
+				Parameters:  json.RawMessage(`{"type":"object","properties":{"document_id":{"type":"string"}},"required":["document_id"]}`),
+			},
+		)
+	}
+	if run.sections != nil {
+		tools = append(tools, llm.Tool{
+			Name:        toolReadSection,
+			Description: "Read the full text of one section of a document.",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"document_id":{"type":"string"},"section_order":{"type":"integer"}},"required":["document_id","section_order"]}`),
+		})
+	}
+	return tools
+}
+
+func (s *Service) runTool(ctx context.Context, run *agentRun, call llm.ToolCall) (string, error) {
+	switch call.Name {
+	case toolSearchChunks:
+		var args struct {
+			Query string `json:"query"`
+			Limit int    `json:"limit"`
+		}
+		if err := call.DecodeArguments(&args); err != nil {
+			return "", err
+		}
+		return s.toolSearchChunks(ctx, run, args.Query, args.Limit)
+	case toolDocumentInsights:
+		var args struct {
+			DocumentIDs []string `json:"document_ids"`
+		}
+		if err := call.DecodeArguments(&args); err != nil {
+			return "", err
+		}
+		return s.toolDocumentInsights(ctx, run, args.DocumentIDs)
+	case toolListRelatedDocuments:
+		var args struct {
+			DocumentID string `json:"document_id"`
+		}
+		if err := call.DecodeArguments(&args); err != nil {
+			return "", err
+		}
+		return s.toolListRelatedDocuments(ctx, run, args.DocumentID)
+	case toolReadSection:
+		var args struct {
+			DocumentID   string `json:"document_id"`
+			SectionOrder int    `json:"section_order"`
+		}
+		if err := call.DecodeArguments(&args); err != nil {
+			return "", err
+		}
+		return s.toolReadSection(ctx, run, args.DocumentID, args.SectionOrder)
+	default:
+		return "", fmt.Errorf("unknown tool: %s", call.Name)
+	}
+}
+
+func (s *Service) toolSearchChunks(ctx context.Context, run *agentRun, query string, limit int) (string, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return "", fmt.Errorf("query is required")
+	}
+	if limit <= 0 {
+		limit = run.cfg.SimilarityLimit
+	}
+	if limit <= 0 {
+		limit = defaultSimilarityLimit
+	}
+
+	stage := time.Now()
+	vectors, served, err := embeddings.EmbedQueryServed(ctx, s.embedder, []string{query})
+	if err != nil {
+		return "", fmt.Errorf("embed query: %w", err)
+	}
+	if err := s.checkServedModel(served, run.cfg); err != nil {
+		return "", err
+	}
+	if len(vectors) == 0 {
+		return "", fmt.Errorf("embedder returned no vectors")
+	}
+	run.timings.Embed += time.Since(stage)
+
+	chunks, err := s.search(ctx, query, vectors[0], limit, run.cfg, &run.timings)
+	if err != nil {
+		return "", err
+	}
+	if len(chunks) == 0 {
+		return "No matching chunks found.", nil
+	}
+	run.collect(chunks)
+
+	var sb strings.Builder
+	for i := range chunks {
+		chunk := &chunks[i]
+		fmt.Fprintf(&sb, "[%d] %s (%s) document_id=%s section_order=%d section=%q score=%.3f\n",
+			i+1, chunk.Title, chunk.Path, chunk.DocumentID, chunk.SectionOrder, chunk.SectionTitle, chunk.Score)
+		sb.WriteString(truncate(strings.TrimSpace(chunk.Content), maxToolSnippetChars))
+		sb.WriteString("\n\n")
+	}
+	return truncate(sb.String(), maxToolResultChars), nil
+}
+
+func (s *Service) toolDocumentInsights(ctx context.Context, run *agentRun, docIDs []string) (string, error) {
+	if len(docIDs) == 0 {
+		return "", fmt.Errorf("document_ids is required")
+	}
+	stage := time.Now()
+	insights, err := s.graph.DocumentInsights(ctx, unique(docIDs))
+	if err != nil {
+		return "", fmt.Errorf("graph insights: %w", err)
+	}
+	run.timings.GraphInsights += time.Since(stage)
+
+	var sb strings.Builder
+	for _, id := range unique(docIDs) {
+		insight, ok := insights[id]
+		if !ok {
+			fmt.Fprintf(&sb, "%s: no insights found\n", id)
+			continue
+		}
+		fmt.Fprintf(&sb, "%s: %d chunks\n", id, insight.ChunkCount)
+		if len(insight.Folders) > 0 {
+			sb.WriteString("  Folders: " + strings.Join(insight.Folders, ", ") + "\n")
+		}
+		if len(insight.Topics) > 0 {
+			sb.WriteString("  Topics: " + strings.Join(insight.Topics, ", ") + "\n")
+		}
+		for _, section := range insight.Sections {
+			fmt.Fprintf(&sb, "  Section %d: %s (level %d)\n", section.Order, section.Title, section.Level)
+		}
+	}
+	return truncate(sb.String(), maxToolResultChars), nil
+}
+
+func (s *Service) toolListRelatedDocuments(ctx context.Context, run *agentRun, docID string) (string, error) {
+	if docID == "" {
+		return "", fmt.Errorf("document_id is required")
+	}
+	stage := time.Now()
+	insights, err := s.graph.DocumentInsights(ctx, []string{docID})
+	if err != nil {
+		return "", fmt.Errorf("graph insights: %w", err)
+	}
+	run.timings.GraphInsights += time.Since(stage)
+
+	related := insights[docID].RelatedDocuments
+	if len(related) == 0 {
+		return "No related documents found.", nil
+	}
+
+	var sb strings.Builder
+	for _, doc := range related {
+		fmt.Fprintf(&sb, "- %s (%s) document_id=%s via %s weight %.2f\n", doc.Title, doc.Path, doc.ID, doc.Reason, doc.Weight)
+	}
+	return truncate(sb.String(), maxToolResultChars), nil
+}
+
+func (s *Service) toolReadSection(ctx context.Context, run *agentRun, docID string, sectionOrder int) (string, error) {
+	if docID == "" {
+		return "", fmt.Errorf("document_id is required")
+	}
+	chunks, err := run.sections.SectionChunks(ctx, docID, sectionOrder)
+	if err != nil {
+		return "", fmt.Errorf("read section: %w", err)
+	}
+	if len(chunks) == 0 {
+		return "Section not found.", nil
+	}
+	run.collect(chunks)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s (%s) section %d: %s\n\n", chunks[0].Title, chunks[0].Path, sectionOrder, chunks[0].SectionTitle)
+	for i := range chunks {
+		sb.WriteString(strings.TrimSpace(chunks[i].Content))
+		sb.WriteString("\n\n")
+	}
+	return truncate(sb.String(), maxToolResultChars), nil
+}
+
+// truncate cuts value to at most limit bytes, backing off to a rune boundary,
+// and marks the cut with an ellipsis.
+func truncate(value string, limit int) string {
+	if len(value) <= limit {
+		return value
+	}
+	for limit > 0 && !utf8.RuneStart(value[limit]) {
+		limit--
+	}
+	return value[:limit] + "..."
+}
+
+func agentSystemPrompt(grounding string) string {
+	prompt := "You are a research assistant with access to a knowledge base through tools. Search the knowledge base before answering, read sections or related documents when a result looks promising, and stop calling tools once you have enough information. Answer in markdown, starting with the direct answer, and cite the documents you relied on by title."
+	if strictGrounding(grounding) {
+		return prompt + " Answer only from what the tools returned, never from general knowledge. If the knowledge base does not cover the question, reply exactly: " + NotFoundAnswer
+	}
+	return prompt + " If the knowledge base does not cover the question, say so and give your best general answer."
+}
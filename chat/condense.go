@@ -0,0 +1,68 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fabfab/go-agent/llm"
+)
+
+const (
+	// condenseMessages bounds the prior messages shown to the rewriter.
+	condenseMessages = 6
+	// maxCondenseChars bounds each prior message shown to the rewriter.
+	maxCondenseChars = 600
+)
+
+// condense rewrites a follow-up question into a standalone search query using
+// the last turns of history. Context passed with earlier questions is left
+// out.
+func (s *Service) condense(ctx context.Context, question string, history []llm.Message) (string, error) {
+	var turns []string
+	for _, message := range history {
+		switch message.Role {
+		case llm.RoleUser:
+			turns = append(turns, "User: "+truncate(turnQuestion(message.Content), maxCondenseChars))
+		case llm.RoleAssistant:
+			if content := strings.TrimSpace(message.Content); content != "" {
+				turns = append(turns, "Assistant: "+truncate(content, maxCondenseChars))
+			}
+		}
+	}
+	if len(turns) == 0 {
+		return question, nil
+	}
+	if len(turns) > condenseMessages {
+		turns = turns[len(turns)-condenseMessages:]
+	}
+
+	rewritten, err := s.llm.Generate(ctx, []llm.Message{
+		{Role: llm.RoleSystem, Content: "You rewrite the latest question of a conversation into a standalone search query for a knowledge base. Resolve pronouns and references such as \"the second one\" from the conversation and keep the key terms. Reply with the query only. If the question already stands alone, repeat it unchanged."},
+		{Role: llm.RoleUser, Content: fmt.Sprintf("Conversation:\n%s\n\nLatest question: %s", strings.Join(turns, "\n"), question)},
+	})
+	if err != nil {
+		return "", fmt.Errorf("condense question: %w", err)
+	}
+	for _, line := range strings.Split(rewritten, "\n") {
+		if line = strings.Trim(line, " \t\"'`"); line != "" {
+			return line, nil
+		}
+	}
+	return question, nil
+}
+
+// turnQuestion returns the question of a user message built by
+// formatUserPrompt, or the whole message for other messages.
+func turnQuestion(content string) string {
+	question, ok := strings.CutPrefix(content, "Question:\n")
+	if !ok {
+		return strings.TrimSpace(content)
+	}
+	for _, marker := range []string{"\nContext (optional, may be incomplete):\n", "\nProvide your answer in markdown."} {
+		if before, _, found := strings.Cut(question, marker); found {
+			question = before
+		}
+	}
+	return strings.TrimSpace(question)
+}
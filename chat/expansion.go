@@ -0,0 +1,159 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fabfab/go-agent/embeddings"
+	"github.com/fabfab/go-agent/llm"
+)
+
+// Query expansion strategies for Config.QueryExpansion.
+const (
+	// QueryExpansionMultiQuery searches paraphrases of the question too.
+	QueryExpansionMultiQuery = "multi-query"
+	// QueryExpansionHyDE searches with the embedding of a hypothetical answer
+	// too (Hypothetical Document Embeddings).
+	QueryExpansionHyDE = "hyde"
+)
+
+const (
+	defaultQueryVariants = 3
+	expansionAttempts    = 2
+)
+
+// ValidateQueryExpansion rejects unknown query expansion strategies.
+func ValidateQueryExpansion(strategy string) error {
+	switch strategy {
+	case "", QueryExpansionMultiQuery, QueryExpansionHyDE:
+		return nil
+	default:
+		return fmt.Errorf("unsupported query expansion %q (want %s or %s)", strategy, QueryExpansionMultiQuery, QueryExpansionHyDE)
+	}
+}
+
+var multiQuerySchema = json.RawMessage(`{"type":"object","properties":{"queries":{"type":"array","items":{"type":"string"}}},"required":["queries"]}`)
+
+// rankExpanded ranks the chunks for query and, with Config.QueryExpansion,
+// for the variants the strategy derives from it, and fuses the rankings with
+// reciprocal rank fusion. When expansion fails the query is searched alone.
+func (s *Service) rankExpanded(ctx context.Context, query string, vector []float32, limit int, cfg Config, timings *Timings) ([]ChunkResult, error) {
+	if err := ValidateQueryExpansion(cfg.QueryExpansion); err != nil {
+		return nil, err
+	}
+	if cfg.QueryExpansion == "" {
+		return s.rank(ctx, query, vector, limit, cfg, timings)
+	}
+
+	variants, vectors, err := s.expandQuery(ctx, query, cfg, timings)
+	if err != nil {
+		s.logger.Printf("query expansion error: %v", err)
+	}
+	if len(variants) == 0 {
+		return s.rank(ctx, query, vector, limit, cfg, timings)
+	}
+	return s.rankVariants(ctx, append([]string{query}, variants...), append([][]float32{vector}, vectors...), limit, cfg, timings)
+}
+
+// expandQuery returns the variants of query and their embeddings. HyDE
+// passages are embedded as documents, paraphrases as queries.
+func (s *Service) expandQuery(ctx context.Context, query string, cfg Config, timings *Timings) ([]string, [][]float32, error) {
+	stage := time.Now()
+	variants, err := s.queryVariants(ctx, query, cfg)
+	timings.QueryExpansion += time.Since(stage)
+	if err != nil || len(variants) == 0 {
+		return nil, nil, err
+	}
+
+	stage = time.Now()
+	var (
+		vectors [][]float32
+		served  embeddings.Fingerprint
+	)
+	if cfg.QueryExpansion == QueryExpansionHyDE {
+		vectors, served, err = embeddings.EmbedDocumentsServed(ctx, s.embedder, variants)
+	} else {
+		vectors, served, err = embeddings.EmbedQueryServed(ctx, s.embedder, variants)
+	}
+	timings.Embed += time.Since(stage)
+	if err != nil {
+		return nil, nil, fmt.Errorf("embed query variants: %w", err)
+	}
+	if err := s.checkServedModel(served, cfg); err != nil {
+		return nil, nil, err
+	}
+	if len(vectors) != len(variants) {
+		return nil, nil, fmt.Errorf("embedder returned %d vectors for %d query variants", len(vectors), len(variants))
+	}
+	return variants, vectors, nil
+}
+
+// rankVariants ranks the chunks for every query and fuses the rankings,
+// weighing them equally.
+func (s *Service) rankVariants(ctx context.Context, queries []string, vectors [][]float32, limit int, cfg Config, timings *Timings) ([]ChunkResult, error) {
+	rankings := make([][]ChunkResult, len(queries))
+	weights := make([]float64, len(queries))
+	for i := range queries {
+		chunks, err := s.rank(ctx, queries[i], vectors[i], limit, cfg, timings)
+		if err != nil {
+			return nil, err
+		}
+		rankings[i], weights[i] = chunks, 1
+	}
+	return fuse(limit, weights, rankings...), nil
+}
+
+// queryVariants asks the LLM for the extra queries of cfg's strategy. Variants
+// repeating the query or each other are dropped.
+func (s *Service) queryVariants(ctx context.Context, query string, cfg Config) ([]string, error) {
+	var candidates []string
+	switch cfg.QueryExpansion {
+	case QueryExpansionHyDE:
+		passage, err := s.llm.Generate(ctx, []llm.Message{
+			{Role: llm.RoleSystem, Content: "Write a short passage, as it would appear in a knowledge base document, that answers the question. Write it even if you are unsure of the facts; do not mention the question or that you are guessing."},
+			{Role: llm.RoleUser, Content: query},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("generate hypothetical answer: %w", err)
+		}
+		candidates = []string{passage}
+	default:
+		count := cfg.QueryVariants
+		if count <= 0 {
+			count = defaultQueryVariants
+		}
+		result, err := llm.GenerateStructured(ctx, s.llm, []llm.Message{
+			{Role: llm.RoleSystem, Content: fmt.Sprintf("You rewrite search queries for a knowledge base. Return %d different phrasings of the user's question in \"queries\", using other words, synonyms and more specific terms.", count)},
+			{Role: llm.RoleUser, Content: query},
+		}, multiQuerySchema, expansionAttempts)
+		if err != nil {
+			return nil, fmt.Errorf("generate query variants: %w", err)
+		}
+		var parsed struct {
+			Queries []string `json:"queries"`
+		}
+		if err := json.Unmarshal(result.Data, &parsed); err != nil {
+			return nil, fmt.Errorf("decode query variants: %w", err)
+		}
+		candidates = parsed.Queries
+		if len(candidates) > count {
+			candidates = candidates[:count]
+		}
+	}
+
+	seen := map[string]bool{strings.ToLower(query): true}
+	variants := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		candidate = strings.TrimSpace(candidate)
+		key := strings.ToLower(candidate)
+		if candidate == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		variants = append(variants, candidate)
+	}
+	return variants, nil
+}
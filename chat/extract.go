@@ -0,0 +1,98 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fabfab/go-agent/llm"
+)
+
+// Extraction is the structured record produced by Extract.
+type Extraction struct {
+	// Data is JSON that validates against the requested schema.
+	Data     json.RawMessage
+	Sources  []Source
+	Attempts int
+	Usage    llm.Usage
+	Timings  Timings
+	Provider string
+}
+
+// Extract retrieves knowledge base context for instruction, as Chat does, and
+// asks the model for a JSON value matching schema. Invalid output is sent back
+// to the model for correction up to cfg.ExtractAttempts times; if it never
+// validates the error wraps llm.ErrInvalidStructuredOutput.
+func (s *Service) Extract(ctx context.Context, instruction string, schema json.RawMessage, cfg Config) (Extraction, error) {
+	instruction = strings.TrimSpace(instruction)
+	if instruction == "" {
+		return Extraction{}, fmt.Errorf("instruction cannot be empty")
+	}
+	if err := llm.ValidateSchema(schema); err != nil {
+		return Extraction{}, err
+	}
+	if err := s.checkDependencies(); err != nil {
+		return Extraction{}, err
+	}
+	if err := s.checkEmbeddingModel(ctx, cfg); err != nil {
+		return Extraction{}, err
+	}
+
+	if cfg.BypassCache {
+		ctx = llm.WithCacheBypass(ctx)
+	}
+	meter := &llm.Meter{}
+	ctx = llm.WithMeter(ctx, meter)
+	started := time.Now()
+
+	var timings Timings
+	sources, err := s.retrieve(ctx, instruction, cfg, &timings)
+	if err != nil {
+		return Extraction{}, err
+	}
+
+	contextPrompt := ""
+	if len(sources) > 0 {
+		contextPrompt = buildContextPrompt(sources)
+	}
+	messages := []llm.Message{
+		{Role: llm.RoleSystem, Content: extractSystemPrompt()},
+		{Role: llm.RoleUser, Content: formatExtractPrompt(instruction, contextPrompt)},
+	}
+
+	stage := time.Now()
+	result, err := llm.GenerateStructured(llm.WithGenerationOptions(ctx, cfg.Generation), s.llm, messages, schema, cfg.ExtractAttempts)
+	if err != nil {
+		return Extraction{}, err
+	}
+	timings.Generation = time.Since(stage)
+	timings.Total = time.Since(started)
+
+	return Extraction{
+		Data:     result.Data,
+		Sources:  sources,
+		Attempts: result.Attempts,
+		Usage:    meter.Usage(),
+		Timings:  timings,
+		Provider: meter.Provider(),
+	}, nil
+}
+
+func extractSystemPrompt() string {
+	return "You extract structured data from a knowledge base. Use only facts stated in the supplied context. When the context does not contain a value, use null or an empty array rather than inventing one."
+}
+
+func formatExtractPrompt(instruction, context string) string {
+	var sb strings.Builder
+	sb.WriteString("Instruction:\n")
+	sb.WriteString(instruction)
+	if strings.TrimSpace(context) != "" {
+		sb.WriteString("\nContext:\n")
+		sb.WriteString(context)
+	} else {
+		sb.WriteString("\nNo context matched this instruction.")
+	}
+	return sb.String()
+}
@@ -0,0 +1,145 @@
+package chat
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Filter restricts a search to matching chunks. Empty fields match every
+// chunk; a chunk must match one value of every field that is set.
+type Filter struct {
+	// Sections match section titles case-insensitively by substring, or the
+	// section order exactly. Chunks without a section title are in
+	// "introduction".
+	Sections []string
+	// Topics match document topics case-insensitively by substring.
+	Topics []string
+	// Folders match documents in the folder or any folder below it.
+	Folders []string
+	// Paths are globs over document paths. * and ? do not match a slash,
+	// ** matches any run of characters.
+	Paths []string
+	// DocumentIDs match documents by id.
+	DocumentIDs []string
+}
+
+// IsZero reports whether the filter matches every chunk.
+func (f Filter) IsZero() bool {
+	return len(normalizeFilters(f.Sections)) == 0 && len(normalizeFilters(f.Topics)) == 0 &&
+		len(trimmed(f.Folders)) == 0 && len(trimmed(f.Paths)) == 0 && len(trimmed(f.DocumentIDs)) == 0
+}
+
+// sqlFilter builds the conditions for f over rag_chunks rc joined with
+// rag_documents rd. Arguments are appended to args and numbered after the
+// ones already there. The result is empty or starts with " AND ".
+func sqlFilter(f Filter, args *[]any) (string, error) {
+	var conds []string
+	arg := func(value any) string {
+		*args = append(*args, value)
+		return "$" + strconv.Itoa(len(*args))
+	}
+
+	if sections := normalizeFilters(f.Sections); len(sections) > 0 {
+		conds = append(conds, fmt.Sprintf(
+			"(lower(COALESCE(NULLIF(trim(rc.section_title), ''), 'introduction')) LIKE ANY(%s) OR COALESCE(rc.section_order, 0)::text = ANY(%s))",
+			arg(containsPatterns(sections)), arg(sections)))
+	}
+	if topics := normalizeFilters(f.Topics); len(topics) > 0 {
+		conds = append(conds, fmt.Sprintf(
+			"EXISTS (SELECT 1 FROM rag_document_topics t WHERE t.document_id = rc.document_id AND lower(t.topic) LIKE ANY(%s))",
+			arg(containsPatterns(topics))))
+	}
+	if folders := trimmed(f.Folders); len(folders) > 0 {
+		patterns := make([]string, len(folders))
+		for i, folder := range folders {
+			patterns[i] = escapeLike(strings.Trim(folder, "/")) + "/%"
+		}
+		conds = append(conds, fmt.Sprintf("rd.source_path LIKE ANY(%s)", arg(patterns)))
+	}
+	if globs := trimmed(f.Paths); len(globs) > 0 {
+		patterns := make([]string, len(globs))
+		for i, glob := range globs {
+			patterns[i] = globPattern(glob)
+		}
+		conds = append(conds, fmt.Sprintf("rd.source_path ~ ANY(%s)", arg(patterns)))
+	}
+	if ids := trimmed(f.DocumentIDs); len(ids) > 0 {
+		parsed := make([]uuid.UUID, len(ids))
+		for i, id := range ids {
+			value, err := uuid.Parse(id)
+			if err != nil {
+				return "", fmt.Errorf("invalid document id %q: %w", id, err)
+			}
+			parsed[i] = value
+		}
+		conds = append(conds, fmt.Sprintf("rc.document_id = ANY(%s)", arg(parsed)))
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(conds, " AND "), nil
+}
+
+func normalizeFilters(filters []string) []string {
+	result := make([]string, 0, len(filters))
+	for _, filter := range filters {
+		trimmed := strings.ToLower(strings.TrimSpace(filter))
+		if trimmed != "" {
+			result = append(result, trimmed)
+		}
+	}
+	return result
+}
+
+func trimmed(values []string) []string {
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+func containsPatterns(values []string) []string {
+	patterns := make([]string, len(values))
+	for i, value := range values {
+		patterns[i] = "%" + escapeLike(value) + "%"
+	}
+	return patterns
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(value string) string {
+	return likeEscaper.Replace(value)
+}
+
+// globPattern translates a path glob into an anchored POSIX regular
+// expression.
+func globPattern(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
@@ -0,0 +1,62 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fabfab/go-agent/config"
+)
+
+// NotFoundAnswer is the reply in strict grounding modes when the knowledge
+// base does not answer the question.
+const NotFoundAnswer = "I could not find the answer to this question in the knowledge base."
+
+// ErrNotGrounded is returned in config.GroundingRefuse mode when no retrieved
+// chunk reaches the minimum score.
+var ErrNotGrounded = errors.New("no knowledge base context supports an answer")
+
+// ValidateGrounding rejects unknown grounding modes.
+func ValidateGrounding(mode string) error {
+	switch mode {
+	case "", config.GroundingLenient, config.GroundingNotFound, config.GroundingRefuse:
+		return nil
+	default:
+		return fmt.Errorf("unsupported grounding mode %q (want %s, %s or %s)", mode, config.GroundingLenient, config.GroundingNotFound, config.GroundingRefuse)
+	}
+}
+
+// strictGrounding reports whether mode restricts answers to the context.
+func strictGrounding(mode string) bool {
+	return mode == config.GroundingNotFound || mode == config.GroundingRefuse
+}
+
+// aboveMinScore drops the chunks scoring below minScore, comparing their
+// RerankScore when they were reranked and their Similarity otherwise, since
+// rank fusion replaces Score with values on another scale.
+func aboveMinScore(chunks []ChunkResult, minScore float64, reranked bool) []ChunkResult {
+	if minScore <= 0 {
+		return chunks
+	}
+	kept := make([]ChunkResult, 0, len(chunks))
+	for _, chunk := range chunks {
+		score := chunk.Similarity
+		if reranked {
+			score = chunk.RerankScore
+		}
+		if score >= minScore {
+			kept = append(kept, chunk)
+		}
+	}
+	return kept
+}
+
+// answeredNotFound reports whether a strict answer declares the question
+// unanswerable from the context.
+func answeredNotFound(answer string) bool {
+	return strings.Contains(strings.ToLower(answer), strings.ToLower(strings.TrimSuffix(NotFoundAnswer, ".")))
+}
+
+func strictSystemPrompt() string {
+	return "You are a helpful assistant that answers strictly from the supplied context. Use only the context, never general knowledge, and cite Source numbers in brackets (e.g., [Source 1]) for every statement. If the context does not contain the answer, reply exactly: " + NotFoundAnswer
+}
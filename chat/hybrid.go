@@ -0,0 +1,140 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// rrfK damps the contribution of top ranks in reciprocal rank fusion; 60
+	// is the value from the original RRF paper.
+	rrfK = 60
+	// hybridCandidateFactor widens each ranking before fusion so chunks ranked
+	// just below the limit by one retriever can still win.
+	hybridCandidateFactor = 4
+)
+
+// LexicalSearcher is implemented by vector stores that can also rank chunks by
+// full-text relevance to a query.
+type LexicalSearcher interface {
+	LexicalChunks(ctx context.Context, query string, limit int, filter Filter) ([]ChunkResult, error)
+}
+
+// FusionWeights scales each ranking's contribution to hybrid search. The zero
+// value weighs both rankings equally.
+type FusionWeights struct {
+	Vector  float64
+	Lexical float64
+}
+
+// ValidateFusionWeights rejects negative weights.
+func ValidateFusionWeights(w FusionWeights) error {
+	if w.Vector < 0 || w.Lexical < 0 {
+		return fmt.Errorf("fusion weights must not be negative, got vector %g and lexical %g", w.Vector, w.Lexical)
+	}
+	return nil
+}
+
+func (w FusionWeights) resolved() FusionWeights {
+	if w.Vector == 0 && w.Lexical == 0 {
+		return FusionWeights{Vector: 1, Lexical: 1}
+	}
+	return w
+}
+
+// rank returns the chunks most relevant to query among those matching the
+// filters from cfg. In hybrid mode the vector and full-text rankings are
+// combined with reciprocal rank fusion and Score holds the fused score; stores
+// without full-text search fall back to vector search. Similarity holds the
+// vector search score either way.
+func (s *Service) rank(ctx context.Context, query string, vector []float32, limit int, cfg Config, timings *Timings) ([]ChunkResult, error) {
+	if err := ValidateFusionWeights(cfg.Weights); err != nil {
+		return nil, err
+	}
+	filter := cfg.filter()
+	lexical, ok := s.vectors.(LexicalSearcher)
+	if !cfg.Hybrid || !ok {
+		stage := time.Now()
+		chunks, err := s.vectors.SimilarChunks(ctx, vector, limit, filter)
+		if err != nil {
+			return nil, fmt.Errorf("vector search: %w", err)
+		}
+		timings.VectorSearch += time.Since(stage)
+		return withSimilarity(chunks), nil
+	}
+
+	candidates := limit * hybridCandidateFactor
+	stage := time.Now()
+	byVector, err := s.vectors.SimilarChunks(ctx, vector, candidates, filter)
+	if err != nil {
+		return nil, fmt.Errorf("vector search: %w", err)
+	}
+	byVector = withSimilarity(byVector)
+	timings.VectorSearch += time.Since(stage)
+
+	stage = time.Now()
+	byText, err := lexical.LexicalChunks(ctx, query, candidates, filter)
+	if err != nil {
+		return nil, fmt.Errorf("lexical search: %w", err)
+	}
+	timings.LexicalSearch += time.Since(stage)
+
+	return fuseRankings(limit, cfg.Weights.resolved(), byVector, byText), nil
+}
+
+// withSimilarity records the vector search scores of chunks as their
+// similarity.
+func withSimilarity(chunks []ChunkResult) []ChunkResult {
+	for i := range chunks {
+		chunks[i].Similarity = chunks[i].Score
+	}
+	return chunks
+}
+
+// fuseRankings scores each chunk by the weighted sum of 1/(rrfK+rank) over the
+// rankings it appears in and returns the best limit chunks.
+func fuseRankings(limit int, weights FusionWeights, byVector, byText []ChunkResult) []ChunkResult {
+	return fuse(limit, []float64{weights.Vector, weights.Lexical}, byVector, byText)
+}
+
+// fuse combines rankings with reciprocal rank fusion, weighing rankings[i] by
+// weights[i]. A chunk keeps the fields of its first appearance, except for
+// Similarity, which is the highest of its appearances.
+func fuse(limit int, weights []float64, rankings ...[]ChunkResult) []ChunkResult {
+	scores := map[string]float64{}
+	chunks := map[string]ChunkResult{}
+	var order []string
+	for i, results := range rankings {
+		for rank, chunk := range results {
+			key := chunk.ChunkID
+			if key == "" {
+				key = chunk.DocumentID + "\x00" + chunk.Content
+			}
+			if first, ok := chunks[key]; !ok {
+				chunks[key] = chunk
+				order = append(order, key)
+			} else if chunk.Similarity > first.Similarity {
+				first.Similarity = chunk.Similarity
+				chunks[key] = first
+			}
+			scores[key] += weights[i] / float64(rrfK+rank+1)
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	if len(order) > limit {
+		order = order[:limit]
+	}
+
+	fused := make([]ChunkResult, 0, len(order))
+	for _, key := range order {
+		chunk := chunks[key]
+		chunk.Score = scores[key]
+		fused = append(fused, chunk)
+	}
+	return fused
+}
@@ -0,0 +1,140 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/fabfab/go-agent/embeddings"
+)
+
+// defaultMMRLambda weighs relevance and novelty equally.
+const defaultMMRLambda = 0.5
+
+// diversify picks up to limit chunks by maximal marginal relevance: each pick
+// maximises lambda*relevance - (1-lambda)*similarity to the chunks already
+// picked. Relevance is the rerank score when the chunks were reranked and the
+// cosine similarity to the query otherwise. Chunks without an embedding are
+// embedded first.
+func (s *Service) diversify(ctx context.Context, query []float32, chunks []ChunkResult, limit int, lambda float64, reranked bool, timings *Timings) ([]ChunkResult, error) {
+	if lambda < 0 || lambda > 1 {
+		return nil, fmt.Errorf("mmr lambda must be between 0 and 1, got %g", lambda)
+	}
+	if lambda == 0 {
+		lambda = defaultMMRLambda
+	}
+	if len(chunks) <= 1 {
+		return chunks, nil
+	}
+
+	stage := time.Now()
+	vectors, err := s.chunkEmbeddings(ctx, chunks)
+	if err != nil {
+		return nil, err
+	}
+	timings.Embed += time.Since(stage)
+
+	relevance := make([]float64, len(chunks))
+	for i := range chunks {
+		if reranked {
+			relevance[i] = chunks[i].RerankScore
+		} else {
+			relevance[i] = cosine(query, vectors[i])
+		}
+	}
+
+	picked := selectMMR(relevance, vectors, limit, lambda)
+	diverse := make([]ChunkResult, len(picked))
+	for i, index := range picked {
+		diverse[i] = chunks[index]
+	}
+	return diverse, nil
+}
+
+// chunkEmbeddings returns the vector of every chunk, embedding the contents of
+// the chunks the store returned without one as documents, like the stored
+// vectors.
+func (s *Service) chunkEmbeddings(ctx context.Context, chunks []ChunkResult) ([][]float32, error) {
+	vectors := make([][]float32, len(chunks))
+	var (
+		missing []int
+		texts   []string
+	)
+	for i := range chunks {
+		if len(chunks[i].Embedding) > 0 {
+			vectors[i] = chunks[i].Embedding
+			continue
+		}
+		missing = append(missing, i)
+		texts = append(texts, chunks[i].Content)
+	}
+	if len(missing) == 0 {
+		return vectors, nil
+	}
+
+	embedded, err := embeddings.EmbedDocuments(ctx, s.embedder, texts)
+	if err != nil {
+		return nil, fmt.Errorf("embed chunks: %w", err)
+	}
+	if len(embedded) != len(missing) {
+		return nil, fmt.Errorf("embedder returned %d vectors for %d chunks", len(embedded), len(missing))
+	}
+	for i, index := range missing {
+		vectors[index] = embedded[i]
+	}
+	return vectors, nil
+}
+
+// selectMMR greedily returns the indexes of up to limit items in pick order.
+// Ties go to the earlier item, so lambda 1 keeps the relevance order of
+// equally relevant items.
+func selectMMR(relevance []float64, vectors [][]float32, limit int, lambda float64) []int {
+	limit = min(limit, len(relevance))
+	picked := make([]int, 0, limit)
+	chosen := make([]bool, len(relevance))
+	// redundancy holds each item's highest similarity to a picked item.
+	redundancy := make([]float64, len(relevance))
+
+	for len(picked) < limit {
+		best, bestScore := -1, math.Inf(-1)
+		for i := range relevance {
+			if chosen[i] {
+				continue
+			}
+			score := lambda * relevance[i]
+			if len(picked) > 0 {
+				score -= (1 - lambda) * redundancy[i]
+			}
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		chosen[best] = true
+		picked = append(picked, best)
+		for i := range relevance {
+			if !chosen[i] {
+				redundancy[i] = max(redundancy[i], cosine(vectors[i], vectors[best]))
+			}
+		}
+	}
+	return picked
+}
+
+// cosine returns the cosine similarity of a and b, or 0 when their lengths
+// differ or either is zero.
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(normA*normB)
+}
@@ -0,0 +1,194 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Context expansion modes for Config.ContextExpansion.
+const (
+	// ContextNeighbors adds the chunks within Config.ContextRadius positions
+	// of each hit.
+	ContextNeighbors = "neighbors"
+	// ContextSection adds the whole section enclosing each hit.
+	ContextSection = "section"
+)
+
+const (
+	defaultContextRadius = 1
+	// maxPassageChars bounds the expanded context of one source.
+	maxPassageChars = 8000
+	// passageGap separates runs of chunks that are not adjacent.
+	passageGap = "\n\n[...]\n\n"
+)
+
+// ValidateContextExpansion rejects unknown context expansion modes.
+func ValidateContextExpansion(mode string) error {
+	switch mode {
+	case "", ContextNeighbors, ContextSection:
+		return nil
+	default:
+		return fmt.Errorf("unsupported context expansion %q (want %s or %s)", mode, ContextNeighbors, ContextSection)
+	}
+}
+
+// expandContext returns, per document, the text around the hits in chunks
+// according to cfg.ContextExpansion. Stores without the needed reader and
+// documents that cannot be read are left out, so their sources fall back to
+// snippets.
+func (s *Service) expandContext(ctx context.Context, chunks []ChunkResult, cfg Config, timings *Timings) (map[string]string, error) {
+	if err := ValidateContextExpansion(cfg.ContextExpansion); err != nil {
+		return nil, err
+	}
+	if cfg.ContextExpansion == "" || len(chunks) == 0 {
+		return nil, nil
+	}
+
+	var read func(ctx context.Context, hits []ChunkResult) ([]ChunkResult, error)
+	switch cfg.ContextExpansion {
+	case ContextNeighbors:
+		reader, ok := s.vectors.(ChunkRangeReader)
+		if !ok {
+			s.logger.Printf("context expansion: vector store cannot read chunk ranges")
+			return nil, nil
+		}
+		radius := cfg.ContextRadius
+		if radius <= 0 {
+			radius = defaultContextRadius
+		}
+		read = func(ctx context.Context, hits []ChunkResult) ([]ChunkResult, error) {
+			return readNeighbors(ctx, reader, hits, radius)
+		}
+	case ContextSection:
+		reader, ok := s.vectors.(SectionReader)
+		if !ok {
+			s.logger.Printf("context expansion: vector store cannot read sections")
+			return nil, nil
+		}
+		read = func(ctx context.Context, hits []ChunkResult) ([]ChunkResult, error) {
+			return readSections(ctx, reader, hits)
+		}
+	}
+
+	var order []string
+	hitsByDocument := map[string][]ChunkResult{}
+	for _, chunk := range chunks {
+		if _, ok := hitsByDocument[chunk.DocumentID]; !ok {
+			order = append(order, chunk.DocumentID)
+		}
+		hitsByDocument[chunk.DocumentID] = append(hitsByDocument[chunk.DocumentID], chunk)
+	}
+
+	stage := time.Now()
+	passages := make(map[string]string, len(order))
+	for _, documentID := range order {
+		hits := hitsByDocument[documentID]
+		expanded, err := read(ctx, hits)
+		if err != nil {
+			s.logger.Printf("context expansion error for document %s: %v", documentID, err)
+			continue
+		}
+		passages[documentID] = truncate(buildPassage(append(expanded, hits...)), maxPassageChars)
+	}
+	timings.ContextExpansion += time.Since(stage)
+	return passages, nil
+}
+
+// readNeighbors reads the chunks within radius of the hits of one document,
+// one query per run of overlapping windows.
+func readNeighbors(ctx context.Context, reader ChunkRangeReader, hits []ChunkResult, radius int) ([]ChunkResult, error) {
+	indexes := make([]int, len(hits))
+	for i := range hits {
+		indexes[i] = hits[i].ChunkIndex
+	}
+	sort.Ints(indexes)
+
+	var chunks []ChunkResult
+	for i := 0; i < len(indexes); {
+		first, last := indexes[i]-radius, indexes[i]+radius
+		for i++; i < len(indexes) && indexes[i]-radius <= last+1; i++ {
+			last = indexes[i] + radius
+		}
+		window, err := reader.ChunkRange(ctx, hits[0].DocumentID, max(first, 0), last)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, window...)
+	}
+	return chunks, nil
+}
+
+// readSections reads every section holding a hit of one document.
+func readSections(ctx context.Context, reader SectionReader, hits []ChunkResult) ([]ChunkResult, error) {
+	seen := map[int]bool{}
+	var chunks []ChunkResult
+	for i := range hits {
+		if seen[hits[i].SectionOrder] {
+			continue
+		}
+		seen[hits[i].SectionOrder] = true
+		section, err := reader.SectionChunks(ctx, hits[i].DocumentID, hits[i].SectionOrder)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, section...)
+	}
+	return chunks, nil
+}
+
+// buildPassage orders the chunks of one document by chunk index, drops
+// duplicates and joins adjacent chunks, removing the paragraphs a chunk
+// repeats from its predecessor as overlap. Runs that are not adjacent are
+// separated by passageGap.
+func buildPassage(chunks []ChunkResult) string {
+	byIndex := make(map[int]ChunkResult, len(chunks))
+	for _, chunk := range chunks {
+		byIndex[chunk.ChunkIndex] = chunk
+	}
+	indexes := make([]int, 0, len(byIndex))
+	for index := range byIndex {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var (
+		sb         strings.Builder
+		paragraphs []string
+	)
+	for i, index := range indexes {
+		next := strings.Split(strings.TrimSpace(byIndex[index].Content), "\n\n")
+		switch {
+		case i == 0:
+		case index == indexes[i-1]+1:
+			next = next[overlap(paragraphs, next):]
+		default:
+			sb.WriteString(strings.Join(paragraphs, "\n\n"))
+			sb.WriteString(passageGap)
+			paragraphs = nil
+		}
+		paragraphs = append(paragraphs, next...)
+	}
+	sb.WriteString(strings.Join(paragraphs, "\n\n"))
+	return sb.String()
+}
+
+// overlap returns the length of the longest run of paragraphs ending prev
+// that also starts next.
+func overlap(prev, next []string) int {
+	for n := min(len(prev), len(next)); n > 0; n-- {
+		match := true
+		for i := 0; i < n; i++ {
+			if prev[len(prev)-n+i] != next[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return n
+		}
+	}
+	return 0
+}
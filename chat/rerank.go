@@ -0,0 +1,322 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/llm"
+	"github.com/fabfab/go-agent/resilience"
+)
+
+const (
+	// candidateFactor widens retrieval before reranking or diversification
+	// when no candidate count is configured.
+	candidateFactor = 4
+	// maxRerankChars bounds each passage sent to a reranker.
+	maxRerankChars = 1500
+	// pointwiseConcurrency caps the pointwise LLM calls in flight.
+	pointwiseConcurrency = 4
+	rerankAttempts       = 2
+)
+
+// Reranker reorders retrieved chunks by relevance to a query. It returns the
+// chunks best first with RerankScore set and may drop chunks.
+type Reranker interface {
+	Rerank(ctx context.Context, query string, chunks []ChunkResult) ([]ChunkResult, error)
+}
+
+// search returns the limit chunks most relevant to query that reach
+// Config.MinScore. With Config.Rerank and a reranker, or with Config.MMR, more
+// candidates are ranked first. The reranker reorders them, keeping the first
+// ranking when it fails, and MMR then picks a diverse subset.
+func (s *Service) search(ctx context.Context, query string, vector []float32, limit int, cfg Config, timings *Timings) ([]ChunkResult, error) {
+	rerank := cfg.Rerank && s.reranker != nil
+	if !rerank && !cfg.MMR {
+		chunks, err := s.rankExpanded(ctx, query, vector, limit, cfg, timings)
+		if err != nil {
+			return nil, err
+		}
+		return aboveMinScore(chunks, cfg.MinScore, false), nil
+	}
+
+	candidates := limit * candidateFactor
+	if rerank && cfg.RerankCandidates > 0 {
+		candidates = cfg.RerankCandidates
+	}
+	chunks, err := s.rankExpanded(ctx, query, vector, max(candidates, limit), cfg, timings)
+	if err != nil {
+		return nil, err
+	}
+
+	reranked := false
+	if rerank {
+		stage := time.Now()
+		ordered, err := s.reranker.Rerank(ctx, query, chunks)
+		timings.Rerank += time.Since(stage)
+		if err != nil {
+			s.logger.Printf("rerank error: %v", err)
+		} else {
+			chunks, reranked = ordered, true
+		}
+	}
+	chunks = aboveMinScore(chunks, cfg.MinScore, reranked)
+	if cfg.MMR {
+		chunks, err = s.diversify(ctx, vector, chunks, limit, cfg.MMRLambda, reranked, timings)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(chunks) > limit {
+		chunks = chunks[:limit]
+	}
+	return chunks, nil
+}
+
+// NewReranker builds the reranker selected by cfg, using client for the LLM
+// reranker. It returns nil when reranking is not configured.
+func NewReranker(cfg config.RerankConfig, client llm.Client) (Reranker, error) {
+	switch cfg.Provider {
+	case "":
+		return nil, nil
+	case config.RerankLLM:
+		if client == nil {
+			return nil, fmt.Errorf("llm reranker requires an llm client")
+		}
+		reranker, err := NewLLMReranker(client, cfg.Mode)
+		if err != nil {
+			return nil, err
+		}
+		return reranker, nil
+	case config.RerankHTTP:
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("http reranker requires RERANK_URL")
+		}
+		return NewHTTPReranker(cfg.URL, cfg.Model, cfg.APIKey), nil
+	default:
+		return nil, fmt.Errorf("unsupported rerank provider %q", cfg.Provider)
+	}
+}
+
+// LLMReranker asks an LLM to judge relevance, either scoring each chunk on
+// its own (pointwise) or ordering all chunks in one call (listwise).
+type LLMReranker struct {
+	client   llm.Client
+	listwise bool
+}
+
+// NewLLMReranker returns an LLM reranker in the given mode; an empty mode is
+// listwise.
+func NewLLMReranker(client llm.Client, mode string) (*LLMReranker, error) {
+	switch mode {
+	case config.RerankListwise, "":
+		return &LLMReranker{client: client, listwise: true}, nil
+	case config.RerankPointwise:
+		return &LLMReranker{client: client}, nil
+	default:
+		return nil, fmt.Errorf("unsupported rerank mode %q (want %s or %s)", mode, config.RerankPointwise, config.RerankListwise)
+	}
+}
+
+var (
+	pointwiseSchema = json.RawMessage(`{"type":"object","properties":{"score":{"type":"number","minimum":0,"maximum":10}},"required":["score"]}`)
+	listwiseSchema  = json.RawMessage(`{"type":"object","properties":{"ranking":{"type":"array","items":{"type":"integer","minimum":1}}},"required":["ranking"]}`)
+)
+
+func (r *LLMReranker) Rerank(ctx context.Context, query string, chunks []ChunkResult) ([]ChunkResult, error) {
+	if len(chunks) == 0 {
+		return chunks, nil
+	}
+	if r.listwise {
+		return r.rerankList(ctx, query, chunks)
+	}
+	return r.rerankPoints(ctx, query, chunks)
+}
+
+// rerankPoints scores every chunk from 0 to 10 and normalises the scores to
+// 0..1.
+func (r *LLMReranker) rerankPoints(ctx context.Context, query string, chunks []ChunkResult) ([]ChunkResult, error) {
+	scored := append([]ChunkResult(nil), chunks...)
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(pointwiseConcurrency)
+	for i := range scored {
+		group.Go(func() error {
+			result, err := llm.GenerateStructured(groupCtx, r.client, []llm.Message{
+				{Role: llm.RoleSystem, Content: "You judge how well a passage answers a search query. Score it from 0 (unrelated) to 10 (answers the query fully)."},
+				{Role: llm.RoleUser, Content: fmt.Sprintf("Query: %s\n\nPassage:\n%s", query, truncate(strings.TrimSpace(scored[i].Content), maxRerankChars))},
+			}, pointwiseSchema, rerankAttempts)
+			if err != nil {
+				return fmt.Errorf("score chunk %d: %w", i+1, err)
+			}
+			var parsed struct {
+				Score float64 `json:"score"`
+			}
+			if err := json.Unmarshal(result.Data, &parsed); err != nil {
+				return fmt.Errorf("decode chunk %d score: %w", i+1, err)
+			}
+			scored[i].RerankScore = parsed.Score / 10
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].RerankScore > scored[j].RerankScore
+	})
+	return scored, nil
+}
+
+// rerankList asks for the passage numbers ordered by relevance. Passages the
+// model leaves out follow in their original order. Scores fall linearly from
+// 1 for the first passage.
+func (r *LLMReranker) rerankList(ctx context.Context, query string, chunks []ChunkResult) ([]ChunkResult, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Query: %s\n\nPassages:\n", query)
+	for i := range chunks {
+		fmt.Fprintf(&sb, "[%d] %s\n\n", i+1, truncate(strings.TrimSpace(chunks[i].Content), maxRerankChars))
+	}
+	result, err := llm.GenerateStructured(ctx, r.client, []llm.Message{
+		{Role: llm.RoleSystem, Content: "You rank passages by how well they answer a search query. Return the passage numbers in \"ranking\", most relevant first."},
+		{Role: llm.RoleUser, Content: sb.String()},
+	}, listwiseSchema, rerankAttempts)
+	if err != nil {
+		return nil, fmt.Errorf("rank chunks: %w", err)
+	}
+	var parsed struct {
+		Ranking []int `json:"ranking"`
+	}
+	if err := json.Unmarshal(result.Data, &parsed); err != nil {
+		return nil, fmt.Errorf("decode chunk ranking: %w", err)
+	}
+
+	order := make([]int, 0, len(chunks))
+	seen := make(map[int]bool, len(chunks))
+	for _, number := range parsed.Ranking {
+		if index := number - 1; index >= 0 && index < len(chunks) && !seen[index] {
+			seen[index] = true
+			order = append(order, index)
+		}
+	}
+	for index := range chunks {
+		if !seen[index] {
+			order = append(order, index)
+		}
+	}
+
+	ranked := make([]ChunkResult, len(order))
+	for position, index := range order {
+		ranked[position] = chunks[index]
+		ranked[position].RerankScore = float64(len(order)-position) / float64(len(order))
+	}
+	return ranked, nil
+}
+
+// HTTPReranker scores chunks with a cross-encoder behind a rerank endpoint
+// speaking the Cohere-style API that Jina, vLLM, Infinity and llama.cpp also
+// serve.
+type HTTPReranker struct {
+	url    string
+	model  string
+	apiKey string
+	client *http.Client
+}
+
+// NewHTTPReranker returns a reranker posting to url. model and apiKey are
+// optional.
+func NewHTTPReranker(url, model, apiKey string) *HTTPReranker {
+	return &HTTPReranker{
+		url:    url,
+		model:  model,
+		apiKey: apiKey,
+		client: &http.Client{
+			Timeout: 60 * time.Second,
+		},
+	}
+}
+
+type httpRerankRequest struct {
+	Model     string   `json:"model,omitempty"`
+	Query     string   `json:"query"`
+	Documents []string `json:"documents"`
+	TopN      int      `json:"top_n"`
+}
+
+type httpRerankResponse struct {
+	Results []struct {
+		Index          int     `json:"index"`
+		RelevanceScore float64 `json:"relevance_score"`
+	} `json:"results"`
+}
+
+func (r *HTTPReranker) Rerank(ctx context.Context, query string, chunks []ChunkResult) ([]ChunkResult, error) {
+	if len(chunks) == 0 {
+		return chunks, nil
+	}
+
+	documents := make([]string, len(chunks))
+	for i := range chunks {
+		documents[i] = truncate(strings.TrimSpace(chunks[i].Content), maxRerankChars)
+	}
+	body, err := json.Marshal(httpRerankRequest{Model: r.model, Query: query, Documents: documents, TopN: len(documents)})
+	if err != nil {
+		return nil, fmt.Errorf("marshal rerank request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("create rerank request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+r.apiKey)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("call rerank API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		data, readErr := io.ReadAll(resp.Body)
+		if readErr != nil {
+			return nil, fmt.Errorf("read rerank error body: %w", readErr)
+		}
+		return nil, &resilience.StatusError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("rerank API error: %s", strings.TrimSpace(string(data)))}
+	}
+
+	var parsed httpRerankResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("decode rerank response: %w", err)
+	}
+
+	ranked := make([]ChunkResult, 0, len(parsed.Results))
+	for _, result := range parsed.Results {
+		if result.Index < 0 || result.Index >= len(chunks) {
+			return nil, fmt.Errorf("rerank API returned index %d for %d documents", result.Index, len(chunks))
+		}
+		chunk := chunks[result.Index]
+		chunk.RerankScore = result.RelevanceScore
+		ranked = append(ranked, chunk)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].RerankScore > ranked[j].RerankScore
+	})
+	return ranked, nil
+}
+
+var (
+	_ Reranker = (*LLMReranker)(nil)
+	_ Reranker = (*HTTPReranker)(nil)
+)
@@ -6,7 +6,9 @@ import (
 	"log"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/fabfab/go-agent/config"
 	"github.com/fabfab/go-agent/embeddings"
 	"github.com/fabfab/go-agent/llm"
 )
@@ -20,27 +22,124 @@ type Service struct {
 	graph    GraphStore
 	embedder embeddings.Embedder
 	llm      llm.Client
+	reranker Reranker
 	logger   *log.Logger
 }
 
+// Option configures optional Service behaviour.
+type Option func(*Service)
+
+// WithReranker reorders retrieved chunks with r for requests that set
+// Config.Rerank.
+func WithReranker(r Reranker) Option {
+	return func(s *Service) {
+		s.reranker = r
+	}
+}
+
 type Config struct {
 	SimilarityLimit int
-	SectionFilters  []string
-	TopicFilters    []string
+	// SectionFilters, TopicFilters, FolderFilters, PathFilters and
+	// DocumentIDs restrict retrieval as described on Filter.
+	SectionFilters []string
+	TopicFilters   []string
+	FolderFilters  []string
+	PathFilters    []string
+	DocumentIDs    []string
+
+	// Agent lets the model gather context through retrieval tools over up to
+	// MaxSteps tool-calling turns instead of a single retrieval pass.
+	Agent    bool
+	MaxSteps int
+	// OnStep, when set, is invoked after each agent tool call completes.
+	OnStep func(AgentStep) error
+
+	// Generation overrides the client's default sampling parameters for the
+	// answer. Condensing, query expansion and reranking keep the defaults.
+	Generation config.GenerationOptions
+
+	// ExtractAttempts bounds how many times Extract asks the model for output
+	// matching the schema. Zero uses the llm package default.
+	ExtractAttempts int
+
+	// BypassCache skips LLM response cache lookups; fresh answers are still
+	// cached.
+	BypassCache bool
+
+	// Hybrid combines vector search with full-text search through reciprocal
+	// rank fusion when the vector store implements LexicalSearcher. Weights
+	// scales the two rankings.
+	Hybrid  bool
+	Weights FusionWeights
+
+	// AllowEmbeddingMismatch searches even when the embedder differs from the
+	// model recorded for the stored vectors.
+	AllowEmbeddingMismatch bool
+
+	// Rerank retrieves RerankCandidates chunks (four times the limit when
+	// zero) and keeps the best ones according to the service's reranker.
+	// Services without a reranker ignore it.
+	Rerank           bool
+	RerankCandidates int
+
+	// MMR retrieves more candidates and keeps a diverse subset chosen by
+	// maximal marginal relevance. MMRLambda trades relevance (1) against
+	// novelty (0); zero uses 0.5.
+	MMR       bool
+	MMRLambda float64
+
+	// QueryExpansion searches with LLM-generated variants of the question as
+	// well, fusing the rankings: QueryExpansionMultiQuery adds QueryVariants
+	// paraphrases (three when zero) and QueryExpansionHyDE a hypothetical
+	// answer. Empty searches with the question alone.
+	QueryExpansion string
+	QueryVariants  int
+
+	// NoCondense searches follow-up questions verbatim instead of rewriting
+	// them with the conversation history into a standalone query.
+	NoCondense bool
+
+	// ContextExpansion gives the prompt the text around each retrieved chunk
+	// instead of a snippet: ContextNeighbors adds the chunks within
+	// ContextRadius positions (one when zero) and ContextSection the whole
+	// enclosing section. Stores lacking ChunkRangeReader or SectionReader
+	// fall back to snippets.
+	ContextExpansion string
+	ContextRadius    int
+
+	// MinScore drops retrieved chunks scoring below it: their RerankScore
+	// when reranked, their vector Similarity otherwise, also with Hybrid and
+	// QueryExpansion, which fuse rankings into Score. With Hybrid and no
+	// reranker, chunks only full-text search found have no similarity, so any
+	// positive MinScore drops them; rerank to threshold them too. The
+	// listwise LLM reranker scores by position, (n-pos)/n of n chunks, so with
+	// it MinScore keeps the top fraction. Zero keeps every chunk.
+	MinScore float64
+	// Grounding is config.GroundingLenient (the default), which lets the
+	// model fall back to general knowledge, or a strict mode that answers
+	// from the context only. Without context the strict modes answer
+	// NotFoundAnswer (config.GroundingNotFound) or fail with ErrNotGrounded
+	// (config.GroundingRefuse). In agent mode they only change the
+	// instructions.
+	Grounding string
 }
 
-func NewService(vectors VectorStore, graph GraphStore, embedder embeddings.Embedder, llmClient llm.Client, logger *log.Logger) *Service {
+func NewService(vectors VectorStore, graph GraphStore, embedder embeddings.Embedder, llmClient llm.Client, logger *log.Logger, opts ...Option) *Service {
 	if logger == nil {
 		logger = log.Default()
 	}
 
-	return &Service{
+	s := &Service{
 		vectors:  vectors,
 		graph:    graph,
 		embedder: embedder,
 		llm:      llmClient,
 		logger:   logger,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s *Service) Chat(ctx context.Context, question string, cfg Config) (Response, error) {
@@ -74,70 +173,119 @@ func (s *Service) chat(
 	if question == "" {
 		return Response{}, nil, fmt.Errorf("question cannot be empty")
 	}
+	if err := s.checkDependencies(); err != nil {
+		return Response{}, nil, err
+	}
+	if err := ValidateGrounding(cfg.Grounding); err != nil {
+		return Response{}, nil, err
+	}
+	if err := s.checkEmbeddingModel(ctx, cfg); err != nil {
+		return Response{}, nil, err
+	}
+
+	if cfg.BypassCache {
+		ctx = llm.WithCacheBypass(ctx)
+	}
+	meter := &llm.Meter{}
+	ctx = llm.WithMeter(ctx, meter)
+	started := time.Now()
+
+	var (
+		resp           Response
+		updatedHistory []llm.Message
+		err            error
+	)
+	if cfg.Agent {
+		resp, updatedHistory, err = s.runAgent(ctx, question, cfg, history, streamFn)
+	} else {
+		resp, updatedHistory, err = s.answer(ctx, question, cfg, history, streamFn)
+	}
+	if err != nil {
+		return Response{}, nil, err
+	}
+
+	resp.Usage = meter.Usage()
+	resp.Provider = meter.Provider()
+	resp.Timings.Total = time.Since(started)
+	return resp, updatedHistory, nil
+}
+
+func (s *Service) checkDependencies() error {
 	if s.embedder == nil {
-		return Response{}, nil, fmt.Errorf("embedder is not configured")
+		return fmt.Errorf("embedder is not configured")
 	}
 	if s.vectors == nil {
-		return Response{}, nil, fmt.Errorf("vector store is not configured")
+		return fmt.Errorf("vector store is not configured")
 	}
 	if s.llm == nil {
-		return Response{}, nil, fmt.Errorf("llm client is not configured")
+		return fmt.Errorf("llm client is not configured")
 	}
+	return nil
+}
 
-	limit := cfg.SimilarityLimit
-	if limit <= 0 {
-		limit = defaultSimilarityLimit
+// checkEmbeddingModel refuses to search vectors produced by another model
+// than the embedder's, when both the store and the embedder report one.
+func (s *Service) checkEmbeddingModel(ctx context.Context, cfg Config) error {
+	if cfg.AllowEmbeddingMismatch {
+		return nil
 	}
-
-	embeddings, err := s.embedder.Embed(ctx, []string{question})
-	if err != nil {
-		return Response{}, nil, fmt.Errorf("embed question: %w", err)
+	reader, ok := s.vectors.(FingerprintReader)
+	if !ok {
+		return nil
 	}
-	if len(embeddings) == 0 {
-		return Response{}, nil, fmt.Errorf("embedder returned no vectors")
+	current, ok := embeddings.FingerprintOf(s.embedder)
+	if !ok {
+		return nil
 	}
-
-	chunks, err := s.vectors.SimilarChunks(ctx, embeddings[0], limit)
+	stored, found, err := reader.EmbeddingFingerprint(ctx)
 	if err != nil {
-		return Response{}, nil, fmt.Errorf("vector search: %w", err)
+		return fmt.Errorf("read embedding fingerprint: %w", err)
 	}
-
-	ctxEmpty := len(chunks) == 0
-
-	if ctxEmpty {
-		s.logger.Printf("no context available for question, falling back to LLM-only response")
+	if found && stored != current {
+		return fmt.Errorf("%w: stored vectors come from %s but the embedder is %s", embeddings.ErrFingerprintMismatch, stored, current)
 	}
+	return nil
+}
 
-	if len(cfg.SectionFilters) > 0 && !ctxEmpty {
-		filtered := filterChunksBySections(chunks, cfg.SectionFilters)
-		if len(filtered) == 0 {
-			return Response{}, nil, fmt.Errorf("no chunks matched the requested sections")
-		}
-		chunks = filtered
+// checkServedModel refuses query vectors served by a fallback of another
+// model than the embedder's, which checkEmbeddingModel matched against the
+// stored vectors.
+func (s *Service) checkServedModel(served embeddings.Fingerprint, cfg Config) error {
+	if cfg.AllowEmbeddingMismatch || served == (embeddings.Fingerprint{}) {
+		return nil
 	}
-
-	docIDs := make([]string, 0, len(chunks))
-	for _, chunk := range chunks {
-		docIDs = append(docIDs, chunk.DocumentID)
+	if primary, ok := embeddings.FingerprintOf(s.embedder); ok && served != primary {
+		return fmt.Errorf("%w: query embedded by fallback %s instead of %s", embeddings.ErrFingerprintMismatch, served, primary)
 	}
+	return nil
+}
 
-	insights := map[string]DocumentInsight{}
-	if s.graph != nil && len(docIDs) > 0 {
-		insightMap, insightErr := s.graph.DocumentInsights(ctx, unique(docIDs))
-		if insightErr != nil {
-			s.logger.Printf("graph insights error: %v", insightErr)
+// answer runs a single retrieval pass over the knowledge base and generates
+// the reply from the retrieved context. Follow-up questions are searched as
+// the standalone query condense rewrites them into.
+func (s *Service) answer(
+	ctx context.Context,
+	question string,
+	cfg Config,
+	history []llm.Message,
+	streamFn func(string) error,
+) (Response, []llm.Message, error) {
+	var timings Timings
+	searchQuery := question
+	if len(history) > 0 && !cfg.NoCondense {
+		stage := time.Now()
+		rewritten, err := s.condense(ctx, question, history)
+		timings.Condense += time.Since(stage)
+		if err != nil {
+			s.logger.Printf("condense question error: %v", err)
 		} else {
-			insights = insightMap
+			searchQuery = rewritten
 		}
 	}
 
-	sources := mergeSources(chunks, insights)
-	if len(cfg.TopicFilters) > 0 && len(sources) > 0 {
-		filteredSources := filterSourcesByTopics(sources, cfg.TopicFilters)
-		if len(filteredSources) == 0 {
-			return Response{}, nil, fmt.Errorf("no documents matched the requested topics")
-		}
-		sources = filteredSources
+	sources, err := s.retrieve(ctx, searchQuery, cfg, &timings)
+	if err != nil {
+		return Response{}, nil, err
 	}
 
 	contextPrompt := ""
@@ -145,8 +293,13 @@ func (s *Service) chat(
 		contextPrompt = buildContextPrompt(sources)
 	}
 
+	strict := strictGrounding(cfg.Grounding)
+	prompt := systemPrompt()
+	if strict {
+		prompt = strictSystemPrompt()
+	}
 	messages := make([]llm.Message, 0, len(history)+2)
-	messages = append(messages, llm.Message{Role: llm.RoleSystem, Content: systemPrompt()})
+	messages = append(messages, llm.Message{Role: llm.RoleSystem, Content: prompt})
 	if len(history) > 0 {
 		messages = append(messages, history...)
 	}
@@ -154,36 +307,23 @@ func (s *Service) chat(
 	messages = append(messages, userMessage)
 
 	var answer string
-	if streamFn != nil {
-		if streamClient, ok := s.llm.(llm.StreamClient); ok {
-			var builder strings.Builder
-			streamErr := streamClient.GenerateStream(ctx, messages, func(chunk string) error {
-				if chunk == "" {
-					return nil
-				}
-				builder.WriteString(chunk)
-				return streamFn(chunk)
-			})
-			if streamErr != nil {
-				return Response{}, nil, fmt.Errorf("llm stream generate: %w", streamErr)
-			}
-			answer = builder.String()
-		} else {
-			generated, genErr := s.llm.Generate(ctx, messages)
-			if genErr != nil {
-				return Response{}, nil, fmt.Errorf("llm generate: %w", genErr)
-			}
-			answer = generated
+	switch {
+	case strict && len(sources) == 0 && cfg.Grounding == config.GroundingRefuse:
+		return Response{}, nil, ErrNotGrounded
+	case strict && len(sources) == 0:
+		answer = NotFoundAnswer
+		if streamFn != nil {
 			if err := streamFn(answer); err != nil {
 				return Response{}, nil, err
 			}
 		}
-	} else {
-		generated, genErr := s.llm.Generate(ctx, messages)
-		if genErr != nil {
-			return Response{}, nil, fmt.Errorf("llm generate: %w", genErr)
+	default:
+		stage := time.Now()
+		answer, err = s.generate(llm.WithGenerationOptions(ctx, cfg.Generation), messages, streamFn)
+		if err != nil {
+			return Response{}, nil, err
 		}
-		answer = generated
+		timings.Generation = time.Since(stage)
 	}
 
 	answer = strings.TrimSpace(answer)
@@ -195,24 +335,154 @@ func (s *Service) chat(
 	}
 	updatedHistory = append(updatedHistory, userMessage, assistantMessage)
 
-	return Response{Answer: answer, Sources: sources}, updatedHistory, nil
+	grounded := len(sources) > 0 && !(strict && answeredNotFound(answer))
+	return Response{Answer: answer, Sources: sources, Timings: timings, SearchQuery: searchQuery, Grounded: grounded}, updatedHistory, nil
+}
+
+// filter returns the search filter configured by cfg.
+func (cfg Config) filter() Filter {
+	return Filter{
+		Sections:    cfg.SectionFilters,
+		Topics:      cfg.TopicFilters,
+		Folders:     cfg.FolderFilters,
+		Paths:       cfg.PathFilters,
+		DocumentIDs: cfg.DocumentIDs,
+	}
+}
+
+// retrieve embeds question, searches for similar chunks matching the filters
+// from cfg, expands their context and merges them with graph insights into
+// sources. Stage durations are recorded in timings.
+func (s *Service) retrieve(ctx context.Context, question string, cfg Config, timings *Timings) ([]Source, error) {
+	limit := cfg.SimilarityLimit
+	if limit <= 0 {
+		limit = defaultSimilarityLimit
+	}
+
+	stage := time.Now()
+	vectors, served, err := embeddings.EmbedQueryServed(ctx, s.embedder, []string{question})
+	if err != nil {
+		return nil, fmt.Errorf("embed question: %w", err)
+	}
+	if err := s.checkServedModel(served, cfg); err != nil {
+		return nil, err
+	}
+	if len(vectors) == 0 {
+		return nil, fmt.Errorf("embedder returned no vectors")
+	}
+	timings.Embed = time.Since(stage)
+
+	chunks, err := s.search(ctx, question, vectors[0], limit, cfg, timings)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chunks) == 0 {
+		switch {
+		case strictGrounding(cfg.Grounding):
+		case !cfg.filter().IsZero() && cfg.MinScore > 0:
+			return nil, fmt.Errorf("no chunks matched the requested filters with a score of at least %g", cfg.MinScore)
+		case !cfg.filter().IsZero():
+			return nil, fmt.Errorf("no chunks matched the requested filters")
+		default:
+			s.logger.Printf("no context available for question, falling back to LLM-only response")
+		}
+	}
+
+	passages, err := s.expandContext(ctx, chunks, cfg, timings)
+	if err != nil {
+		return nil, err
+	}
+
+	stage = time.Now()
+	insights := s.documentInsights(ctx, chunks)
+	timings.GraphInsights = time.Since(stage)
+
+	sources := mergeSources(chunks, insights)
+	for i := range sources {
+		sources[i].Passage = passages[sources[i].DocumentID]
+	}
+	return sources, nil
+}
+
+// documentInsights loads graph insights for the documents behind chunks.
+// Graph failures are logged rather than returned so that answers degrade to
+// vector-only context.
+func (s *Service) documentInsights(ctx context.Context, chunks []ChunkResult) map[string]DocumentInsight {
+	docIDs := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		docIDs = append(docIDs, chunk.DocumentID)
+	}
+
+	insights := map[string]DocumentInsight{}
+	if s.graph != nil && len(docIDs) > 0 {
+		insightMap, insightErr := s.graph.DocumentInsights(ctx, unique(docIDs))
+		if insightErr != nil {
+			s.logger.Printf("graph insights error: %v", insightErr)
+		} else {
+			insights = insightMap
+		}
+	}
+	return insights
+}
+
+// generate produces the assistant answer for messages, streaming it through
+// streamFn when provided. Clients without streaming support deliver the whole
+// answer to streamFn at once.
+func (s *Service) generate(ctx context.Context, messages []llm.Message, streamFn func(string) error) (string, error) {
+	if streamFn == nil {
+		generated, err := s.llm.Generate(ctx, messages)
+		if err != nil {
+			return "", fmt.Errorf("llm generate: %w", err)
+		}
+		return generated, nil
+	}
+
+	streamClient, ok := s.llm.(llm.StreamClient)
+	if !ok {
+		generated, err := s.llm.Generate(ctx, messages)
+		if err != nil {
+			return "", fmt.Errorf("llm generate: %w", err)
+		}
+		if err := streamFn(generated); err != nil {
+			return "", err
+		}
+		return generated, nil
+	}
+
+	var builder strings.Builder
+	streamErr := streamClient.GenerateStream(ctx, messages, func(chunk string) error {
+		if chunk == "" {
+			return nil
+		}
+		builder.WriteString(chunk)
+		return streamFn(chunk)
+	})
+	if streamErr != nil {
+		return "", fmt.Errorf("llm stream generate: %w", streamErr)
+	}
+	return builder.String(), nil
 }
 
 func mergeSources(chunks []ChunkResult, insights map[string]DocumentInsight) []Source {
 	grouped := make(map[string]*Source, len(chunks))
+	ordered := make([]*Source, 0, len(chunks))
 	for i := range chunks {
 		chunk := chunks[i]
 		source, ok := grouped[chunk.DocumentID]
 		if !ok {
 			source = &Source{
-				DocumentID: chunk.DocumentID,
-				Title:      chunk.Title,
-				Path:       chunk.Path,
-				Score:      chunk.Score,
+				DocumentID:  chunk.DocumentID,
+				Title:       chunk.Title,
+				Path:        chunk.Path,
+				Score:       chunk.Score,
+				RerankScore: chunk.RerankScore,
 			}
 			grouped[chunk.DocumentID] = source
-		} else if chunk.Score > source.Score {
-			source.Score = chunk.Score
+			ordered = append(ordered, source)
+		} else {
+			source.Score = max(source.Score, chunk.Score)
+			source.RerankScore = max(source.RerankScore, chunk.RerankScore)
 		}
 
 		snippet := strings.TrimSpace(chunk.Content)
@@ -230,12 +500,17 @@ func mergeSources(chunks []ChunkResult, insights map[string]DocumentInsight) []S
 		}
 	}
 
-	sources := make([]Source, 0, len(grouped))
-	for _, src := range grouped {
+	sources := make([]Source, 0, len(ordered))
+	for _, src := range ordered {
 		sources = append(sources, *src)
 	}
 
-	sort.Slice(sources, func(i, j int) bool {
+	// Rerank scores, when present, decide the order; ties keep the retrieval
+	// order.
+	sort.SliceStable(sources, func(i, j int) bool {
+		if sources[i].RerankScore != sources[j].RerankScore {
+			return sources[i].RerankScore > sources[j].RerankScore
+		}
 		return sources[i].Score > sources[j].Score
 	})
 
@@ -284,7 +559,11 @@ func buildContextPrompt(sources []Source) string {
 				sb.WriteString(fmt.Sprintf("- %s (%s)%s%s\n", related.Title, related.Path, weightInfo, reasonInfo))
 			}
 		}
-		sb.WriteString(source.Snippet)
+		if source.Passage != "" {
+			sb.WriteString(source.Passage)
+		} else {
+			sb.WriteString(source.Snippet)
+		}
 		sb.WriteString("\n\n")
 	}
 	return sb.String()
@@ -318,76 +597,3 @@ func unique(values []string) []string {
 	}
 	return result
 }
-
-func filterChunksBySections(chunks []ChunkResult, filters []string) []ChunkResult {
-	normalized := normalizeFilters(filters)
-	if len(normalized) == 0 {
-		return chunks
-	}
-
-	filtered := make([]ChunkResult, 0, len(chunks))
-	for i := range chunks {
-		chunk := chunks[i]
-		sectionTitle := strings.ToLower(strings.TrimSpace(chunk.SectionTitle))
-		if sectionTitle == "" {
-			sectionTitle = "introduction"
-		}
-		order := fmt.Sprintf("%d", chunk.SectionOrder)
-		for _, filter := range normalized {
-			if strings.Contains(sectionTitle, filter) || (filter != "" && order == filter) {
-				filtered = append(filtered, chunk)
-				break
-			}
-		}
-	}
-	return filtered
-}
-
-func filterSourcesByTopics(sources []Source, filters []string) []Source {
-	normalized := normalizeFilters(filters)
-	if len(normalized) == 0 {
-		return sources
-	}
-
-	filtered := make([]Source, 0, len(sources))
-	for i := range sources {
-		source := &sources[i]
-		topics := make([]string, len(source.Insight.Topics))
-		for j, topic := range source.Insight.Topics {
-			topics[j] = strings.ToLower(strings.TrimSpace(topic))
-		}
-		if containsAny(topics, normalized) {
-			filtered = append(filtered, *source)
-		}
-	}
-	return filtered
-}
-
-func normalizeFilters(filters []string) []string {
-	result := make([]string, 0, len(filters))
-	for _, filter := range filters {
-		trimmed := strings.ToLower(strings.TrimSpace(filter))
-		if trimmed != "" {
-			result = append(result, trimmed)
-		}
-	}
-	return result
-}
-
-func containsAny(values, filters []string) bool {
-	valueSet := make(map[string]struct{}, len(values))
-	for _, v := range values {
-		valueSet[v] = struct{}{}
-	}
-	for _, filter := range filters {
-		if _, ok := valueSet[filter]; ok {
-			return true
-		}
-		for value := range valueSet {
-			if strings.Contains(value, filter) {
-				return true
-			}
-		}
-	}
-	return false
-}
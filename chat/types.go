@@ -1,15 +1,31 @@
 package chat
 
+import (
+	"time"
+
+	"github.com/fabfab/go-agent/llm"
+)
+
 type ChunkResult struct {
-	ChunkID      string
-	DocumentID   string
-	Title        string
-	Path         string
-	Content      string
-	Score        float64
+	ChunkID    string
+	DocumentID string
+	Title      string
+	Path       string
+	Content    string
+	Score      float64
+	// Similarity is the chunk's vector similarity to the query, the best
+	// across the rankings fused into Score. It is zero for chunks only
+	// full-text search found.
+	Similarity float64
+	// RerankScore is set by the reranker, when one ran.
+	RerankScore  float64
 	SectionTitle string
 	SectionLevel int
 	SectionOrder int
+	// ChunkIndex is the chunk's position in its document.
+	ChunkIndex int
+	// Embedding is the chunk's vector when the store returns it.
+	Embedding []float32
 }
 
 type DocumentInsight struct {
@@ -41,10 +57,59 @@ type Source struct {
 	Path       string
 	Snippet    string
 	Score      float64
-	Insight    DocumentInsight
+	// RerankScore is the best rerank score among the source's chunks, when a
+	// reranker ran.
+	RerankScore float64
+	Insight     DocumentInsight
+	// Passage is the text around the source's chunks, in document order,
+	// when context expansion ran. The prompt then uses it instead of Snippet.
+	Passage string
+}
+
+// AgentStep records a single tool invocation made while running in agent mode.
+type AgentStep struct {
+	Step      int
+	Tool      string
+	Arguments string
+	Result    string
+	Error     string
+}
+
+// Timings records how long each stage of a chat turn took. In agent mode the
+// retrieval stages are summed across tool calls.
+type Timings struct {
+	// Condense is the time spent rewriting a follow-up question into a
+	// standalone query.
+	Condense time.Duration
+	// QueryExpansion is the time spent generating query variants.
+	QueryExpansion time.Duration
+	Embed          time.Duration
+	VectorSearch   time.Duration
+	LexicalSearch  time.Duration
+	Rerank         time.Duration
+	// ContextExpansion is the time spent reading the chunks around the hits.
+	ContextExpansion time.Duration
+	GraphInsights    time.Duration
+	Generation       time.Duration
+	Total            time.Duration
 }
 
 type Response struct {
 	Answer  string
 	Sources []Source
+	Steps   []AgentStep
+	// SearchQuery is what retrieval searched for: the question, or the
+	// standalone query a follow-up question was rewritten into. It is empty
+	// in agent mode, where the model writes its own queries.
+	SearchQuery string
+	// Grounded reports whether the answer rests on retrieved context: sources
+	// were found and, in strict grounding modes, the model did not reply that
+	// the knowledge base lacks the answer.
+	Grounded bool
+	// Usage sums the tokens reported by every LLM call made for the turn.
+	Usage   llm.Usage
+	Timings Timings
+	// Provider is the provider/model that generated the answer, which differs
+	// from the configured primary after a failover.
+	Provider string
 }
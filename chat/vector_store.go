@@ -6,21 +6,99 @@ import (
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/pgvector/pgvector-go"
+
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/database"
+	"github.com/fabfab/go-agent/embeddings"
 )
 
+// VectorStore returns the chunks nearest to an embedding among those matching
+// filter. Stores should set ChunkResult.Embedding; diversification embeds the
+// chunks returned without one.
 type VectorStore interface {
-	SimilarChunks(ctx context.Context, embedding []float32, limit int) ([]ChunkResult, error)
+	SimilarChunks(ctx context.Context, embedding []float32, limit int, filter Filter) ([]ChunkResult, error)
+}
+
+// SectionReader is implemented by vector stores that can return every chunk of
+// a document section in document order.
+type SectionReader interface {
+	SectionChunks(ctx context.Context, documentID string, sectionOrder int) ([]ChunkResult, error)
+}
+
+// ChunkRangeReader is implemented by vector stores that can return the chunks
+// of a document whose chunk index lies between first and last, inclusive, in
+// document order.
+type ChunkRangeReader interface {
+	ChunkRange(ctx context.Context, documentID string, first, last int) ([]ChunkResult, error)
+}
+
+// FingerprintReader is implemented by vector stores that record which
+// embedding model produced the vectors they search. found is false when
+// nothing was recorded.
+type FingerprintReader interface {
+	EmbeddingFingerprint(ctx context.Context) (fp embeddings.Fingerprint, found bool, err error)
 }
 
 type PostgresVectorStore struct {
-	pool *pgxpool.Pool
+	pool  *pgxpool.Pool
+	space string
+	index config.VectorIndexConfig
+}
+
+// VectorStoreOption configures a PostgresVectorStore.
+type VectorStoreOption func(*PostgresVectorStore)
+
+// WithSpace pins the store to the named embedding space. Without it every
+// search queries the active space, so switching spaces takes effect on the
+// next search.
+func WithSpace(name string) VectorStoreOption {
+	return func(s *PostgresVectorStore) {
+		s.space = name
+	}
+}
+
+// WithVectorIndex searches with the metric and search parameters of cfg. It
+// must match the settings the index was built with.
+func WithVectorIndex(cfg config.VectorIndexConfig) VectorStoreOption {
+	return func(s *PostgresVectorStore) {
+		s.index = cfg
+	}
+}
+
+func NewPostgresVectorStore(pool *pgxpool.Pool, opts ...VectorStoreOption) *PostgresVectorStore {
+	s := &PostgresVectorStore{pool: pool}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
-func NewPostgresVectorStore(pool *pgxpool.Pool) *PostgresVectorStore {
-	return &PostgresVectorStore{pool: pool}
+// searchSpace returns the space to query. Before any space is registered the
+// default column is searched.
+func (s *PostgresVectorStore) searchSpace(ctx context.Context) (database.EmbeddingSpace, error) {
+	var (
+		space database.EmbeddingSpace
+		found bool
+		err   error
+	)
+	if s.space != "" {
+		space, found, err = database.GetEmbeddingSpace(ctx, s.pool, s.space)
+	} else {
+		space, found, err = database.ActiveEmbeddingSpace(ctx, s.pool)
+	}
+	if err != nil {
+		return database.EmbeddingSpace{}, err
+	}
+	if !found {
+		if s.space != "" && s.space != database.DefaultSpace {
+			return database.EmbeddingSpace{}, fmt.Errorf("embedding space %s is not registered", s.space)
+		}
+		return database.EmbeddingSpace{Name: database.DefaultSpace}, nil
+	}
+	return space, nil
 }
 
-func (s *PostgresVectorStore) SimilarChunks(ctx context.Context, embedding []float32, limit int) ([]ChunkResult, error) {
+func (s *PostgresVectorStore) SimilarChunks(ctx context.Context, embedding []float32, limit int, filter Filter) ([]ChunkResult, error) {
 	if s.pool == nil {
 		return nil, fmt.Errorf("postgres pool is nil")
 	}
@@ -31,21 +109,155 @@ func (s *PostgresVectorStore) SimilarChunks(ctx context.Context, embedding []flo
 		limit = 5
 	}
 
+	space, err := s.searchSpace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if space.Dimension > 0 && space.Dimension != len(embedding) {
+		return nil, fmt.Errorf("query embedding has %d dimensions but embedding space %s holds %d", len(embedding), space.Name, space.Dimension)
+	}
+	from, column, where := "rag_chunks rc", "rc.embedding", "rc.embedding IS NOT NULL"
+	if !space.IsDefault() {
+		from = fmt.Sprintf("%s sv JOIN rag_chunks rc ON rc.id = sv.chunk_id", space.Table())
+		column, where = "sv.embedding", "TRUE"
+	}
+	args := []any{pgvector.NewVector(embedding), limit}
+	conditions, err := sqlFilter(filter, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := database.ResolveVectorIndex(s.index)
+	if err != nil {
+		return nil, err
+	}
+	operator, err := database.DistanceOperator(index.Metric)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := fmt.Sprintf(`
+        SELECT
+            rc.id,
+            rc.document_id,
+            rd.title,
+            rd.source_path,
+            rc.content,
+            rc.section_title,
+            COALESCE(rc.section_level, 0) AS section_level,
+            COALESCE(rc.section_order, 0) AS section_order,
+            rc.chunk_index,
+            %[1]s AS embedding,
+            (%[1]s %[5]s $1::vector) AS distance
+        FROM %[2]s
+        JOIN rag_documents rd ON rd.id = rc.document_id
+        WHERE %[3]s%[4]s
+    `, column, from, where, conditions, operator)
+	query := matches + fmt.Sprintf("ORDER BY %s %s $1::vector LIMIT $2", column, operator)
+	if !filter.IsZero() {
+		// An index scan applies the filters to the candidates it found, which
+		// can leave fewer than limit chunks, so filtered searches rank every
+		// matching chunk exactly. Materializing the matches keeps the
+		// ordering off the vector index.
+		query = "WITH matches AS MATERIALIZED (" + matches + ") SELECT * FROM matches ORDER BY distance LIMIT $2"
+	}
+
 	conn, err := s.pool.Acquire(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("acquire connection: %w", err)
 	}
 	defer conn.Release()
 
-	probes := limit * 10
-	if probes < 10 {
-		probes = 10
+	if filter.IsZero() {
+		for _, stmt := range searchParameters(index, limit) {
+			if _, err := conn.Exec(ctx, stmt); err != nil {
+				return nil, fmt.Errorf("set vector search parameter: %w", err)
+			}
+		}
+	}
+
+	rows, err := conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query similar chunks: %w", err)
 	}
-	if _, err := conn.Exec(ctx, fmt.Sprintf("SET ivfflat.probes = %d", probes)); err != nil {
-		return nil, fmt.Errorf("set ivfflat probes: %w", err)
+	defer rows.Close()
+
+	results := make([]ChunkResult, 0)
+	for rows.Next() {
+		var (
+			item     ChunkResult
+			vector   pgvector.Vector
+			distance float64
+		)
+		if scanErr := rows.Scan(&item.ChunkID, &item.DocumentID, &item.Title, &item.Path, &item.Content, &item.SectionTitle, &item.SectionLevel, &item.SectionOrder, &item.ChunkIndex, &vector, &distance); scanErr != nil {
+			return nil, fmt.Errorf("scan similar chunk: %w", scanErr)
+		}
+		item.Embedding = vector.Slice()
+		item.Score = similarity(index.Metric, distance)
+		results = append(results, item)
 	}
 
-	rows, err := conn.Query(ctx, `
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return results, nil
+}
+
+// searchParameters returns the statements widening the index scan enough to
+// fill limit results. Both index types are tuned, since the installed index
+// may predate the configured type until it is rebuilt.
+func searchParameters(index config.VectorIndexConfig, limit int) []string {
+	probes := index.Probes
+	if probes <= 0 {
+		probes = max(10, limit)
+	}
+	efSearch := index.EfSearch
+	if efSearch <= 0 {
+		efSearch = max(40, limit*4)
+	}
+	return []string{
+		fmt.Sprintf("SET ivfflat.probes = %d", probes),
+		fmt.Sprintf("SET hnsw.ef_search = %d", max(efSearch, limit)),
+	}
+}
+
+// similarity converts a distance into a score where higher is more similar:
+// the cosine similarity, the inner product, or 1/(1+d) for L2.
+func similarity(metric string, distance float64) float64 {
+	switch metric {
+	case config.MetricCosine:
+		return 1 - distance
+	case config.MetricInnerProduct:
+		return -distance
+	default:
+		return 1 / (1 + distance)
+	}
+}
+
+// LexicalChunks ranks chunks containing any of the query's terms by ts_rank.
+// Terms are stemmed and stop words dropped with the english configuration,
+// matching the content_tsv column.
+func (s *PostgresVectorStore) LexicalChunks(ctx context.Context, query string, limit int, filter Filter) ([]ChunkResult, error) {
+	if s.pool == nil {
+		return nil, fmt.Errorf("postgres pool is nil")
+	}
+	if limit <= 0 {
+		limit = 5
+	}
+	args := []any{query, limit}
+	conditions, err := sqlFilter(filter, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	// plainto_tsquery ANDs the terms; a question rarely repeats all of them,
+	// so they are ORed and ts_rank rewards chunks matching more of them.
+	// Normalization 1|32 divides by log length and scales ranks into 0..1.
+	rows, err := s.pool.Query(ctx, fmt.Sprintf(`
+        WITH q AS (
+            SELECT replace(plainto_tsquery('english', $1)::text, ' & ', ' | ')::tsquery AS query
+        )
         SELECT
             rc.id,
             rc.document_id,
@@ -55,25 +267,79 @@ func (s *PostgresVectorStore) SimilarChunks(ctx context.Context, embedding []flo
             rc.section_title,
             COALESCE(rc.section_level, 0) AS section_level,
             COALESCE(rc.section_order, 0) AS section_order,
-            (rc.embedding <-> $1::vector) AS distance
-        FROM rag_chunks rc
+            rc.chunk_index,
+            ts_rank(rc.content_tsv, q.query, 33) AS rank
+        FROM q, rag_chunks rc
         JOIN rag_documents rd ON rd.id = rc.document_id
-        ORDER BY rc.embedding <-> $1::vector
+        WHERE rc.content_tsv @@ q.query%s
+        ORDER BY rank DESC
         LIMIT $2
-    `, pgvector.NewVector(embedding), limit)
+    `, conditions), args...)
 	if err != nil {
-		return nil, fmt.Errorf("query similar chunks: %w", err)
+		return nil, fmt.Errorf("query lexical chunks: %w", err)
 	}
 	defer rows.Close()
 
 	results := make([]ChunkResult, 0)
 	for rows.Next() {
 		var item ChunkResult
-		var distance float64
-		if scanErr := rows.Scan(&item.ChunkID, &item.DocumentID, &item.Title, &item.Path, &item.Content, &item.SectionTitle, &item.SectionLevel, &item.SectionOrder, &distance); scanErr != nil {
-			return nil, fmt.Errorf("scan similar chunk: %w", scanErr)
+		if scanErr := rows.Scan(&item.ChunkID, &item.DocumentID, &item.Title, &item.Path, &item.Content, &item.SectionTitle, &item.SectionLevel, &item.SectionOrder, &item.ChunkIndex, &item.Score); scanErr != nil {
+			return nil, fmt.Errorf("scan lexical chunk: %w", scanErr)
+		}
+		results = append(results, item)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return results, nil
+}
+
+// EmbeddingFingerprint returns the fingerprint of the space searched next.
+func (s *PostgresVectorStore) EmbeddingFingerprint(ctx context.Context) (embeddings.Fingerprint, bool, error) {
+	if s.pool == nil {
+		return embeddings.Fingerprint{}, false, fmt.Errorf("postgres pool is nil")
+	}
+	space, err := s.searchSpace(ctx)
+	if err != nil || space.Provider == "" {
+		return embeddings.Fingerprint{}, false, err
+	}
+	return space.Fingerprint(), true, nil
+}
+
+func (s *PostgresVectorStore) SectionChunks(ctx context.Context, documentID string, sectionOrder int) ([]ChunkResult, error) {
+	if s.pool == nil {
+		return nil, fmt.Errorf("postgres pool is nil")
+	}
+
+	rows, err := s.pool.Query(ctx, `
+        SELECT
+            rc.id,
+            rc.document_id,
+            rd.title,
+            rd.source_path,
+            rc.content,
+            rc.section_title,
+            COALESCE(rc.section_level, 0) AS section_level,
+            COALESCE(rc.section_order, 0) AS section_order,
+            rc.chunk_index
+        FROM rag_chunks rc
+        JOIN rag_documents rd ON rd.id = rc.document_id
+        WHERE rc.document_id = $1 AND COALESCE(rc.section_order, 0) = $2
+        ORDER BY rc.chunk_index
+    `, documentID, sectionOrder)
+	if err != nil {
+		return nil, fmt.Errorf("query section chunks: %w", err)
+	}
+	defer rows.Close()
+
+	results := make([]ChunkResult, 0)
+	for rows.Next() {
+		var item ChunkResult
+		if scanErr := rows.Scan(&item.ChunkID, &item.DocumentID, &item.Title, &item.Path, &item.Content, &item.SectionTitle, &item.SectionLevel, &item.SectionOrder, &item.ChunkIndex); scanErr != nil {
+			return nil, fmt.Errorf("scan section chunk: %w", scanErr)
 		}
-		item.Score = 1 / (1 + distance)
 		results = append(results, item)
 	}
 
@@ -84,4 +350,52 @@ func (s *PostgresVectorStore) SimilarChunks(ctx context.Context, embedding []flo
 	return results, nil
 }
 
-var _ VectorStore = (*PostgresVectorStore)(nil)
+func (s *PostgresVectorStore) ChunkRange(ctx context.Context, documentID string, first, last int) ([]ChunkResult, error) {
+	if s.pool == nil {
+		return nil, fmt.Errorf("postgres pool is nil")
+	}
+
+	rows, err := s.pool.Query(ctx, `
+        SELECT
+            rc.id,
+            rc.document_id,
+            rd.title,
+            rd.source_path,
+            rc.content,
+            rc.section_title,
+            COALESCE(rc.section_level, 0) AS section_level,
+            COALESCE(rc.section_order, 0) AS section_order,
+            rc.chunk_index
+        FROM rag_chunks rc
+        JOIN rag_documents rd ON rd.id = rc.document_id
+        WHERE rc.document_id = $1 AND rc.chunk_index BETWEEN $2 AND $3
+        ORDER BY rc.chunk_index
+    `, documentID, first, last)
+	if err != nil {
+		return nil, fmt.Errorf("query chunk range: %w", err)
+	}
+	defer rows.Close()
+
+	results := make([]ChunkResult, 0)
+	for rows.Next() {
+		var item ChunkResult
+		if scanErr := rows.Scan(&item.ChunkID, &item.DocumentID, &item.Title, &item.Path, &item.Content, &item.SectionTitle, &item.SectionLevel, &item.SectionOrder, &item.ChunkIndex); scanErr != nil {
+			return nil, fmt.Errorf("scan chunk range: %w", scanErr)
+		}
+		results = append(results, item)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return results, nil
+}
+
+var (
+	_ VectorStore       = (*PostgresVectorStore)(nil)
+	_ SectionReader     = (*PostgresVectorStore)(nil)
+	_ ChunkRangeReader  = (*PostgresVectorStore)(nil)
+	_ FingerprintReader = (*PostgresVectorStore)(nil)
+	_ LexicalSearcher   = (*PostgresVectorStore)(nil)
+)
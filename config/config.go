@@ -4,11 +4,45 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	ProviderOllama = "ollama"
-	ProviderOpenAI = "openai"
+	ProviderOllama    = "ollama"
+	ProviderOpenAI    = "openai"
+	ProviderAnthropic = "anthropic"
+	// ProviderLocal computes hashed n-gram embeddings in process.
+	ProviderLocal = "local"
+	// ProviderReplay answers from a cassette recorded earlier instead of a
+	// live provider.
+	ProviderReplay = "replay"
+)
+
+const (
+	IndexHNSW    = "hnsw"
+	IndexIVFFlat = "ivfflat"
+
+	MetricL2           = "l2"
+	MetricCosine       = "cosine"
+	MetricInnerProduct = "inner_product"
+
+	// RerankLLM asks the chat model to judge relevance; RerankHTTP calls a
+	// cross-encoder behind a rerank endpoint.
+	RerankLLM  = "llm"
+	RerankHTTP = "http"
+
+	// RerankPointwise scores each chunk in its own call; RerankListwise
+	// orders all chunks in one call.
+	RerankPointwise = "pointwise"
+	RerankListwise  = "listwise"
+
+	// GroundingLenient lets answers fall back to general knowledge;
+	// GroundingNotFound answers a standard message and GroundingRefuse
+	// fails when no context supports an answer.
+	GroundingLenient  = "lenient"
+	GroundingNotFound = "not-found"
+	GroundingRefuse   = "refuse"
 )
 
 type Config struct {
@@ -23,39 +57,263 @@ type Config struct {
 	OpenAIAPIKey  string
 	OpenAIBaseURL string
 
+	AnthropicAPIKey  string
+	AnthropicBaseURL string
+
 	Embeddings EmbeddingConfig
-	LLM        LLMConfig
+	// VectorIndex applies to the vectors of every embedding space.
+	VectorIndex VectorIndexConfig
+	LLM         LLMConfig
+	Rerank      RerankConfig
+	// Grounding sets the default for chat requests that do not choose.
+	Grounding GroundingConfig
+	// Resilience applies to every LLM and embedding provider call.
+	Resilience ResilienceConfig
 }
 
 type EmbeddingConfig struct {
 	Provider  string
 	Model     string
 	Dimension int
+	// Space names the embedding space ingestion writes to. Spaces let several
+	// models' vectors coexist while migrating between them.
+	Space string
+	// BatchSize caps the texts sent per embedding request; zero uses the
+	// provider default. Concurrency caps the requests in flight.
+	BatchSize   int
+	Concurrency int
+	// Fallbacks are tried in order when the primary provider fails. Each must
+	// produce vectors of Dimension; a zero Dimension on an entry means it.
+	Fallbacks []ProviderSpec
+	// Cassette is the file replayed by the replay provider. With any other
+	// provider, interactions are recorded to it.
+	Cassette string
+	// Cache reuses stored vectors for unchanged chunk text during ingestion.
+	Cache bool
+	// AllowMismatch lets chat search vectors recorded for another model than
+	// the configured one.
+	AllowMismatch bool
+	// QueryTemplate and DocumentTemplate wrap search queries and indexed
+	// chunks before embedding, either as a prefix or around a {text}
+	// placeholder. Empty values use the model's published prefixes.
+	QueryTemplate    string
+	DocumentTemplate string
+}
+
+// Chain returns the primary provider followed by its fallbacks.
+func (c EmbeddingConfig) Chain() []ProviderSpec {
+	chain := []ProviderSpec{{Provider: c.Provider, Model: c.Model, Dimension: c.Dimension}}
+	for _, spec := range c.Fallbacks {
+		if spec.Dimension == 0 {
+			spec.Dimension = c.Dimension
+		}
+		chain = append(chain, spec)
+	}
+	return chain
+}
+
+// VectorIndexConfig selects the approximate nearest neighbour index over
+// stored vectors and the distance searches order by.
+type VectorIndexConfig struct {
+	// Type is IndexHNSW or IndexIVFFlat and Metric one of the Metric
+	// constants. Empty values mean HNSW and L2.
+	Type   string
+	Metric string
+	// M and EfConstruction tune HNSW builds; zero keeps pgvector's defaults.
+	// Lists sets the ivfflat lists; zero sizes them from the row count.
+	M              int
+	EfConstruction int
+	Lists          int
+	// EfSearch and Probes tune HNSW and ivfflat searches; zero derives them
+	// from the search limit.
+	EfSearch int
+	Probes   int
+}
+
+// RerankConfig selects the reranker applied after retrieval. An empty
+// Provider disables reranking.
+type RerankConfig struct {
+	Provider string
+	// Mode is RerankPointwise or RerankListwise for the LLM reranker.
+	Mode string
+	// URL, Model and APIKey address the HTTP reranker.
+	URL    string
+	Model  string
+	APIKey string
+	// Candidates is how many chunks are retrieved for reranking; zero
+	// retrieves four times the search limit.
+	Candidates int
+}
+
+// GroundingConfig controls how chat treats weak or missing context.
+type GroundingConfig struct {
+	// Mode is GroundingLenient, GroundingNotFound or GroundingRefuse.
+	Mode string
+	// MinScore drops retrieved chunks whose vector similarity, or rerank
+	// score when reranking ran, is below it; zero keeps all. Hybrid hits
+	// only full-text search found have no similarity and are dropped unless
+	// reranked.
+	MinScore float64
 }
 
 type LLMConfig struct {
 	Provider string
 	Model    string
+	// Generation holds the default sampling parameters applied to every call.
+	Generation GenerationOptions
+	// Fallbacks are tried in order when the primary provider fails.
+	Fallbacks []ProviderSpec
+	Cache     LLMCacheConfig
+	// Cassette is the file replayed by the replay provider. With any other
+	// provider, interactions are recorded to it.
+	Cassette string
+}
+
+// LLMCacheConfig controls the Postgres-backed response cache. A zero TTL keeps
+// entries until they are deleted.
+type LLMCacheConfig struct {
+	Enabled bool
+	TTL     time.Duration
+}
+
+// Chain returns the primary provider followed by its fallbacks.
+func (c LLMConfig) Chain() []ProviderSpec {
+	return append([]ProviderSpec{{Provider: c.Provider, Model: c.Model}}, c.Fallbacks...)
+}
+
+// ProviderSpec names a provider and model. Dimension is only used for
+// embedding providers.
+type ProviderSpec struct {
+	Provider  string
+	Model     string
+	Dimension int
+}
+
+// String formats the spec as provider/model.
+func (p ProviderSpec) String() string {
+	return p.Provider + "/" + p.Model
+}
+
+// ResilienceConfig controls retries, timeouts and circuit breaking around
+// provider calls. Zero values disable the corresponding behaviour.
+type ResilienceConfig struct {
+	MaxRetries       int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	Timeout          time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// GenerationOptions holds sampling parameters for LLM calls. Unset fields
+// (nil pointers, zero values, empty slices) keep the provider default.
+type GenerationOptions struct {
+	Temperature *float64
+	TopP        *float64
+	MaxTokens   int
+	Stop        []string
+	Seed        *int
+	// NumCtx sets the context window size. Only Ollama honours it.
+	NumCtx int
+}
+
+// Merge returns a copy of o with every field set in override taking
+// precedence.
+func (o GenerationOptions) Merge(override GenerationOptions) GenerationOptions {
+	merged := o
+	if override.Temperature != nil {
+		merged.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		merged.TopP = override.TopP
+	}
+	if override.MaxTokens > 0 {
+		merged.MaxTokens = override.MaxTokens
+	}
+	if len(override.Stop) > 0 {
+		merged.Stop = override.Stop
+	}
+	if override.Seed != nil {
+		merged.Seed = override.Seed
+	}
+	if override.NumCtx > 0 {
+		merged.NumCtx = override.NumCtx
+	}
+	return merged
 }
 
 func Load() Config {
 	return Config{
-		PostgresDSN:   getEnv("POSTGRES_DSN", "postgres://localhost:5432/go-agent?sslmode=disable"),
-		Neo4jURI:      getEnv("NEO4J_URI", "neo4j://localhost:7687"),
-		Neo4jUser:     getEnv("NEO4J_USERNAME", "neo4j"),
-		Neo4jPass:     getEnv("NEO4J_PASSWORD", "password"),
-		DataDir:       getEnv("DATA_DIR", "./documents"),
-		OllamaHost:    getEnv("OLLAMA_HOST", "http://localhost:11434"),
-		OpenAIAPIKey:  os.Getenv("OPENAI_API_KEY"),
-		OpenAIBaseURL: getEnv("OPENAI_BASE_URL", ""),
+		PostgresDSN:      getEnv("POSTGRES_DSN", "postgres://localhost:5432/go-agent?sslmode=disable"),
+		Neo4jURI:         getEnv("NEO4J_URI", "neo4j://localhost:7687"),
+		Neo4jUser:        getEnv("NEO4J_USERNAME", "neo4j"),
+		Neo4jPass:        getEnv("NEO4J_PASSWORD", "password"),
+		DataDir:          getEnv("DATA_DIR", "./documents"),
+		OllamaHost:       getEnv("OLLAMA_HOST", "http://localhost:11434"),
+		OpenAIAPIKey:     os.Getenv("OPENAI_API_KEY"),
+		OpenAIBaseURL:    getEnv("OPENAI_BASE_URL", ""),
+		AnthropicAPIKey:  os.Getenv("ANTHROPIC_API_KEY"),
+		AnthropicBaseURL: getEnv("ANTHROPIC_BASE_URL", ""),
 		Embeddings: EmbeddingConfig{
-			Provider:  getEnv("EMBEDDING_PROVIDER", ProviderOllama),
-			Model:     getEnv("EMBEDDING_MODEL", "nomic-embed-text"),
-			Dimension: getEnvInt("EMBEDDING_DIMENSION", 768),
+			Provider:         getEnv("EMBEDDING_PROVIDER", ProviderOllama),
+			Model:            getEnv("EMBEDDING_MODEL", "nomic-embed-text"),
+			Dimension:        getEnvInt("EMBEDDING_DIMENSION", 768),
+			Space:            getEnv("EMBEDDING_SPACE", "default"),
+			BatchSize:        getEnvInt("EMBEDDING_BATCH_SIZE", 0),
+			Concurrency:      getEnvInt("EMBEDDING_CONCURRENCY", 4),
+			Fallbacks:        getEnvProviders("EMBEDDING_FALLBACKS"),
+			Cassette:         getEnv("EMBEDDING_CASSETTE", ""),
+			Cache:            getEnvBool("EMBEDDING_CACHE", true),
+			AllowMismatch:    getEnvBool("EMBEDDING_ALLOW_MISMATCH", false),
+			QueryTemplate:    getEnv("EMBEDDING_QUERY_TEMPLATE", ""),
+			DocumentTemplate: getEnv("EMBEDDING_DOCUMENT_TEMPLATE", ""),
+		},
+		VectorIndex: VectorIndexConfig{
+			Type:           getEnv("VECTOR_INDEX_TYPE", IndexHNSW),
+			Metric:         getEnv("VECTOR_METRIC", MetricL2),
+			M:              getEnvInt("VECTOR_INDEX_M", 16),
+			EfConstruction: getEnvInt("VECTOR_INDEX_EF_CONSTRUCTION", 64),
+			Lists:          getEnvInt("VECTOR_INDEX_LISTS", 0),
+			EfSearch:       getEnvInt("VECTOR_INDEX_EF_SEARCH", 0),
+			Probes:         getEnvInt("VECTOR_INDEX_PROBES", 0),
 		},
 		LLM: LLMConfig{
 			Provider: getEnv("LLM_PROVIDER", ProviderOllama),
 			Model:    getEnv("LLM_MODEL", "llama3.1:8b"),
+			Generation: GenerationOptions{
+				Temperature: getEnvFloatPtr("LLM_TEMPERATURE"),
+				TopP:        getEnvFloatPtr("LLM_TOP_P"),
+				MaxTokens:   getEnvInt("LLM_MAX_TOKENS", 0),
+				Stop:        getEnvList("LLM_STOP"),
+				Seed:        getEnvIntPtr("LLM_SEED"),
+				NumCtx:      getEnvInt("LLM_NUM_CTX", 0),
+			},
+			Fallbacks: getEnvProviders("LLM_FALLBACKS"),
+			Cache: LLMCacheConfig{
+				Enabled: getEnvBool("LLM_CACHE", false),
+				TTL:     getEnvDuration("LLM_CACHE_TTL", 24*time.Hour),
+			},
+			Cassette: getEnv("LLM_CASSETTE", ""),
+		},
+		Rerank: RerankConfig{
+			Provider:   getEnv("RERANK_PROVIDER", ""),
+			Mode:       getEnv("RERANK_MODE", RerankListwise),
+			URL:        getEnv("RERANK_URL", ""),
+			Model:      getEnv("RERANK_MODEL", ""),
+			APIKey:     os.Getenv("RERANK_API_KEY"),
+			Candidates: getEnvInt("RERANK_CANDIDATES", 0),
+		},
+		Grounding: GroundingConfig{
+			Mode:     getEnv("GROUNDING_MODE", GroundingLenient),
+			MinScore: getEnvFloat("GROUNDING_MIN_SCORE", 0),
+		},
+		Resilience: ResilienceConfig{
+			MaxRetries:       getEnvInt("PROVIDER_MAX_RETRIES", 2),
+			BaseDelay:        getEnvDuration("PROVIDER_RETRY_BASE_DELAY", 500*time.Millisecond),
+			MaxDelay:         getEnvDuration("PROVIDER_RETRY_MAX_DELAY", 10*time.Second),
+			Timeout:          getEnvDuration("PROVIDER_TIMEOUT", 0),
+			BreakerThreshold: getEnvInt("PROVIDER_BREAKER_THRESHOLD", 5),
+			BreakerCooldown:  getEnvDuration("PROVIDER_BREAKER_COOLDOWN", 30*time.Second),
 		},
 	}
 }
@@ -76,3 +334,89 @@ func getEnvInt(key string, fallback int) int {
 	}
 	return fallback
 }
+
+func getEnvBool(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+func getEnvFloatPtr(key string) *float64 {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			return &parsed
+		}
+	}
+	return nil
+}
+
+func getEnvIntPtr(key string) *int {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err == nil {
+			return &parsed
+		}
+	}
+	return nil
+}
+
+// getEnvList splits a comma separated variable, dropping empty entries.
+func getEnvList(key string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return nil
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if trimmed := strings.TrimSpace(item); trimmed != "" {
+			items = append(items, trimmed)
+		}
+	}
+	return items
+}
+
+// getEnvProviders parses a comma separated list of provider:model entries.
+// The model may itself contain colons (llama3.1:8b) and may be followed by
+// @dimension for embedding providers. Malformed entries are skipped.
+func getEnvProviders(key string) []ProviderSpec {
+	var specs []ProviderSpec
+	for _, item := range getEnvList(key) {
+		provider, model, ok := strings.Cut(item, ":")
+		if !ok || provider == "" || model == "" {
+			continue
+		}
+		spec := ProviderSpec{Provider: strings.TrimSpace(provider), Model: strings.TrimSpace(model)}
+		if at := strings.LastIndex(spec.Model, "@"); at > 0 {
+			if dimension, err := strconv.Atoi(spec.Model[at+1:]); err == nil {
+				spec.Model, spec.Dimension = spec.Model[:at], dimension
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
@@ -0,0 +1,239 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/fabfab/go-agent/config"
+)
+
+// ResolveVectorIndex fills empty index settings with their defaults and
+// rejects unknown types and metrics.
+func ResolveVectorIndex(cfg config.VectorIndexConfig) (config.VectorIndexConfig, error) {
+	if cfg.Type == "" {
+		cfg.Type = config.IndexHNSW
+	}
+	if cfg.Metric == "" {
+		cfg.Metric = config.MetricL2
+	}
+	if cfg.Type != config.IndexHNSW && cfg.Type != config.IndexIVFFlat {
+		return cfg, fmt.Errorf("unsupported vector index type %q (want %s or %s)", cfg.Type, config.IndexHNSW, config.IndexIVFFlat)
+	}
+	if _, err := DistanceOperator(cfg.Metric); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// DistanceOperator returns the pgvector operator computing metric. Inner
+// product distances are negated so that smaller is nearer for every metric.
+func DistanceOperator(metric string) (string, error) {
+	switch metric {
+	case config.MetricL2, "":
+		return "<->", nil
+	case config.MetricCosine:
+		return "<=>", nil
+	case config.MetricInnerProduct:
+		return "<#>", nil
+	default:
+		return "", fmt.Errorf("unsupported vector metric %q (want %s, %s or %s)", metric, config.MetricL2, config.MetricCosine, config.MetricInnerProduct)
+	}
+}
+
+func operatorClass(metric string) string {
+	switch metric {
+	case config.MetricCosine:
+		return "vector_cosine_ops"
+	case config.MetricInnerProduct:
+		return "vector_ip_ops"
+	default:
+		return "vector_l2_ops"
+	}
+}
+
+// IvfflatLists returns the list count pgvector recommends for rows vectors:
+// rows/1000 up to a million rows and sqrt(rows) beyond.
+func IvfflatLists(rows int64) int {
+	lists := rows / 1000
+	if rows > 1_000_000 {
+		lists = int64(math.Sqrt(float64(rows)))
+	}
+	if lists < 1 {
+		lists = 1
+	}
+	return int(lists)
+}
+
+// VectorIndexName returns the name of the index over table's vectors.
+func VectorIndexName(table string) string {
+	return "idx_" + table + "_embedding"
+}
+
+// vectorIndexSpec describes an index build. It is stored as the index comment
+// so later runs can tell whether the settings changed.
+func vectorIndexSpec(cfg config.VectorIndexConfig, lists int) string {
+	parts := []string{cfg.Type, operatorClass(cfg.Metric)}
+	if cfg.Type == config.IndexIVFFlat {
+		parts = append(parts, fmt.Sprintf("lists=%d", lists))
+	} else {
+		if cfg.M > 0 {
+			parts = append(parts, fmt.Sprintf("m=%d", cfg.M))
+		}
+		if cfg.EfConstruction > 0 {
+			parts = append(parts, fmt.Sprintf("ef_construction=%d", cfg.EfConstruction))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// ErrVectorIndexMismatch reports an existing vector index built with other
+// settings than the configured ones.
+var ErrVectorIndexMismatch = errors.New("vector index does not match the configured settings")
+
+// EnsureVectorIndex creates the index over table's vectors. An existing index
+// built with other settings, or built before they were recorded, is kept and
+// reported with ErrVectorIndexMismatch: rebuilding locks the table for as long
+// as the build takes, so it is left to RebuildVectorIndex. An ivfflat index is
+// kept whatever its list count unless Lists is configured.
+func EnsureVectorIndex(ctx context.Context, pool *pgxpool.Pool, table string, cfg config.VectorIndexConfig) error {
+	if pool == nil {
+		return fmt.Errorf("postgres pool is not configured")
+	}
+	cfg, err := ResolveVectorIndex(cfg)
+	if err != nil {
+		return err
+	}
+	exists, err := checkVectorIndex(ctx, pool, table, cfg)
+	if exists || err != nil {
+		return err
+	}
+	_, err = RebuildVectorIndex(ctx, pool, table, cfg)
+	return err
+}
+
+// CheckVectorIndex reports with ErrVectorIndexMismatch an index over table's
+// vectors that was built with other settings than cfg. Searches ordering by
+// another metric than the index's do not use it. A missing index is not an
+// error.
+func CheckVectorIndex(ctx context.Context, pool *pgxpool.Pool, table string, cfg config.VectorIndexConfig) error {
+	if pool == nil {
+		return fmt.Errorf("postgres pool is not configured")
+	}
+	cfg, err := ResolveVectorIndex(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = checkVectorIndex(ctx, pool, table, cfg)
+	return err
+}
+
+// checkVectorIndex compares the index over table's vectors, when there is
+// one, with cfg. Indexes built before their settings were recorded are
+// compared on their type and operator class only.
+func checkVectorIndex(ctx context.Context, pool *pgxpool.Pool, table string, cfg config.VectorIndexConfig) (exists bool, err error) {
+	var spec, method, opclass string
+	name := VectorIndexName(table)
+	err = pool.QueryRow(ctx, `
+		SELECT COALESCE(obj_description(c.oid, 'pg_class'), ''), am.amname, opc.opcname
+		FROM pg_class c
+		JOIN pg_index i ON i.indexrelid = c.oid
+		JOIN pg_am am ON am.oid = c.relam
+		JOIN pg_opclass opc ON opc.oid = i.indclass[0]
+		WHERE c.oid = to_regclass($1)
+	`, name).Scan(&spec, &method, &opclass)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("inspect vector index: %w", err)
+	}
+
+	want := vectorIndexSpec(cfg, cfg.Lists)
+	switch {
+	case spec == "":
+		spec = method + " " + opclass
+		if method == cfg.Type && opclass == operatorClass(cfg.Metric) {
+			return true, nil
+		}
+		spec += " (unrecorded build settings)"
+	case cfg.Type == config.IndexIVFFlat && cfg.Lists == 0:
+		want = cfg.Type + " " + operatorClass(cfg.Metric)
+		if strings.HasPrefix(spec, want+" lists=") {
+			return true, nil
+		}
+	case spec == want:
+		return true, nil
+	}
+	return true, fmt.Errorf("%w: %s was built as %s, not %s; rebuild it with reindex", ErrVectorIndexMismatch, name, spec, want)
+}
+
+// RebuildVectorIndex drops and recreates the index over table's vectors and
+// returns a description of the new index. Unless Lists is configured, ivfflat
+// lists are sized to the vectors the table holds now.
+func RebuildVectorIndex(ctx context.Context, pool *pgxpool.Pool, table string, cfg config.VectorIndexConfig) (description string, err error) {
+	if pool == nil {
+		return "", fmt.Errorf("postgres pool is not configured")
+	}
+	cfg, err = ResolveVectorIndex(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	lists := cfg.Lists
+	var with []string
+	if cfg.Type == config.IndexIVFFlat {
+		if lists <= 0 {
+			var rows int64
+			if err := pool.QueryRow(ctx, fmt.Sprintf("SELECT COUNT(embedding) FROM %s", table)).Scan(&rows); err != nil {
+				return "", fmt.Errorf("count vectors: %w", err)
+			}
+			lists = IvfflatLists(rows)
+		}
+		with = append(with, fmt.Sprintf("lists = %d", lists))
+	} else {
+		if cfg.M > 0 {
+			with = append(with, fmt.Sprintf("m = %d", cfg.M))
+		}
+		if cfg.EfConstruction > 0 {
+			with = append(with, fmt.Sprintf("ef_construction = %d", cfg.EfConstruction))
+		}
+	}
+
+	name := VectorIndexName(table)
+	create := fmt.Sprintf("CREATE INDEX %s ON %s USING %s (embedding %s)", name, table, cfg.Type, operatorClass(cfg.Metric))
+	if len(with) > 0 {
+		create += " WITH (" + strings.Join(with, ", ") + ")"
+	}
+	description = vectorIndexSpec(cfg, lists)
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		}
+	}()
+
+	stmts := []string{
+		"DROP INDEX IF EXISTS " + name,
+		create,
+		fmt.Sprintf("COMMENT ON INDEX %s IS '%s'", name, description),
+	}
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(ctx, stmt); err != nil {
+			return "", fmt.Errorf("build vector index: %w", err)
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return "", fmt.Errorf("commit transaction: %w", err)
+	}
+	return description, nil
+}
@@ -39,9 +39,21 @@ func EnsureRAGSchema(ctx context.Context, pool *pgxpool.Pool, dimension int) err
 		"ALTER TABLE rag_chunks ADD COLUMN IF NOT EXISTS section_level INT",
 		"ALTER TABLE rag_chunks ADD COLUMN IF NOT EXISTS section_title TEXT",
 		"CREATE INDEX IF NOT EXISTS idx_rag_chunks_document ON rag_chunks(document_id)",
-		"CREATE INDEX IF NOT EXISTS idx_rag_chunks_embedding ON rag_chunks USING ivfflat (embedding vector_l2_ops)",
 		"CREATE INDEX IF NOT EXISTS idx_rag_chunks_section ON rag_chunks(document_id, section_order)",
+		// Full-text search over chunk content for hybrid retrieval.
+		"ALTER TABLE rag_chunks ADD COLUMN IF NOT EXISTS content_tsv TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', content)) STORED",
+		"CREATE INDEX IF NOT EXISTS idx_rag_chunks_content_tsv ON rag_chunks USING GIN (content_tsv)",
+		// Chunks ingested into another embedding space have no default vector.
+		"ALTER TABLE rag_chunks ALTER COLUMN embedding DROP NOT NULL",
+		// Document topics mirrored from the knowledge graph so searches can
+		// filter on them.
+		`CREATE TABLE IF NOT EXISTS rag_document_topics (
+			document_id UUID NOT NULL REFERENCES rag_documents(id) ON DELETE CASCADE,
+			topic TEXT NOT NULL,
+			PRIMARY KEY (document_id, topic)
+		)`,
 	}
+	stmts = append(stmts, embeddingSpacesSchema...)
 
 	for _, stmt := range stmts {
 		if _, err := pool.Exec(ctx, stmt); err != nil {
@@ -51,3 +63,90 @@ func EnsureRAGSchema(ctx context.Context, pool *pgxpool.Pool, dimension int) err
 
 	return nil
 }
+
+// embeddingSpacesSchema creates the registry of embedding spaces.
+var embeddingSpacesSchema = []string{
+	`CREATE TABLE IF NOT EXISTS rag_embedding_spaces (
+		name TEXT PRIMARY KEY,
+		provider TEXT NOT NULL,
+		model TEXT NOT NULL,
+		dimension INT NOT NULL,
+		query_template TEXT NOT NULL DEFAULT '',
+		document_template TEXT NOT NULL DEFAULT '',
+		active BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	"CREATE UNIQUE INDEX IF NOT EXISTS idx_rag_embedding_spaces_active ON rag_embedding_spaces(active) WHERE active",
+}
+
+// EnsureLLMCacheSchema creates the table backing the LLM response cache.
+func EnsureLLMCacheSchema(ctx context.Context, pool *pgxpool.Pool) error {
+	if pool == nil {
+		return fmt.Errorf("postgres pool is not configured")
+	}
+
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS llm_cache (
+			key TEXT PRIMARY KEY,
+			provider TEXT NOT NULL,
+			model TEXT NOT NULL,
+			response TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMPTZ
+		)`,
+		"CREATE INDEX IF NOT EXISTS idx_llm_cache_expires ON llm_cache(expires_at)",
+	}
+
+	for _, stmt := range stmts {
+		if _, err := pool.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("execute llm cache schema statement: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// EnsureEmbeddingCacheSchema creates the content-addressed embedding cache.
+// Vectors of every dimension share the table, so the column is untyped.
+func EnsureEmbeddingCacheSchema(ctx context.Context, pool *pgxpool.Pool) error {
+	if pool == nil {
+		return fmt.Errorf("postgres pool is not configured")
+	}
+
+	stmts := []string{
+		"CREATE EXTENSION IF NOT EXISTS vector",
+		`CREATE TABLE IF NOT EXISTS embedding_cache (
+			provider TEXT NOT NULL,
+			model TEXT NOT NULL,
+			dimension INT NOT NULL,
+			template TEXT NOT NULL DEFAULT '',
+			text_sha256 TEXT NOT NULL,
+			embedding VECTOR NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			last_used_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (provider, model, dimension, template, text_sha256)
+		)`,
+		// Tables created before templates were part of the key.
+		"ALTER TABLE embedding_cache ADD COLUMN IF NOT EXISTS template TEXT NOT NULL DEFAULT ''",
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM pg_index i
+				JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+				WHERE i.indrelid = 'embedding_cache'::regclass AND i.indisprimary AND a.attname = 'template'
+			) THEN
+				ALTER TABLE embedding_cache DROP CONSTRAINT IF EXISTS embedding_cache_pkey;
+				ALTER TABLE embedding_cache ADD PRIMARY KEY (provider, model, dimension, template, text_sha256);
+			END IF;
+		END $$`,
+		"CREATE INDEX IF NOT EXISTS idx_embedding_cache_last_used ON embedding_cache(last_used_at)",
+	}
+
+	for _, stmt := range stmts {
+		if _, err := pool.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("execute embedding cache schema statement: %w", err)
+		}
+	}
+
+	return nil
+}
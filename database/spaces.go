@@ -0,0 +1,419 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/embeddings"
+)
+
+// DefaultSpace is the embedding space stored in rag_chunks.embedding. Every
+// other space keeps its vectors in a table of its own.
+const DefaultSpace = "default"
+
+// undefinedTable is the SQLSTATE for a missing relation.
+const undefinedTable = "42P01"
+
+var spaceNamePattern = regexp.MustCompile(`^[a-z0-9_]{1,40}$`)
+
+// EmbeddingSpace is a named set of chunk vectors produced by one embedding
+// model. QueryTemplate is the configured override, not the model default.
+// DocumentTemplate is the template the vectors were embedded with, resolved
+// from the model defaults at registration, so that a later change of those
+// defaults still shows in the space's fingerprint.
+type EmbeddingSpace struct {
+	Name             string
+	Provider         string
+	Model            string
+	Dimension        int
+	QueryTemplate    string
+	DocumentTemplate string
+	Active           bool
+	CreatedAt        time.Time
+}
+
+// SpaceFromConfig describes the space the configured embedder writes to.
+func SpaceFromConfig(cfg config.EmbeddingConfig) EmbeddingSpace {
+	return EmbeddingSpace{
+		Name:             cfg.Space,
+		Provider:         cfg.Provider,
+		Model:            cfg.Model,
+		Dimension:        cfg.Dimension,
+		QueryTemplate:    cfg.QueryTemplate,
+		DocumentTemplate: embeddings.ResolveTemplates(cfg).Document,
+	}
+}
+
+// EmbeddingConfig returns base with the space's model settings, so that an
+// embedder built from it produces vectors for the space. Fallbacks are kept
+// only when the space uses the base model.
+func (s EmbeddingSpace) EmbeddingConfig(base config.EmbeddingConfig) config.EmbeddingConfig {
+	if s.Provider != base.Provider || s.Model != base.Model || s.Dimension != base.Dimension {
+		base.Fallbacks = nil
+	}
+	base.Space = s.Name
+	base.Provider = s.Provider
+	base.Model = s.Model
+	base.Dimension = s.Dimension
+	base.QueryTemplate = s.QueryTemplate
+	base.DocumentTemplate = s.DocumentTemplate
+	return base
+}
+
+// Fingerprint identifies the document vectors stored in the space.
+func (s EmbeddingSpace) Fingerprint() embeddings.Fingerprint {
+	return embeddings.FingerprintFor(config.EmbeddingConfig{
+		Provider:         s.Provider,
+		Model:            s.Model,
+		Dimension:        s.Dimension,
+		DocumentTemplate: s.DocumentTemplate,
+	})
+}
+
+// SearchConfig returns the embedding settings used to query the space. The
+// configured space is queried with the configured model, so that a changed
+// model is caught by the mismatch guard; other spaces use their own model.
+func (s EmbeddingSpace) SearchConfig(cfg config.EmbeddingConfig) config.EmbeddingConfig {
+	if s.Name == cfg.Space {
+		return cfg
+	}
+	return s.EmbeddingConfig(cfg)
+}
+
+// IsDefault reports whether the space is stored in rag_chunks.embedding.
+func (s EmbeddingSpace) IsDefault() bool {
+	return s.Name == DefaultSpace
+}
+
+// Table returns the table holding the space's vectors.
+func (s EmbeddingSpace) Table() string {
+	if s.IsDefault() {
+		return "rag_chunks"
+	}
+	return SpaceTable(s.Name)
+}
+
+// SpaceTable returns the vector table of a non-default space.
+func SpaceTable(name string) string {
+	return "rag_space_" + name
+}
+
+// ValidateSpaceName rejects names that are not safe to use in table names.
+func ValidateSpaceName(name string) error {
+	if !spaceNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid embedding space name %q: use 1-40 lowercase letters, digits or underscores", name)
+	}
+	return nil
+}
+
+// SpaceOptions controls EnsureEmbeddingSpace.
+type SpaceOptions struct {
+	// ActivateFirst activates a space registered while no space is active.
+	ActivateFirst bool
+	// Migrate re-registers a space whose stored vectors came from another
+	// model, discarding those vectors so they can be re-embedded, instead of
+	// failing with embeddings.ErrFingerprintMismatch.
+	Migrate bool
+}
+
+// EnsureEmbeddingSpace registers space and creates its vector table. A space
+// already holding vectors from another model, dimension or document template
+// is rejected unless opts.Migrate is set; an empty one is re-registered.
+// Unregistered vectors in the default column count as the default space's,
+// embedded by space's model at their stored dimension.
+// EnsureRAGSchema must run first, and EnsureVectorIndex after it.
+func EnsureEmbeddingSpace(ctx context.Context, pool *pgxpool.Pool, space EmbeddingSpace, opts SpaceOptions) (EmbeddingSpace, error) {
+	if pool == nil {
+		return EmbeddingSpace{}, fmt.Errorf("postgres pool is not configured")
+	}
+	if err := ValidateSpaceName(space.Name); err != nil {
+		return EmbeddingSpace{}, err
+	}
+	if space.Dimension <= 0 {
+		return EmbeddingSpace{}, fmt.Errorf("embedding dimension must be positive")
+	}
+	if space.IsDefault() {
+		if _, _, err := adoptLegacyVectors(ctx, pool, space, opts.ActivateFirst); err != nil {
+			return EmbeddingSpace{}, err
+		}
+	}
+
+	if _, err := pool.Exec(ctx, `
+		INSERT INTO rag_embedding_spaces (name, provider, model, dimension, query_template, document_template, active, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7 AND NOT EXISTS (SELECT 1 FROM rag_embedding_spaces WHERE active), NOW())
+		ON CONFLICT (name) DO NOTHING
+	`, space.Name, space.Provider, space.Model, space.Dimension, space.QueryTemplate, space.DocumentTemplate, opts.ActivateFirst); err != nil {
+		return EmbeddingSpace{}, fmt.Errorf("register embedding space: %w", err)
+	}
+
+	registered, found, err := GetEmbeddingSpace(ctx, pool, space.Name)
+	if err != nil {
+		return EmbeddingSpace{}, err
+	}
+	if !found {
+		return EmbeddingSpace{}, fmt.Errorf("embedding space %s was not registered", space.Name)
+	}
+	if !registered.IsDefault() {
+		for _, stmt := range spaceTableStatements(registered) {
+			if _, err := pool.Exec(ctx, stmt); err != nil {
+				return EmbeddingSpace{}, fmt.Errorf("create embedding space table: %w", err)
+			}
+		}
+	}
+
+	if registered.Fingerprint() != space.Fingerprint() {
+		embedded, _, err := CountSpaceEmbeddings(ctx, pool, registered)
+		if err != nil {
+			return EmbeddingSpace{}, err
+		}
+		if embedded > 0 && !opts.Migrate {
+			return EmbeddingSpace{}, fmt.Errorf("%w: embedding space %s holds %d vectors from %s but the embedder is %s; use another space, or migrate to discard them and re-embed",
+				embeddings.ErrFingerprintMismatch, space.Name, embedded, registered.Fingerprint(), space.Fingerprint())
+		}
+		if err := migrateSpace(ctx, pool, registered, space); err != nil {
+			return EmbeddingSpace{}, err
+		}
+		space.Active, space.CreatedAt = registered.Active, time.Now()
+		return space, nil
+	}
+
+	// The query template does not affect stored vectors, and spaces
+	// registered with an empty document override record the default their
+	// vectors were embedded with.
+	if registered.QueryTemplate != space.QueryTemplate || registered.DocumentTemplate != space.DocumentTemplate {
+		if _, err := pool.Exec(ctx, "UPDATE rag_embedding_spaces SET query_template = $2, document_template = $3 WHERE name = $1", space.Name, space.QueryTemplate, space.DocumentTemplate); err != nil {
+			return EmbeddingSpace{}, fmt.Errorf("update embedding space: %w", err)
+		}
+		registered.QueryTemplate, registered.DocumentTemplate = space.QueryTemplate, space.DocumentTemplate
+	}
+
+	return registered, nil
+}
+
+// migrateSpace records next as the model of an existing space and discards the
+// space's vectors, resizing its storage when the dimension changes. A resize
+// drops the vector index.
+func migrateSpace(ctx context.Context, pool *pgxpool.Pool, current, next EmbeddingSpace) (err error) {
+	var stmts []string
+	switch {
+	case current.IsDefault() && current.Dimension != next.Dimension:
+		stmts = []string{
+			"DROP INDEX IF EXISTS idx_rag_chunks_embedding",
+			"UPDATE rag_chunks SET embedding = NULL",
+			fmt.Sprintf("ALTER TABLE rag_chunks ALTER COLUMN embedding TYPE VECTOR(%d)", next.Dimension),
+		}
+	case current.IsDefault():
+		stmts = []string{"UPDATE rag_chunks SET embedding = NULL WHERE embedding IS NOT NULL"}
+	case current.Dimension != next.Dimension:
+		stmts = append([]string{"DROP TABLE " + current.Table()}, spaceTableStatements(next)...)
+	default:
+		stmts = []string{"TRUNCATE " + current.Table()}
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		}
+	}()
+
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("discard embedding space vectors: %w", err)
+		}
+	}
+	if _, err = tx.Exec(ctx, `
+		UPDATE rag_embedding_spaces
+		SET provider = $2, model = $3, dimension = $4, query_template = $5, document_template = $6, created_at = NOW()
+		WHERE name = $1
+	`, next.Name, next.Provider, next.Model, next.Dimension, next.QueryTemplate, next.DocumentTemplate); err != nil {
+		return fmt.Errorf("update embedding space: %w", err)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+func spaceTableStatements(space EmbeddingSpace) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			chunk_id UUID PRIMARY KEY REFERENCES rag_chunks(id) ON DELETE CASCADE,
+			embedding VECTOR(%d) NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`, space.Table(), space.Dimension),
+	}
+}
+
+// GetEmbeddingSpace returns the named space.
+func GetEmbeddingSpace(ctx context.Context, pool *pgxpool.Pool, name string) (EmbeddingSpace, bool, error) {
+	spaces, err := querySpaces(ctx, pool, "WHERE name = $1", name)
+	if err != nil || len(spaces) == 0 {
+		return EmbeddingSpace{}, false, err
+	}
+	return spaces[0], true, nil
+}
+
+// ActiveEmbeddingSpace returns the space that chat queries. found is false
+// before any space has been registered.
+func ActiveEmbeddingSpace(ctx context.Context, pool *pgxpool.Pool) (EmbeddingSpace, bool, error) {
+	spaces, err := querySpaces(ctx, pool, "WHERE active")
+	if err != nil || len(spaces) == 0 {
+		return EmbeddingSpace{}, false, err
+	}
+	return spaces[0], true, nil
+}
+
+// QueryEmbeddingSpace returns the space chat should search. Before any space
+// is registered, vectors already in the default column are recorded as the
+// default space, attributed to the configured model.
+func QueryEmbeddingSpace(ctx context.Context, pool *pgxpool.Pool, cfg config.EmbeddingConfig) (EmbeddingSpace, error) {
+	space, found, err := ActiveEmbeddingSpace(ctx, pool)
+	if err != nil || found {
+		return space, err
+	}
+	space, found, err = adoptLegacyVectors(ctx, pool, SpaceFromConfig(cfg), true)
+	if err != nil {
+		return EmbeddingSpace{}, err
+	}
+	if !found {
+		space = SpaceFromConfig(cfg)
+		space.Name = DefaultSpace
+	}
+	return space, nil
+}
+
+// adoptLegacyVectors registers the default space for vectors written to
+// rag_chunks before spaces were recorded, so that the mismatch guard has a
+// fingerprint to check. The vectors are attributed to space's model, the only
+// one known, but keep their own dimension so that a change of dimension is
+// caught. A registered default space is returned as is; found is false when
+// the default column holds no vectors.
+func adoptLegacyVectors(ctx context.Context, pool *pgxpool.Pool, space EmbeddingSpace, activate bool) (EmbeddingSpace, bool, error) {
+	if pool == nil {
+		return EmbeddingSpace{}, false, fmt.Errorf("postgres pool is not configured")
+	}
+
+	var dimension int
+	err := pool.QueryRow(ctx, "SELECT vector_dims(embedding) FROM rag_chunks WHERE embedding IS NOT NULL LIMIT 1").Scan(&dimension)
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows), errors.As(err, &pgErr) && pgErr.Code == undefinedTable:
+		return EmbeddingSpace{}, false, nil
+	case err != nil:
+		return EmbeddingSpace{}, false, fmt.Errorf("read default vector dimension: %w", err)
+	}
+
+	for _, stmt := range embeddingSpacesSchema {
+		if _, err := pool.Exec(ctx, stmt); err != nil {
+			return EmbeddingSpace{}, false, fmt.Errorf("execute schema statement: %w", err)
+		}
+	}
+	space.Name, space.Dimension = DefaultSpace, dimension
+	if _, err := pool.Exec(ctx, `
+		INSERT INTO rag_embedding_spaces (name, provider, model, dimension, query_template, document_template, active, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7 AND NOT EXISTS (SELECT 1 FROM rag_embedding_spaces WHERE active), NOW())
+		ON CONFLICT (name) DO NOTHING
+	`, space.Name, space.Provider, space.Model, space.Dimension, space.QueryTemplate, space.DocumentTemplate, activate); err != nil {
+		return EmbeddingSpace{}, false, fmt.Errorf("register embedding space: %w", err)
+	}
+	return GetEmbeddingSpace(ctx, pool, DefaultSpace)
+}
+
+// ListEmbeddingSpaces returns every registered space by name.
+func ListEmbeddingSpaces(ctx context.Context, pool *pgxpool.Pool) ([]EmbeddingSpace, error) {
+	return querySpaces(ctx, pool, "")
+}
+
+// ActivateEmbeddingSpace makes name the space chat queries. The switch is a
+// single transaction, so readers see either the old or the new space.
+func ActivateEmbeddingSpace(ctx context.Context, pool *pgxpool.Pool, name string) (err error) {
+	if pool == nil {
+		return fmt.Errorf("postgres pool is not configured")
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		}
+	}()
+
+	if _, err = tx.Exec(ctx, "UPDATE rag_embedding_spaces SET active = FALSE WHERE active"); err != nil {
+		return fmt.Errorf("deactivate embedding spaces: %w", err)
+	}
+	tag, err := tx.Exec(ctx, "UPDATE rag_embedding_spaces SET active = TRUE WHERE name = $1", name)
+	if err != nil {
+		return fmt.Errorf("activate embedding space: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		err = fmt.Errorf("embedding space %s is not registered", name)
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// CountSpaceEmbeddings returns how many chunks have a vector in the space and
+// how many chunks exist in total.
+func CountSpaceEmbeddings(ctx context.Context, pool *pgxpool.Pool, space EmbeddingSpace) (embedded, total int64, err error) {
+	column := "s.chunk_id"
+	join := fmt.Sprintf("LEFT JOIN %s s ON s.chunk_id = rc.id", space.Table())
+	if space.IsDefault() {
+		column, join = "rc.embedding", ""
+	}
+	query := fmt.Sprintf("SELECT COUNT(%s), COUNT(*) FROM rag_chunks rc %s", column, join)
+	if err := pool.QueryRow(ctx, query).Scan(&embedded, &total); err != nil {
+		return 0, 0, fmt.Errorf("count space embeddings: %w", err)
+	}
+	return embedded, total, nil
+}
+
+func querySpaces(ctx context.Context, pool *pgxpool.Pool, where string, args ...any) ([]EmbeddingSpace, error) {
+	if pool == nil {
+		return nil, fmt.Errorf("postgres pool is not configured")
+	}
+
+	rows, err := pool.Query(ctx, `
+		SELECT name, provider, model, dimension, query_template, document_template, active, created_at
+		FROM rag_embedding_spaces `+where+`
+		ORDER BY name
+	`, args...)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == undefinedTable {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("query embedding spaces: %w", err)
+	}
+
+	spaces, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (EmbeddingSpace, error) {
+		var space EmbeddingSpace
+		err := row.Scan(&space.Name, &space.Provider, &space.Model, &space.Dimension, &space.QueryTemplate, &space.DocumentTemplate, &space.Active, &space.CreatedAt)
+		return space, err
+	})
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == undefinedTable {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("scan embedding spaces: %w", err)
+	}
+	return spaces, nil
+}
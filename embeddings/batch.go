@@ -0,0 +1,61 @@
+package embeddings
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultOllamaBatchSize = 32
+	defaultConcurrency     = 4
+)
+
+// splitBatches splits texts into consecutive batches of at most size texts.
+func splitBatches(texts []string, size int) [][]string {
+	if size <= 0 {
+		size = len(texts)
+	}
+	var batches [][]string
+	for start := 0; start < len(texts); start += size {
+		end := min(start+size, len(texts))
+		batches = append(batches, texts[start:end])
+	}
+	return batches
+}
+
+// embedBatches runs embed over every batch with at most concurrency requests
+// in flight and returns the vectors in input order. The first failure cancels
+// the remaining batches.
+func embedBatches(ctx context.Context, batches [][]string, concurrency int, embed func(context.Context, []string) ([][]float32, error)) ([][]float32, error) {
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	results := make([][][]float32, len(batches))
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(concurrency)
+	for i, batch := range batches {
+		group.Go(func() error {
+			vectors, err := embed(groupCtx, batch)
+			if err != nil {
+				return err
+			}
+			if len(vectors) != len(batch) {
+				return fmt.Errorf("embedding batch returned %d vectors for %d texts", len(vectors), len(batch))
+			}
+			results[i] = vectors
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	var vectors [][]float32
+	for _, batch := range results {
+		vectors = append(vectors, batch...)
+	}
+	return vectors, nil
+}
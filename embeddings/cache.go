@@ -0,0 +1,229 @@
+package embeddings
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pgvector/pgvector-go"
+
+	"github.com/fabfab/go-agent/config"
+)
+
+// Fingerprint identifies the embedding space a vector belongs to. Vectors are
+// only reused for an identical fingerprint. Template is the document template
+// applied before embedding, since it changes the resulting vectors.
+type Fingerprint struct {
+	Provider  string
+	Model     string
+	Dimension int
+	Template  string
+}
+
+// FingerprintFor returns the fingerprint of document vectors produced by the
+// configured primary embedder.
+func FingerprintFor(cfg config.EmbeddingConfig) Fingerprint {
+	return Fingerprint{
+		Provider:  cfg.Provider,
+		Model:     cfg.Model,
+		Dimension: cfg.Dimension,
+		Template:  ResolveTemplates(cfg).Document,
+	}
+}
+
+// String formats the fingerprint as provider/model@dimension, followed by the
+// quoted template when there is one.
+func (f Fingerprint) String() string {
+	if f.Template == "" {
+		return fmt.Sprintf("%s/%s@%d", f.Provider, f.Model, f.Dimension)
+	}
+	return fmt.Sprintf("%s/%s@%d %q", f.Provider, f.Model, f.Dimension, f.Template)
+}
+
+// ErrFingerprintMismatch reports that an embedder's fingerprint differs from
+// the one recorded for the vectors it would be compared with.
+var ErrFingerprintMismatch = errors.New("embedding model does not match the stored vectors")
+
+// Fingerprinter is implemented by embedders that know the fingerprint of the
+// document vectors they produce. Embedders built by NewEmbedder do.
+type Fingerprinter interface {
+	Fingerprint() Fingerprint
+}
+
+// FingerprintOf returns e's fingerprint when it reports one.
+func FingerprintOf(e Embedder) (Fingerprint, bool) {
+	if f, ok := e.(Fingerprinter); ok {
+		if fp := f.Fingerprint(); fp != (Fingerprint{}) {
+			return fp, true
+		}
+	}
+	return Fingerprint{}, false
+}
+
+// TextHash returns the content address used as the cache key for text.
+func TextHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// Cache stores vectors by fingerprint and TextHash.
+type Cache interface {
+	// Get returns the cached vectors for the given hashes; misses are absent
+	// from the map.
+	Get(ctx context.Context, fp Fingerprint, hashes []string) (map[string][]float32, error)
+	Put(ctx context.Context, fp Fingerprint, vectors map[string][]float32) error
+}
+
+// CacheStats summarises the cached vectors of one fingerprint.
+type CacheStats struct {
+	Fingerprint Fingerprint
+	Entries     int64
+	LastUsed    time.Time
+}
+
+// PruneOptions selects the entries removed by PostgresCache.Prune. Entries
+// matching either criterion are removed.
+type PruneOptions struct {
+	// UnusedFor removes entries not read or written within the duration.
+	UnusedFor time.Duration
+	// Keep, when set, removes entries of every other fingerprint.
+	Keep *Fingerprint
+}
+
+// PostgresCache stores vectors in the embedding_cache table created by
+// database.EnsureEmbeddingCacheSchema.
+type PostgresCache struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresCache(pool *pgxpool.Pool) *PostgresCache {
+	return &PostgresCache{pool: pool}
+}
+
+func (c *PostgresCache) Get(ctx context.Context, fp Fingerprint, hashes []string) (map[string][]float32, error) {
+	if c.pool == nil {
+		return nil, fmt.Errorf("postgres pool is nil")
+	}
+	if len(hashes) == 0 {
+		return map[string][]float32{}, nil
+	}
+
+	rows, err := c.pool.Query(ctx, `
+        UPDATE embedding_cache
+        SET last_used_at = NOW()
+        WHERE provider = $1 AND model = $2 AND dimension = $3 AND template = $4 AND text_sha256 = ANY($5)
+        RETURNING text_sha256, embedding
+    `, fp.Provider, fp.Model, fp.Dimension, fp.Template, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("query embedding cache: %w", err)
+	}
+	defer rows.Close()
+
+	vectors := make(map[string][]float32, len(hashes))
+	for rows.Next() {
+		var (
+			hash   string
+			vector pgvector.Vector
+		)
+		if err := rows.Scan(&hash, &vector); err != nil {
+			return nil, fmt.Errorf("scan embedding cache row: %w", err)
+		}
+		vectors[hash] = vector.Slice()
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate embedding cache rows: %w", err)
+	}
+	return vectors, nil
+}
+
+func (c *PostgresCache) Put(ctx context.Context, fp Fingerprint, vectors map[string][]float32) error {
+	if c.pool == nil {
+		return fmt.Errorf("postgres pool is nil")
+	}
+
+	if len(vectors) == 0 {
+		return nil
+	}
+
+	// One round trip for the whole document.
+	batch := &pgx.Batch{}
+	for hash, vector := range vectors {
+		batch.Queue(`
+            INSERT INTO embedding_cache (provider, model, dimension, template, text_sha256, embedding, created_at, last_used_at)
+            VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW())
+            ON CONFLICT (provider, model, dimension, template, text_sha256) DO UPDATE SET
+                embedding = EXCLUDED.embedding,
+                last_used_at = NOW()
+        `, fp.Provider, fp.Model, fp.Dimension, fp.Template, hash, pgvector.NewVector(vector))
+	}
+	if err := c.pool.SendBatch(ctx, batch).Close(); err != nil {
+		return fmt.Errorf("store cached embeddings: %w", err)
+	}
+	return nil
+}
+
+// Stats reports the number of cached vectors per fingerprint.
+func (c *PostgresCache) Stats(ctx context.Context) ([]CacheStats, error) {
+	if c.pool == nil {
+		return nil, fmt.Errorf("postgres pool is nil")
+	}
+
+	rows, err := c.pool.Query(ctx, `
+        SELECT provider, model, dimension, template, COUNT(*), MAX(last_used_at)
+        FROM embedding_cache
+        GROUP BY provider, model, dimension, template
+        ORDER BY provider, model, dimension, template
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("query embedding cache stats: %w", err)
+	}
+	defer rows.Close()
+
+	var stats []CacheStats
+	for rows.Next() {
+		var entry CacheStats
+		if err := rows.Scan(&entry.Fingerprint.Provider, &entry.Fingerprint.Model, &entry.Fingerprint.Dimension, &entry.Fingerprint.Template, &entry.Entries, &entry.LastUsed); err != nil {
+			return nil, fmt.Errorf("scan embedding cache stats: %w", err)
+		}
+		stats = append(stats, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate embedding cache stats: %w", err)
+	}
+	return stats, nil
+}
+
+// Prune deletes the entries selected by opts and returns how many were
+// removed. With no criteria it removes nothing.
+func (c *PostgresCache) Prune(ctx context.Context, opts PruneOptions) (int64, error) {
+	if c.pool == nil {
+		return 0, fmt.Errorf("postgres pool is nil")
+	}
+
+	var removed int64
+	if opts.UnusedFor > 0 {
+		tag, err := c.pool.Exec(ctx, "DELETE FROM embedding_cache WHERE last_used_at < $1", time.Now().Add(-opts.UnusedFor))
+		if err != nil {
+			return removed, fmt.Errorf("prune unused embeddings: %w", err)
+		}
+		removed += tag.RowsAffected()
+	}
+	if opts.Keep != nil {
+		tag, err := c.pool.Exec(ctx, `
+            DELETE FROM embedding_cache
+            WHERE (provider, model, dimension, template) <> ($1, $2, $3, $4)
+        `, opts.Keep.Provider, opts.Keep.Model, opts.Keep.Dimension, opts.Keep.Template)
+		if err != nil {
+			return removed, fmt.Errorf("prune other fingerprints: %w", err)
+		}
+		removed += tag.RowsAffected()
+	}
+	return removed, nil
+}
+
+var _ Cache = (*PostgresCache)(nil)
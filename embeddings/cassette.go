@@ -0,0 +1,73 @@
+package embeddings
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fabfab/go-agent/cassette"
+)
+
+const cassetteKindEmbed = "embed"
+
+// embedRequest is recorded per text so that replay does not depend on how
+// callers batch their input.
+type embedRequest struct {
+	Text string `json:"text"`
+}
+
+type recordingEmbedder struct {
+	embedder Embedder
+	cassette *cassette.Cassette
+}
+
+// NewRecordingEmbedder wraps embedder so that the vector of every text it
+// embeds is appended to the cassette, once per text, for later replay with
+// NewReplayEmbedder.
+func NewRecordingEmbedder(embedder Embedder, c *cassette.Cassette) Embedder {
+	return &recordingEmbedder{embedder: embedder, cassette: c}
+}
+
+func (e *recordingEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors, err := e.embedder.Embed(ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) != len(texts) {
+		return nil, fmt.Errorf("embedder returned %d vectors for %d texts", len(vectors), len(texts))
+	}
+	for i, text := range texts {
+		if err := e.cassette.RecordOnce(cassetteKindEmbed, embedRequest{Text: text}, vectors[i]); err != nil {
+			return nil, fmt.Errorf("record embedding: %w", err)
+		}
+	}
+	return vectors, nil
+}
+
+type replayEmbedder struct {
+	cassette  *cassette.Cassette
+	dimension int
+}
+
+// NewReplayEmbedder answers from a cassette written by NewRecordingEmbedder.
+// Texts that were never recorded fail with cassette.ErrNotRecorded.
+func NewReplayEmbedder(c *cassette.Cassette, dimension int) Embedder {
+	return &replayEmbedder{cassette: c, dimension: dimension}
+}
+
+func (e *replayEmbedder) Embed(_ context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		if err := e.cassette.Replay(cassetteKindEmbed, embedRequest{Text: text}, &vectors[i]); err != nil {
+			return nil, fmt.Errorf("replay embedding: %w", err)
+		}
+		if e.dimension > 0 && len(vectors[i]) != e.dimension {
+			return nil, fmt.Errorf("replayed embedding has dimension %d, expected %d", len(vectors[i]), e.dimension)
+		}
+	}
+	return vectors, nil
+}
+
+var (
+	_ Embedder = (*recordingEmbedder)(nil)
+	_ Embedder = (*replayEmbedder)(nil)
+)
@@ -1,11 +1,14 @@
-// Package embeddings provides pluggable text embedding generation for Ollama and OpenAI.
+// Package embeddings provides pluggable text embedding generation for Ollama, OpenAI and an
+// in-process local provider.
 package embeddings
 
 import (
 	"context"
 	"fmt"
 
+	"github.com/fabfab/go-agent/cassette"
 	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/resilience"
 )
 
 type Embedder interface {
@@ -16,22 +19,85 @@ type Options struct {
 	Provider  string
 	Model     string
 	Dimension int
+	// BatchSize caps the texts sent per request; zero uses the provider
+	// default. Concurrency caps the requests in flight.
+	BatchSize   int
+	Concurrency int
 
 	OllamaHost    string
 	OpenAIAPIKey  string
 	OpenAIBaseURL string
 }
 
+// NewEmbedder builds the configured embedder. The result also implements
+// QueryDocumentEmbedder, applying the query and document templates resolved
+// for the model that serves each batch, and Fingerprinter, reporting the
+// primary model.
 func NewEmbedder(cfg config.Config) (Embedder, error) {
+	if cfg.Embeddings.Provider == config.ProviderReplay {
+		if cfg.Embeddings.Cassette == "" {
+			return nil, fmt.Errorf("replay provider selected but EMBEDDING_CASSETTE not set")
+		}
+		c, err := cassette.Load(cfg.Embeddings.Cassette)
+		if err != nil {
+			return nil, err
+		}
+		return newTemplatedEmbedder(NewReplayEmbedder(c, cfg.Embeddings.Dimension), cfg.Embeddings), nil
+	}
+
+	var recording *cassette.Cassette
+	if cfg.Embeddings.Cassette != "" {
+		c, err := cassette.Open(cfg.Embeddings.Cassette)
+		if err != nil {
+			return nil, err
+		}
+		recording = c
+	}
+
 	opts := Options{
-		Provider:      cfg.Embeddings.Provider,
-		Model:         cfg.Embeddings.Model,
-		Dimension:     cfg.Embeddings.Dimension,
+		BatchSize:     cfg.Embeddings.BatchSize,
+		Concurrency:   cfg.Embeddings.Concurrency,
 		OllamaHost:    cfg.OllamaHost,
 		OpenAIAPIKey:  cfg.OpenAIAPIKey,
 		OpenAIBaseURL: cfg.OpenAIBaseURL,
 	}
+	policy := resilience.FromConfig(cfg.Resilience)
+	chain := cfg.Embeddings.Chain()
+	embedders := make([]NamedEmbedder, 0, len(chain))
+	for i, spec := range chain {
+		specOpts := opts
+		specOpts.Provider, specOpts.Model, specOpts.Dimension = spec.Provider, spec.Model, spec.Dimension
+		embedder, err := newProviderEmbedder(specOpts)
+		if err != nil {
+			return nil, err
+		}
+		if policy.Enabled() {
+			embedder = NewResilientEmbedder(embedder, resilience.NewExecutor(policy))
+		}
+		// Recordings hold templated texts, as replay sends them.
+		if recording != nil {
+			embedder = NewRecordingEmbedder(embedder, recording)
+		}
+		// Template overrides are configured for the primary model; fallbacks
+		// use the defaults of their own model.
+		specCfg := config.EmbeddingConfig{Provider: spec.Provider, Model: spec.Model, Dimension: spec.Dimension}
+		if i == 0 {
+			specCfg = cfg.Embeddings
+		}
+		embedders = append(embedders, NamedEmbedder{Name: spec.String(), Dimension: spec.Dimension, Embedder: newTemplatedEmbedder(embedder, specCfg)})
+	}
+	return NewFallbackEmbedder(embedders...)
+}
+
+func newTemplatedEmbedder(embedder Embedder, cfg config.EmbeddingConfig) *templatedEmbedder {
+	return &templatedEmbedder{
+		embedder:    embedder,
+		templates:   ResolveTemplates(cfg),
+		fingerprint: FingerprintFor(cfg),
+	}
+}
 
+func newProviderEmbedder(opts Options) (Embedder, error) {
 	switch opts.Provider {
 	case config.ProviderOllama:
 		return NewOllamaEmbedder(opts), nil
@@ -40,6 +106,8 @@ func NewEmbedder(cfg config.Config) (Embedder, error) {
 			return nil, fmt.Errorf("openai provider selected but OPENAI_API_KEY not set")
 		}
 		return NewOpenAIEmbedder(opts), nil
+	case config.ProviderLocal:
+		return NewLocalEmbedder(opts)
 	default:
 		return nil, fmt.Errorf("unknown embedding provider: %s", opts.Provider)
 	}
@@ -0,0 +1,119 @@
+package embeddings
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// NamedEmbedder pairs an embedder with its label and the vector dimension it
+// produces.
+type NamedEmbedder struct {
+	Name      string
+	Dimension int
+	Embedder  Embedder
+}
+
+type fallbackEmbedder struct {
+	embedders []NamedEmbedder
+	dimension int
+}
+
+// NewFallbackEmbedder returns an embedder that tries embedders in order,
+// moving to the next one when a batch fails. Vectors from different
+// dimensions cannot share an index, so every fallback must declare the same
+// dimension as the first embedder and its vectors are checked against it.
+//
+// Queries and documents go through each embedder's own templates, and the
+// chain reports the first embedder's fingerprint. A batch served by a
+// fallback of another model is still a different embedding space, so
+// EmbedQueryServed and EmbedDocumentsServed report the fingerprint of the
+// embedder that served it, and callers searching or storing vectors must
+// compare it.
+func NewFallbackEmbedder(embedders ...NamedEmbedder) (Embedder, error) {
+	if len(embedders) == 0 {
+		return nil, fmt.Errorf("no embedding providers configured")
+	}
+	dimension := embedders[0].Dimension
+	for _, named := range embedders[1:] {
+		if named.Dimension != dimension {
+			return nil, fmt.Errorf("embedding fallback %s has dimension %d but %s uses %d", named.Name, named.Dimension, embedders[0].Name, dimension)
+		}
+	}
+	if len(embedders) == 1 {
+		return embedders[0].Embedder, nil
+	}
+	return &fallbackEmbedder{embedders: embedders, dimension: dimension}, nil
+}
+
+func (e *fallbackEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors, _, err := e.embed(ctx, func(embedder Embedder) ([][]float32, Fingerprint, error) {
+		vectors, err := embedder.Embed(ctx, texts)
+		return vectors, Fingerprint{}, err
+	})
+	return vectors, err
+}
+
+func (e *fallbackEmbedder) EmbedQuery(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors, _, err := e.embedQueryServed(ctx, texts)
+	return vectors, err
+}
+
+func (e *fallbackEmbedder) embedQueryServed(ctx context.Context, texts []string) ([][]float32, Fingerprint, error) {
+	return e.embed(ctx, func(embedder Embedder) ([][]float32, Fingerprint, error) {
+		return EmbedQueryServed(ctx, embedder, texts)
+	})
+}
+
+func (e *fallbackEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors, _, err := e.embedDocumentsServed(ctx, texts)
+	return vectors, err
+}
+
+func (e *fallbackEmbedder) embedDocumentsServed(ctx context.Context, texts []string) ([][]float32, Fingerprint, error) {
+	return e.embed(ctx, func(embedder Embedder) ([][]float32, Fingerprint, error) {
+		return EmbedDocumentsServed(ctx, embedder, texts)
+	})
+}
+
+// Fingerprint returns the first embedder's fingerprint.
+func (e *fallbackEmbedder) Fingerprint() Fingerprint {
+	fp, _ := FingerprintOf(e.embedders[0].Embedder)
+	return fp
+}
+
+// embed runs call against each embedder in turn until one succeeds.
+func (e *fallbackEmbedder) embed(ctx context.Context, call func(Embedder) ([][]float32, Fingerprint, error)) ([][]float32, Fingerprint, error) {
+	var errs []error
+	for _, named := range e.embedders {
+		vectors, fp, err := call(named.Embedder)
+		if err == nil {
+			err = e.checkDimension(vectors)
+		}
+		if err == nil {
+			return vectors, fp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, Fingerprint{}, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", named.Name, err))
+	}
+	return nil, Fingerprint{}, fmt.Errorf("all embedding providers failed: %w", errors.Join(errs...))
+}
+
+func (e *fallbackEmbedder) checkDimension(vectors [][]float32) error {
+	if e.dimension <= 0 {
+		return nil
+	}
+	for _, vec := range vectors {
+		if len(vec) != e.dimension {
+			return fmt.Errorf("embedding dimension mismatch: expected %d, got %d", e.dimension, len(vec))
+		}
+	}
+	return nil
+}
+
+var (
+	_ QueryDocumentEmbedder = (*fallbackEmbedder)(nil)
+	_ Fingerprinter         = (*fallbackEmbedder)(nil)
+)
@@ -0,0 +1,89 @@
+package embeddings
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// localEmbedder derives vectors from the text itself by hashing word unigrams,
+// word bigrams and character trigrams into Dimension signed buckets. It needs
+// no model server, so it suits air-gapped machines and CI. Similarity tracks
+// shared vocabulary rather than meaning.
+type localEmbedder struct {
+	dimension int
+}
+
+func NewLocalEmbedder(opts Options) (Embedder, error) {
+	if opts.Dimension <= 0 {
+		return nil, fmt.Errorf("local embedding provider requires a positive EMBEDDING_DIMENSION")
+	}
+	return &localEmbedder{dimension: opts.Dimension}, nil
+}
+
+func (e *localEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		vectors[i] = e.embed(text)
+	}
+	return vectors, nil
+}
+
+func (e *localEmbedder) embed(text string) []float32 {
+	counts := map[string]int{}
+	words := localTokens(text)
+	for i, word := range words {
+		counts["w:"+word]++
+		if i > 0 {
+			counts["b:"+words[i-1]+" "+word]++
+		}
+		padded := []rune("^" + word + "$")
+		for j := 0; j+3 <= len(padded); j++ {
+			counts["c:"+string(padded[j:j+3])]++
+		}
+	}
+
+	vector := make([]float64, e.dimension)
+	for feature, count := range counts {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(feature))
+		sum := h.Sum64()
+		// Sublinear term frequency keeps repeated words from dominating; the
+		// sign bit spreads collisions so they cancel out on average.
+		weight := 1 + math.Log(float64(count))
+		if sum&(1<<63) != 0 {
+			weight = -weight
+		}
+		vector[sum%uint64(e.dimension)] += weight
+	}
+
+	var norm float64
+	for _, value := range vector {
+		norm += value * value
+	}
+	norm = math.Sqrt(norm)
+
+	result := make([]float32, e.dimension)
+	if norm == 0 {
+		return result
+	}
+	for i, value := range vector {
+		result[i] = float32(value / norm)
+	}
+	return result
+}
+
+// localTokens lower-cases text and splits it into runs of letters and digits.
+func localTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+var _ Embedder = (*localEmbedder)(nil)
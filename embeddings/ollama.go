@@ -5,25 +5,31 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/fabfab/go-agent/resilience"
 )
 
 type ollamaEmbedder struct {
-	host      string
-	model     string
-	dimension int
-	client    *http.Client
+	host        string
+	model       string
+	dimension   int
+	batchSize   int
+	concurrency int
+	client      *http.Client
 }
 
 type ollamaRequest struct {
-	Model  string `json:"model"`
-	Prompt string `json:"prompt"`
+	Model string   `json:"model"`
+	Input []string `json:"input"`
 }
 
 type ollamaResponse struct {
-	Embedding []float64 `json:"embedding"`
+	Embeddings [][]float32 `json:"embeddings"`
+	Error      string      `json:"error"`
 }
 
 func NewOllamaEmbedder(opts Options) Embedder {
@@ -31,57 +37,80 @@ func NewOllamaEmbedder(opts Options) Embedder {
 	if host == "" {
 		host = "http://localhost:11434"
 	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultOllamaBatchSize
+	}
 
 	return &ollamaEmbedder{
-		host:      host,
-		model:     opts.Model,
-		dimension: opts.Dimension,
+		host:        host,
+		model:       opts.Model,
+		dimension:   opts.Dimension,
+		batchSize:   batchSize,
+		concurrency: opts.Concurrency,
 		client: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout: 60 * time.Second,
 		},
 	}
 }
 
+// Embed sends texts to /api/embed in batches of batchSize, with up to
+// concurrency batches in flight.
 func (e *ollamaEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
-	results := make([][]float32, 0, len(texts))
+	if len(texts) == 0 {
+		return [][]float32{}, nil
+	}
+	return embedBatches(ctx, splitBatches(texts, e.batchSize), e.concurrency, e.embedBatch)
+}
 
-	url := fmt.Sprintf("%s/api/embeddings", e.host)
+func (e *ollamaEmbedder) embedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	reqBody, err := json.Marshal(ollamaRequest{Model: e.model, Input: texts})
+	if err != nil {
+		return nil, fmt.Errorf("marshal ollama request: %w", err)
+	}
 
-	for _, text := range texts {
-		reqBody, err := json.Marshal(ollamaRequest{Model: e.model, Prompt: text})
-		if err != nil {
-			return nil, fmt.Errorf("marshal ollama request: %w", err)
-		}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.host+"/api/embed", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("create ollama request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
 
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
-		if err != nil {
-			return nil, fmt.Errorf("create ollama request: %w", err)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("call ollama embed API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		data, _ := io.ReadAll(resp.Body)
+		message := strings.TrimSpace(string(data))
+		var parsed ollamaResponse
+		if json.Unmarshal(data, &parsed) == nil && parsed.Error != "" {
+			message = parsed.Error
 		}
-		req.Header.Set("Content-Type", "application/json")
-
-		resp, err := e.client.Do(req)
-		if err != nil {
-			return nil, fmt.Errorf("call ollama embeddings API: %w", err)
+		return nil, &resilience.StatusError{
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("ollama embed API returned status %s: %s", resp.Status, message),
 		}
+	}
 
-		var payload ollamaResponse
-		if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-			resp.Body.Close()
-			return nil, fmt.Errorf("decode ollama response: %w", err)
-		}
-		resp.Body.Close()
-
-		vec := make([]float32, len(payload.Embedding))
-		for i, value := range payload.Embedding {
-			vec[i] = float32(value)
-		}
+	var payload ollamaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("decode ollama response: %w", err)
+	}
+	if payload.Error != "" {
+		return nil, fmt.Errorf("ollama embed error: %s", payload.Error)
+	}
+	if len(payload.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("ollama returned %d embeddings for %d texts", len(payload.Embeddings), len(texts))
+	}
 
+	for _, vec := range payload.Embeddings {
 		if e.dimension > 0 && len(vec) != e.dimension {
 			return nil, fmt.Errorf("ollama embedding dimension mismatch: expected %d, got %d", e.dimension, len(vec))
 		}
-
-		results = append(results, vec)
 	}
-
-	return results, nil
+	return payload.Embeddings, nil
 }
+
+var _ Embedder = (*ollamaEmbedder)(nil)
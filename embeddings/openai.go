@@ -7,10 +7,22 @@ import (
 	openai "github.com/sashabaranov/go-openai"
 )
 
+const (
+	// openAIMaxInputs and openAIMaxTokens are the per-request limits of the
+	// embeddings endpoint.
+	openAIMaxInputs = 2048
+	openAIMaxTokens = 300000
+	// openAICharsPerToken underestimates real tokenisation so that estimated
+	// batches stay under the token limit.
+	openAICharsPerToken = 3
+)
+
 type openAIEmbedder struct {
-	client    *openai.Client
-	model     string
-	dimension int
+	client      *openai.Client
+	model       string
+	dimension   int
+	batchSize   int
+	concurrency int
 }
 
 func NewOpenAIEmbedder(opts Options) Embedder {
@@ -18,15 +30,30 @@ func NewOpenAIEmbedder(opts Options) Embedder {
 	if opts.OpenAIBaseURL != "" {
 		cfg.BaseURL = opts.OpenAIBaseURL
 	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 || batchSize > openAIMaxInputs {
+		batchSize = openAIMaxInputs
+	}
 
 	return &openAIEmbedder{
-		client:    openai.NewClientWithConfig(cfg),
-		model:     opts.Model,
-		dimension: opts.Dimension,
+		client:      openai.NewClientWithConfig(cfg),
+		model:       opts.Model,
+		dimension:   opts.Dimension,
+		batchSize:   batchSize,
+		concurrency: opts.Concurrency,
 	}
 }
 
+// Embed splits texts into requests that respect the endpoint's input count
+// and token limits.
 func (e *openAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if len(texts) == 0 {
+		return [][]float32{}, nil
+	}
+	return embedBatches(ctx, splitOpenAIBatches(texts, e.batchSize), e.concurrency, e.embedBatch)
+}
+
+func (e *openAIEmbedder) embedBatch(ctx context.Context, texts []string) ([][]float32, error) {
 	resp, err := e.client.CreateEmbeddings(ctx, openai.EmbeddingRequest{
 		Model: openai.EmbeddingModel(e.model),
 		Input: texts,
@@ -34,14 +61,41 @@ func (e *openAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32
 	if err != nil {
 		return nil, fmt.Errorf("create openai embeddings: %w", err)
 	}
+	if len(resp.Data) != len(texts) {
+		return nil, fmt.Errorf("openai returned %d embeddings for %d texts", len(resp.Data), len(texts))
+	}
 
-	results := make([][]float32, len(resp.Data))
-	for i, datum := range resp.Data {
+	results := make([][]float32, len(texts))
+	for _, datum := range resp.Data {
+		if datum.Index < 0 || datum.Index >= len(texts) {
+			return nil, fmt.Errorf("openai embedding index %d out of range", datum.Index)
+		}
 		if e.dimension > 0 && len(datum.Embedding) != e.dimension {
 			return nil, fmt.Errorf("openai embedding dimension mismatch: expected %d, got %d", e.dimension, len(datum.Embedding))
 		}
-		results[i] = datum.Embedding
+		results[datum.Index] = datum.Embedding
 	}
 
 	return results, nil
 }
+
+// splitOpenAIBatches groups texts into batches of at most size inputs whose
+// estimated token count stays within openAIMaxTokens.
+func splitOpenAIBatches(texts []string, size int) [][]string {
+	var (
+		batches [][]string
+		start   int
+		tokens  int
+	)
+	for i, text := range texts {
+		estimate := len(text)/openAICharsPerToken + 1
+		if i > start && (i-start >= size || tokens+estimate > openAIMaxTokens) {
+			batches = append(batches, texts[start:i])
+			start, tokens = i, 0
+		}
+		tokens += estimate
+	}
+	return append(batches, texts[start:])
+}
+
+var _ Embedder = (*openAIEmbedder)(nil)
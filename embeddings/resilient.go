@@ -0,0 +1,29 @@
+package embeddings
+
+import (
+	"context"
+
+	"github.com/fabfab/go-agent/resilience"
+)
+
+type resilientEmbedder struct {
+	embedder Embedder
+	exec     *resilience.Executor
+}
+
+// NewResilientEmbedder wraps embedder so that every batch runs under exec.
+func NewResilientEmbedder(embedder Embedder, exec *resilience.Executor) Embedder {
+	return &resilientEmbedder{embedder: embedder, exec: exec}
+}
+
+func (e *resilientEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	var vectors [][]float32
+	err := e.exec.Do(ctx, func(ctx context.Context) error {
+		var err error
+		vectors, err = e.embedder.Embed(ctx, texts)
+		return err
+	})
+	return vectors, err
+}
+
+var _ Embedder = (*resilientEmbedder)(nil)
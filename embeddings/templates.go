@@ -0,0 +1,190 @@
+package embeddings
+
+import (
+	"context"
+	"strings"
+
+	"github.com/fabfab/go-agent/config"
+)
+
+// textPlaceholder marks where the text goes in a template. Templates without it
+// are used as a prefix.
+const textPlaceholder = "{text}"
+
+// QueryDocumentEmbedder embeds search queries and indexed documents
+// differently, as asymmetric retrieval models expect.
+type QueryDocumentEmbedder interface {
+	Embedder
+	EmbedQuery(ctx context.Context, texts []string) ([][]float32, error)
+	EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// EmbedQuery embeds search queries with e, using its query path when it has
+// one.
+func EmbedQuery(ctx context.Context, e Embedder, texts []string) ([][]float32, error) {
+	if qd, ok := e.(QueryDocumentEmbedder); ok {
+		return qd.EmbedQuery(ctx, texts)
+	}
+	return e.Embed(ctx, texts)
+}
+
+// EmbedDocuments embeds texts to be indexed with e, using its document path
+// when it has one.
+func EmbedDocuments(ctx context.Context, e Embedder, texts []string) ([][]float32, error) {
+	if qd, ok := e.(QueryDocumentEmbedder); ok {
+		return qd.EmbedDocuments(ctx, texts)
+	}
+	return e.Embed(ctx, texts)
+}
+
+// servedEmbedder is implemented by embedders that know which embedding space
+// each batch of vectors came from.
+type servedEmbedder interface {
+	embedQueryServed(ctx context.Context, texts []string) ([][]float32, Fingerprint, error)
+	embedDocumentsServed(ctx context.Context, texts []string) ([][]float32, Fingerprint, error)
+}
+
+// EmbedQueryServed embeds search queries like EmbedQuery and also returns the
+// fingerprint of the space the vectors belong to, as EmbedDocumentsServed
+// does for documents.
+func EmbedQueryServed(ctx context.Context, e Embedder, texts []string) ([][]float32, Fingerprint, error) {
+	if served, ok := e.(servedEmbedder); ok {
+		return served.embedQueryServed(ctx, texts)
+	}
+	vectors, err := EmbedQuery(ctx, e, texts)
+	if err != nil {
+		return nil, Fingerprint{}, err
+	}
+	fp, _ := FingerprintOf(e)
+	return vectors, fp, nil
+}
+
+// EmbedDocumentsServed embeds texts like EmbedDocuments and also returns the
+// fingerprint of the vectors. It differs from FingerprintOf(e) when a fallback
+// of another model served the batch, and is zero when e does not know it.
+func EmbedDocumentsServed(ctx context.Context, e Embedder, texts []string) ([][]float32, Fingerprint, error) {
+	if served, ok := e.(servedEmbedder); ok {
+		return served.embedDocumentsServed(ctx, texts)
+	}
+	vectors, err := EmbedDocuments(ctx, e, texts)
+	if err != nil {
+		return nil, Fingerprint{}, err
+	}
+	fp, _ := FingerprintOf(e)
+	return vectors, fp, nil
+}
+
+// Templates wrap query and document texts before they are embedded. Empty
+// templates leave the text unchanged.
+type Templates struct {
+	Query    string
+	Document string
+}
+
+// modelTemplates lists the prefixes published for common retrieval models,
+// matched against the model name without its tag.
+var modelTemplates = []struct {
+	model     string
+	templates Templates
+}{
+	{"nomic-embed-text", Templates{Query: "search_query: ", Document: "search_document: "}},
+	{"mxbai-embed-large", Templates{Query: "Represent this sentence for searching relevant passages: "}},
+	{"snowflake-arctic-embed", Templates{Query: "Represent this sentence for searching relevant passages: "}},
+	{"e5", Templates{Query: "query: ", Document: "passage: "}},
+}
+
+// DefaultTemplates returns the built-in templates for model, or none for
+// models without published prefixes and for the local provider.
+func DefaultTemplates(provider, model string) Templates {
+	if provider == config.ProviderLocal {
+		return Templates{}
+	}
+	name := strings.ToLower(model)
+	if slash := strings.LastIndex(name, "/"); slash >= 0 {
+		name = name[slash+1:]
+	}
+	name, _, _ = strings.Cut(name, ":")
+	for _, entry := range modelTemplates {
+		if matchesModel(name, entry.model) {
+			return entry.templates
+		}
+	}
+	return Templates{}
+}
+
+// matchesModel reports whether name is family or a variant of it, such as
+// nomic-embed-text-v1.5 or multilingual-e5-large.
+func matchesModel(name, family string) bool {
+	return name == family ||
+		strings.HasPrefix(name, family+"-") ||
+		strings.HasSuffix(name, "-"+family) ||
+		strings.Contains(name, "-"+family+"-")
+}
+
+// ResolveTemplates returns the model defaults overridden by any templates set
+// in cfg. A template of "{text}" disables the default.
+func ResolveTemplates(cfg config.EmbeddingConfig) Templates {
+	templates := DefaultTemplates(cfg.Provider, cfg.Model)
+	if cfg.QueryTemplate != "" {
+		templates.Query = cfg.QueryTemplate
+	}
+	if cfg.DocumentTemplate != "" {
+		templates.Document = cfg.DocumentTemplate
+	}
+	return templates
+}
+
+func applyTemplate(template, text string) string {
+	if template == "" {
+		return text
+	}
+	if strings.Contains(template, textPlaceholder) {
+		return strings.ReplaceAll(template, textPlaceholder, text)
+	}
+	return template + text
+}
+
+func applyTemplates(template string, texts []string) []string {
+	if template == "" || template == textPlaceholder {
+		return texts
+	}
+	wrapped := make([]string, len(texts))
+	for i, text := range texts {
+		wrapped[i] = applyTemplate(template, text)
+	}
+	return wrapped
+}
+
+type templatedEmbedder struct {
+	embedder    Embedder
+	templates   Templates
+	fingerprint Fingerprint
+}
+
+// NewTemplatedEmbedder wraps embedder so that EmbedQuery and EmbedDocuments
+// apply the matching template. Embed passes texts through unchanged.
+func NewTemplatedEmbedder(embedder Embedder, templates Templates) QueryDocumentEmbedder {
+	return &templatedEmbedder{embedder: embedder, templates: templates}
+}
+
+func (e *templatedEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	return e.embedder.Embed(ctx, texts)
+}
+
+// Fingerprint is zero unless the embedder was built by NewEmbedder.
+func (e *templatedEmbedder) Fingerprint() Fingerprint {
+	return e.fingerprint
+}
+
+func (e *templatedEmbedder) EmbedQuery(ctx context.Context, texts []string) ([][]float32, error) {
+	return e.embedder.Embed(ctx, applyTemplates(e.templates.Query, texts))
+}
+
+func (e *templatedEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	return e.embedder.Embed(ctx, applyTemplates(e.templates.Document, texts))
+}
+
+var (
+	_ QueryDocumentEmbedder = (*templatedEmbedder)(nil)
+	_ Fingerprinter         = (*templatedEmbedder)(nil)
+)
@@ -0,0 +1,83 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fabfab/go-agent/embeddings"
+)
+
+// embed returns a vector per text, serving texts found in the embedding cache
+// without calling the embedder. Cache failures are logged and fall back to
+// embedding everything.
+func (s *Service) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if s.cache == nil {
+		return s.embedDocuments(ctx, texts)
+	}
+
+	hashes := make([]string, len(texts))
+	for i, text := range texts {
+		hashes[i] = embeddings.TextHash(text)
+	}
+
+	cached, err := s.cache.Get(ctx, s.fingerprint, hashes)
+	if err != nil {
+		s.logger.Printf("embedding cache lookup: %v", err)
+		cached = map[string][]float32{}
+	}
+
+	// Identical texts within the document are embedded once.
+	var (
+		missing     []string
+		missingHash []string
+		queued      = map[string]bool{}
+	)
+	for i, hash := range hashes {
+		if _, ok := cached[hash]; ok || queued[hash] {
+			continue
+		}
+		queued[hash] = true
+		missing = append(missing, texts[i])
+		missingHash = append(missingHash, hash)
+	}
+
+	if len(missing) > 0 {
+		vectors, err := s.embedDocuments(ctx, missing)
+		if err != nil {
+			return nil, err
+		}
+		if len(vectors) != len(missing) {
+			return nil, fmt.Errorf("embedding count mismatch: have %d texts, %d embeddings", len(missing), len(vectors))
+		}
+		fresh := make(map[string][]float32, len(missing))
+		for i, hash := range missingHash {
+			fresh[hash] = vectors[i]
+			cached[hash] = vectors[i]
+		}
+		if err := s.cache.Put(ctx, s.fingerprint, fresh); err != nil {
+			s.logger.Printf("embedding cache store: %v", err)
+		}
+	}
+	s.logger.Printf("embedding cache: reused %d of %d chunk vectors", len(texts)-len(missing), len(texts))
+
+	results := make([][]float32, len(texts))
+	for i, hash := range hashes {
+		results[i] = cached[hash]
+	}
+	return results, nil
+}
+
+// embedDocuments embeds texts with the service's embedder. Vectors from a
+// fallback of another model belong to another embedding space, so they are
+// refused rather than cached or stored; the documents are embedded again on
+// the next run.
+func (s *Service) embedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors, served, err := embeddings.EmbedDocumentsServed(ctx, s.embedder, texts)
+	if err != nil {
+		return nil, err
+	}
+	if primary, ok := embeddings.FingerprintOf(s.embedder); ok && served != (embeddings.Fingerprint{}) && served != primary {
+		return nil, fmt.Errorf("%w: batch served by fallback %s instead of %s", embeddings.ErrFingerprintMismatch, served, primary)
+	}
+	return vectors, nil
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
 	"github.com/pgvector/pgvector-go"
 
+	"github.com/fabfab/go-agent/config"
 	"github.com/fabfab/go-agent/database"
 	"github.com/fabfab/go-agent/embeddings"
 	"github.com/fabfab/go-agent/knowledge"
@@ -36,6 +37,29 @@ type Service struct {
 	logger    *log.Logger
 	dimension int
 	parsers   map[DocumentFormat]DocumentParser
+
+	cache       embeddings.Cache
+	fingerprint embeddings.Fingerprint
+	space       database.EmbeddingSpace
+	index       config.VectorIndexConfig
+	migrate     bool
+	// migrated is set once a migration discarded the space's vectors.
+	migrated bool
+	// spaceReady is set once the space and its index have been ensured, so
+	// that documents persisted afterwards skip the registry and index checks.
+	spaceReady bool
+}
+
+// Option configures optional Service behaviour.
+type Option func(*Service)
+
+// WithEmbeddingCache reuses vectors for chunk texts already embedded under fp,
+// so re-ingesting an edited document only embeds the changed chunks.
+func WithEmbeddingCache(cache embeddings.Cache, fp embeddings.Fingerprint) Option {
+	return func(s *Service) {
+		s.cache = cache
+		s.fingerprint = fp
+	}
 }
 
 // DocumentPayload represents the data required to ingest a document.
@@ -84,12 +108,12 @@ type TopicMeta struct {
 	Name string
 }
 
-func NewService(pool *pgxpool.Pool, driver neo4j.DriverWithContext, embedder embeddings.Embedder, logger *log.Logger, dimension int) *Service {
+func NewService(pool *pgxpool.Pool, driver neo4j.DriverWithContext, embedder embeddings.Embedder, logger *log.Logger, dimension int, opts ...Option) *Service {
 	if logger == nil {
 		logger = log.Default()
 	}
 
-	return &Service{
+	s := &Service{
 		pool:      pool,
 		driver:    driver,
 		embedder:  embedder,
@@ -101,6 +125,10 @@ func NewService(pool *pgxpool.Pool, driver neo4j.DriverWithContext, embedder emb
 			FormatCSV:      csvParser{},
 		},
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // IngestDocument chunks the provided payload, generates embeddings for each
@@ -167,7 +195,7 @@ func (s *Service) IngestDocument(ctx context.Context, payload DocumentPayload) (
 		texts[i] = fragment.Text
 	}
 
-	embeddings, err := s.embedder.Embed(ctx, texts)
+	embeddings, err := s.embed(ctx, texts)
 	if err != nil {
 		return nil, fmt.Errorf("generate embeddings: %w", err)
 	}
@@ -196,6 +224,11 @@ func (s *Service) IngestDirectory(ctx context.Context, dir string) error {
 		return fmt.Errorf("ensure schema: %w", err)
 	}
 
+	// Refuse a mismatched space before spending time on embeddings.
+	if err := s.ensureSpace(ctx, true); err != nil {
+		return fmt.Errorf("ensure embedding space: %w", err)
+	}
+
 	if _, err := os.Stat(dir); err != nil {
 		return fmt.Errorf("data directory: %w", err)
 	}
@@ -227,6 +260,16 @@ func (s *Service) IngestDirectory(ctx context.Context, dir string) error {
 		}
 	}
 
+	// Unchanged documents lost their vectors in the migration.
+	if s.migrated {
+		done, err := s.Reembed(ctx, defaultReembedBatchSize, nil)
+		if err != nil {
+			return fmt.Errorf("re-embed migrated space: %w", err)
+		}
+		s.logger.Printf("re-embedded %d unchanged chunks into space %s", done, s.space.Name)
+		s.migrated = false
+	}
+
 	return nil
 }
 
@@ -263,6 +306,9 @@ func (s *Service) PersistDocument(ctx context.Context, result *DocumentResult, f
 	if err := database.EnsureRAGSchema(ctx, s.pool, s.dimension); err != nil {
 		return 0, fmt.Errorf("ensure schema: %w", err)
 	}
+	if err := s.ensureSpace(ctx, true); err != nil {
+		return 0, fmt.Errorf("ensure embedding space: %w", err)
+	}
 
 	tx, err := s.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
 	if err != nil {
@@ -303,6 +349,12 @@ func (s *Service) PersistDocument(ctx context.Context, result *DocumentResult, f
 		topics = append(topics, knowledge.Topic{Name: topicMeta.Name})
 	}
 
+	// Topics are synced for unchanged documents too, so documents ingested
+	// before topics were mirrored can be filtered on.
+	if err = syncDocumentTopics(ctx, tx, docID, topics); err != nil {
+		return 0, err
+	}
+
 	chunkNodes := make([]knowledge.Chunk, 0, len(result.Fragments))
 
 	if changed {
@@ -319,13 +371,22 @@ func (s *Service) PersistDocument(ctx context.Context, result *DocumentResult, f
 				SectionID: sectionIDs[fragment.Section.Order],
 			})
 
-			vec := pgvector.NewVector(result.Embeddings[idx])
+			// Vectors of other spaces live in their own table.
+			var vec any = pgvector.NewVector(result.Embeddings[idx])
+			if s.writesSpaceTable() {
+				vec = nil
+			}
 			if _, err := tx.Exec(ctx, `
                                 INSERT INTO rag_chunks (id, document_id, chunk_index, section_order, section_level, section_title, content, embedding, created_at, updated_at)
                                 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW(), NOW())
                         `, chunkID, docID, idx, fragment.Section.Order, fragment.Section.Level, fragment.Section.Title, fragment.Text, vec); err != nil {
 				return 0, fmt.Errorf("insert chunk %d: %w", idx, err)
 			}
+			if s.writesSpaceTable() {
+				if err := s.insertSpaceVector(ctx, tx, chunkID, result.Embeddings[idx]); err != nil {
+					return 0, fmt.Errorf("insert chunk %d vector: %w", idx, err)
+				}
+			}
 		}
 	}
 
@@ -396,6 +457,64 @@ func upsertDocument(ctx context.Context, tx pgx.Tx, path, title, sha string) (uu
 	return docID, true, nil
 }
 
+// syncDocumentTopics replaces the topics stored for a document in Postgres.
+func syncDocumentTopics(ctx context.Context, tx pgx.Tx, docID uuid.UUID, topics []knowledge.Topic) error {
+	if _, err := tx.Exec(ctx, "DELETE FROM rag_document_topics WHERE document_id = $1", docID); err != nil {
+		return fmt.Errorf("clear document topics: %w", err)
+	}
+	if len(topics) == 0 {
+		return nil
+	}
+
+	names := make([]string, len(topics))
+	for i, topic := range topics {
+		names[i] = topic.Name
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO rag_document_topics (document_id, topic)
+		SELECT $1, unnest($2::text[])
+		ON CONFLICT DO NOTHING
+	`, docID, names); err != nil {
+		return fmt.Errorf("insert document topics: %w", err)
+	}
+	return nil
+}
+
+// BackfillTopics copies the document topics recorded in the knowledge graph
+// to Postgres, where topic filters read them, for documents ingested before
+// topics were mirrored. Topics already stored are kept. It returns how many
+// documents the graph holds topics for.
+func (s *Service) BackfillTopics(ctx context.Context) (int, error) {
+	if err := database.EnsureRAGSchema(ctx, s.pool, s.dimension); err != nil {
+		return 0, fmt.Errorf("ensure schema: %w", err)
+	}
+	topics, err := knowledge.DocumentTopics(ctx, s.driver)
+	if err != nil {
+		return 0, err
+	}
+	if len(topics) == 0 {
+		return 0, nil
+	}
+
+	batch := &pgx.Batch{}
+	for id, names := range topics {
+		docID, err := uuid.Parse(id)
+		if err != nil {
+			s.logger.Printf("skip topics of graph document %q: %v", id, err)
+			continue
+		}
+		batch.Queue(`
+			INSERT INTO rag_document_topics (document_id, topic)
+			SELECT d.id, unnest($2::text[]) FROM rag_documents d WHERE d.id = $1
+			ON CONFLICT DO NOTHING
+		`, docID, names)
+	}
+	if err := s.pool.SendBatch(ctx, batch).Close(); err != nil {
+		return 0, fmt.Errorf("insert document topics: %w", err)
+	}
+	return len(topics), nil
+}
+
 func ExtractTitle(content, fallback string) string {
 	lines := strings.Split(content, "\n")
 	for _, line := range lines {
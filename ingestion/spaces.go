@@ -0,0 +1,233 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pgvector/pgvector-go"
+
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/database"
+)
+
+const defaultReembedBatchSize = 64
+
+// WithEmbeddingSpace writes chunk vectors to space instead of the default
+// rag_chunks.embedding column. The embedder must produce vectors for it.
+func WithEmbeddingSpace(space database.EmbeddingSpace) Option {
+	return func(s *Service) {
+		s.space = space
+	}
+}
+
+// WithEmbeddingMigration lets the service take over a space whose stored
+// vectors came from another model. Those vectors are discarded and re-embedded
+// with the service's embedder; without this option such a space is refused.
+func WithEmbeddingMigration() Option {
+	return func(s *Service) {
+		s.migrate = true
+	}
+}
+
+// WithVectorIndex builds the vector index with cfg instead of the default
+// HNSW index over L2 distance.
+func WithVectorIndex(cfg config.VectorIndexConfig) Option {
+	return func(s *Service) {
+		s.index = cfg
+	}
+}
+
+// ReembedProgress reports how many chunks have been embedded so far and how
+// many still lacked a vector when the run started.
+type ReembedProgress func(done, pending int)
+
+// ensureSpace registers the configured space and ensures the index over its
+// vectors, once per Service. Services without a space keep writing the
+// default column without touching the registry.
+func (s *Service) ensureSpace(ctx context.Context, activateFirst bool) error {
+	if s.spaceReady {
+		return nil
+	}
+	if s.space.Name == "" {
+		if err := s.ensureVectorIndex(ctx, "rag_chunks"); err != nil {
+			return err
+		}
+		s.spaceReady = true
+		return nil
+	}
+	previous, _, err := database.GetEmbeddingSpace(ctx, s.pool, s.space.Name)
+	if err != nil {
+		return err
+	}
+	space, err := database.EnsureEmbeddingSpace(ctx, s.pool, s.space, database.SpaceOptions{ActivateFirst: activateFirst, Migrate: s.migrate})
+	if err != nil {
+		return err
+	}
+	if previous.Name != "" && previous.Fingerprint() != space.Fingerprint() {
+		s.logger.Printf("embedding space %s migrated from %s to %s; its vectors will be re-embedded", space.Name, previous.Fingerprint(), space.Fingerprint())
+		s.migrated = true
+	}
+	s.space = space
+	if err := s.ensureVectorIndex(ctx, space.Table()); err != nil {
+		return err
+	}
+	s.spaceReady = true
+	return nil
+}
+
+func (s *Service) ensureVectorIndex(ctx context.Context, table string) error {
+	err := database.EnsureVectorIndex(ctx, s.pool, table, s.index)
+	if errors.Is(err, database.ErrVectorIndexMismatch) {
+		// Searches tune both index types, so the old index keeps serving
+		// them unless its metric differs; ingestion goes on either way.
+		s.logger.Printf("warning: %v", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ensure vector index: %w", err)
+	}
+	return nil
+}
+
+// writesSpaceTable reports whether vectors go to a per-space table rather than
+// rag_chunks.embedding.
+func (s *Service) writesSpaceTable() bool {
+	return s.space.Name != "" && !s.space.IsDefault()
+}
+
+func (s *Service) insertSpaceVector(ctx context.Context, tx pgx.Tx, chunkID uuid.UUID, vector []float32) error {
+	_, err := tx.Exec(ctx, fmt.Sprintf(`
+		INSERT INTO %s (chunk_id, embedding, created_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (chunk_id) DO UPDATE SET embedding = EXCLUDED.embedding, created_at = NOW()
+	`, s.space.Table()), chunkID, pgvector.NewVector(vector))
+	return err
+}
+
+// Reembed embeds every chunk that has no vector in the service's space, in
+// batches of batchSize. Chunks are visited in id order and each batch is
+// committed on its own, so an interrupted run resumes where it stopped and
+// ingestion and chat keep working meanwhile.
+func (s *Service) Reembed(ctx context.Context, batchSize int, progress ReembedProgress) (int, error) {
+	if s.embedder == nil {
+		return 0, fmt.Errorf("embedder not configured")
+	}
+	if s.space.Name == "" {
+		return 0, fmt.Errorf("embedding space not configured")
+	}
+	if err := database.EnsureRAGSchema(ctx, s.pool, s.dimension); err != nil {
+		return 0, fmt.Errorf("ensure schema: %w", err)
+	}
+	// A space being backfilled is not searched until it is activated.
+	if err := s.ensureSpace(ctx, false); err != nil {
+		return 0, fmt.Errorf("ensure embedding space: %w", err)
+	}
+	if batchSize <= 0 {
+		batchSize = defaultReembedBatchSize
+	}
+
+	embedded, total, err := database.CountSpaceEmbeddings(ctx, s.pool, s.space)
+	if err != nil {
+		return 0, err
+	}
+	pending := int(total - embedded)
+
+	missing := "rc.embedding IS NULL"
+	if s.writesSpaceTable() {
+		missing = fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s s WHERE s.chunk_id = rc.id)", s.space.Table())
+	}
+	query := fmt.Sprintf(`
+		SELECT rc.id, rc.content
+		FROM rag_chunks rc
+		WHERE %s AND rc.id > $1
+		ORDER BY rc.id
+		LIMIT $2
+	`, missing)
+
+	done := 0
+	after := uuid.Nil
+	for {
+		rows, err := s.pool.Query(ctx, query, after, batchSize)
+		if err != nil {
+			return done, fmt.Errorf("query chunks to embed: %w", err)
+		}
+		var (
+			ids   []uuid.UUID
+			texts []string
+		)
+		for rows.Next() {
+			var (
+				id   uuid.UUID
+				text string
+			)
+			if err := rows.Scan(&id, &text); err != nil {
+				rows.Close()
+				return done, fmt.Errorf("scan chunk: %w", err)
+			}
+			ids = append(ids, id)
+			texts = append(texts, text)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return done, fmt.Errorf("query chunks to embed: %w", err)
+		}
+		if len(ids) == 0 {
+			return done, nil
+		}
+
+		vectors, err := s.embed(ctx, texts)
+		if err != nil {
+			return done, fmt.Errorf("generate embeddings: %w", err)
+		}
+		if len(vectors) != len(ids) {
+			return done, fmt.Errorf("embedding count mismatch: have %d chunks, %d embeddings", len(ids), len(vectors))
+		}
+		if err := s.storeSpaceVectors(ctx, ids, vectors); err != nil {
+			return done, err
+		}
+
+		done += len(ids)
+		after = ids[len(ids)-1]
+		if progress != nil {
+			progress(done, pending)
+		}
+	}
+}
+
+func (s *Service) storeSpaceVectors(ctx context.Context, ids []uuid.UUID, vectors [][]float32) (err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(ctx); rbErr != nil {
+				s.logger.Printf("rollback error: %v", rbErr)
+			}
+		}
+	}()
+
+	for i, id := range ids {
+		if s.writesSpaceTable() {
+			// Chunks deleted by a concurrent re-ingest are skipped.
+			_, err = tx.Exec(ctx, fmt.Sprintf(`
+				INSERT INTO %s (chunk_id, embedding, created_at)
+				SELECT id, $2, NOW() FROM rag_chunks WHERE id = $1
+				ON CONFLICT (chunk_id) DO UPDATE SET embedding = EXCLUDED.embedding, created_at = NOW()
+			`, s.space.Table()), id, pgvector.NewVector(vectors[i]))
+		} else {
+			_, err = tx.Exec(ctx, "UPDATE rag_chunks SET embedding = $2, updated_at = NOW() WHERE id = $1", id, pgvector.NewVector(vectors[i]))
+		}
+		if err != nil {
+			return fmt.Errorf("store chunk vector: %w", err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
@@ -226,3 +226,43 @@ func SyncDocument(ctx context.Context, driver neo4j.DriverWithContext, doc Docum
 
 	return err
 }
+
+// DocumentTopics returns the topic names of every document with topics, by
+// document id.
+func DocumentTopics(ctx context.Context, driver neo4j.DriverWithContext) (map[string][]string, error) {
+	if driver == nil {
+		return nil, fmt.Errorf("neo4j driver is nil")
+	}
+
+	session := driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	defer session.Close(ctx)
+
+	result, err := session.Run(ctx, `
+		MATCH (d:Document)-[:HAS_TOPIC]->(t:Topic)
+		RETURN d.id AS id, collect(DISTINCT t.name) AS topics
+	`, nil)
+	if err != nil {
+		return nil, fmt.Errorf("run document topics query: %w", err)
+	}
+
+	topics := map[string][]string{}
+	for result.Next(ctx) {
+		record := result.Record()
+		id, _ := record.Get("id")
+		names, _ := record.Get("topics")
+		docID, ok := id.(string)
+		if !ok {
+			continue
+		}
+		values, _ := names.([]any)
+		for _, value := range values {
+			if name, ok := value.(string); ok && name != "" {
+				topics[docID] = append(topics[docID], name)
+			}
+		}
+	}
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("document topics result error: %w", err)
+	}
+	return topics, nil
+}
@@ -0,0 +1,249 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/resilience"
+)
+
+const (
+	anthropicDefaultBaseURL   = "https://api.anthropic.com"
+	anthropicAPIVersion       = "2023-06-01"
+	anthropicDefaultMaxTokens = 4096
+	// anthropicOverloadedStatus is the status the API uses for overloaded_error.
+	anthropicOverloadedStatus = 529
+)
+
+type anthropicClient struct {
+	baseURL  string
+	apiKey   string
+	model    string
+	defaults config.GenerationOptions
+	client   *http.Client
+}
+
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	MaxTokens     int                `json:"max_tokens"`
+	System        string             `json:"system,omitempty"`
+	Messages      []anthropicMessage `json:"messages"`
+	Stream        bool               `json:"stream,omitempty"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type anthropicResponse struct {
+	Content []anthropicContentBlock `json:"content"`
+	Usage   anthropicUsage          `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicContentBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type anthropicStreamEvent struct {
+	Type  string `json:"type"`
+	Delta struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"`
+	Error   *anthropicError `json:"error"`
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Usage anthropicUsage `json:"usage"`
+}
+
+type anthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func NewAnthropicClient(opts Options) Client {
+	baseURL := strings.TrimRight(opts.AnthropicBaseURL, "/")
+	if baseURL == "" {
+		baseURL = anthropicDefaultBaseURL
+	}
+
+	return &anthropicClient{
+		baseURL:  baseURL,
+		apiKey:   opts.AnthropicAPIKey,
+		model:    opts.Model,
+		defaults: opts.Generation,
+		client: &http.Client{
+			Timeout: 120 * time.Second,
+		},
+	}
+}
+
+func (c *anthropicClient) Generate(ctx context.Context, messages []Message) (string, error) {
+	resp, err := c.send(ctx, c.buildRequest(ctx, messages, false))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var parsed anthropicResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return "", fmt.Errorf("decode anthropic response: %w", err)
+	}
+	recordUsage(ctx, Usage{PromptTokens: parsed.Usage.InputTokens, CompletionTokens: parsed.Usage.OutputTokens})
+
+	var sb strings.Builder
+	for _, block := range parsed.Content {
+		if block.Type == "text" {
+			sb.WriteString(block.Text)
+		}
+	}
+	return sb.String(), nil
+}
+
+func (c *anthropicClient) GenerateStream(ctx context.Context, messages []Message, fn func(string) error) error {
+	resp, err := c.send(ctx, c.buildRequest(ctx, messages, true))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Input tokens arrive with message_start; message_delta carries the
+	// cumulative output count.
+	var usage Usage
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "" {
+			continue
+		}
+
+		var event anthropicStreamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fmt.Errorf("decode anthropic stream event: %w", err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			usage.PromptTokens = event.Message.Usage.InputTokens
+			usage.CompletionTokens = event.Message.Usage.OutputTokens
+		case "message_delta":
+			usage.CompletionTokens = event.Usage.OutputTokens
+		case "content_block_delta":
+			if event.Delta.Type == "text_delta" && event.Delta.Text != "" {
+				if err := fn(event.Delta.Text); err != nil {
+					return err
+				}
+			}
+		case "error":
+			if event.Error != nil {
+				if event.Error.Type == "overloaded_error" {
+					return &resilience.StatusError{StatusCode: anthropicOverloadedStatus, Message: fmt.Sprintf("anthropic stream error: %s", event.Error.Message)}
+				}
+				return fmt.Errorf("anthropic stream error: %s", event.Error.Message)
+			}
+			return fmt.Errorf("anthropic stream error")
+		case "message_stop":
+			recordUsage(ctx, usage)
+			return nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read anthropic stream: %w", err)
+	}
+	return fmt.Errorf("anthropic stream ended before message_stop: %w", io.ErrUnexpectedEOF)
+}
+
+// buildRequest converts messages to the Messages API shape. System messages
+// are lifted into the top-level system field, which the API requires instead
+// of a system role. The API has no seed or context size parameters.
+func (c *anthropicClient) buildRequest(ctx context.Context, messages []Message, stream bool) anthropicRequest {
+	opts := resolveGenerationOptions(ctx, c.defaults)
+	req := anthropicRequest{
+		Model:         c.model,
+		MaxTokens:     anthropicDefaultMaxTokens,
+		Stream:        stream,
+		Temperature:   opts.Temperature,
+		TopP:          opts.TopP,
+		StopSequences: opts.Stop,
+	}
+	if opts.MaxTokens > 0 {
+		req.MaxTokens = opts.MaxTokens
+	}
+
+	var system []string
+	for _, msg := range messages {
+		if msg.Role == RoleSystem {
+			if strings.TrimSpace(msg.Content) != "" {
+				system = append(system, msg.Content)
+			}
+			continue
+		}
+		req.Messages = append(req.Messages, anthropicMessage{Role: msg.Role, Content: msg.Content})
+	}
+	req.System = strings.Join(system, "\n\n")
+	return req
+}
+
+func (c *anthropicClient) send(ctx context.Context, payload anthropicRequest) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("marshal anthropic request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("create anthropic request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", c.apiKey)
+	req.Header.Set("anthropic-version", anthropicAPIVersion)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("call anthropic messages API: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		data, readErr := io.ReadAll(resp.Body)
+		if readErr != nil {
+			return nil, fmt.Errorf("read anthropic error body: %w", readErr)
+		}
+		var parsed struct {
+			Error anthropicError `json:"error"`
+		}
+		if json.Unmarshal(data, &parsed) == nil && parsed.Error.Message != "" {
+			return nil, &resilience.StatusError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("anthropic messages API error (%s): %s", resp.Status, parsed.Error.Message)}
+		}
+		return nil, &resilience.StatusError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("anthropic messages API returned status %s", resp.Status)}
+	}
+
+	return resp, nil
+}
+
+var _ StreamClient = (*anthropicClient)(nil)
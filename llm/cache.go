@@ -0,0 +1,191 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fabfab/go-agent/config"
+)
+
+// ResponseCache stores generated answers by key.
+type ResponseCache interface {
+	Get(ctx context.Context, key string) (string, bool, error)
+	Put(ctx context.Context, entry CacheEntry, ttl time.Duration) error
+}
+
+// CacheEntry is a cached answer together with the provider and model that
+// produced it.
+type CacheEntry struct {
+	Key      string
+	Provider string
+	Model    string
+	Response string
+}
+
+// CacheOptions configures NewCachingClient.
+type CacheOptions struct {
+	Provider string
+	Model    string
+	// Defaults are the client's default generation options, which are part of
+	// the key alongside any per-call overrides.
+	Defaults config.GenerationOptions
+	// TTL bounds how long entries are served. Zero keeps them indefinitely.
+	TTL    time.Duration
+	Logger *log.Logger
+}
+
+type cacheBypassKey struct{}
+
+// WithCacheBypass returns a context whose calls skip cache lookups. Fresh
+// answers are still stored, refreshing the cache.
+func WithCacheBypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheBypassKey{}, true)
+}
+
+func cacheBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(cacheBypassKey{}).(bool)
+	return bypass
+}
+
+type cachingClient struct {
+	client Client
+	cache  ResponseCache
+	opts   CacheOptions
+}
+
+type cachingToolClient struct {
+	*cachingClient
+	ToolClient
+}
+
+// NewCachingClient wraps client so that identical requests are answered from
+// cache. The key covers the provider, model, resolved generation options,
+// requested JSON schema and messages. Cache hits are replayed through
+// GenerateStream as a single chunk. Tool calls are passed through uncached.
+// Cache failures are logged and never fail a call.
+func NewCachingClient(client Client, cache ResponseCache, opts CacheOptions) Client {
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
+	wrapped := &cachingClient{client: client, cache: cache, opts: opts}
+	if tools, ok := client.(ToolClient); ok {
+		return &cachingToolClient{cachingClient: wrapped, ToolClient: tools}
+	}
+	return wrapped
+}
+
+func (c *cachingClient) Generate(ctx context.Context, messages []Message) (string, error) {
+	key, cached, ok := c.lookup(ctx, messages)
+	if ok {
+		return cached, nil
+	}
+
+	answer, err := c.client.Generate(ctx, messages)
+	if err != nil {
+		return "", err
+	}
+	c.store(ctx, key, answer)
+	return answer, nil
+}
+
+func (c *cachingClient) GenerateStream(ctx context.Context, messages []Message, fn func(string) error) error {
+	key, cached, ok := c.lookup(ctx, messages)
+	if ok {
+		if cached == "" {
+			return nil
+		}
+		return fn(cached)
+	}
+
+	streamer, isStream := c.client.(StreamClient)
+	if !isStream {
+		answer, err := c.client.Generate(ctx, messages)
+		if err != nil {
+			return err
+		}
+		c.store(ctx, key, answer)
+		return fn(answer)
+	}
+
+	var builder strings.Builder
+	err := streamer.GenerateStream(ctx, messages, func(chunk string) error {
+		builder.WriteString(chunk)
+		return fn(chunk)
+	})
+	if err != nil {
+		return err
+	}
+	c.store(ctx, key, builder.String())
+	return nil
+}
+
+// Generate and GenerateStream are promoted from cachingClient rather than the
+// embedded ToolClient.
+func (c *cachingToolClient) Generate(ctx context.Context, messages []Message) (string, error) {
+	return c.cachingClient.Generate(ctx, messages)
+}
+
+func (c *cachingToolClient) GenerateStream(ctx context.Context, messages []Message, fn func(string) error) error {
+	return c.cachingClient.GenerateStream(ctx, messages, fn)
+}
+
+func (c *cachingClient) lookup(ctx context.Context, messages []Message) (string, string, bool) {
+	key, err := c.key(ctx, messages)
+	if err != nil {
+		c.opts.Logger.Printf("llm cache key: %v", err)
+		return "", "", false
+	}
+	if cacheBypassed(ctx) {
+		return key, "", false
+	}
+
+	cached, ok, err := c.cache.Get(ctx, key)
+	if err != nil {
+		c.opts.Logger.Printf("llm cache lookup: %v", err)
+		return key, "", false
+	}
+	return key, cached, ok
+}
+
+func (c *cachingClient) store(ctx context.Context, key, answer string) {
+	if key == "" {
+		return
+	}
+	entry := CacheEntry{Key: key, Provider: c.opts.Provider, Model: c.opts.Model, Response: answer}
+	if err := c.cache.Put(ctx, entry, c.opts.TTL); err != nil {
+		c.opts.Logger.Printf("llm cache store: %v", err)
+	}
+}
+
+// key fingerprints everything that influences the answer.
+func (c *cachingClient) key(ctx context.Context, messages []Message) (string, error) {
+	payload, err := json.Marshal(struct {
+		Provider string                   `json:"provider"`
+		Model    string                   `json:"model"`
+		Options  config.GenerationOptions `json:"options"`
+		Schema   json.RawMessage          `json:"schema,omitempty"`
+		Messages []Message                `json:"messages"`
+	}{
+		Provider: c.opts.Provider,
+		Model:    c.opts.Model,
+		Options:  resolveGenerationOptions(ctx, c.opts.Defaults),
+		Schema:   jsonSchemaFromContext(ctx),
+		Messages: messages,
+	})
+	if err != nil {
+		return "", fmt.Errorf("marshal cache key: %w", err)
+	}
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+var (
+	_ StreamClient = (*cachingClient)(nil)
+	_ ToolClient   = (*cachingToolClient)(nil)
+)
@@ -0,0 +1,241 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/fabfab/go-agent/cassette"
+	"github.com/fabfab/go-agent/config"
+)
+
+const (
+	cassetteKindGenerate = "llm.generate"
+	cassetteKindTools    = "llm.tools"
+)
+
+// cassetteRequest identifies a call. Generate and GenerateStream share a
+// recording, as do the two tool-calling methods.
+type cassetteRequest struct {
+	Messages []Message                `json:"messages"`
+	Tools    []Tool                   `json:"tools,omitempty"`
+	Options  config.GenerationOptions `json:"options"`
+	Schema   json.RawMessage          `json:"schema,omitempty"`
+}
+
+type cassetteResponse struct {
+	Content  string        `json:"content"`
+	Chunks   []string      `json:"chunks,omitempty"`
+	Message  *Message      `json:"message,omitempty"`
+	Deltas   []StreamDelta `json:"deltas,omitempty"`
+	Usage    Usage         `json:"usage"`
+	Provider string        `json:"provider,omitempty"`
+}
+
+func newCassetteRequest(ctx context.Context, messages []Message, tools []Tool) cassetteRequest {
+	opts, _ := GenerationOptionsFromContext(ctx)
+	return cassetteRequest{Messages: messages, Tools: tools, Options: opts, Schema: jsonSchemaFromContext(ctx)}
+}
+
+type recordingClient struct {
+	client   Client
+	cassette *cassette.Cassette
+}
+
+type recordingToolClient struct {
+	*recordingClient
+	tools ToolClient
+}
+
+// NewRecordingClient wraps client so that every successful call is appended to
+// the cassette for later replay with NewReplayClient. Failed calls are not
+// recorded.
+func NewRecordingClient(client Client, c *cassette.Cassette) Client {
+	recorder := &recordingClient{client: client, cassette: c}
+	if tools, ok := client.(ToolClient); ok {
+		return &recordingToolClient{recordingClient: recorder, tools: tools}
+	}
+	return recorder
+}
+
+func (c *recordingClient) Generate(ctx context.Context, messages []Message) (string, error) {
+	callCtx, meter := meteredContext(ctx)
+	answer, err := c.client.Generate(callCtx, messages)
+	forwardMeter(ctx, meter)
+	if err != nil {
+		return "", err
+	}
+	return answer, c.record(cassetteKindGenerate, newCassetteRequest(ctx, messages, nil), cassetteResponse{Content: answer}, meter)
+}
+
+func (c *recordingClient) GenerateStream(ctx context.Context, messages []Message, fn func(string) error) error {
+	streamer, ok := c.client.(StreamClient)
+	if !ok {
+		answer, err := c.Generate(ctx, messages)
+		if err != nil {
+			return err
+		}
+		return fn(answer)
+	}
+
+	callCtx, meter := meteredContext(ctx)
+	var chunks []string
+	err := streamer.GenerateStream(callCtx, messages, func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return fn(chunk)
+	})
+	forwardMeter(ctx, meter)
+	if err != nil {
+		return err
+	}
+	response := cassetteResponse{Content: strings.Join(chunks, ""), Chunks: chunks}
+	return c.record(cassetteKindGenerate, newCassetteRequest(ctx, messages, nil), response, meter)
+}
+
+func (c *recordingToolClient) GenerateWithTools(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	callCtx, meter := meteredContext(ctx)
+	reply, err := c.tools.GenerateWithTools(callCtx, messages, tools)
+	forwardMeter(ctx, meter)
+	if err != nil {
+		return Message{}, err
+	}
+	response := cassetteResponse{Content: reply.Content, Message: &reply}
+	return reply, c.record(cassetteKindTools, newCassetteRequest(ctx, messages, tools), response, meter)
+}
+
+func (c *recordingToolClient) GenerateWithToolsStream(ctx context.Context, messages []Message, tools []Tool, fn func(StreamDelta) error) (Message, error) {
+	callCtx, meter := meteredContext(ctx)
+	var deltas []StreamDelta
+	reply, err := c.tools.GenerateWithToolsStream(callCtx, messages, tools, func(delta StreamDelta) error {
+		deltas = append(deltas, delta)
+		return fn(delta)
+	})
+	forwardMeter(ctx, meter)
+	if err != nil {
+		return Message{}, err
+	}
+	response := cassetteResponse{Content: reply.Content, Message: &reply, Deltas: deltas}
+	return reply, c.record(cassetteKindTools, newCassetteRequest(ctx, messages, tools), response, meter)
+}
+
+func (c *recordingClient) record(kind string, request cassetteRequest, response cassetteResponse, meter *Meter) error {
+	response.Usage = meter.Usage()
+	response.Provider = meter.Provider()
+	if err := c.cassette.Record(kind, request, response); err != nil {
+		return fmt.Errorf("record llm interaction: %w", err)
+	}
+	return nil
+}
+
+// meteredContext captures the usage and provider reported by the wrapped
+// client so that they can be recorded; forwardMeter passes them on to the
+// caller's meter.
+func meteredContext(ctx context.Context) (context.Context, *Meter) {
+	meter := &Meter{}
+	return WithMeter(ctx, meter), meter
+}
+
+func forwardMeter(ctx context.Context, meter *Meter) {
+	if meter.Calls() > 0 {
+		recordUsage(ctx, meter.Usage())
+	}
+	if provider := meter.Provider(); provider != "" {
+		recordProvider(ctx, provider)
+	}
+}
+
+type replayClient struct {
+	cassette *cassette.Cassette
+}
+
+// NewReplayClient answers calls from a cassette written by NewRecordingClient.
+// Requests that were never recorded fail with cassette.ErrNotRecorded.
+func NewReplayClient(c *cassette.Cassette) ToolClient {
+	return &replayClient{cassette: c}
+}
+
+func (c *replayClient) Generate(ctx context.Context, messages []Message) (string, error) {
+	response, err := c.replay(ctx, cassetteKindGenerate, newCassetteRequest(ctx, messages, nil))
+	if err != nil {
+		return "", err
+	}
+	return response.Content, nil
+}
+
+func (c *replayClient) GenerateStream(ctx context.Context, messages []Message, fn func(string) error) error {
+	response, err := c.replay(ctx, cassetteKindGenerate, newCassetteRequest(ctx, messages, nil))
+	if err != nil {
+		return err
+	}
+	chunks := response.Chunks
+	if len(chunks) == 0 && response.Content != "" {
+		chunks = []string{response.Content}
+	}
+	for _, chunk := range chunks {
+		if err := fn(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *replayClient) GenerateWithTools(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	response, err := c.replay(ctx, cassetteKindTools, newCassetteRequest(ctx, messages, tools))
+	if err != nil {
+		return Message{}, err
+	}
+	return response.message(), nil
+}
+
+func (c *replayClient) GenerateWithToolsStream(ctx context.Context, messages []Message, tools []Tool, fn func(StreamDelta) error) (Message, error) {
+	response, err := c.replay(ctx, cassetteKindTools, newCassetteRequest(ctx, messages, tools))
+	if err != nil {
+		return Message{}, err
+	}
+	reply := response.message()
+
+	// Calls recorded without streaming are replayed as a single delta.
+	deltas := response.Deltas
+	if len(deltas) == 0 {
+		delta := StreamDelta{Content: reply.Content}
+		for i, call := range reply.ToolCalls {
+			delta.ToolCalls = append(delta.ToolCalls, ToolCallDelta{Index: i, ID: call.ID, Name: call.Name, Arguments: call.Arguments})
+		}
+		deltas = []StreamDelta{delta}
+	}
+	for _, delta := range deltas {
+		if delta.Content == "" && len(delta.ToolCalls) == 0 {
+			continue
+		}
+		if err := fn(delta); err != nil {
+			return Message{}, err
+		}
+	}
+	return reply, nil
+}
+
+func (c *replayClient) replay(ctx context.Context, kind string, request cassetteRequest) (cassetteResponse, error) {
+	var response cassetteResponse
+	if err := c.cassette.Replay(kind, request, &response); err != nil {
+		return cassetteResponse{}, fmt.Errorf("replay llm interaction: %w", err)
+	}
+	recordUsage(ctx, response.Usage)
+	if response.Provider != "" {
+		recordProvider(ctx, response.Provider)
+	}
+	return response, nil
+}
+
+func (r cassetteResponse) message() Message {
+	if r.Message != nil {
+		return *r.Message
+	}
+	return Message{Role: RoleAssistant, Content: r.Content}
+}
+
+var (
+	_ StreamClient = (*recordingClient)(nil)
+	_ ToolClient   = (*recordingToolClient)(nil)
+	_ ToolClient   = (*replayClient)(nil)
+)
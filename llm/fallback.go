@@ -0,0 +1,125 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// NamedClient pairs a client with the label recorded when it serves a call,
+// conventionally provider/model.
+type NamedClient struct {
+	Name   string
+	Client Client
+}
+
+type fallbackClient struct {
+	clients []NamedClient
+}
+
+type fallbackToolClient struct {
+	*fallbackClient
+}
+
+// NewFallbackClient returns a client that tries clients in order, moving to
+// the next one when a call fails. Streams fail over only until the first chunk
+// reaches the caller; after that the error is returned as is. The name of the
+// client that served the call is recorded on the context's Meter. The result
+// supports tools when at least one client does, skipping those that do not.
+func NewFallbackClient(clients ...NamedClient) Client {
+	wrapped := &fallbackClient{clients: clients}
+	for _, named := range clients {
+		if _, ok := named.Client.(ToolClient); ok {
+			return &fallbackToolClient{fallbackClient: wrapped}
+		}
+	}
+	return wrapped
+}
+
+func (c *fallbackClient) Generate(ctx context.Context, messages []Message) (string, error) {
+	var answer string
+	err := c.each(ctx, func(named NamedClient) (bool, error) {
+		var err error
+		answer, err = named.Client.Generate(ctx, messages)
+		return false, err
+	})
+	return answer, err
+}
+
+func (c *fallbackClient) GenerateStream(ctx context.Context, messages []Message, fn func(string) error) error {
+	return c.each(ctx, func(named NamedClient) (bool, error) {
+		streamer, ok := named.Client.(StreamClient)
+		if !ok {
+			answer, err := named.Client.Generate(ctx, messages)
+			if err != nil {
+				return false, err
+			}
+			return true, fn(answer)
+		}
+
+		emitted := false
+		err := streamer.GenerateStream(ctx, messages, func(chunk string) error {
+			emitted = true
+			return fn(chunk)
+		})
+		return emitted, err
+	})
+}
+
+func (c *fallbackToolClient) GenerateWithTools(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	var reply Message
+	err := c.each(ctx, func(named NamedClient) (bool, error) {
+		toolClient, ok := named.Client.(ToolClient)
+		if !ok {
+			return false, ErrToolsUnsupported
+		}
+		var err error
+		reply, err = toolClient.GenerateWithTools(ctx, messages, tools)
+		return false, err
+	})
+	return reply, err
+}
+
+func (c *fallbackToolClient) GenerateWithToolsStream(ctx context.Context, messages []Message, tools []Tool, fn func(StreamDelta) error) (Message, error) {
+	var reply Message
+	err := c.each(ctx, func(named NamedClient) (bool, error) {
+		toolClient, ok := named.Client.(ToolClient)
+		if !ok {
+			return false, ErrToolsUnsupported
+		}
+		emitted := false
+		var err error
+		reply, err = toolClient.GenerateWithToolsStream(ctx, messages, tools, func(delta StreamDelta) error {
+			emitted = true
+			return fn(delta)
+		})
+		return emitted, err
+	})
+	return reply, err
+}
+
+// each runs call against the clients in order until one succeeds. call
+// reports whether output already reached the caller, which stops failover.
+func (c *fallbackClient) each(ctx context.Context, call func(NamedClient) (bool, error)) error {
+	var errs []error
+	for _, named := range c.clients {
+		emitted, err := call(named)
+		if err == nil {
+			recordProvider(ctx, named.Name)
+			return nil
+		}
+		if emitted || ctx.Err() != nil {
+			return err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", named.Name, err))
+	}
+	if len(errs) == 1 {
+		return errors.Unwrap(errs[0])
+	}
+	return fmt.Errorf("all llm providers failed: %w", errors.Join(errs...))
+}
+
+var (
+	_ StreamClient = (*fallbackClient)(nil)
+	_ ToolClient   = (*fallbackToolClient)(nil)
+)
@@ -0,0 +1,214 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// jsonSchema is the subset of JSON Schema understood by ValidateJSON: type,
+// properties, required, additionalProperties, items, enum, the numeric and
+// length bounds, and nested combinations of these. Other keywords are
+// accepted and ignored so that provider-specific schemas still load.
+type jsonSchema struct {
+	Type                 schemaType             `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"-"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []any                  `json:"enum"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+}
+
+// schemaType accepts both "type": "string" and "type": ["string", "null"].
+type schemaType []string
+
+func (t *schemaType) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaType{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+	*t = many
+	return nil
+}
+
+// UnmarshalJSON reads additionalProperties, which may be a boolean or a
+// schema; only false restricts anything here.
+func (s *jsonSchema) UnmarshalJSON(data []byte) error {
+	type plain jsonSchema
+	var decoded struct {
+		plain
+		AdditionalProperties json.RawMessage `json:"additionalProperties"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*s = jsonSchema(decoded.plain)
+	if bytes.Equal(bytes.TrimSpace(decoded.AdditionalProperties), []byte("false")) {
+		allowed := false
+		s.AdditionalProperties = &allowed
+	}
+	return nil
+}
+
+// ValidateJSON checks data against schema and returns every violation found,
+// each prefixed with the JSON path of the offending value.
+func ValidateJSON(schema, data json.RawMessage) error {
+	var parsed jsonSchema
+	if err := json.Unmarshal(schema, &parsed); err != nil {
+		return fmt.Errorf("parse json schema: %w", err)
+	}
+
+	var value any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return fmt.Errorf("parse json: %w", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("parse json: unexpected data after the top-level value")
+	}
+
+	var violations []string
+	parsed.validate("$", value, &violations)
+	if len(violations) > 0 {
+		return errors.New(strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+func (s *jsonSchema) validate(path string, value any, violations *[]string) {
+	report := func(format string, args ...any) {
+		*violations = append(*violations, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(s.Type) > 0 && !s.Type.matches(value) {
+		report("expected %s, got %s", strings.Join(s.Type, " or "), jsonTypeOf(value))
+		return
+	}
+	if len(s.Enum) > 0 && !enumContains(s.Enum, value) {
+		report("value is not one of the allowed values")
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				report("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					report("unexpected property %q", name)
+				}
+				continue
+			}
+			prop.validate(path+"."+name, v[name], violations)
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			report("expected at least %d items, got %d", *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			report("expected at most %d items, got %d", *s.MaxItems, len(v))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, violations)
+			}
+		}
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			report("expected at least %d characters, got %d", *s.MinLength, length)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			report("expected at most %d characters, got %d", *s.MaxLength, length)
+		}
+	case json.Number:
+		number, err := v.Float64()
+		if err != nil {
+			report("invalid number %s", v)
+			return
+		}
+		if s.Minimum != nil && number < *s.Minimum {
+			report("expected a value >= %v, got %v", *s.Minimum, number)
+		}
+		if s.Maximum != nil && number > *s.Maximum {
+			report("expected a value <= %v, got %v", *s.Maximum, number)
+		}
+	}
+}
+
+func (t schemaType) matches(value any) bool {
+	actual := jsonTypeOf(value)
+	for _, expected := range t {
+		if expected == actual {
+			return true
+		}
+		if expected == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonTypeOf(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) && !strings.ContainsAny(v.String(), ".eE") {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// enumContains compares value with the enum entries after normalising
+// numbers, which decode as json.Number in values but float64 in schemas.
+func enumContains(enum []any, value any) bool {
+	if number, ok := value.(json.Number); ok {
+		if f, err := number.Float64(); err == nil {
+			value = f
+		}
+	}
+	for _, candidate := range enum {
+		if reflect.DeepEqual(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,22 +1,31 @@
-// Package llm provides language model client interfaces for Ollama and OpenAI.
+// Package llm provides language model client interfaces for Ollama, OpenAI and Anthropic.
 package llm
 
 import (
 	"context"
 	"fmt"
 
+	"github.com/fabfab/go-agent/cassette"
 	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/resilience"
 )
 
 const (
 	RoleSystem    = "system"
 	RoleUser      = "user"
 	RoleAssistant = "assistant"
+	RoleTool      = "tool"
 )
 
+// Message is a single chat turn. Assistant messages may carry ToolCalls
+// requested by the model; tool messages answer one of those calls and set
+// ToolCallID (and Name) to identify it.
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	Name       string     `json:"name,omitempty"`
 }
 
 type Client interface {
@@ -34,21 +43,101 @@ type StreamClient interface {
 type Options struct {
 	Provider string
 	Model    string
+	// Generation holds the default sampling parameters for every call. Per-call
+	// overrides are supplied with WithGenerationOptions.
+	Generation config.GenerationOptions
 
 	OllamaHost    string
 	OpenAIAPIKey  string
 	OpenAIBaseURL string
+
+	AnthropicAPIKey  string
+	AnthropicBaseURL string
+}
+
+// ClientOption customises the client built by NewClient.
+type ClientOption func(*clientSettings)
+
+type clientSettings struct {
+	cache ResponseCache
+}
+
+// WithResponseCache caches each provider's answers in cache, using the TTL from
+// cfg.LLM.Cache.
+func WithResponseCache(cache ResponseCache) ClientOption {
+	return func(s *clientSettings) {
+		s.cache = cache
+	}
 }
 
-func NewClient(cfg config.Config) (Client, error) {
+func NewClient(cfg config.Config, options ...ClientOption) (Client, error) {
+	var settings clientSettings
+	for _, option := range options {
+		option(&settings)
+	}
+
+	if cfg.LLM.Provider == config.ProviderReplay {
+		if cfg.LLM.Cassette == "" {
+			return nil, fmt.Errorf("replay provider selected but LLM_CASSETTE not set")
+		}
+		c, err := cassette.Load(cfg.LLM.Cassette)
+		if err != nil {
+			return nil, err
+		}
+		return NewReplayClient(c), nil
+	}
+
 	opts := Options{
 		Provider:      cfg.LLM.Provider,
 		Model:         cfg.LLM.Model,
+		Generation:    cfg.LLM.Generation,
 		OllamaHost:    cfg.OllamaHost,
 		OpenAIAPIKey:  cfg.OpenAIAPIKey,
 		OpenAIBaseURL: cfg.OpenAIBaseURL,
+
+		AnthropicAPIKey:  cfg.AnthropicAPIKey,
+		AnthropicBaseURL: cfg.AnthropicBaseURL,
 	}
 
+	policy := resilience.FromConfig(cfg.Resilience)
+	chain := cfg.LLM.Chain()
+	clients := make([]NamedClient, 0, len(chain))
+	for _, spec := range chain {
+		specOpts := opts
+		specOpts.Provider, specOpts.Model = spec.Provider, spec.Model
+		client, err := newProviderClient(specOpts)
+		if err != nil {
+			return nil, err
+		}
+		// Each provider gets its own executor so that one provider's open
+		// circuit fails over to the next immediately.
+		if policy.Enabled() {
+			client = NewResilientClient(client, resilience.NewExecutor(policy))
+		}
+		// The cache sits outside the retries so that hits never touch the
+		// provider's circuit breaker.
+		if settings.cache != nil {
+			client = NewCachingClient(client, settings.cache, CacheOptions{
+				Provider: spec.Provider,
+				Model:    spec.Model,
+				Defaults: specOpts.Generation,
+				TTL:      cfg.LLM.Cache.TTL,
+			})
+		}
+		clients = append(clients, NamedClient{Name: spec.String(), Client: client})
+	}
+	client := NewFallbackClient(clients...)
+	if cfg.LLM.Cassette != "" {
+		c, err := cassette.Open(cfg.LLM.Cassette)
+		if err != nil {
+			return nil, err
+		}
+		client = NewRecordingClient(client, c)
+	}
+	return client, nil
+}
+
+func newProviderClient(opts Options) (Client, error) {
 	switch opts.Provider {
 	case config.ProviderOllama:
 		return NewOllamaClient(opts), nil
@@ -57,6 +146,11 @@ func NewClient(cfg config.Config) (Client, error) {
 			return nil, fmt.Errorf("openai provider selected but OPENAI_API_KEY not set")
 		}
 		return NewOpenAIClient(opts), nil
+	case config.ProviderAnthropic:
+		if opts.AnthropicAPIKey == "" {
+			return nil, fmt.Errorf("anthropic provider selected but ANTHROPIC_API_KEY not set")
+		}
+		return NewAnthropicClient(opts), nil
 	default:
 		return nil, fmt.Errorf("unknown llm provider: %s", opts.Provider)
 	}
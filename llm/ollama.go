@@ -10,29 +10,65 @@ import (
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/resilience"
 )
 
 type ollamaClient struct {
-	host   string
-	model  string
-	client *http.Client
+	host     string
+	model    string
+	defaults config.GenerationOptions
+	client   *http.Client
 }
 
 type ollamaChatRequest struct {
 	Model    string              `json:"model"`
 	Messages []ollamaChatMessage `json:"messages"`
 	Stream   bool                `json:"stream"`
+	Tools    []ollamaTool        `json:"tools,omitempty"`
+	Options  *ollamaOptions      `json:"options,omitempty"`
+	Format   json.RawMessage     `json:"format,omitempty"`
 }
 
 type ollamaChatMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+type ollamaTool struct {
+	Type     string             `json:"type"`
+	Function ollamaToolFunction `json:"function"`
+}
+
+type ollamaToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+type ollamaToolCall struct {
+	Function ollamaToolCallFunction `json:"function"`
+}
+
+type ollamaToolCallFunction struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
 }
 
 type ollamaChatResponse struct {
-	Message ollamaChatMessage `json:"message"`
-	Done    bool              `json:"done"`
-	Error   string            `json:"error"`
+	Message         ollamaChatMessage `json:"message"`
+	Done            bool              `json:"done"`
+	Error           string            `json:"error"`
+	PromptEvalCount int               `json:"prompt_eval_count"`
+	EvalCount       int               `json:"eval_count"`
+}
+
+// usage reads the token counts Ollama reports on the final response.
+func (r ollamaChatResponse) usage() Usage {
+	return Usage{PromptTokens: r.PromptEvalCount, CompletionTokens: r.EvalCount}
 }
 
 func NewOllamaClient(opts Options) Client {
@@ -42,8 +78,9 @@ func NewOllamaClient(opts Options) Client {
 	}
 
 	return &ollamaClient{
-		host:  host,
-		model: opts.Model,
+		host:     host,
+		model:    opts.Model,
+		defaults: opts.Generation,
 		client: &http.Client{
 			Timeout: 60 * time.Second,
 		},
@@ -51,122 +88,208 @@ func NewOllamaClient(opts Options) Client {
 }
 
 func (c *ollamaClient) Generate(ctx context.Context, messages []Message) (string, error) {
-	payload := ollamaChatRequest{
-		Model:  c.model,
-		Stream: false,
+	reply, err := c.chat(ctx, messages, nil)
+	if err != nil {
+		return "", err
 	}
+	return reply.Content, nil
+}
 
-	payload.Messages = toOllamaMessages(messages)
+func (c *ollamaClient) GenerateStream(ctx context.Context, messages []Message, fn func(string) error) error {
+	_, err := c.chatStream(ctx, messages, nil, func(delta StreamDelta) error {
+		if delta.Content == "" {
+			return nil
+		}
+		return fn(delta.Content)
+	})
+	return err
+}
 
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return "", fmt.Errorf("marshal ollama request: %w", err)
-	}
+func (c *ollamaClient) GenerateWithTools(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	return c.chat(ctx, messages, tools)
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.host+"/api/chat", bytes.NewReader(body))
-	if err != nil {
-		return "", fmt.Errorf("create ollama request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
+func (c *ollamaClient) GenerateWithToolsStream(ctx context.Context, messages []Message, tools []Tool, fn func(StreamDelta) error) (Message, error) {
+	return c.chatStream(ctx, messages, tools, fn)
+}
 
-	resp, err := c.client.Do(req)
+func (c *ollamaClient) chat(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	resp, err := c.send(ctx, ollamaChatRequest{
+		Model:    c.model,
+		Messages: toOllamaMessages(messages),
+		Stream:   false,
+		Tools:    toOllamaTools(tools),
+		Options:  toOllamaOptions(resolveGenerationOptions(ctx, c.defaults)),
+		Format:   jsonSchemaFromContext(ctx),
+	})
 	if err != nil {
-		return "", fmt.Errorf("call ollama chat API: %w", err)
+		return Message{}, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		data, readErr := io.ReadAll(resp.Body)
-		if readErr != nil {
-			return "", fmt.Errorf("read ollama chat error body: %w", readErr)
-		}
-		if len(data) > 0 {
-			return "", fmt.Errorf("ollama chat API error: %s", string(data))
-		}
-		return "", fmt.Errorf("ollama chat API returned status %s", resp.Status)
-	}
-
 	var parsed ollamaChatResponse
 	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
-		return "", fmt.Errorf("decode ollama response: %w", err)
+		return Message{}, fmt.Errorf("decode ollama response: %w", err)
 	}
 
 	if parsed.Error != "" {
-		return "", fmt.Errorf("ollama chat error: %s", parsed.Error)
+		return Message{}, fmt.Errorf("ollama chat error: %s", parsed.Error)
 	}
+	recordUsage(ctx, parsed.usage())
 
-	return parsed.Message.Content, nil
+	reply := Message{Role: RoleAssistant, Content: parsed.Message.Content}
+	for i, call := range parsed.Message.ToolCalls {
+		reply.ToolCalls = append(reply.ToolCalls, fromOllamaToolCall(i, call))
+	}
+	return reply, nil
 }
 
-func (c *ollamaClient) GenerateStream(ctx context.Context, messages []Message, fn func(string) error) error {
-	payload := ollamaChatRequest{
-		Model:  c.model,
-		Stream: true,
+func (c *ollamaClient) chatStream(ctx context.Context, messages []Message, tools []Tool, fn func(StreamDelta) error) (Message, error) {
+	resp, err := c.send(ctx, ollamaChatRequest{
+		Model:    c.model,
+		Messages: toOllamaMessages(messages),
+		Stream:   true,
+		Tools:    toOllamaTools(tools),
+		Options:  toOllamaOptions(resolveGenerationOptions(ctx, c.defaults)),
+		Format:   jsonSchemaFromContext(ctx),
+	})
+	if err != nil {
+		return Message{}, err
 	}
+	defer resp.Body.Close()
 
-	payload.Messages = toOllamaMessages(messages)
+	var (
+		content strings.Builder
+		calls   toolCallAccumulator
+	)
+	finish := func() Message {
+		return Message{Role: RoleAssistant, Content: content.String(), ToolCalls: calls.result()}
+	}
 
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var chunk ollamaChatResponse
+		if err := dec.Decode(&chunk); err != nil {
+			if errors.Is(err, io.EOF) {
+				return finish(), nil
+			}
+			return Message{}, fmt.Errorf("decode ollama stream response: %w", err)
+		}
+
+		if chunk.Error != "" {
+			return Message{}, fmt.Errorf("ollama chat error: %s", chunk.Error)
+		}
+
+		// Ollama emits each tool call whole rather than as argument fragments.
+		delta := StreamDelta{Content: chunk.Message.Content}
+		for _, call := range chunk.Message.ToolCalls {
+			index := len(calls.calls)
+			converted := fromOllamaToolCall(index, call)
+			toolDelta := ToolCallDelta{Index: index, ID: converted.ID, Name: converted.Name, Arguments: converted.Arguments}
+			calls.add(toolDelta)
+			delta.ToolCalls = append(delta.ToolCalls, toolDelta)
+		}
+
+		if delta.Content != "" || len(delta.ToolCalls) > 0 {
+			content.WriteString(delta.Content)
+			if err := fn(delta); err != nil {
+				return Message{}, err
+			}
+		}
+
+		if chunk.Done {
+			recordUsage(ctx, chunk.usage())
+			return finish(), nil
+		}
+	}
+}
+
+func (c *ollamaClient) send(ctx context.Context, payload ollamaChatRequest) (*http.Response, error) {
 	body, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("marshal ollama stream request: %w", err)
+		return nil, fmt.Errorf("marshal ollama request: %w", err)
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.host+"/api/chat", bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("create ollama stream request: %w", err)
+		return nil, fmt.Errorf("create ollama request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("call ollama chat API: %w", err)
+		return nil, fmt.Errorf("call ollama chat API: %w", err)
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
 		data, readErr := io.ReadAll(resp.Body)
 		if readErr != nil {
-			return fmt.Errorf("read ollama chat error body: %w", readErr)
+			return nil, fmt.Errorf("read ollama chat error body: %w", readErr)
 		}
 		if len(data) > 0 {
-			return fmt.Errorf("ollama chat API error: %s", string(data))
+			return nil, &resilience.StatusError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("ollama chat API error: %s", string(data))}
 		}
-		return fmt.Errorf("ollama chat API returned status %s", resp.Status)
+		return nil, &resilience.StatusError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("ollama chat API returned status %s", resp.Status)}
 	}
 
-	dec := json.NewDecoder(resp.Body)
-	for {
-		var chunk ollamaChatResponse
-		if err := dec.Decode(&chunk); err != nil {
-			if errors.Is(err, io.EOF) {
-				return nil
-			}
-			return fmt.Errorf("decode ollama stream response: %w", err)
-		}
+	return resp, nil
+}
 
-		if chunk.Error != "" {
-			return fmt.Errorf("ollama chat error: %s", chunk.Error)
+func toOllamaMessages(messages []Message) []ollamaChatMessage {
+	if len(messages) == 0 {
+		return nil
+	}
+	converted := make([]ollamaChatMessage, len(messages))
+	for i := range messages {
+		msg := messages[i]
+		converted[i] = ollamaChatMessage{Role: msg.Role, Content: msg.Content}
+		if msg.Role == RoleTool {
+			converted[i].ToolName = msg.Name
 		}
-
-		if chunk.Message.Content != "" {
-			if err := fn(chunk.Message.Content); err != nil {
-				return err
+		for _, call := range msg.ToolCalls {
+			args := json.RawMessage(call.Arguments)
+			if !json.Valid(args) {
+				args = json.RawMessage("{}")
 			}
-		}
-
-		if chunk.Done {
-			return nil
+			converted[i].ToolCalls = append(converted[i].ToolCalls, ollamaToolCall{
+				Function: ollamaToolCallFunction{Name: call.Name, Arguments: args},
+			})
 		}
 	}
+	return converted
 }
 
-func toOllamaMessages(messages []Message) []ollamaChatMessage {
-	if len(messages) == 0 {
+func toOllamaTools(tools []Tool) []ollamaTool {
+	if len(tools) == 0 {
 		return nil
 	}
-	converted := make([]ollamaChatMessage, len(messages))
-	for i := range messages {
-		converted[i] = ollamaChatMessage(messages[i])
+	converted := make([]ollamaTool, len(tools))
+	for i, tool := range tools {
+		converted[i] = ollamaTool{
+			Type: "function",
+			Function: ollamaToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  toolParameters(tool),
+			},
+		}
 	}
 	return converted
 }
+
+// fromOllamaToolCall converts an Ollama tool call. Ollama does not assign call
+// IDs, so one is derived from the call's position in the reply.
+func fromOllamaToolCall(index int, call ollamaToolCall) ToolCall {
+	args := string(call.Function.Arguments)
+	if args == "" || args == "null" {
+		args = "{}"
+	}
+	return ToolCall{
+		ID:        fmt.Sprintf("call_%d", index),
+		Name:      call.Function.Name,
+		Arguments: args,
+	}
+}
+
+var _ ToolClient = (*ollamaClient)(nil)
@@ -5,13 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	openai "github.com/sashabaranov/go-openai"
+
+	"github.com/fabfab/go-agent/config"
 )
 
 type openAIClient struct {
-	client *openai.Client
-	model  string
+	client   *openai.Client
+	model    string
+	defaults config.GenerationOptions
 }
 
 func NewOpenAIClient(opts Options) Client {
@@ -21,73 +25,191 @@ func NewOpenAIClient(opts Options) Client {
 	}
 
 	return &openAIClient{
-		client: openai.NewClientWithConfig(cfg),
-		model:  opts.Model,
+		client:   openai.NewClientWithConfig(cfg),
+		model:    opts.Model,
+		defaults: opts.Generation,
 	}
 }
 
 func (c *openAIClient) Generate(ctx context.Context, messages []Message) (string, error) {
-	req := openai.ChatCompletionRequest{
-		Model: c.model,
+	reply, err := c.GenerateWithTools(ctx, messages, nil)
+	if err != nil {
+		return "", err
 	}
+	return reply.Content, nil
+}
 
-	req.Messages = make([]openai.ChatCompletionMessage, len(messages))
-	for i, msg := range messages {
-		req.Messages[i] = openai.ChatCompletionMessage{
-			Role:    msg.Role,
-			Content: msg.Content,
+func (c *openAIClient) GenerateStream(ctx context.Context, messages []Message, fn func(string) error) error {
+	_, err := c.GenerateWithToolsStream(ctx, messages, nil, func(delta StreamDelta) error {
+		if delta.Content == "" {
+			return nil
 		}
-	}
+		return fn(delta.Content)
+	})
+	return err
+}
+
+func (c *openAIClient) GenerateWithTools(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	req := c.newRequest(ctx, messages, tools)
 
 	resp, err := c.client.CreateChatCompletion(ctx, req)
 	if err != nil {
-		return "", fmt.Errorf("create openai chat completion: %w", err)
+		return Message{}, fmt.Errorf("create openai chat completion: %w", err)
 	}
 
 	if len(resp.Choices) == 0 {
-		return "", fmt.Errorf("openai chat completion returned no choices")
+		return Message{}, fmt.Errorf("openai chat completion returned no choices")
 	}
-
-	return resp.Choices[0].Message.Content, nil
+	recordUsage(ctx, fromOpenAIUsage(resp.Usage))
+
+	choice := resp.Choices[0].Message
+	reply := Message{Role: RoleAssistant, Content: choice.Content}
+	for _, call := range choice.ToolCalls {
+		reply.ToolCalls = append(reply.ToolCalls, ToolCall{
+			ID:        call.ID,
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+		})
+	}
+	return reply, nil
 }
 
-func (c *openAIClient) GenerateStream(ctx context.Context, messages []Message, fn func(string) error) error {
-	req := openai.ChatCompletionRequest{Model: c.model}
+func (c *openAIClient) GenerateWithToolsStream(ctx context.Context, messages []Message, tools []Tool, fn func(StreamDelta) error) (Message, error) {
+	req := c.newRequest(ctx, messages, tools)
 	req.Stream = true
-
-	req.Messages = make([]openai.ChatCompletionMessage, len(messages))
-	for i, msg := range messages {
-		req.Messages[i] = openai.ChatCompletionMessage{Role: msg.Role, Content: msg.Content}
-	}
+	req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
 
 	stream, err := c.client.CreateChatCompletionStream(ctx, req)
 	if err != nil {
-		return fmt.Errorf("create openai chat completion stream: %w", err)
+		return Message{}, fmt.Errorf("create openai chat completion stream: %w", err)
 	}
 	defer stream.Close()
 
+	var (
+		content strings.Builder
+		calls   toolCallAccumulator
+	)
+	finish := func() Message {
+		return Message{Role: RoleAssistant, Content: content.String(), ToolCalls: calls.result()}
+	}
+
+	// With include_usage the token counts arrive in a final chunk without
+	// choices after the finish reason, so the stream is read until EOF.
 	for {
 		response, err := stream.Recv()
 		if errors.Is(err, io.EOF) {
-			return nil
+			return finish(), nil
 		}
 		if err != nil {
-			return fmt.Errorf("stream openai chat completion: %w", err)
+			return Message{}, fmt.Errorf("stream openai chat completion: %w", err)
 		}
 
+		if response.Usage != nil {
+			recordUsage(ctx, fromOpenAIUsage(*response.Usage))
+		}
 		if len(response.Choices) == 0 {
 			continue
 		}
 
-		delta := response.Choices[0].Delta.Content
-		if delta != "" {
+		choice := response.Choices[0]
+		delta := StreamDelta{Content: choice.Delta.Content}
+		for i, call := range choice.Delta.ToolCalls {
+			index := i
+			if call.Index != nil {
+				index = *call.Index
+			}
+			toolDelta := ToolCallDelta{Index: index, ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments}
+			calls.add(toolDelta)
+			delta.ToolCalls = append(delta.ToolCalls, toolDelta)
+		}
+
+		if delta.Content != "" || len(delta.ToolCalls) > 0 {
+			content.WriteString(delta.Content)
 			if err := fn(delta); err != nil {
-				return err
+				return Message{}, err
 			}
 		}
+	}
+}
 
-		if response.Choices[0].FinishReason != "" {
-			return nil
+func (c *openAIClient) newRequest(ctx context.Context, messages []Message, tools []Tool) openai.ChatCompletionRequest {
+	opts := resolveGenerationOptions(ctx, c.defaults)
+	// max_tokens rather than max_completion_tokens keeps OpenAI-compatible
+	// servers (vLLM, Ollama, LiteLLM) working.
+	req := openai.ChatCompletionRequest{
+		Model:       c.model,
+		Messages:    toOpenAIMessages(messages),
+		Tools:       toOpenAITools(tools),
+		Temperature: openAIFloat(opts.Temperature),
+		TopP:        openAIFloat(opts.TopP),
+		MaxTokens:   opts.MaxTokens,
+		Stop:        opts.Stop,
+		Seed:        opts.Seed,
+	}
+	if schema := jsonSchemaFromContext(ctx); len(schema) > 0 {
+		// Strict mode rejects common schemas (optional properties, missing
+		// additionalProperties), so output is validated by the caller instead.
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+				Name:   "response",
+				Schema: schema,
+			},
+		}
+	}
+	return req
+}
+
+func fromOpenAIUsage(usage openai.Usage) Usage {
+	return Usage{
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+	}
+}
+
+func toOpenAIMessages(messages []Message) []openai.ChatCompletionMessage {
+	converted := make([]openai.ChatCompletionMessage, len(messages))
+	for i := range messages {
+		msg := messages[i]
+		converted[i] = openai.ChatCompletionMessage{
+			Role:       msg.Role,
+			Content:    msg.Content,
+			ToolCallID: msg.ToolCallID,
+		}
+		if msg.Role == RoleTool {
+			converted[i].Name = msg.Name
+		}
+		for _, call := range msg.ToolCalls {
+			converted[i].ToolCalls = append(converted[i].ToolCalls, openai.ToolCall{
+				ID:   call.ID,
+				Type: openai.ToolTypeFunction,
+				Function: openai.FunctionCall{
+					Name:      call.Name,
+					Arguments: call.Arguments,
+				},
+			})
+		}
+	}
+	return converted
+}
+
+func toOpenAITools(tools []Tool) []openai.Tool {
+	if len(tools) == 0 {
+		return nil
+	}
+	converted := make([]openai.Tool, len(tools))
+	for i, tool := range tools {
+		converted[i] = openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  toolParameters(tool),
+			},
 		}
 	}
+	return converted
 }
+
+var _ ToolClient = (*openAIClient)(nil)
@@ -0,0 +1,75 @@
+package llm
+
+import (
+	"context"
+	"math"
+
+	"github.com/fabfab/go-agent/config"
+)
+
+type generationOptionsKey struct{}
+
+// WithGenerationOptions returns a context carrying per-call generation
+// options. Clients merge them over their configured defaults, so decorators
+// and callers that only see a Client can still tune individual calls.
+func WithGenerationOptions(ctx context.Context, opts config.GenerationOptions) context.Context {
+	if existing, ok := GenerationOptionsFromContext(ctx); ok {
+		opts = existing.Merge(opts)
+	}
+	return context.WithValue(ctx, generationOptionsKey{}, opts)
+}
+
+// GenerationOptionsFromContext returns the per-call options attached to ctx.
+func GenerationOptionsFromContext(ctx context.Context) (config.GenerationOptions, bool) {
+	opts, ok := ctx.Value(generationOptionsKey{}).(config.GenerationOptions)
+	return opts, ok
+}
+
+// resolveGenerationOptions merges per-call options from ctx over defaults.
+func resolveGenerationOptions(ctx context.Context, defaults config.GenerationOptions) config.GenerationOptions {
+	if override, ok := GenerationOptionsFromContext(ctx); ok {
+		return defaults.Merge(override)
+	}
+	return defaults
+}
+
+type ollamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	NumCtx      int      `json:"num_ctx,omitempty"`
+}
+
+func toOllamaOptions(opts config.GenerationOptions) *ollamaOptions {
+	converted := &ollamaOptions{
+		Temperature: opts.Temperature,
+		TopP:        opts.TopP,
+		NumPredict:  opts.MaxTokens,
+		Stop:        opts.Stop,
+		Seed:        opts.Seed,
+		NumCtx:      opts.NumCtx,
+	}
+	if converted.Temperature == nil && converted.TopP == nil && converted.NumPredict == 0 &&
+		len(converted.Stop) == 0 && converted.Seed == nil && converted.NumCtx == 0 {
+		return nil
+	}
+	return converted
+}
+
+// openAIFloat converts an optional sampling parameter for go-openai, whose
+// request fields are plain float32 values tagged omitempty, so a zero never
+// reaches the API and the server default applies instead. This is a deliberate
+// workaround: an explicit zero is sent as the smallest positive float32, which
+// servers treat as zero (greedy decoding for temperature). Unset values stay
+// zero and are omitted.
+func openAIFloat(value *float64) float32 {
+	if value == nil {
+		return 0
+	}
+	if *value == 0 {
+		return math.SmallestNonzeroFloat32
+	}
+	return float32(*value)
+}
@@ -0,0 +1,70 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresResponseCache stores responses in the llm_cache table created by
+// database.EnsureLLMCacheSchema.
+type PostgresResponseCache struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresResponseCache(pool *pgxpool.Pool) *PostgresResponseCache {
+	return &PostgresResponseCache{pool: pool}
+}
+
+func (c *PostgresResponseCache) Get(ctx context.Context, key string) (string, bool, error) {
+	if c.pool == nil {
+		return "", false, fmt.Errorf("postgres pool is nil")
+	}
+
+	var response string
+	err := c.pool.QueryRow(ctx, `
+        SELECT response
+        FROM llm_cache
+        WHERE key = $1 AND (expires_at IS NULL OR expires_at > NOW())
+    `, key).Scan(&response)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("query llm cache: %w", err)
+	}
+	return response, true, nil
+}
+
+func (c *PostgresResponseCache) Put(ctx context.Context, entry CacheEntry, ttl time.Duration) error {
+	if c.pool == nil {
+		return fmt.Errorf("postgres pool is nil")
+	}
+
+	var expiresAt *time.Time
+	if ttl > 0 {
+		expiry := time.Now().Add(ttl)
+		expiresAt = &expiry
+	}
+
+	_, err := c.pool.Exec(ctx, `
+        INSERT INTO llm_cache (key, provider, model, response, created_at, expires_at)
+        VALUES ($1, $2, $3, $4, NOW(), $5)
+        ON CONFLICT (key) DO UPDATE SET
+            provider = EXCLUDED.provider,
+            model = EXCLUDED.model,
+            response = EXCLUDED.response,
+            created_at = EXCLUDED.created_at,
+            expires_at = EXCLUDED.expires_at
+    `, entry.Key, entry.Provider, entry.Model, entry.Response, expiresAt)
+	if err != nil {
+		return fmt.Errorf("store llm cache entry: %w", err)
+	}
+	return nil
+}
+
+var _ ResponseCache = (*PostgresResponseCache)(nil)
@@ -0,0 +1,101 @@
+package llm
+
+import (
+	"context"
+
+	"github.com/fabfab/go-agent/resilience"
+)
+
+type resilientClient struct {
+	client Client
+	exec   *resilience.Executor
+}
+
+type resilientToolClient struct {
+	*resilientClient
+	tools ToolClient
+}
+
+// NewResilientClient wraps client so that every call runs under exec. The
+// wrapper always supports streaming, delivering the whole answer at once when
+// client cannot stream, and supports tools only when client does. Streams are
+// retried, and bounded by the policy timeout, only until the first chunk
+// reaches the caller.
+func NewResilientClient(client Client, exec *resilience.Executor) Client {
+	wrapped := &resilientClient{client: client, exec: exec}
+	if tools, ok := client.(ToolClient); ok {
+		return &resilientToolClient{resilientClient: wrapped, tools: tools}
+	}
+	return wrapped
+}
+
+func (c *resilientClient) Generate(ctx context.Context, messages []Message) (string, error) {
+	var answer string
+	err := c.exec.Do(ctx, func(ctx context.Context) error {
+		var err error
+		answer, err = c.client.Generate(ctx, messages)
+		return err
+	})
+	return answer, err
+}
+
+func (c *resilientClient) GenerateStream(ctx context.Context, messages []Message, fn func(string) error) error {
+	streamer, ok := c.client.(StreamClient)
+	if !ok {
+		answer, err := c.Generate(ctx, messages)
+		if err != nil {
+			return err
+		}
+		return fn(answer)
+	}
+
+	return c.exec.DoStream(ctx, func(ctx context.Context, started func()) error {
+		emitted := false
+		err := streamer.GenerateStream(ctx, messages, func(chunk string) error {
+			if !emitted {
+				emitted = true
+				started()
+			}
+			return fn(chunk)
+		})
+		if err != nil && emitted {
+			return resilience.Permanent(err)
+		}
+		return err
+	})
+}
+
+func (c *resilientToolClient) GenerateWithTools(ctx context.Context, messages []Message, tools []Tool) (Message, error) {
+	var reply Message
+	err := c.exec.Do(ctx, func(ctx context.Context) error {
+		var err error
+		reply, err = c.tools.GenerateWithTools(ctx, messages, tools)
+		return err
+	})
+	return reply, err
+}
+
+func (c *resilientToolClient) GenerateWithToolsStream(ctx context.Context, messages []Message, tools []Tool, fn func(StreamDelta) error) (Message, error) {
+	var reply Message
+	err := c.exec.DoStream(ctx, func(ctx context.Context, started func()) error {
+		emitted := false
+		var err error
+		reply, err = c.tools.GenerateWithToolsStream(ctx, messages, tools, func(delta StreamDelta) error {
+			if !emitted {
+				emitted = true
+				started()
+			}
+			return fn(delta)
+		})
+		if err != nil && emitted {
+			return resilience.Permanent(err)
+		}
+		return err
+	})
+	return reply, err
+}
+
+var (
+	_ StreamClient = (*resilientClient)(nil)
+	_ ToolClient   = (*resilientToolClient)(nil)
+)
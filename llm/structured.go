@@ -0,0 +1,110 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const defaultStructuredAttempts = 3
+
+// ErrInvalidStructuredOutput is returned by GenerateStructured when the model
+// does not produce JSON matching the schema within the allowed attempts.
+var ErrInvalidStructuredOutput = errors.New("model did not return valid structured output")
+
+type jsonSchemaKey struct{}
+
+// WithJSONSchema returns a context asking clients to constrain their output
+// to JSON matching schema: Ollama receives it as format and OpenAI as a
+// json_schema response_format. Clients without native support ignore it, so
+// callers should also describe the schema in the prompt.
+func WithJSONSchema(ctx context.Context, schema json.RawMessage) context.Context {
+	return context.WithValue(ctx, jsonSchemaKey{}, schema)
+}
+
+func jsonSchemaFromContext(ctx context.Context) json.RawMessage {
+	schema, _ := ctx.Value(jsonSchemaKey{}).(json.RawMessage)
+	return schema
+}
+
+// StructuredResult is the validated output of GenerateStructured.
+type StructuredResult struct {
+	Data json.RawMessage
+	// Attempts is the number of generations needed, including re-prompts.
+	Attempts int
+}
+
+// GenerateStructured asks client for JSON matching schema. The schema is
+// passed natively where the provider supports it and is also included in the
+// prompt. Output that fails validation is sent back to the model with the
+// violations, up to maxAttempts generations in total (3 when zero).
+func GenerateStructured(ctx context.Context, client Client, messages []Message, schema json.RawMessage, maxAttempts int) (StructuredResult, error) {
+	if err := ValidateSchema(schema); err != nil {
+		return StructuredResult{}, err
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = defaultStructuredAttempts
+	}
+
+	ctx = WithJSONSchema(ctx, schema)
+	conversation := make([]Message, 0, len(messages)+1+2*maxAttempts)
+	conversation = append(conversation, Message{Role: RoleSystem, Content: structuredPrompt(schema)})
+	conversation = append(conversation, messages...)
+
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		output, err := client.Generate(ctx, conversation)
+		if err != nil {
+			return StructuredResult{}, fmt.Errorf("llm generate: %w", err)
+		}
+
+		data := json.RawMessage(extractJSON(output))
+		if lastErr = ValidateJSON(schema, data); lastErr == nil {
+			return StructuredResult{Data: data, Attempts: attempt}, nil
+		}
+
+		conversation = append(conversation,
+			Message{Role: RoleAssistant, Content: output},
+			Message{Role: RoleUser, Content: fmt.Sprintf("That response is invalid: %v. Reply again with only a JSON value that matches the schema.", lastErr)},
+		)
+	}
+	return StructuredResult{}, fmt.Errorf("%w after %d attempts: %v", ErrInvalidStructuredOutput, maxAttempts, lastErr)
+}
+
+// ValidateSchema reports whether schema is a JSON object that ValidateJSON can
+// use.
+func ValidateSchema(schema json.RawMessage) error {
+	var parsed jsonSchema
+	if err := json.Unmarshal(schema, &parsed); err != nil {
+		return fmt.Errorf("invalid json schema: %w", err)
+	}
+	return nil
+}
+
+func structuredPrompt(schema json.RawMessage) string {
+	return "Respond with a single JSON value that conforms to this JSON schema, without markdown fences or commentary:\n" + string(schema)
+}
+
+// extractJSON strips markdown code fences and surrounding prose that models
+// sometimes add despite instructions.
+func extractJSON(output string) string {
+	trimmed := strings.TrimSpace(output)
+	if strings.HasPrefix(trimmed, "```") {
+		trimmed = strings.TrimPrefix(trimmed, "```")
+		if newline := strings.IndexByte(trimmed, '\n'); newline >= 0 {
+			trimmed = trimmed[newline+1:]
+		}
+		trimmed = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(trimmed), "```"))
+	}
+	if json.Valid([]byte(trimmed)) {
+		return trimmed
+	}
+	start := strings.IndexAny(trimmed, "{[")
+	end := strings.LastIndexAny(trimmed, "}]")
+	if start >= 0 && end > start && json.Valid([]byte(trimmed[start:end+1])) {
+		return trimmed[start : end+1]
+	}
+	return trimmed
+}
@@ -0,0 +1,111 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrToolsUnsupported is returned when a client cannot perform tool calling.
+var ErrToolsUnsupported = errors.New("llm client does not support tool calling")
+
+// Tool describes a function the model may call. Parameters holds the JSON
+// schema of the function arguments; an empty schema accepts no arguments.
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage
+}
+
+// ToolCall is a function invocation requested by the model. Arguments holds
+// the raw JSON object produced by the model.
+type ToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// ToolCallDelta is an incremental fragment of a tool call emitted while
+// streaming. Fragments sharing an Index belong to the same call; ID and Name
+// are usually only present on the first fragment.
+type ToolCallDelta struct {
+	Index     int
+	ID        string
+	Name      string
+	Arguments string
+}
+
+// StreamDelta is a single streamed increment of an assistant message.
+type StreamDelta struct {
+	Content   string
+	ToolCalls []ToolCallDelta
+}
+
+// ToolClient extends Client with function calling. Both methods return the
+// complete assistant message, including any tool calls the model requested.
+// The streaming variant additionally reports content and tool-call fragments
+// through the callback as they arrive.
+type ToolClient interface {
+	Client
+	GenerateWithTools(ctx context.Context, messages []Message, tools []Tool) (Message, error)
+	GenerateWithToolsStream(ctx context.Context, messages []Message, tools []Tool, fn func(StreamDelta) error) (Message, error)
+}
+
+// DecodeArguments unmarshals the JSON arguments of a tool call into dst.
+func (c ToolCall) DecodeArguments(dst any) error {
+	args := c.Arguments
+	if args == "" {
+		args = "{}"
+	}
+	if err := json.Unmarshal([]byte(args), dst); err != nil {
+		return fmt.Errorf("decode arguments for tool %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+func toolParameters(tool Tool) json.RawMessage {
+	if len(tool.Parameters) == 0 {
+		return json.RawMessage(`{"type":"object","properties":{}}`)
+	}
+	return tool.Parameters
+}
+
+// toolCallAccumulator assembles streamed tool-call fragments into complete
+// calls, preserving the order in which the model emitted them.
+type toolCallAccumulator struct {
+	calls []ToolCall
+	index map[int]int
+}
+
+func (a *toolCallAccumulator) add(delta ToolCallDelta) {
+	if a.index == nil {
+		a.index = make(map[int]int)
+	}
+	pos, ok := a.index[delta.Index]
+	if !ok {
+		pos = len(a.calls)
+		a.index[delta.Index] = pos
+		a.calls = append(a.calls, ToolCall{})
+	}
+	call := &a.calls[pos]
+	if delta.ID != "" {
+		call.ID = delta.ID
+	}
+	if delta.Name != "" {
+		call.Name = delta.Name
+	}
+	call.Arguments += delta.Arguments
+}
+
+func (a *toolCallAccumulator) result() []ToolCall {
+	if len(a.calls) == 0 {
+		return nil
+	}
+	for i := range a.calls {
+		if a.calls[i].ID == "" {
+			a.calls[i].ID = fmt.Sprintf("call_%d", i)
+		}
+	}
+	return a.calls
+}
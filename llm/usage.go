@@ -0,0 +1,93 @@
+package llm
+
+import (
+	"context"
+	"sync"
+)
+
+// Usage reports the tokens consumed by one or more LLM calls. Providers that
+// do not report usage leave it zero.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+}
+
+// Add returns the sum of u and other.
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		PromptTokens:     u.PromptTokens + other.PromptTokens,
+		CompletionTokens: u.CompletionTokens + other.CompletionTokens,
+		TotalTokens:      u.TotalTokens + other.TotalTokens,
+	}
+}
+
+// Meter accumulates usage reported by every client call made with a context
+// returned from WithMeter. It is safe for concurrent use.
+type Meter struct {
+	mu       sync.Mutex
+	usage    Usage
+	calls    int
+	provider string
+}
+
+type meterKey struct{}
+
+// WithMeter returns a context whose LLM calls report their usage to m.
+func WithMeter(ctx context.Context, m *Meter) context.Context {
+	return context.WithValue(ctx, meterKey{}, m)
+}
+
+// Usage returns the usage accumulated so far.
+func (m *Meter) Usage() Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usage
+}
+
+// Calls returns the number of completed calls that reported usage.
+func (m *Meter) Calls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls
+}
+
+// Provider returns the provider/model that served the most recent call made
+// through a fallback client, or "" when none has.
+func (m *Meter) Provider() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.provider
+}
+
+func (m *Meter) add(usage Usage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.usage = m.usage.Add(usage)
+	m.calls++
+}
+
+// recordUsage reports usage to the meter attached to ctx, if any. A missing
+// total is derived from the prompt and completion counts.
+func recordUsage(ctx context.Context, usage Usage) {
+	m, ok := ctx.Value(meterKey{}).(*Meter)
+	if !ok || m == nil {
+		return
+	}
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	m.add(usage)
+}
+
+// recordProvider notes on the meter attached to ctx which provider served a
+// call.
+func recordProvider(ctx context.Context, name string) {
+	m, ok := ctx.Value(meterKey{}).(*Meter)
+	if !ok || m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.provider = name
+}
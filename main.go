@@ -13,9 +13,11 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
 
 	"github.com/fabfab/go-agent/api"
+	"github.com/fabfab/go-agent/cassette"
 	"github.com/fabfab/go-agent/chat"
 	"github.com/fabfab/go-agent/config"
 	"github.com/fabfab/go-agent/database"
@@ -25,7 +27,7 @@ import (
 )
 
 func main() {
-	logger := log.New(os.Stdout, "", log.LstdFlags)
+	logger := cliLogger{log.New(os.Stdout, "", log.LstdFlags)}
 
 	if len(os.Args) < 2 {
 		printUsage()
@@ -43,16 +45,45 @@ func main() {
 		clearCmd(cfg, logger, os.Args[2:])
 	case "serve":
 		serveCmd(cfg, logger, os.Args[2:])
+	case "embed-cache":
+		embedCacheCmd(cfg, logger, os.Args[2:])
+	case "reembed":
+		reembedCmd(cfg, logger, os.Args[2:])
+	case "spaces":
+		spacesCmd(cfg, logger, os.Args[2:])
+	case "reindex":
+		reindexCmd(cfg, logger, os.Args[2:])
+	case "backfill-topics":
+		backfillTopicsCmd(cfg, logger, os.Args[2:])
 	default:
 		logger.Printf("unknown command: %s", os.Args[1])
 		printUsage()
 		os.Exit(1)
 	}
+
+	// Recorded interactions are buffered until the command finishes.
+	if err := cassette.FlushAll(); err != nil {
+		logger.Logger.Fatalf("write cassette: %v", err)
+	}
+}
+
+// cliLogger writes the recorded cassettes before a fatal exit, so that a
+// failed run keeps the interactions that led to the failure.
+type cliLogger struct {
+	*log.Logger
+}
+
+func (l cliLogger) Fatalf(format string, v ...any) {
+	if err := cassette.FlushAll(); err != nil {
+		l.Printf("write cassette: %v", err)
+	}
+	l.Logger.Fatalf(format, v...)
 }
 
-func ingestCmd(cfg config.Config, logger *log.Logger, args []string) {
+func ingestCmd(cfg config.Config, logger cliLogger, args []string) {
 	flags := flag.NewFlagSet("ingest", flag.ExitOnError)
 	dataDir := flags.String("dir", cfg.DataDir, "path to directory containing markdown documents")
+	migrate := flags.Bool("migrate", false, "re-embed everything when EMBEDDING_SPACE holds vectors from another embedding model")
 	if err := flags.Parse(args); err != nil {
 		logger.Fatalf("parse ingest flags: %v", err)
 	}
@@ -77,25 +108,88 @@ func ingestCmd(cfg config.Config, logger *log.Logger, args []string) {
 		logger.Fatalf("embedder setup: %v", err)
 	}
 
-	svc := ingestion.NewService(pgPool, neo4jDriver, embedder, logger, cfg.Embeddings.Dimension)
-	logger.Printf("ingesting markdown from %s using %s/%s embeddings", *dataDir, strings.ToUpper(cfg.Embeddings.Provider), cfg.Embeddings.Model)
+	var ingestOpts []ingestion.Option
+	if cfg.Embeddings.Cache {
+		if err := database.EnsureEmbeddingCacheSchema(ctx, pgPool); err != nil {
+			logger.Fatalf("embedding cache schema: %v", err)
+		}
+		ingestOpts = append(ingestOpts, ingestion.WithEmbeddingCache(embeddings.NewPostgresCache(pgPool), embeddings.FingerprintFor(cfg.Embeddings)))
+	}
+
+	ingestOpts = append(ingestOpts, ingestion.WithEmbeddingSpace(database.SpaceFromConfig(cfg.Embeddings)), ingestion.WithVectorIndex(cfg.VectorIndex))
+	if *migrate {
+		ingestOpts = append(ingestOpts, ingestion.WithEmbeddingMigration())
+	}
+
+	svc := ingestion.NewService(pgPool, neo4jDriver, embedder, logger.Logger, cfg.Embeddings.Dimension, ingestOpts...)
+	logger.Printf("ingesting markdown from %s using %s/%s embeddings into space %s", *dataDir, strings.ToUpper(cfg.Embeddings.Provider), cfg.Embeddings.Model, cfg.Embeddings.Space)
 
 	if err := svc.IngestDirectory(ctx, *dataDir); err != nil {
 		logger.Fatalf("ingestion failed: %v", err)
 	}
 }
 
-func chatCmd(cfg config.Config, logger *log.Logger, args []string) {
+func chatCmd(cfg config.Config, logger cliLogger, args []string) {
 	flags := flag.NewFlagSet("chat", flag.ExitOnError)
 	question := flags.String("question", "", "question to ask the agent")
 	limit := flags.Int("limit", 5, "number of context chunks to retrieve")
+	agent := flags.Bool("agent", false, "let the model search the knowledge base with tools over multiple steps")
+	maxSteps := flags.Int("max-steps", 5, "maximum number of tool-calling steps in agent mode")
+	temperature := flags.Float64("temperature", 0, "sampling temperature (defaults to LLM_TEMPERATURE or the provider default)")
+	topP := flags.Float64("top-p", 0, "nucleus sampling probability (defaults to LLM_TOP_P or the provider default)")
+	maxTokens := flags.Int("max-tokens", 0, "maximum number of tokens to generate")
+	seed := flags.Int("seed", 0, "sampling seed for reproducible answers")
+	numCtx := flags.Int("num-ctx", 0, "context window size in tokens (ollama only)")
+	noCache := flags.Bool("no-cache", false, "skip LLM response cache lookups (answers are still cached)")
+	hybrid := flags.Bool("hybrid", false, "combine vector search with full-text search (reciprocal rank fusion)")
+	rerank := flags.Bool("rerank", cfg.Rerank.Provider != "", "reorder retrieved chunks with the RERANK_PROVIDER reranker")
+	rerankCandidates := flags.Int("rerank-candidates", cfg.Rerank.Candidates, "chunks retrieved for reranking (0 retrieves four times --limit)")
+	expand := flags.String("expand", "", "also search LLM-generated query variants: multi-query (paraphrases) or hyde (a hypothetical answer)")
+	queryVariants := flags.Int("query-variants", 0, "with --expand multi-query, number of paraphrases (0 uses 3)")
+	noCondense := flags.Bool("no-condense", false, "search follow-up questions verbatim instead of rewriting them with the conversation into a standalone query")
+	contextExpansion := flags.String("context", "", "give the LLM the text around each hit: neighbors (adjacent chunks) or section (the enclosing section)")
+	contextRadius := flags.Int("context-radius", 0, "with --context neighbors, chunks added on each side of a hit (0 uses 1)")
+	grounding := flags.String("grounding", cfg.Grounding.Mode, "answers without supporting context: lenient (general knowledge), not-found (a standard reply) or refuse")
+	minScore := flags.Float64("min-score", cfg.Grounding.MinScore, "drop retrieved chunks whose vector similarity, or rerank score, is below this (0 keeps all); without --rerank it also drops --hybrid hits only full-text search found")
+	mmr := flags.Bool("mmr", false, "diversify retrieved chunks with maximal marginal relevance")
+	mmrLambda := flags.Float64("mmr-lambda", 0, "with --mmr, relevance versus novelty from 0 to 1 (0 uses 0.5)")
+	vectorWeight := flags.Float64("vector-weight", 0, "with --hybrid, weight of the vector ranking (both weights 0 weighs them equally)")
+	lexicalWeight := flags.Float64("lexical-weight", 0, "with --hybrid, weight of the full-text ranking")
+	allowMismatch := flags.Bool("allow-embedding-mismatch", cfg.Embeddings.AllowMismatch, "search even if the stored vectors came from another embedding model")
 	sectionFilters := multiFlag{}
 	topicFilters := multiFlag{}
+	folderFilters := multiFlag{}
+	pathFilters := multiFlag{}
+	documentIDs := multiFlag{}
+	stopSequences := multiFlag{}
 	flags.Var(&sectionFilters, "sections", "section filter (repeatable)")
 	flags.Var(&topicFilters, "topics", "topic filter (repeatable)")
+	flags.Var(&folderFilters, "folders", "folder filter, including subfolders (repeatable)")
+	flags.Var(&pathFilters, "paths", "document path glob, ** crosses folders (repeatable)")
+	flags.Var(&documentIDs, "documents", "document id filter (repeatable)")
+	flags.Var(&stopSequences, "stop", "stop sequence (repeatable)")
 	if err := flags.Parse(args); err != nil {
 		logger.Fatalf("parse chat flags: %v", err)
 	}
+	if err := chat.ValidateFusionWeights(chat.FusionWeights{Vector: *vectorWeight, Lexical: *lexicalWeight}); err != nil {
+		logger.Fatalf("invalid --vector-weight or --lexical-weight: %v", err)
+	}
+
+	generation := config.GenerationOptions{
+		MaxTokens: *maxTokens,
+		Stop:      stopSequences.values,
+		NumCtx:    *numCtx,
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "temperature":
+			generation.Temperature = temperature
+		case "top-p":
+			generation.TopP = topP
+		case "seed":
+			generation.Seed = seed
+		}
+	})
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
@@ -112,25 +206,72 @@ func chatCmd(cfg config.Config, logger *log.Logger, args []string) {
 	}
 	defer neo4jDriver.Close(ctx)
 
+	space, err := database.QueryEmbeddingSpace(ctx, pgPool, cfg.Embeddings)
+	if err != nil {
+		logger.Fatalf("resolve embedding space: %v", err)
+	}
+	cfg.Embeddings = space.SearchConfig(cfg.Embeddings)
+	if err := database.CheckVectorIndex(ctx, pgPool, space.Table(), cfg.VectorIndex); err != nil {
+		logger.Printf("warning: %v", err)
+	}
+
 	embedder, err := embeddings.NewEmbedder(cfg)
 	if err != nil {
 		logger.Fatalf("embedder setup: %v", err)
 	}
 
-	llmClient, err := llm.NewClient(cfg)
+	var llmOptions []llm.ClientOption
+	if cfg.LLM.Cache.Enabled {
+		if err := database.EnsureLLMCacheSchema(ctx, pgPool); err != nil {
+			logger.Fatalf("llm cache schema: %v", err)
+		}
+		llmOptions = append(llmOptions, llm.WithResponseCache(llm.NewPostgresResponseCache(pgPool)))
+	}
+
+	llmClient, err := llm.NewClient(cfg, llmOptions...)
 	if err != nil {
 		logger.Fatalf("llm setup: %v", err)
 	}
 
-	vectorStore := chat.NewPostgresVectorStore(pgPool)
+	reranker, err := chat.NewReranker(cfg.Rerank, llmClient)
+	if err != nil {
+		logger.Fatalf("reranker setup: %v", err)
+	}
+
+	vectorStore := chat.NewPostgresVectorStore(pgPool, chat.WithSpace(space.Name), chat.WithVectorIndex(cfg.VectorIndex))
 	graphStore := chat.NewNeo4jGraphStore(neo4jDriver)
-	svc := chat.NewService(vectorStore, graphStore, embedder, llmClient, logger)
+	svc := chat.NewService(vectorStore, graphStore, embedder, llmClient, logger.Logger, chat.WithReranker(reranker))
 
 	conversationHistory := make([]llm.Message, 0)
 	config := chat.Config{
-		SimilarityLimit: *limit,
-		SectionFilters:  sectionFilters.values,
-		TopicFilters:    topicFilters.values,
+		SimilarityLimit:        *limit,
+		SectionFilters:         sectionFilters.values,
+		TopicFilters:           topicFilters.values,
+		FolderFilters:          folderFilters.values,
+		PathFilters:            pathFilters.values,
+		DocumentIDs:            documentIDs.values,
+		Agent:                  *agent,
+		MaxSteps:               *maxSteps,
+		Generation:             generation,
+		BypassCache:            *noCache,
+		AllowEmbeddingMismatch: *allowMismatch,
+		Hybrid:                 *hybrid,
+		Weights:                chat.FusionWeights{Vector: *vectorWeight, Lexical: *lexicalWeight},
+		Rerank:                 *rerank,
+		RerankCandidates:       *rerankCandidates,
+		MMR:                    *mmr,
+		MMRLambda:              *mmrLambda,
+		QueryExpansion:         *expand,
+		QueryVariants:          *queryVariants,
+		NoCondense:             *noCondense,
+		ContextExpansion:       *contextExpansion,
+		ContextRadius:          *contextRadius,
+		Grounding:              *grounding,
+		MinScore:               *minScore,
+		OnStep: func(step chat.AgentStep) error {
+			fmt.Printf("\n[step %d] %s %s\n", step.Step, step.Tool, step.Arguments)
+			return nil
+		},
 	}
 
 	scanner := bufio.NewScanner(os.Stdin)
@@ -178,6 +319,12 @@ func chatCmd(cfg config.Config, logger *log.Logger, args []string) {
 		}
 
 		conversationHistory = updatedHistory
+		if !resp.Grounded {
+			fmt.Println("\n(Not grounded in the knowledge base.)")
+		}
+		if resp.SearchQuery != "" && resp.SearchQuery != inputPending {
+			fmt.Printf("\nSearched for: %s\n", resp.SearchQuery)
+		}
 
 		if len(resp.Sources) > 0 {
 			fmt.Println()
@@ -187,6 +334,15 @@ func chatCmd(cfg config.Config, logger *log.Logger, args []string) {
 			if len(topicFilters.values) > 0 {
 				fmt.Printf("Filters (topics): %s\n", strings.Join(topicFilters.values, ", "))
 			}
+			if len(folderFilters.values) > 0 {
+				fmt.Printf("Filters (folders): %s\n", strings.Join(folderFilters.values, ", "))
+			}
+			if len(pathFilters.values) > 0 {
+				fmt.Printf("Filters (paths): %s\n", strings.Join(pathFilters.values, ", "))
+			}
+			if len(documentIDs.values) > 0 {
+				fmt.Printf("Filters (documents): %s\n", strings.Join(documentIDs.values, ", "))
+			}
 			fmt.Println("Sources:")
 			for idx := range resp.Sources {
 				source := &resp.Sources[idx]
@@ -233,12 +389,20 @@ func chatCmd(cfg config.Config, logger *log.Logger, args []string) {
 			}
 		}
 
+		if resp.Provider != "" {
+			fmt.Printf("\nAnswered by: %s", resp.Provider)
+		}
+		fmt.Printf("\nTokens: %d prompt + %d completion = %d | condense %s, expansion %s, embed %s, search %s, rerank %s, context %s, graph %s, generation %s, total %s\n",
+			resp.Usage.PromptTokens, resp.Usage.CompletionTokens, resp.Usage.TotalTokens,
+			resp.Timings.Condense.Round(time.Millisecond), resp.Timings.QueryExpansion.Round(time.Millisecond), resp.Timings.Embed.Round(time.Millisecond), (resp.Timings.VectorSearch + resp.Timings.LexicalSearch).Round(time.Millisecond),
+			resp.Timings.Rerank.Round(time.Millisecond), resp.Timings.ContextExpansion.Round(time.Millisecond), resp.Timings.GraphInsights.Round(time.Millisecond), resp.Timings.Generation.Round(time.Millisecond),
+			resp.Timings.Total.Round(time.Millisecond))
 		fmt.Println()
 		inputPending = ""
 	}
 }
 
-func clearCmd(cfg config.Config, logger *log.Logger, args []string) {
+func clearCmd(cfg config.Config, logger cliLogger, args []string) {
 	flags := flag.NewFlagSet("clear", flag.ExitOnError)
 	confirmed := flags.Bool("confirm", false, "skip confirmation prompt")
 	if err := flags.Parse(args); err != nil {
@@ -275,7 +439,7 @@ func clearCmd(cfg config.Config, logger *log.Logger, args []string) {
 		logger.Fatalf("ensure postgres schema: %v", err)
 	}
 
-	if _, err := pgPool.Exec(ctx, "TRUNCATE rag_chunks, rag_documents"); err != nil {
+	if _, err := pgPool.Exec(ctx, "TRUNCATE rag_chunks, rag_documents CASCADE"); err != nil {
 		logger.Fatalf("truncate postgres tables: %v", err)
 	}
 	logger.Println("cleared Postgres rag_documents and rag_chunks")
@@ -297,7 +461,291 @@ func clearCmd(cfg config.Config, logger *log.Logger, args []string) {
 	logger.Println("RAG data removed")
 }
 
-func serveCmd(cfg config.Config, logger *log.Logger, args []string) {
+func embedCacheCmd(cfg config.Config, logger cliLogger, args []string) {
+	flags := flag.NewFlagSet("embed-cache", flag.ExitOnError)
+	prune := flags.Bool("prune", false, "delete cached embeddings selected by --unused-for and --other-models")
+	unusedFor := flags.Duration("unused-for", 0, "with --prune, delete entries not used within this duration (e.g. 720h)")
+	otherModels := flags.Bool("other-models", false, "with --prune, delete entries not produced by the configured embedding provider, model, dimension and document template")
+	if err := flags.Parse(args); err != nil {
+		logger.Fatalf("parse embed-cache flags: %v", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pgPool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		logger.Fatalf("postgres connection: %v", err)
+	}
+	defer pgPool.Close()
+
+	if err := database.EnsureEmbeddingCacheSchema(ctx, pgPool); err != nil {
+		logger.Fatalf("embedding cache schema: %v", err)
+	}
+	cache := embeddings.NewPostgresCache(pgPool)
+	current := embeddings.FingerprintFor(cfg.Embeddings)
+
+	if *prune {
+		opts := embeddings.PruneOptions{UnusedFor: *unusedFor}
+		if *otherModels {
+			opts.Keep = &current
+		}
+		if opts.UnusedFor <= 0 && opts.Keep == nil {
+			logger.Fatalf("--prune requires --unused-for or --other-models")
+		}
+		removed, err := cache.Prune(ctx, opts)
+		if err != nil {
+			logger.Fatalf("prune embedding cache: %v", err)
+		}
+		logger.Printf("removed %d cached embeddings", removed)
+	}
+
+	stats, err := cache.Stats(ctx)
+	if err != nil {
+		logger.Fatalf("embedding cache stats: %v", err)
+	}
+	if len(stats) == 0 {
+		fmt.Println("Embedding cache is empty")
+		return
+	}
+	for _, entry := range stats {
+		marker := ""
+		if entry.Fingerprint == current {
+			marker = " (current)"
+		}
+		fmt.Printf("%s%s: %d entries, last used %s\n", entry.Fingerprint, marker, entry.Entries, entry.LastUsed.Format(time.RFC3339))
+	}
+}
+
+func reembedCmd(cfg config.Config, logger cliLogger, args []string) {
+	flags := flag.NewFlagSet("reembed", flag.ExitOnError)
+	spaceName := flags.String("space", "", "embedding space to backfill (required)")
+	provider := flags.String("provider", cfg.Embeddings.Provider, "embedding provider for the space")
+	model := flags.String("model", cfg.Embeddings.Model, "embedding model for the space")
+	dimension := flags.Int("dimension", cfg.Embeddings.Dimension, "embedding dimension for the space")
+	queryTemplate := flags.String("query-template", cfg.Embeddings.QueryTemplate, "query template for the space")
+	documentTemplate := flags.String("document-template", cfg.Embeddings.DocumentTemplate, "document template for the space")
+	batchSize := flags.Int("batch-size", 64, "chunks embedded and committed per batch")
+	activate := flags.Bool("activate", false, "search the space once every chunk has a vector in it")
+	migrate := flags.Bool("migrate", false, "switch a registered space to the flagged model, discarding its vectors")
+	if err := flags.Parse(args); err != nil {
+		logger.Fatalf("parse reembed flags: %v", err)
+	}
+	if *spaceName == "" {
+		logger.Fatalf("--space is required")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pgPool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		logger.Fatalf("postgres connection: %v", err)
+	}
+	defer pgPool.Close()
+
+	// A registered space keeps its model unless it is migrated; the flags
+	// describe new spaces.
+	spec := database.SpaceFromConfig(config.EmbeddingConfig{
+		Space:            *spaceName,
+		Provider:         *provider,
+		Model:            *model,
+		Dimension:        *dimension,
+		QueryTemplate:    *queryTemplate,
+		DocumentTemplate: *documentTemplate,
+	})
+	existing, found, err := database.GetEmbeddingSpace(ctx, pgPool, *spaceName)
+	if err != nil {
+		logger.Fatalf("load embedding space: %v", err)
+	}
+	if found && !*migrate {
+		spec = existing
+	}
+	cfg.Embeddings = spec.EmbeddingConfig(cfg.Embeddings)
+
+	embedder, err := embeddings.NewEmbedder(cfg)
+	if err != nil {
+		logger.Fatalf("embedder setup: %v", err)
+	}
+
+	ingestOpts := []ingestion.Option{ingestion.WithEmbeddingSpace(spec), ingestion.WithVectorIndex(cfg.VectorIndex)}
+	if *migrate {
+		ingestOpts = append(ingestOpts, ingestion.WithEmbeddingMigration())
+	}
+	if cfg.Embeddings.Cache {
+		if err := database.EnsureEmbeddingCacheSchema(ctx, pgPool); err != nil {
+			logger.Fatalf("embedding cache schema: %v", err)
+		}
+		ingestOpts = append(ingestOpts, ingestion.WithEmbeddingCache(embeddings.NewPostgresCache(pgPool), embeddings.FingerprintFor(cfg.Embeddings)))
+	}
+
+	svc := ingestion.NewService(pgPool, nil, embedder, logger.Logger, cfg.Embeddings.Dimension, ingestOpts...)
+	logger.Printf("re-embedding chunks into space %s using %s/%s@%d", spec.Name, strings.ToUpper(spec.Provider), spec.Model, spec.Dimension)
+
+	done, err := svc.Reembed(ctx, *batchSize, func(done, pending int) {
+		logger.Printf("embedded %d of %d chunks", done, pending)
+	})
+	if err != nil {
+		logger.Fatalf("reembed failed after %d chunks: %v", done, err)
+	}
+	logger.Printf("space %s is up to date (%d chunks embedded)", spec.Name, done)
+
+	if *activate {
+		activateSpace(ctx, pgPool, cfg.Embeddings, logger, spec.Name, false)
+	}
+}
+
+func spacesCmd(cfg config.Config, logger cliLogger, args []string) {
+	flags := flag.NewFlagSet("spaces", flag.ExitOnError)
+	activate := flags.String("activate", "", "search this embedding space from now on")
+	force := flags.Bool("force", false, "with --activate, switch even if some chunks have no vector in the space")
+	if err := flags.Parse(args); err != nil {
+		logger.Fatalf("parse spaces flags: %v", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pgPool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		logger.Fatalf("postgres connection: %v", err)
+	}
+	defer pgPool.Close()
+
+	if err := database.EnsureRAGSchema(ctx, pgPool, cfg.Embeddings.Dimension); err != nil {
+		logger.Fatalf("ensure postgres schema: %v", err)
+	}
+
+	if *activate != "" {
+		activateSpace(ctx, pgPool, cfg.Embeddings, logger, *activate, *force)
+	}
+
+	spaces, err := database.ListEmbeddingSpaces(ctx, pgPool)
+	if err != nil {
+		logger.Fatalf("list embedding spaces: %v", err)
+	}
+	if len(spaces) == 0 {
+		fmt.Println("No embedding spaces registered yet; ingest documents to create one")
+		return
+	}
+	for _, space := range spaces {
+		embedded, total, err := database.CountSpaceEmbeddings(ctx, pgPool, space)
+		if err != nil {
+			logger.Fatalf("count space embeddings: %v", err)
+		}
+		marker := ""
+		if space.Active {
+			marker = " (active)"
+		}
+		fmt.Printf("%s%s: %s/%s@%d, %d of %d chunks embedded\n", space.Name, marker, space.Provider, space.Model, space.Dimension, embedded, total)
+	}
+}
+
+// activateSpace switches chat to the named space, refusing spaces that are
+// missing chunk vectors unless force is set.
+func activateSpace(ctx context.Context, pool *pgxpool.Pool, cfg config.EmbeddingConfig, logger cliLogger, name string, force bool) {
+	space, found, err := database.GetEmbeddingSpace(ctx, pool, name)
+	if err != nil {
+		logger.Fatalf("load embedding space: %v", err)
+	}
+	if !found && name == database.DefaultSpace {
+		// Data ingested before spaces existed lives in the default column.
+		spec := database.SpaceFromConfig(cfg)
+		spec.Name = database.DefaultSpace
+		space, err = database.EnsureEmbeddingSpace(ctx, pool, spec, database.SpaceOptions{})
+		if err != nil {
+			logger.Fatalf("register embedding space: %v", err)
+		}
+		found = true
+	}
+	if !found {
+		logger.Fatalf("embedding space %s is not registered; run reembed --space %s first", name, name)
+	}
+	embedded, total, err := database.CountSpaceEmbeddings(ctx, pool, space)
+	if err != nil {
+		logger.Fatalf("count space embeddings: %v", err)
+	}
+	if embedded < total && !force {
+		logger.Fatalf("embedding space %s has vectors for %d of %d chunks; run reembed --space %s or pass --force", name, embedded, total, name)
+	}
+	if err := database.ActivateEmbeddingSpace(ctx, pool, name); err != nil {
+		logger.Fatalf("activate embedding space: %v", err)
+	}
+	logger.Printf("chat now searches embedding space %s", name)
+}
+
+func reindexCmd(cfg config.Config, logger cliLogger, args []string) {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	spaceName := flags.String("space", cfg.Embeddings.Space, "embedding space whose vector index is rebuilt")
+	lists := flags.Int("lists", cfg.VectorIndex.Lists, "ivfflat lists (0 sizes them to the current row count)")
+	if err := flags.Parse(args); err != nil {
+		logger.Fatalf("parse reindex flags: %v", err)
+	}
+	if err := database.ValidateSpaceName(*spaceName); err != nil {
+		logger.Fatalf("invalid --space: %v", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pgPool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		logger.Fatalf("postgres connection: %v", err)
+	}
+	defer pgPool.Close()
+
+	if err := database.EnsureRAGSchema(ctx, pgPool, cfg.Embeddings.Dimension); err != nil {
+		logger.Fatalf("ensure postgres schema: %v", err)
+	}
+
+	space := database.EmbeddingSpace{Name: *spaceName}
+	if !space.IsDefault() {
+		if _, found, err := database.GetEmbeddingSpace(ctx, pgPool, space.Name); err != nil {
+			logger.Fatalf("load embedding space: %v", err)
+		} else if !found {
+			logger.Fatalf("embedding space %s is not registered", space.Name)
+		}
+	}
+
+	index := cfg.VectorIndex
+	index.Lists = *lists
+	description, err := database.RebuildVectorIndex(ctx, pgPool, space.Table(), index)
+	if err != nil {
+		logger.Fatalf("rebuild vector index: %v", err)
+	}
+	logger.Printf("rebuilt vector index of embedding space %s: %s", space.Name, description)
+}
+
+func backfillTopicsCmd(cfg config.Config, logger cliLogger, args []string) {
+	flags := flag.NewFlagSet("backfill-topics", flag.ExitOnError)
+	if err := flags.Parse(args); err != nil {
+		logger.Fatalf("parse backfill-topics flags: %v", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pgPool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		logger.Fatalf("postgres connection: %v", err)
+	}
+	defer pgPool.Close()
+
+	neo4jDriver, err := database.NewNeo4jDriver(ctx, cfg.Neo4jURI, cfg.Neo4jUser, cfg.Neo4jPass)
+	if err != nil {
+		logger.Fatalf("neo4j connection: %v", err)
+	}
+	defer neo4jDriver.Close(ctx)
+
+	svc := ingestion.NewService(pgPool, neo4jDriver, nil, logger.Logger, cfg.Embeddings.Dimension)
+	count, err := svc.BackfillTopics(ctx)
+	if err != nil {
+		logger.Fatalf("backfill topics: %v", err)
+	}
+	logger.Printf("backfilled the topics of %d documents", count)
+}
+
+func serveCmd(cfg config.Config, logger cliLogger, args []string) {
 	flags := flag.NewFlagSet("serve", flag.ExitOnError)
 	addr := flags.String("addr", ":8080", "address to bind the HTTP API server")
 	if err := flags.Parse(args); err != nil {
@@ -307,7 +755,7 @@ func serveCmd(cfg config.Config, logger *log.Logger, args []string) {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	server, cleanup, err := api.New(cfg, logger)
+	server, cleanup, err := api.New(cfg, logger.Logger)
 	if err != nil {
 		logger.Fatalf("initialize server: %v", err)
 	}
@@ -351,6 +799,11 @@ func printUsage() {
 	fmt.Println("  chat     Query the agent using the ingested knowledge base")
 	fmt.Println("  clear    Remove ingested data from Postgres/Neo4j")
 	fmt.Println("  serve    Start the HTTP API exposing ingest/chat/clear")
+	fmt.Println("  embed-cache  Report or prune (--prune) cached chunk embeddings")
+	fmt.Println("  reembed  Backfill an embedding space with another model (--space, --activate)")
+	fmt.Println("  spaces   List embedding spaces or switch the searched one (--activate)")
+	fmt.Println("  reindex  Rebuild the vector index of an embedding space (--space, --lists)")
+	fmt.Println("  backfill-topics  Copy document topics from Neo4j to Postgres for topic filters")
 }
 
 type multiFlag struct {
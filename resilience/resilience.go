@@ -0,0 +1,271 @@
+// Package resilience provides retries with jittered exponential backoff,
+// per-call timeouts and circuit breaking for calls to model providers.
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/fabfab/go-agent/config"
+)
+
+// ErrCircuitOpen is returned without calling the provider while the circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Policy configures an Executor. Zero values disable the corresponding
+// behaviour: no retries, no per-call timeout and no circuit breaker.
+type Policy struct {
+	// MaxRetries is the number of additional attempts after the first.
+	MaxRetries int
+	// BaseDelay is the backoff before the first retry. It doubles on every
+	// retry up to MaxDelay, and each wait is jittered.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Timeout bounds each attempt. Streams started with DoStream are only
+	// bounded until their first chunk.
+	Timeout time.Duration
+	// BreakerThreshold is the number of consecutive retryable failures that
+	// opens the circuit, which then rejects calls for BreakerCooldown before
+	// letting a single trial call through.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// FromConfig converts the environment configuration into a Policy.
+func FromConfig(cfg config.ResilienceConfig) Policy {
+	return Policy{
+		MaxRetries:       cfg.MaxRetries,
+		BaseDelay:        cfg.BaseDelay,
+		MaxDelay:         cfg.MaxDelay,
+		Timeout:          cfg.Timeout,
+		BreakerThreshold: cfg.BreakerThreshold,
+		BreakerCooldown:  cfg.BreakerCooldown,
+	}
+}
+
+// Enabled reports whether the policy changes call behaviour at all.
+func (p Policy) Enabled() bool {
+	return p.MaxRetries > 0 || p.Timeout > 0 || p.BreakerThreshold > 0
+}
+
+// Executor runs calls under a Policy. The circuit breaker state is shared by
+// every call made through the same Executor, so one Executor should guard one
+// provider.
+type Executor struct {
+	policy  Policy
+	breaker *breaker
+}
+
+// NewExecutor returns an Executor for policy.
+func NewExecutor(policy Policy) *Executor {
+	exec := &Executor{policy: policy}
+	if policy.BreakerThreshold > 0 {
+		exec.breaker = &breaker{threshold: policy.BreakerThreshold, cooldown: policy.BreakerCooldown}
+	}
+	return exec
+}
+
+// Do calls fn until it succeeds, returns a non-retryable error, or the retry
+// budget is spent. Each attempt receives a context bounded by the policy
+// timeout. Errors wrapped with Permanent are returned without retrying.
+func (e *Executor) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	return e.do(ctx, func(ctx context.Context) error {
+		return e.attempt(ctx, fn)
+	})
+}
+
+// DoStream is Do for streaming calls. The policy timeout bounds each attempt
+// only until fn calls started, which it does when the first chunk arrives, so
+// that long but healthy streams are not cut off.
+func (e *Executor) DoStream(ctx context.Context, fn func(ctx context.Context, started func()) error) error {
+	return e.do(ctx, func(ctx context.Context) error {
+		return e.attemptStream(ctx, fn)
+	})
+}
+
+func (e *Executor) do(ctx context.Context, call func(ctx context.Context) error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if e.breaker != nil && !e.breaker.allow() {
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrCircuitOpen, err)
+			}
+			return ErrCircuitOpen
+		}
+
+		err = call(ctx)
+		if err == nil {
+			e.record(nil)
+			return nil
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			e.record(permanent.err)
+			return permanent.err
+		}
+		if ctx.Err() != nil {
+			// The caller gave up, which says nothing about the provider.
+			e.release()
+			return err
+		}
+		if !Retryable(err) {
+			e.record(nil)
+			return err
+		}
+		e.record(err)
+		if attempt >= e.policy.MaxRetries {
+			return err
+		}
+		if sleepErr := sleepContext(ctx, e.backoff(attempt)); sleepErr != nil {
+			return err
+		}
+	}
+}
+
+func (e *Executor) attempt(ctx context.Context, fn func(ctx context.Context) error) error {
+	if e.policy.Timeout <= 0 {
+		return fn(ctx)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, e.policy.Timeout)
+	defer cancel()
+	return fn(callCtx)
+}
+
+func (e *Executor) attemptStream(ctx context.Context, fn func(ctx context.Context, started func()) error) error {
+	if e.policy.Timeout <= 0 {
+		return fn(ctx, func() {})
+	}
+	callCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	timer := time.AfterFunc(e.policy.Timeout, func() { cancel(context.DeadlineExceeded) })
+	defer timer.Stop()
+
+	err := fn(callCtx, func() { timer.Stop() })
+	if err != nil && ctx.Err() == nil && errors.Is(context.Cause(callCtx), context.DeadlineExceeded) {
+		// The provider sees a plain cancellation, which is not retryable.
+		return fmt.Errorf("no first chunk within %s: %w", e.policy.Timeout, context.DeadlineExceeded)
+	}
+	return err
+}
+
+// record updates the breaker. Only retryable errors count as provider
+// failures; a nil or client error closes the circuit.
+func (e *Executor) record(err error) {
+	if e.breaker == nil {
+		return
+	}
+	if err != nil && Retryable(err) {
+		e.breaker.failure()
+		return
+	}
+	e.breaker.success()
+}
+
+// release ends a trial call without an outcome, so that the next call may
+// try again.
+func (e *Executor) release() {
+	if e.breaker != nil {
+		e.breaker.release()
+	}
+}
+
+// backoff returns the jittered delay before retry number attempt+1: a random
+// duration between half and all of BaseDelay*2^attempt, capped at MaxDelay.
+func (e *Executor) backoff(attempt int) time.Duration {
+	delay := e.policy.BaseDelay
+	if delay <= 0 {
+		return 0
+	}
+	for i := 0; i < attempt && (e.policy.MaxDelay <= 0 || delay < e.policy.MaxDelay); i++ {
+		delay *= 2
+	}
+	if e.policy.MaxDelay > 0 && delay > e.policy.MaxDelay {
+		delay = e.policy.MaxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err so that Executor.Do returns it without retrying. Stream
+// wrappers use it once output has been delivered to the caller.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// allow reports whether a call may proceed. Once the cooldown has elapsed a
+// single trial call is let through; its outcome closes or re-opens the
+// circuit.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.trial || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trial = false
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.trial = false
+}
+
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
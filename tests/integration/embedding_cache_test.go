@@ -0,0 +1,72 @@
+package integration_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/database"
+	"github.com/fabfab/go-agent/embeddings"
+)
+
+func TestPostgresEmbeddingCacheRoundTrip(t *testing.T) {
+	if os.Getenv("RUN_DB_INTEGRATION_TESTS") != "1" {
+		t.Skip("set RUN_DB_INTEGRATION_TESTS=1 to run database connectivity checks")
+	}
+
+	cfg := config.Load()
+	ctx := context.Background()
+
+	pool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		t.Fatalf("postgres connection: %v", err)
+	}
+	defer pool.Close()
+
+	if err := database.EnsureEmbeddingCacheSchema(ctx, pool); err != nil {
+		t.Fatalf("ensure schema: %v", err)
+	}
+
+	fp := embeddings.Fingerprint{Provider: "test", Model: "cache-roundtrip", Dimension: 3}
+	t.Cleanup(func() {
+		_, _ = pool.Exec(ctx, "DELETE FROM embedding_cache WHERE provider = $1 AND model = $2", fp.Provider, fp.Model)
+	})
+
+	cache := embeddings.NewPostgresCache(pool)
+	hash := embeddings.TextHash("cached chunk")
+	if err := cache.Put(ctx, fp, map[string][]float32{hash: {0.1, 0.2, 0.3}}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	found, err := cache.Get(ctx, fp, []string{hash, embeddings.TextHash("missing chunk")})
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if len(found) != 1 || len(found[hash]) != 3 {
+		t.Fatalf("expected one cached vector, got %v", found)
+	}
+
+	other := fp
+	other.Dimension = 4
+	if found, err := cache.Get(ctx, other, []string{hash}); err != nil || len(found) != 0 {
+		t.Fatalf("expected no hit for another fingerprint, got %v (%v)", found, err)
+	}
+
+	templated := fp
+	templated.Template = "passage: "
+	if err := cache.Put(ctx, templated, map[string][]float32{hash: {0.3, 0.2, 0.1}}); err != nil {
+		t.Fatalf("put templated: %v", err)
+	}
+	if found, err := cache.Get(ctx, fp, []string{hash}); err != nil || found[hash][0] != 0.1 {
+		t.Fatalf("expected the template to keep vectors apart, got %v (%v)", found, err)
+	}
+
+	// Running the schema again, as every start does, keeps the entries.
+	if err := database.EnsureEmbeddingCacheSchema(ctx, pool); err != nil {
+		t.Fatalf("ensure schema again: %v", err)
+	}
+	if found, err := cache.Get(ctx, templated, []string{hash}); err != nil || len(found) != 1 {
+		t.Fatalf("expected the templated entry to survive, got %v (%v)", found, err)
+	}
+}
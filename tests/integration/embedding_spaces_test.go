@@ -0,0 +1,182 @@
+package integration_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+
+	"github.com/fabfab/go-agent/chat"
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/database"
+	"github.com/fabfab/go-agent/embeddings"
+	"github.com/fabfab/go-agent/ingestion"
+)
+
+// TestReembedIntoNewSpace backfills a space of another dimension with the
+// local provider and searches it while it is still inactive.
+func TestReembedIntoNewSpace(t *testing.T) {
+	if os.Getenv("RUN_DB_INTEGRATION_TESTS") != "1" {
+		t.Skip("set RUN_DB_INTEGRATION_TESTS=1 to run database connectivity checks")
+	}
+
+	cfg := config.Load()
+	ctx := context.Background()
+
+	pool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		t.Fatalf("postgres connection: %v", err)
+	}
+	defer pool.Close()
+
+	driver, err := database.NewNeo4jDriver(ctx, cfg.Neo4jURI, cfg.Neo4jUser, cfg.Neo4jPass)
+	if err != nil {
+		t.Fatalf("neo4j connection: %v", err)
+	}
+	defer driver.Close(ctx)
+
+	space := database.EmbeddingSpace{Name: "it_local_256", Provider: config.ProviderLocal, Model: "hash", Dimension: 256}
+	const rel = "spaces-e2e/pilots.md"
+	cleanup := func() {
+		_, _ = pool.Exec(ctx, "DELETE FROM rag_documents WHERE source_path = $1", rel)
+		_, _ = pool.Exec(ctx, "DROP TABLE IF EXISTS "+space.Table())
+		_, _ = pool.Exec(ctx, "DELETE FROM rag_embedding_spaces WHERE name = $1", space.Name)
+		session := driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+		defer session.Close(ctx)
+		_, _ = session.Run(ctx, "MATCH (d:Document {path: $path}) DETACH DELETE d", map[string]any{"path": rel})
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+
+	root := t.TempDir()
+	path := filepath.Join(root, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("create doc dir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("# Pilot Programme\n\n## Adoption\n\nOur adoption strategy starts with pilot teams who trial the platform."), 0o644); err != nil {
+		t.Fatalf("write doc: %v", err)
+	}
+
+	logger := log.New(io.Discard, "", 0)
+	defaultEmbedder, err := embeddings.NewLocalEmbedder(embeddings.Options{Dimension: cfg.Embeddings.Dimension})
+	if err != nil {
+		t.Fatalf("local embedder: %v", err)
+	}
+	if err := ingestion.NewService(pool, driver, defaultEmbedder, logger, cfg.Embeddings.Dimension).IngestDirectory(ctx, root); err != nil {
+		t.Fatalf("ingest: %v", err)
+	}
+
+	spaceEmbedder, err := embeddings.NewLocalEmbedder(embeddings.Options{Dimension: space.Dimension})
+	if err != nil {
+		t.Fatalf("local embedder: %v", err)
+	}
+	reembed := ingestion.NewService(pool, nil, spaceEmbedder, logger, space.Dimension, ingestion.WithEmbeddingSpace(space))
+	if _, err := reembed.Reembed(ctx, 2, nil); err != nil {
+		t.Fatalf("reembed: %v", err)
+	}
+	// A second run has nothing left to embed.
+	if done, err := reembed.Reembed(ctx, 2, nil); err != nil || done != 0 {
+		t.Fatalf("expected resumed reembed to be a no-op, got %d, %v", done, err)
+	}
+
+	registered, found, err := database.GetEmbeddingSpace(ctx, pool, space.Name)
+	if err != nil || !found {
+		t.Fatalf("expected space to be registered, found=%v err=%v", found, err)
+	}
+	if registered.Active {
+		t.Fatal("expected a backfilled space to stay inactive until activated")
+	}
+
+	vectors, err := spaceEmbedder.Embed(ctx, []string{"adoption strategy with pilot teams"})
+	if err != nil {
+		t.Fatalf("embed query: %v", err)
+	}
+	store := chat.NewPostgresVectorStore(pool, chat.WithSpace(space.Name))
+	chunks, err := store.SimilarChunks(ctx, vectors[0], 50, chat.Filter{})
+	if err != nil {
+		t.Fatalf("search space: %v", err)
+	}
+	for _, chunk := range chunks {
+		if chunk.Path == rel {
+			return
+		}
+	}
+	t.Fatalf("expected %s among space results, got %+v", rel, chunks)
+}
+
+// TestEmbeddingSpaceRefusesOtherModel checks that a space holding vectors is
+// only taken over by another model when migrating, which discards them.
+func TestEmbeddingSpaceRefusesOtherModel(t *testing.T) {
+	if os.Getenv("RUN_DB_INTEGRATION_TESTS") != "1" {
+		t.Skip("set RUN_DB_INTEGRATION_TESTS=1 to run database connectivity checks")
+	}
+
+	cfg := config.Load()
+	ctx := context.Background()
+
+	pool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		t.Fatalf("postgres connection: %v", err)
+	}
+	defer pool.Close()
+
+	driver, err := database.NewNeo4jDriver(ctx, cfg.Neo4jURI, cfg.Neo4jUser, cfg.Neo4jPass)
+	if err != nil {
+		t.Fatalf("neo4j connection: %v", err)
+	}
+	defer driver.Close(ctx)
+
+	space := database.EmbeddingSpace{Name: "it_guard", Provider: config.ProviderLocal, Model: "hash", Dimension: 64}
+	const rel = "spaces-guard/pilots.md"
+	cleanup := func() {
+		_, _ = pool.Exec(ctx, "DELETE FROM rag_documents WHERE source_path = $1", rel)
+		_, _ = pool.Exec(ctx, "DROP TABLE IF EXISTS "+space.Table())
+		_, _ = pool.Exec(ctx, "DELETE FROM rag_embedding_spaces WHERE name = $1", space.Name)
+		session := driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+		defer session.Close(ctx)
+		_, _ = session.Run(ctx, "MATCH (d:Document {path: $path}) DETACH DELETE d", map[string]any{"path": rel})
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+
+	root := t.TempDir()
+	path := filepath.Join(root, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("create doc dir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("# Pilots\n\nPilot teams trial the platform first."), 0o644); err != nil {
+		t.Fatalf("write doc: %v", err)
+	}
+
+	embedder, err := embeddings.NewLocalEmbedder(embeddings.Options{Dimension: space.Dimension})
+	if err != nil {
+		t.Fatalf("local embedder: %v", err)
+	}
+	logger := log.New(io.Discard, "", 0)
+	ingest := ingestion.NewService(pool, driver, embedder, logger, cfg.Embeddings.Dimension, ingestion.WithEmbeddingSpace(space))
+	if err := ingest.IngestDirectory(ctx, root); err != nil {
+		t.Fatalf("ingest: %v", err)
+	}
+
+	other := space
+	other.Model = "hash-v2"
+	if _, err := database.EnsureEmbeddingSpace(ctx, pool, other, database.SpaceOptions{}); !errors.Is(err, embeddings.ErrFingerprintMismatch) {
+		t.Fatalf("expected a fingerprint mismatch, got %v", err)
+	}
+
+	migrated, err := database.EnsureEmbeddingSpace(ctx, pool, other, database.SpaceOptions{Migrate: true})
+	if err != nil {
+		t.Fatalf("migrate space: %v", err)
+	}
+	if migrated.Model != other.Model {
+		t.Fatalf("expected the space to record %s, got %s", other.Model, migrated.Model)
+	}
+	if embedded, _, err := database.CountSpaceEmbeddings(ctx, pool, migrated); err != nil || embedded != 0 {
+		t.Fatalf("expected migration to discard the old vectors, got %d, %v", embedded, err)
+	}
+}
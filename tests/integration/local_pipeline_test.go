@@ -0,0 +1,173 @@
+package integration_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+
+	"github.com/fabfab/go-agent/chat"
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/database"
+	"github.com/fabfab/go-agent/embeddings"
+	"github.com/fabfab/go-agent/ingestion"
+	"github.com/fabfab/go-agent/llm"
+)
+
+// TestLocalEmbeddingPipeline ingests and queries documents with the local
+// embedding provider, so it needs the databases but no model server.
+func TestLocalEmbeddingPipeline(t *testing.T) {
+	if os.Getenv("RUN_DB_INTEGRATION_TESTS") != "1" {
+		t.Skip("set RUN_DB_INTEGRATION_TESTS=1 to run database connectivity checks")
+	}
+
+	cfg := config.Load()
+	cfg.Embeddings.Provider = config.ProviderLocal
+	cfg.Embeddings.Fallbacks = nil
+	cfg.Embeddings.Cassette = ""
+	ctx := context.Background()
+
+	pool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		t.Fatalf("postgres connection: %v", err)
+	}
+	defer pool.Close()
+
+	driver, err := database.NewNeo4jDriver(ctx, cfg.Neo4jURI, cfg.Neo4jUser, cfg.Neo4jPass)
+	if err != nil {
+		t.Fatalf("neo4j connection: %v", err)
+	}
+	defer driver.Close(ctx)
+
+	embedder, err := embeddings.NewEmbedder(cfg)
+	if err != nil {
+		t.Fatalf("local embedder: %v", err)
+	}
+
+	root := t.TempDir()
+	docs := map[string]string{
+		"local-e2e/pilots.md":  "# Pilot Programme\n\n## Adoption\n\nOur adoption strategy starts with pilot teams who trial the platform.",
+		"local-e2e/revenue.md": "# Revenue\n\n## Retail\n\nQuarterly revenue grew in the retail segment thanks to seasonal demand.",
+	}
+	paths := make([]string, 0, len(docs))
+	for rel, content := range docs {
+		path := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("create doc dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write doc: %v", err)
+		}
+		paths = append(paths, rel)
+	}
+
+	cleanup := func() {
+		_, _ = pool.Exec(ctx, "DELETE FROM rag_documents WHERE source_path = ANY($1)", paths)
+		session := driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+		defer session.Close(ctx)
+		_, _ = session.Run(ctx, "MATCH (d:Document) WHERE d.path IN $paths DETACH DELETE d", map[string]any{"paths": paths})
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+
+	logger := log.New(io.Discard, "", 0)
+	ingest := ingestion.NewService(pool, driver, embedder, logger, cfg.Embeddings.Dimension)
+	if err := ingest.IngestDirectory(ctx, root); err != nil {
+		t.Fatalf("ingest: %v", err)
+	}
+
+	svc := chat.NewService(chat.NewPostgresVectorStore(pool), chat.NewNeo4jGraphStore(driver), embedder, &fixedLLM{answer: "Start with pilot teams."}, logger)
+	resp, err := svc.Chat(ctx, "What is our adoption strategy with pilot teams?", chat.Config{SimilarityLimit: 5})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+
+	for _, source := range resp.Sources {
+		if source.Path == "local-e2e/pilots.md" {
+			return
+		}
+	}
+	t.Fatalf("expected the pilot document among the sources, got %+v", resp.Sources)
+}
+
+// TestBackfillTopicsFromGraph drops the Postgres copy of a document's topics
+// and checks that the backfill restores it from Neo4j.
+func TestBackfillTopicsFromGraph(t *testing.T) {
+	if os.Getenv("RUN_DB_INTEGRATION_TESTS") != "1" {
+		t.Skip("set RUN_DB_INTEGRATION_TESTS=1 to run database connectivity checks")
+	}
+
+	cfg := config.Load()
+	cfg.Embeddings.Provider = config.ProviderLocal
+	cfg.Embeddings.Fallbacks = nil
+	cfg.Embeddings.Cassette = ""
+	ctx := context.Background()
+
+	pool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		t.Fatalf("postgres connection: %v", err)
+	}
+	defer pool.Close()
+
+	driver, err := database.NewNeo4jDriver(ctx, cfg.Neo4jURI, cfg.Neo4jUser, cfg.Neo4jPass)
+	if err != nil {
+		t.Fatalf("neo4j connection: %v", err)
+	}
+	defer driver.Close(ctx)
+
+	embedder, err := embeddings.NewEmbedder(cfg)
+	if err != nil {
+		t.Fatalf("local embedder: %v", err)
+	}
+
+	const rel = "topics-backfill/onboarding.md"
+	cleanup := func() {
+		_, _ = pool.Exec(ctx, "DELETE FROM rag_documents WHERE source_path = $1", rel)
+		session := driver.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+		defer session.Close(ctx)
+		_, _ = session.Run(ctx, "MATCH (d:Document {path: $path}) DETACH DELETE d", map[string]any{"path": rel})
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+
+	root := t.TempDir()
+	path := filepath.Join(root, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("create doc dir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("# Onboarding\n\n## Mentors\n\nEvery new hire is paired with a mentor."), 0o644); err != nil {
+		t.Fatalf("write doc: %v", err)
+	}
+
+	logger := log.New(io.Discard, "", 0)
+	ingest := ingestion.NewService(pool, driver, embedder, logger, cfg.Embeddings.Dimension)
+	if err := ingest.IngestDirectory(ctx, root); err != nil {
+		t.Fatalf("ingest: %v", err)
+	}
+	if _, err := pool.Exec(ctx, "DELETE FROM rag_document_topics WHERE document_id = (SELECT id FROM rag_documents WHERE source_path = $1)", rel); err != nil {
+		t.Fatalf("drop topics: %v", err)
+	}
+
+	if _, err := ingest.BackfillTopics(ctx); err != nil {
+		t.Fatalf("backfill topics: %v", err)
+	}
+	var count int
+	if err := pool.QueryRow(ctx, "SELECT COUNT(*) FROM rag_document_topics t JOIN rag_documents d ON d.id = t.document_id WHERE d.source_path = $1", rel).Scan(&count); err != nil {
+		t.Fatalf("count topics: %v", err)
+	}
+	if count == 0 {
+		t.Fatal("expected the backfill to restore the document's topics")
+	}
+}
+
+type fixedLLM struct {
+	answer string
+}
+
+func (f *fixedLLM) Generate(context.Context, []llm.Message) (string, error) {
+	return f.answer, nil
+}
@@ -0,0 +1,205 @@
+package integration_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pgvector/pgvector-go"
+
+	"github.com/fabfab/go-agent/chat"
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/database"
+)
+
+// TestVectorIndexFollowsSettings builds the index of a small space with
+// several settings and searches it by cosine distance.
+func TestVectorIndexFollowsSettings(t *testing.T) {
+	if os.Getenv("RUN_DB_INTEGRATION_TESTS") != "1" {
+		t.Skip("set RUN_DB_INTEGRATION_TESTS=1 to run database connectivity checks")
+	}
+
+	cfg := config.Load()
+	ctx := context.Background()
+
+	pool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		t.Fatalf("postgres connection: %v", err)
+	}
+	defer pool.Close()
+
+	if err := database.EnsureRAGSchema(ctx, pool, cfg.Embeddings.Dimension); err != nil {
+		t.Fatalf("ensure schema: %v", err)
+	}
+
+	space := database.EmbeddingSpace{Name: "it_index", Provider: config.ProviderLocal, Model: "hash", Dimension: 3}
+	docID := uuid.New()
+	cleanup := func() {
+		_, _ = pool.Exec(ctx, "DELETE FROM rag_documents WHERE source_path = 'test/index.md'")
+		_, _ = pool.Exec(ctx, "DROP TABLE IF EXISTS "+space.Table())
+		_, _ = pool.Exec(ctx, "DELETE FROM rag_embedding_spaces WHERE name = $1", space.Name)
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+
+	if _, err := database.EnsureEmbeddingSpace(ctx, pool, space, database.SpaceOptions{}); err != nil {
+		t.Fatalf("ensure space: %v", err)
+	}
+	if _, err := pool.Exec(ctx, "INSERT INTO rag_documents (id, source_path, title, sha256) VALUES ($1, 'test/index.md', 'Index', 'hash-index')", docID); err != nil {
+		t.Fatalf("insert document: %v", err)
+	}
+	near, far := uuid.New(), uuid.New()
+	if _, err := pool.Exec(ctx, "INSERT INTO rag_chunks (id, document_id, chunk_index, content) VALUES ($1, $3, 0, 'near'), ($2, $3, 1, 'far')", near, far, docID); err != nil {
+		t.Fatalf("insert chunks: %v", err)
+	}
+	// By L2 distance the far vector is nearer [1, 0, 0]; by cosine it is not.
+	if _, err := pool.Exec(ctx, "INSERT INTO "+space.Table()+" (chunk_id, embedding) VALUES ($1, $2), ($3, $4)",
+		near, pgvector.NewVector([]float32{5, 0.5, 0}), far, pgvector.NewVector([]float32{0.5, 1, 0})); err != nil {
+		t.Fatalf("insert vectors: %v", err)
+	}
+
+	indexDef := func() string {
+		var def string
+		if err := pool.QueryRow(ctx, "SELECT indexdef FROM pg_indexes WHERE indexname = $1", database.VectorIndexName(space.Table())).Scan(&def); err != nil {
+			t.Fatalf("load index definition: %v", err)
+		}
+		return def
+	}
+
+	cosine := config.VectorIndexConfig{Type: config.IndexHNSW, Metric: config.MetricCosine, M: 8, EfConstruction: 32}
+	if err := database.EnsureVectorIndex(ctx, pool, space.Table(), cosine); err != nil {
+		t.Fatalf("ensure hnsw index: %v", err)
+	}
+	if def := indexDef(); !strings.Contains(def, "hnsw") || !strings.Contains(def, "vector_cosine_ops") || !strings.Contains(def, "m='8'") {
+		t.Fatalf("unexpected hnsw index: %s", def)
+	}
+
+	store := chat.NewPostgresVectorStore(pool, chat.WithSpace(space.Name), chat.WithVectorIndex(cosine))
+	results, err := store.SimilarChunks(ctx, []float32{1, 0, 0}, 2, chat.Filter{})
+	if err != nil {
+		t.Fatalf("cosine search: %v", err)
+	}
+	if len(results) != 2 || results[0].ChunkID != near.String() {
+		t.Fatalf("expected the chunk pointing the same way first, got %+v", results)
+	}
+	if math.Abs(results[0].Score-0.995) > 0.01 {
+		t.Fatalf("expected the cosine similarity as score, got %f", results[0].Score)
+	}
+
+	ivfflat := config.VectorIndexConfig{Type: config.IndexIVFFlat, Metric: config.MetricCosine}
+	if err := database.EnsureVectorIndex(ctx, pool, space.Table(), ivfflat); !errors.Is(err, database.ErrVectorIndexMismatch) {
+		t.Fatalf("expected the changed settings to be reported, got %v", err)
+	}
+	if def := indexDef(); !strings.Contains(def, "hnsw") {
+		t.Fatalf("expected the hnsw index to be kept until a rebuild, got %s", def)
+	}
+
+	description, err := database.RebuildVectorIndex(ctx, pool, space.Table(), ivfflat)
+	if err != nil {
+		t.Fatalf("rebuild ivfflat index: %v", err)
+	}
+	if description != "ivfflat vector_cosine_ops lists=1" {
+		t.Fatalf("unexpected rebuilt index %q", description)
+	}
+	if def := indexDef(); !strings.Contains(def, "ivfflat") {
+		t.Fatalf("expected the index to be rebuilt as ivfflat, got %s", def)
+	}
+	if err := database.EnsureVectorIndex(ctx, pool, space.Table(), ivfflat); err != nil {
+		t.Fatalf("expected the rebuilt index to match, got %v", err)
+	}
+
+	// Indexes built before their settings were recorded are compared on
+	// their type and operator class.
+	if _, err := pool.Exec(ctx, "COMMENT ON INDEX "+database.VectorIndexName(space.Table())+" IS NULL"); err != nil {
+		t.Fatalf("drop index comment: %v", err)
+	}
+	if err := database.CheckVectorIndex(ctx, pool, space.Table(), ivfflat); err != nil {
+		t.Fatalf("expected the unrecorded ivfflat index to match, got %v", err)
+	}
+	if err := database.CheckVectorIndex(ctx, pool, space.Table(), cosine); !errors.Is(err, database.ErrVectorIndexMismatch) {
+		t.Fatalf("expected the unrecorded ivfflat index to differ from hnsw, got %v", err)
+	}
+}
+
+// TestFilteredVectorSearchFillsTheLimit checks that a filter matching only
+// chunks far from the query still returns limit results when the space is
+// large enough for the planner to use its vector index.
+func TestFilteredVectorSearchFillsTheLimit(t *testing.T) {
+	if os.Getenv("RUN_DB_INTEGRATION_TESTS") != "1" {
+		t.Skip("set RUN_DB_INTEGRATION_TESTS=1 to run database connectivity checks")
+	}
+
+	cfg := config.Load()
+	ctx := context.Background()
+
+	pool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		t.Fatalf("postgres connection: %v", err)
+	}
+	defer pool.Close()
+
+	if err := database.EnsureRAGSchema(ctx, pool, cfg.Embeddings.Dimension); err != nil {
+		t.Fatalf("ensure schema: %v", err)
+	}
+
+	space := database.EmbeddingSpace{Name: "it_filtered", Provider: config.ProviderLocal, Model: "hash", Dimension: 3}
+	paths := []string{"test/filtered/noise.md", "test/filtered/target.md"}
+	cleanup := func() {
+		_, _ = pool.Exec(ctx, "DELETE FROM rag_documents WHERE source_path = ANY($1)", paths)
+		_, _ = pool.Exec(ctx, "DROP TABLE IF EXISTS "+space.Table())
+		_, _ = pool.Exec(ctx, "DELETE FROM rag_embedding_spaces WHERE name = $1", space.Name)
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+
+	if _, err := database.EnsureEmbeddingSpace(ctx, pool, space, database.SpaceOptions{}); err != nil {
+		t.Fatalf("ensure space: %v", err)
+	}
+	noise, target := uuid.New(), uuid.New()
+	if _, err := pool.Exec(ctx, "INSERT INTO rag_documents (id, source_path, title, sha256) VALUES ($1, $2, 'Noise', 'hash-noise'), ($3, $4, 'Target', 'hash-target')",
+		noise, paths[0], target, paths[1]); err != nil {
+		t.Fatalf("insert documents: %v", err)
+	}
+	// Thousands of noise chunks point at the query; the five target chunks
+	// point away from it, beyond any candidate list the index scan returns.
+	if _, err := pool.Exec(ctx, `
+		INSERT INTO rag_chunks (id, document_id, chunk_index, content)
+		SELECT gen_random_uuid(), CASE WHEN i <= 5 THEN $2::uuid ELSE $1::uuid END, i, 'chunk ' || i
+		FROM generate_series(1, 5000) AS i
+	`, noise, target); err != nil {
+		t.Fatalf("insert chunks: %v", err)
+	}
+	if _, err := pool.Exec(ctx, `
+		INSERT INTO `+space.Table()+` (chunk_id, embedding)
+		SELECT id, CASE WHEN document_id = $1 THEN '[0, 1, 0]'::vector ELSE ('[1, ' || (chunk_index % 100) / 1000.0 || ', 0]')::vector END
+		FROM rag_chunks WHERE document_id = ANY($2)
+	`, target, []uuid.UUID{noise, target}); err != nil {
+		t.Fatalf("insert vectors: %v", err)
+	}
+
+	index := config.VectorIndexConfig{Type: config.IndexHNSW, Metric: config.MetricCosine, M: 8, EfConstruction: 32, EfSearch: 10}
+	if err := database.EnsureVectorIndex(ctx, pool, space.Table(), index); err != nil {
+		t.Fatalf("ensure hnsw index: %v", err)
+	}
+	if _, err := pool.Exec(ctx, "ANALYZE "+space.Table()); err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+
+	store := chat.NewPostgresVectorStore(pool, chat.WithSpace(space.Name), chat.WithVectorIndex(index))
+	results, err := store.SimilarChunks(ctx, []float32{1, 0, 0}, 5, chat.Filter{DocumentIDs: []string{target.String()}})
+	if err != nil {
+		t.Fatalf("filtered search: %v", err)
+	}
+	if len(results) != 5 {
+		t.Fatalf("expected the five target chunks, got %d", len(results))
+	}
+	for _, result := range results {
+		if result.DocumentID != target.String() {
+			t.Fatalf("expected only target chunks, got %+v", result)
+		}
+	}
+}
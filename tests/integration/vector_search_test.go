@@ -76,7 +76,7 @@ func TestVectorSearchRanking(t *testing.T) {
 
 	store := chat.NewPostgresVectorStore(pool)
 
-	results, err := store.SimilarChunks(ctx, makeVector(0.9), 2)
+	results, err := store.SimilarChunks(ctx, makeVector(0.9), 2, chat.Filter{})
 	if err != nil {
 		t.Fatalf("vector search: %v", err)
 	}
@@ -92,4 +92,192 @@ func TestVectorSearchRanking(t *testing.T) {
 	if results[0].Score <= results[1].Score {
 		t.Fatalf("expected first score to be higher, got %f <= %f", results[0].Score, results[1].Score)
 	}
+
+	if want := makeVector(1.0); len(results[0].Embedding) != len(want) || results[0].Embedding[0] != want[0] {
+		t.Fatalf("expected the stored embedding to be returned, got %d dimensions", len(results[0].Embedding))
+	}
+}
+
+func TestLexicalSearchMatchesIdentifiers(t *testing.T) {
+	if os.Getenv("RUN_DB_INTEGRATION_TESTS") != "1" {
+		t.Skip("set RUN_DB_INTEGRATION_TESTS=1 to run database connectivity checks")
+	}
+
+	cfg := config.Load()
+	ctx := context.Background()
+
+	pool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		t.Fatalf("postgres connection: %v", err)
+	}
+	defer pool.Close()
+
+	if err := database.EnsureRAGSchema(ctx, pool, cfg.Embeddings.Dimension); err != nil {
+		t.Fatalf("ensure schema: %v", err)
+	}
+
+	docID := uuid.New()
+	chunkCode, chunkOther := uuid.New(), uuid.New()
+	if _, err := pool.Exec(ctx, "DELETE FROM rag_documents WHERE source_path = $1", "test/lexical.md"); err != nil {
+		t.Fatalf("cleanup documents: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = pool.Exec(ctx, "DELETE FROM rag_documents WHERE id = $1", docID)
+	})
+
+	if _, err := pool.Exec(ctx, `
+        INSERT INTO rag_documents (id, source_path, title, sha256) VALUES ($1, 'test/lexical.md', 'Lexical', 'hash-lexical')
+    `, docID); err != nil {
+		t.Fatalf("insert document: %v", err)
+	}
+	if _, err := pool.Exec(ctx, `
+        INSERT INTO rag_chunks (id, document_id, chunk_index, content)
+        VALUES ($1, $3, 0, 'The gateway returns E4711 when the upstream TLS handshake fails.'),
+               ($2, $3, 1, 'Retries back off exponentially between attempts.')
+    `, chunkCode, chunkOther, docID); err != nil {
+		t.Fatalf("insert chunks: %v", err)
+	}
+
+	results, err := chat.NewPostgresVectorStore(pool).LexicalChunks(ctx, "What does error E4711 mean?", 5, chat.Filter{})
+	if err != nil {
+		t.Fatalf("lexical search: %v", err)
+	}
+	if len(results) == 0 || results[0].ChunkID != chunkCode.String() {
+		t.Fatalf("expected the chunk mentioning E4711 first, got %+v", results)
+	}
+	for _, result := range results {
+		if result.ChunkID == chunkOther.String() {
+			t.Fatalf("expected the unrelated chunk to be excluded, got %+v", results)
+		}
+	}
+}
+
+func TestVectorSearchFilters(t *testing.T) {
+	if os.Getenv("RUN_DB_INTEGRATION_TESTS") != "1" {
+		t.Skip("set RUN_DB_INTEGRATION_TESTS=1 to run database connectivity checks")
+	}
+
+	cfg := config.Load()
+	ctx := context.Background()
+
+	pool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		t.Fatalf("postgres connection: %v", err)
+	}
+	defer pool.Close()
+
+	dim := cfg.Embeddings.Dimension
+	if err := database.EnsureRAGSchema(ctx, pool, dim); err != nil {
+		t.Fatalf("ensure schema: %v", err)
+	}
+
+	paths := []string{"test/filters/guides/onboarding.md", "test/filters/notes/release.md"}
+	docGuide, docNotes := uuid.New(), uuid.New()
+	chunkGuide, chunkNotes := uuid.New(), uuid.New()
+	if _, err := pool.Exec(ctx, "DELETE FROM rag_documents WHERE source_path = ANY($1)", paths); err != nil {
+		t.Fatalf("cleanup documents: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = pool.Exec(ctx, "DELETE FROM rag_documents WHERE id = ANY($1)", []uuid.UUID{docGuide, docNotes})
+	})
+
+	if _, err := pool.Exec(ctx, `
+        INSERT INTO rag_documents (id, source_path, title, sha256)
+        VALUES ($1, $2, 'Onboarding', 'hash-guide'), ($3, $4, 'Release notes', 'hash-notes')
+    `, docGuide, paths[0], docNotes, paths[1]); err != nil {
+		t.Fatalf("insert documents: %v", err)
+	}
+	if _, err := pool.Exec(ctx, "INSERT INTO rag_document_topics (document_id, topic) VALUES ($1, 'Onboarding')", docGuide); err != nil {
+		t.Fatalf("insert topics: %v", err)
+	}
+
+	makeVector := func(weight float32) []float32 {
+		vec := make([]float32, dim)
+		vec[0] = weight
+		return vec
+	}
+	// The notes chunk is nearest the query, so unfiltered searches return it
+	// first and a limit of one never reaches the guide.
+	if _, err := pool.Exec(ctx, `
+        INSERT INTO rag_chunks (id, document_id, chunk_index, section_order, section_title, content, embedding)
+        VALUES ($1, $2, 0, 0, NULL, 'Welcome aboard', $3),
+               ($4, $5, 0, 1, 'Changes', 'Version two', $6)
+    `, chunkGuide, docGuide, pgvector.NewVector(makeVector(0.2)), chunkNotes, docNotes, pgvector.NewVector(makeVector(1.0))); err != nil {
+		t.Fatalf("insert chunks: %v", err)
+	}
+
+	store := chat.NewPostgresVectorStore(pool)
+	cases := []struct {
+		name   string
+		filter chat.Filter
+		want   uuid.UUID
+	}{
+		{"topics", chat.Filter{Topics: []string{"onboard"}}, chunkGuide},
+		{"sections", chat.Filter{Sections: []string{"introduction"}}, chunkGuide},
+		{"folders", chat.Filter{Folders: []string{"test/filters/guides"}}, chunkGuide},
+		{"paths", chat.Filter{Paths: []string{"test/**/onboarding.md"}}, chunkGuide},
+		{"documents", chat.Filter{DocumentIDs: []string{docGuide.String()}}, chunkGuide},
+		{"combined", chat.Filter{Folders: []string{"test/filters"}, Sections: []string{"1"}}, chunkNotes},
+	}
+	for _, tc := range cases {
+		results, err := store.SimilarChunks(ctx, makeVector(1.0), 1, tc.filter)
+		if err != nil {
+			t.Fatalf("%s: vector search: %v", tc.name, err)
+		}
+		if len(results) != 1 || results[0].ChunkID != tc.want.String() {
+			t.Fatalf("%s: expected chunk %s, got %+v", tc.name, tc.want, results)
+		}
+	}
+
+	results, err := store.SimilarChunks(ctx, makeVector(1.0), 5, chat.Filter{Paths: []string{"test/*.md"}})
+	if err != nil {
+		t.Fatalf("paths: vector search: %v", err)
+	}
+	if len(results) != 0 {
+		t.Fatalf("expected * not to cross folders, got %+v", results)
+	}
+}
+
+func TestChunkRangeReadsNeighbors(t *testing.T) {
+	if os.Getenv("RUN_DB_INTEGRATION_TESTS") != "1" {
+		t.Skip("set RUN_DB_INTEGRATION_TESTS=1 to run database connectivity checks")
+	}
+
+	cfg := config.Load()
+	ctx := context.Background()
+
+	pool, err := database.NewPostgresPool(ctx, cfg.PostgresDSN)
+	if err != nil {
+		t.Fatalf("postgres connection: %v", err)
+	}
+	defer pool.Close()
+
+	if err := database.EnsureRAGSchema(ctx, pool, cfg.Embeddings.Dimension); err != nil {
+		t.Fatalf("ensure schema: %v", err)
+	}
+
+	docID := uuid.New()
+	if _, err := pool.Exec(ctx, "DELETE FROM rag_documents WHERE source_path = $1", "test/range.md"); err != nil {
+		t.Fatalf("cleanup documents: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = pool.Exec(ctx, "DELETE FROM rag_documents WHERE id = $1", docID)
+	})
+
+	if _, err := pool.Exec(ctx, "INSERT INTO rag_documents (id, source_path, title, sha256) VALUES ($1, 'test/range.md', 'Range', 'hash-range')", docID); err != nil {
+		t.Fatalf("insert document: %v", err)
+	}
+	for index := 0; index < 5; index++ {
+		if _, err := pool.Exec(ctx, "INSERT INTO rag_chunks (id, document_id, chunk_index, content) VALUES ($1, $2, $3, $4)", uuid.New(), docID, index, string(rune('a'+index))); err != nil {
+			t.Fatalf("insert chunk: %v", err)
+		}
+	}
+
+	chunks, err := chat.NewPostgresVectorStore(pool).ChunkRange(ctx, docID.String(), 1, 3)
+	if err != nil {
+		t.Fatalf("chunk range: %v", err)
+	}
+	if len(chunks) != 3 || chunks[0].Content != "b" || chunks[2].Content != "d" || chunks[2].ChunkIndex != 3 {
+		t.Fatalf("expected chunks 1 to 3 in order, got %+v", chunks)
+	}
 }
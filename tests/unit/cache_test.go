@@ -0,0 +1,149 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/llm"
+)
+
+func newTestCachingClient(inner llm.Client, cache llm.ResponseCache) llm.StreamClient {
+	client := llm.NewCachingClient(inner, cache, llm.CacheOptions{
+		Provider: "ollama",
+		Model:    "llama3.1:8b",
+		TTL:      time.Hour,
+		Logger:   log.New(io.Discard, "", 0),
+	})
+	return client.(llm.StreamClient)
+}
+
+func TestCachingClientReplaysHitsThroughStream(t *testing.T) {
+	inner := &stubStreamLLM{chunks: []string{"Hello", ", world"}}
+	cache := newMemoryResponseCache()
+	client := newTestCachingClient(inner, cache)
+	messages := []llm.Message{{Role: llm.RoleUser, Content: "hi"}}
+
+	var first string
+	if err := client.GenerateStream(context.Background(), messages, func(chunk string) error {
+		first += chunk
+		return nil
+	}); err != nil {
+		t.Fatalf("first stream: %v", err)
+	}
+
+	var second []string
+	if err := client.GenerateStream(context.Background(), messages, func(chunk string) error {
+		second = append(second, chunk)
+		return nil
+	}); err != nil {
+		t.Fatalf("second stream: %v", err)
+	}
+
+	if inner.calls != 1 {
+		t.Fatalf("expected provider to be called once, got %d", inner.calls)
+	}
+	if first != "Hello, world" || len(second) != 1 || second[0] != first {
+		t.Fatalf("expected cached replay of %q, got %q", first, second)
+	}
+	if cache.ttl != time.Hour {
+		t.Fatalf("expected ttl to be passed to the cache, got %v", cache.ttl)
+	}
+
+	answer, err := client.Generate(context.Background(), messages)
+	if err != nil || answer != first {
+		t.Fatalf("expected Generate to share the cache entry, got %q (%v)", answer, err)
+	}
+}
+
+func TestCachingClientKeysOnOptionsAndMessages(t *testing.T) {
+	inner := &stubStreamLLM{chunks: []string{"answer"}}
+	client := newTestCachingClient(inner, newMemoryResponseCache())
+	discard := func(string) error { return nil }
+	messages := []llm.Message{{Role: llm.RoleUser, Content: "hi"}}
+
+	ctx := context.Background()
+	temperature := 0.2
+	calls := []struct {
+		ctx      context.Context
+		messages []llm.Message
+	}{
+		{ctx, messages},
+		{llm.WithGenerationOptions(ctx, config.GenerationOptions{Temperature: &temperature}), messages},
+		{ctx, []llm.Message{{Role: llm.RoleUser, Content: "hello"}}},
+		{ctx, messages},
+	}
+	for _, call := range calls {
+		if err := client.GenerateStream(call.ctx, call.messages, discard); err != nil {
+			t.Fatalf("stream: %v", err)
+		}
+	}
+
+	if inner.calls != 3 {
+		t.Fatalf("expected 3 provider calls, got %d", inner.calls)
+	}
+}
+
+func TestCachingClientBypassRefreshesEntry(t *testing.T) {
+	inner := &stubStreamLLM{chunks: []string{"old"}}
+	client := newTestCachingClient(inner, newMemoryResponseCache())
+	messages := []llm.Message{{Role: llm.RoleUser, Content: "hi"}}
+
+	if _, err := client.Generate(context.Background(), messages); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	inner.chunks = []string{"new"}
+	answer, err := client.Generate(llm.WithCacheBypass(context.Background()), messages)
+	if err != nil || answer != "new" {
+		t.Fatalf("expected bypass to reach the provider, got %q (%v)", answer, err)
+	}
+	answer, err = client.Generate(context.Background(), messages)
+	if err != nil || answer != "new" {
+		t.Fatalf("expected bypass to refresh the cache, got %q (%v)", answer, err)
+	}
+}
+
+func TestCachingClientIgnoresCacheFailures(t *testing.T) {
+	inner := &stubStreamLLM{chunks: []string{"answer"}}
+	cache := newMemoryResponseCache()
+	cache.err = errors.New("connection refused")
+	client := newTestCachingClient(inner, cache)
+
+	answer, err := client.Generate(context.Background(), []llm.Message{{Role: llm.RoleUser, Content: "hi"}})
+	if err != nil || answer != "answer" {
+		t.Fatalf("expected cache failure to be ignored, got %q (%v)", answer, err)
+	}
+}
+
+type memoryResponseCache struct {
+	entries map[string]string
+	ttl     time.Duration
+	err     error
+}
+
+func newMemoryResponseCache() *memoryResponseCache {
+	return &memoryResponseCache{entries: map[string]string{}}
+}
+
+func (c *memoryResponseCache) Get(_ context.Context, key string) (string, bool, error) {
+	if c.err != nil {
+		return "", false, c.err
+	}
+	response, ok := c.entries[key]
+	return response, ok, nil
+}
+
+func (c *memoryResponseCache) Put(_ context.Context, entry llm.CacheEntry, ttl time.Duration) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.entries[entry.Key] = entry.Response
+	c.ttl = ttl
+	return nil
+}
+
+var _ llm.ResponseCache = (*memoryResponseCache)(nil)
@@ -0,0 +1,178 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fabfab/go-agent/cassette"
+	"github.com/fabfab/go-agent/chat"
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/embeddings"
+	"github.com/fabfab/go-agent/llm"
+)
+
+func TestCassetteReplaysRecordedChat(t *testing.T) {
+	dir := t.TempDir()
+	llmCassette, err := cassette.Open(filepath.Join(dir, "llm.json"))
+	if err != nil {
+		t.Fatalf("open llm cassette: %v", err)
+	}
+	embedCassette, err := cassette.Open(filepath.Join(dir, "embeddings.json"))
+	if err != nil {
+		t.Fatalf("open embedding cassette: %v", err)
+	}
+
+	vectors := &stubVectorStore{results: []chat.ChunkResult{
+		{ChunkID: "chunk-1", DocumentID: "doc-1", Title: "Doc One", Path: "doc1.md", Content: "Adoption starts with pilots.", Score: 0.9},
+	}}
+	ask := func(embedder embeddings.Embedder, client llm.Client) string {
+		t.Helper()
+		svc := chat.NewService(vectors, &stubGraphStore{}, embedder, client, log.New(io.Discard, "", 0))
+		var streamed string
+		resp, _, err := svc.ChatStream(context.Background(), "How do we adopt?", chat.Config{SimilarityLimit: 3}, nil, func(chunk string) error {
+			streamed += chunk
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("chat: %v", err)
+		}
+		if streamed != resp.Answer {
+			t.Fatalf("streamed %q but answered %q", streamed, resp.Answer)
+		}
+		return resp.Answer
+	}
+
+	recorded := ask(
+		embeddings.NewRecordingEmbedder(&stubEmbedder{vectors: [][]float32{{0.1, 0.2, 0.3}}}, embedCassette),
+		llm.NewRecordingClient(&stubStreamLLM{chunks: []string{"Start ", "with pilots."}}, llmCassette),
+	)
+	if err := cassette.FlushAll(); err != nil {
+		t.Fatalf("flush cassettes: %v", err)
+	}
+
+	cfg := config.Config{
+		Embeddings: config.EmbeddingConfig{Provider: config.ProviderReplay, Dimension: 3, Cassette: filepath.Join(dir, "embeddings.json")},
+		LLM:        config.LLMConfig{Provider: config.ProviderReplay, Cassette: filepath.Join(dir, "llm.json")},
+	}
+	embedder, err := embeddings.NewEmbedder(cfg)
+	if err != nil {
+		t.Fatalf("replay embedder: %v", err)
+	}
+	client, err := llm.NewClient(cfg)
+	if err != nil {
+		t.Fatalf("replay client: %v", err)
+	}
+
+	if replayed := ask(embedder, client); replayed != recorded {
+		t.Fatalf("expected replayed answer %q, got %q", recorded, replayed)
+	}
+}
+
+func TestReplayClientRejectsUnrecordedRequests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "llm.json")
+	c, err := cassette.Open(path)
+	if err != nil {
+		t.Fatalf("open cassette: %v", err)
+	}
+	recorder := llm.NewRecordingClient(&stubLLM{answer: "recorded"}, c)
+	if _, err := recorder.Generate(context.Background(), []llm.Message{{Role: llm.RoleUser, Content: "hi"}}); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("close cassette: %v", err)
+	}
+
+	loaded, err := cassette.Load(path)
+	if err != nil {
+		t.Fatalf("load cassette: %v", err)
+	}
+	replay := llm.NewReplayClient(loaded)
+	answer, err := replay.Generate(context.Background(), []llm.Message{{Role: llm.RoleUser, Content: "hi"}})
+	if err != nil || answer != "recorded" {
+		t.Fatalf("expected recorded answer, got %q (%v)", answer, err)
+	}
+	if _, err := replay.Generate(context.Background(), []llm.Message{{Role: llm.RoleUser, Content: "bye"}}); !errors.Is(err, cassette.ErrNotRecorded) {
+		t.Fatalf("expected ErrNotRecorded, got %v", err)
+	}
+}
+
+func TestRecordingEmbedderBuffersAndSkipsRepeatedTexts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "embeddings.json")
+	c, err := cassette.Open(path)
+	if err != nil {
+		t.Fatalf("open cassette: %v", err)
+	}
+	recorder := embeddings.NewRecordingEmbedder(&stubEmbedder{vectors: [][]float32{{0.1}, {0.2}}}, c)
+	for i := 0; i < 3; i++ {
+		if _, err := recorder.Embed(context.Background(), []string{"alpha", "beta"}); err != nil {
+			t.Fatalf("embed: %v", err)
+		}
+	}
+
+	if c.Len() != 2 {
+		t.Fatalf("expected each text to be recorded once, got %d interactions", c.Len())
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected nothing to be written before Flush, got %v", err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read cassette: %v", err)
+	}
+	var written struct {
+		Interactions []cassette.Interaction `json:"interactions"`
+	}
+	if err := json.Unmarshal(data, &written); err != nil || len(written.Interactions) != 2 {
+		t.Fatalf("expected the flushed cassette to hold 2 interactions, got %d (%v)", len(written.Interactions), err)
+	}
+}
+
+func TestOpenSharesCassettesByPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "shared.json")
+	first, err := cassette.Open(path)
+	if err != nil {
+		t.Fatalf("open cassette: %v", err)
+	}
+	second, err := cassette.Open(filepath.Join(dir, ".", "shared.json"))
+	if err != nil {
+		t.Fatalf("open cassette again: %v", err)
+	}
+	if first != second {
+		t.Fatal("expected one cassette per path")
+	}
+
+	if err := first.Record("llm", "question", "answer"); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if err := second.Record("embedding", "text", []float32{0.1}); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if err := cassette.FlushAll(); err != nil {
+		t.Fatalf("flush all: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read cassette: %v", err)
+	}
+	if !strings.Contains(string(data), `"kind": "llm"`) || !strings.Contains(string(data), `"kind": "embedding"`) {
+		t.Fatalf("expected both recordings in the file, got %s", data)
+	}
+}
+
+func TestReplayProviderRequiresCassette(t *testing.T) {
+	cfg := config.Config{LLM: config.LLMConfig{Provider: config.ProviderReplay}}
+	if _, err := llm.NewClient(cfg); err == nil {
+		t.Fatal("expected error when LLM_CASSETTE is not set")
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"io"
 	"log"
+	"strings"
 	"testing"
 
 	"github.com/fabfab/go-agent/chat"
+	"github.com/fabfab/go-agent/config"
 	"github.com/fabfab/go-agent/embeddings"
 	"github.com/fabfab/go-agent/llm"
 )
@@ -32,9 +34,11 @@ var _ embeddings.Embedder = (*stubEmbedder)(nil)
 type stubVectorStore struct {
 	results []chat.ChunkResult
 	err     error
+	filters []chat.Filter
 }
 
-func (s *stubVectorStore) SimilarChunks(_ context.Context, _ []float32, _ int) ([]chat.ChunkResult, error) {
+func (s *stubVectorStore) SimilarChunks(_ context.Context, _ []float32, _ int, filter chat.Filter) ([]chat.ChunkResult, error) {
+	s.filters = append(s.filters, filter)
 	if s.err != nil {
 		return nil, s.err
 	}
@@ -162,17 +166,18 @@ func TestChatServiceHandlesNoResults(t *testing.T) {
 }
 
 func TestChatServiceSectionFilter(t *testing.T) {
+	store := &stubVectorStore{results: []chat.ChunkResult{{
+		ChunkID:      "chunk-1",
+		DocumentID:   "doc-1",
+		Title:        "Doc One",
+		Path:         "doc1.md",
+		Content:      "Paragraph",
+		Score:        0.9,
+		SectionTitle: "Overview",
+		SectionOrder: 1,
+	}}}
 	svc := chat.NewService(
-		&stubVectorStore{results: []chat.ChunkResult{{
-			ChunkID:      "chunk-1",
-			DocumentID:   "doc-1",
-			Title:        "Doc One",
-			Path:         "doc1.md",
-			Content:      "Paragraph",
-			Score:        0.9,
-			SectionTitle: "Overview",
-			SectionOrder: 1,
-		}}},
+		store,
 		&stubGraphStore{data: map[string]chat.DocumentInsight{
 			"doc-1": {
 				ChunkCount: 1,
@@ -187,24 +192,29 @@ func TestChatServiceSectionFilter(t *testing.T) {
 	if _, err := svc.Chat(context.Background(), "question", chat.Config{SectionFilters: []string{"overview"}}); err != nil {
 		t.Fatalf("expected section filter to pass, got %v", err)
 	}
+	if got := store.filters[0].Sections; len(got) != 1 || got[0] != "overview" {
+		t.Fatalf("expected section filter to reach the store, got %v", got)
+	}
 
+	store.results = nil
 	if _, err := svc.Chat(context.Background(), "question", chat.Config{SectionFilters: []string{"detail"}}); err == nil {
-		t.Fatal("expected error when section filter does not match")
+		t.Fatal("expected error when no chunks match the section filter")
 	}
 }
 
 func TestChatServiceTopicFilter(t *testing.T) {
+	store := &stubVectorStore{results: []chat.ChunkResult{{
+		ChunkID:      "chunk-1",
+		DocumentID:   "doc-1",
+		Title:        "Doc One",
+		Path:         "doc1.md",
+		Content:      "Paragraph",
+		Score:        0.9,
+		SectionTitle: "Overview",
+		SectionOrder: 1,
+	}}}
 	svc := chat.NewService(
-		&stubVectorStore{results: []chat.ChunkResult{{
-			ChunkID:      "chunk-1",
-			DocumentID:   "doc-1",
-			Title:        "Doc One",
-			Path:         "doc1.md",
-			Content:      "Paragraph",
-			Score:        0.9,
-			SectionTitle: "Overview",
-			SectionOrder: 1,
-		}}},
+		store,
 		&stubGraphStore{data: map[string]chat.DocumentInsight{
 			"doc-1": {
 				ChunkCount: 1,
@@ -216,11 +226,428 @@ func TestChatServiceTopicFilter(t *testing.T) {
 		log.New(io.Discard, "", 0),
 	)
 
-	if _, err := svc.Chat(context.Background(), "question", chat.Config{TopicFilters: []string{"topic"}}); err != nil {
+	cfg := chat.Config{TopicFilters: []string{"topic"}, FolderFilters: []string{"guides"}, PathFilters: []string{"**/*.md"}}
+	if _, err := svc.Chat(context.Background(), "question", cfg); err != nil {
 		t.Fatalf("expected topic filter to pass, got %v", err)
 	}
+	filter := store.filters[0]
+	if len(filter.Topics) != 1 || filter.Topics[0] != "topic" || len(filter.Folders) != 1 || len(filter.Paths) != 1 {
+		t.Fatalf("expected filters to reach the store, got %+v", filter)
+	}
 
+	store.results = nil
 	if _, err := svc.Chat(context.Background(), "question", chat.Config{TopicFilters: []string{"other"}}); err == nil {
-		t.Fatal("expected error when topic filter does not match")
+		t.Fatal("expected error when no chunks match the topic filter")
+	}
+	if _, err := svc.Chat(context.Background(), "question", chat.Config{}); err != nil {
+		t.Fatalf("expected unfiltered question without context to fall back, got %v", err)
+	}
+}
+
+type stubToolLLM struct {
+	stubLLM
+	replies []llm.Message
+	calls   int
+}
+
+func (s *stubToolLLM) GenerateWithTools(_ context.Context, _ []llm.Message, _ []llm.Tool) (llm.Message, error) {
+	if s.calls >= len(s.replies) {
+		return llm.Message{Role: llm.RoleAssistant, Content: s.answer}, nil
+	}
+	reply := s.replies[s.calls]
+	s.calls++
+	return reply, nil
+}
+
+func (s *stubToolLLM) GenerateWithToolsStream(ctx context.Context, messages []llm.Message, tools []llm.Tool, fn func(llm.StreamDelta) error) (llm.Message, error) {
+	reply, err := s.GenerateWithTools(ctx, messages, tools)
+	if err != nil {
+		return llm.Message{}, err
+	}
+	if reply.Content != "" {
+		if err := fn(llm.StreamDelta{Content: reply.Content}); err != nil {
+			return llm.Message{}, err
+		}
+	}
+	return reply, nil
+}
+
+var _ llm.ToolClient = (*stubToolLLM)(nil)
+
+func TestChatServiceAgentModeRunsTools(t *testing.T) {
+	toolLLM := &stubToolLLM{
+		stubLLM: stubLLM{answer: "Adoption is phased."},
+		replies: []llm.Message{{
+			Role:      llm.RoleAssistant,
+			ToolCalls: []llm.ToolCall{{ID: "call_0", Name: "search_chunks", Arguments: `{"query":"adoption"}`}},
+		}},
+	}
+	svc := chat.NewService(
+		&stubVectorStore{results: []chat.ChunkResult{{
+			ChunkID:    "chunk-1",
+			DocumentID: "doc-1",
+			Title:      "Doc One",
+			Path:       "doc1.md",
+			Content:    "Adoption happens in phases.",
+			Score:      0.8,
+		}}},
+		&stubGraphStore{},
+		&stubEmbedder{vectors: [][]float32{{0.1}}},
+		toolLLM,
+		log.New(io.Discard, "", 0),
+	)
+
+	var streamed []chat.AgentStep
+	resp, history, err := svc.ChatStream(context.Background(), "How do we adopt?", chat.Config{
+		Agent: true,
+		OnStep: func(step chat.AgentStep) error {
+			streamed = append(streamed, step)
+			return nil
+		},
+	}, nil, func(string) error { return nil })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resp.Answer != "Adoption is phased." {
+		t.Fatalf("unexpected answer: %q", resp.Answer)
+	}
+	if len(resp.Steps) != 1 || resp.Steps[0].Tool != "search_chunks" || resp.Steps[0].Error != "" {
+		t.Fatalf("unexpected steps: %#v", resp.Steps)
+	}
+	if len(streamed) != 1 {
+		t.Fatalf("expected OnStep to be called once, got %d", len(streamed))
+	}
+	if len(resp.Sources) != 1 || resp.Sources[0].DocumentID != "doc-1" {
+		t.Fatalf("expected searched chunk to become a source, got %#v", resp.Sources)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected user and assistant turns in history, got %d", len(history))
+	}
+}
+
+func TestChatServiceAgentModeStreamsOnlyTheFinalTurn(t *testing.T) {
+	toolLLM := &stubToolLLM{
+		stubLLM: stubLLM{answer: "Adoption is phased."},
+		replies: []llm.Message{{
+			Role:      llm.RoleAssistant,
+			Content:   "Let me search the knowledge base.",
+			ToolCalls: []llm.ToolCall{{ID: "call_0", Name: "search_chunks", Arguments: `{"query":"adoption"}`}},
+		}},
+	}
+	svc := chat.NewService(
+		&stubVectorStore{results: []chat.ChunkResult{{ChunkID: "chunk-1", DocumentID: "doc-1", Content: "Adoption happens in phases.", Score: 0.8}}},
+		&stubGraphStore{},
+		&stubEmbedder{vectors: [][]float32{{0.1}}},
+		toolLLM,
+		log.New(io.Discard, "", 0),
+	)
+
+	var streamed strings.Builder
+	if _, _, err := svc.ChatStream(context.Background(), "How do we adopt?", chat.Config{Agent: true}, nil, func(delta string) error {
+		streamed.WriteString(delta)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if streamed.String() != "Adoption is phased." {
+		t.Fatalf("expected only the final answer to be streamed, got %q", streamed.String())
+	}
+}
+
+// wordStreamToolLLM streams each reply of stubToolLLM word by word.
+type wordStreamToolLLM struct {
+	stubToolLLM
+}
+
+func (s *wordStreamToolLLM) GenerateWithToolsStream(ctx context.Context, messages []llm.Message, tools []llm.Tool, fn func(llm.StreamDelta) error) (llm.Message, error) {
+	reply, err := s.GenerateWithTools(ctx, messages, tools)
+	if err != nil {
+		return llm.Message{}, err
+	}
+	for _, word := range strings.SplitAfter(reply.Content, " ") {
+		if err := fn(llm.StreamDelta{Content: word}); err != nil {
+			return llm.Message{}, err
+		}
+	}
+	if len(reply.ToolCalls) > 0 {
+		if err := fn(llm.StreamDelta{ToolCalls: []llm.ToolCallDelta{{ID: reply.ToolCalls[0].ID, Name: reply.ToolCalls[0].Name}}}); err != nil {
+			return llm.Message{}, err
+		}
+	}
+	return reply, nil
+}
+
+func TestChatServiceAgentModeStreamsTheFinalTurnAsItArrives(t *testing.T) {
+	answer := strings.Repeat("Adoption happens in phases, starting with a pilot team. ", 10)
+	toolLLM := &wordStreamToolLLM{stubToolLLM{
+		stubLLM: stubLLM{answer: answer},
+		replies: []llm.Message{{
+			Role:      llm.RoleAssistant,
+			Content:   "Let me search the knowledge base.",
+			ToolCalls: []llm.ToolCall{{ID: "call_0", Name: "search_chunks", Arguments: `{"query":"adoption"}`}},
+		}},
+	}}
+	svc := chat.NewService(
+		&stubVectorStore{results: []chat.ChunkResult{{ChunkID: "chunk-1", DocumentID: "doc-1", Content: "Adoption happens in phases.", Score: 0.8}}},
+		&stubGraphStore{},
+		&stubEmbedder{vectors: [][]float32{{0.1}}},
+		toolLLM,
+		log.New(io.Discard, "", 0),
+	)
+
+	var deltas []string
+	if _, _, err := svc.ChatStream(context.Background(), "How do we adopt?", chat.Config{Agent: true}, nil, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(deltas, "") != answer {
+		t.Fatalf("expected only the final answer to be streamed, got %q", strings.Join(deltas, ""))
+	}
+	if len(deltas) < 10 {
+		t.Fatalf("expected the answer streamed incrementally, got %d deltas", len(deltas))
+	}
+}
+
+func TestChatServiceAgentModeRequiresToolClient(t *testing.T) {
+	svc := chat.NewService(&stubVectorStore{}, &stubGraphStore{}, &stubEmbedder{vectors: [][]float32{{0.1}}}, &stubLLM{answer: "ok"}, log.New(io.Discard, "", 0))
+	_, err := svc.Chat(context.Background(), "question", chat.Config{Agent: true})
+	if !errors.Is(err, llm.ErrToolsUnsupported) {
+		t.Fatalf("expected ErrToolsUnsupported, got %v", err)
+	}
+}
+
+type optionsRecordingLLM struct {
+	stubLLM
+	options config.GenerationOptions
+}
+
+func (s *optionsRecordingLLM) Generate(ctx context.Context, messages []llm.Message) (string, error) {
+	s.options, _ = llm.GenerationOptionsFromContext(ctx)
+	return s.stubLLM.Generate(ctx, messages)
+}
+
+func TestChatServicePassesGenerationOptions(t *testing.T) {
+	embed := &stubEmbedder{vectors: [][]float32{{0.1, 0.2}}}
+	vectors := &stubVectorStore{results: []chat.ChunkResult{{DocumentID: "doc-1", Title: "Doc", Content: "Content"}}}
+	model := &optionsRecordingLLM{stubLLM: stubLLM{answer: "Answer"}}
+	svc := chat.NewService(vectors, nil, embed, model, log.New(io.Discard, "", 0))
+
+	temperature := 0.2
+	cfg := chat.Config{Generation: config.GenerationOptions{Temperature: &temperature, NumCtx: 32768}}
+	if _, err := svc.Chat(context.Background(), "What?", cfg); err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+
+	if model.options.Temperature == nil || *model.options.Temperature != temperature || model.options.NumCtx != 32768 {
+		t.Fatalf("expected generation options on the llm context, got %+v", model.options)
+	}
+}
+
+type optionsScriptedLLM struct {
+	scriptedLLM
+	options []config.GenerationOptions
+}
+
+func (s *optionsScriptedLLM) Generate(ctx context.Context, messages []llm.Message) (string, error) {
+	options, _ := llm.GenerationOptionsFromContext(ctx)
+	s.options = append(s.options, options)
+	return s.scriptedLLM.Generate(ctx, messages)
+}
+
+func TestChatServiceKeepsGenerationOptionsOffAuxiliaryCalls(t *testing.T) {
+	history := []llm.Message{
+		{Role: llm.RoleUser, Content: "Which plans do we sell?"},
+		{Role: llm.RoleAssistant, Content: "Basic and Pro."},
+	}
+	store := &variantStore{rankings: map[float32][]chat.ChunkResult{1: {hybridChunk("pro")}}}
+	embedder := &keyedEmbedder{vectors: map[string][]float32{"Pro plan features": {1}}}
+	model := &optionsScriptedLLM{scriptedLLM: scriptedLLM{replies: []string{"Pro plan features", "answer"}}}
+	svc := chat.NewService(store, &stubGraphStore{}, embedder, model, log.New(io.Discard, "", 0))
+
+	cfg := chat.Config{Generation: config.GenerationOptions{MaxTokens: 5, Stop: []string{"\n"}}}
+	if _, _, err := svc.ChatStream(context.Background(), "and the second one?", cfg, history, nil); err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+
+	if len(model.options) != 2 {
+		t.Fatalf("expected a condense and an answer call, got %d", len(model.options))
+	}
+	if model.options[0].MaxTokens != 0 || len(model.options[0].Stop) != 0 {
+		t.Fatalf("expected the condense call without request options, got %+v", model.options[0])
+	}
+	if model.options[1].MaxTokens != 5 || len(model.options[1].Stop) != 1 {
+		t.Fatalf("expected request options on the answer call, got %+v", model.options[1])
+	}
+}
+
+func TestChatServiceReportsTimings(t *testing.T) {
+	embed := &stubEmbedder{vectors: [][]float32{{0.1, 0.2}}}
+	vectors := &stubVectorStore{results: []chat.ChunkResult{{DocumentID: "doc-1", Title: "Doc", Content: "Content"}}}
+	svc := chat.NewService(vectors, &stubGraphStore{}, embed, &stubLLM{answer: "Answer"}, log.New(io.Discard, "", 0))
+
+	resp, err := svc.Chat(context.Background(), "What?", chat.Config{})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+
+	timings := resp.Timings
+	if timings.Total <= 0 {
+		t.Fatalf("expected total duration to be recorded, got %+v", timings)
+	}
+	if stages := timings.Embed + timings.VectorSearch + timings.GraphInsights + timings.Generation; stages > timings.Total {
+		t.Fatalf("stage durations %s exceed total %s", stages, timings.Total)
+	}
+	if resp.Usage != (llm.Usage{}) {
+		t.Fatalf("expected zero usage from a client that reports none, got %+v", resp.Usage)
+	}
+}
+
+func TestChatServiceEmbedsQuestionAsQuery(t *testing.T) {
+	inner := &textRecordingEmbedder{}
+	svc := chat.NewService(
+		&stubVectorStore{},
+		&stubGraphStore{},
+		embeddings.NewTemplatedEmbedder(inner, embeddings.Templates{Query: "search_query: ", Document: "search_document: "}),
+		&stubLLM{answer: "ok"},
+		log.New(io.Discard, "", 0),
+	)
+
+	if _, err := svc.Chat(context.Background(), "What is the plan?", chat.Config{}); err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if len(inner.texts) != 1 || inner.texts[0] != "search_query: What is the plan?" {
+		t.Fatalf("expected the question to use the query template, got %q", inner.texts)
+	}
+}
+
+type fingerprintedVectorStore struct {
+	stubVectorStore
+	fingerprint embeddings.Fingerprint
+}
+
+func (s *fingerprintedVectorStore) EmbeddingFingerprint(context.Context) (embeddings.Fingerprint, bool, error) {
+	return s.fingerprint, true, nil
+}
+
+var _ chat.FingerprintReader = (*fingerprintedVectorStore)(nil)
+
+func TestChatServiceRefusesMismatchedEmbeddingModel(t *testing.T) {
+	embedCfg := config.EmbeddingConfig{Provider: config.ProviderLocal, Model: "hash", Dimension: 8}
+	embedder, err := embeddings.NewEmbedder(config.Config{Embeddings: embedCfg})
+	if err != nil {
+		t.Fatalf("new embedder: %v", err)
+	}
+
+	stored := embeddings.FingerprintFor(config.EmbeddingConfig{Provider: config.ProviderOllama, Model: "nomic-embed-text", Dimension: 8})
+	store := &fingerprintedVectorStore{fingerprint: stored}
+	svc := chat.NewService(store, &stubGraphStore{}, embedder, &stubLLM{answer: "ok"}, log.New(io.Discard, "", 0))
+
+	_, err = svc.Chat(context.Background(), "What is the plan?", chat.Config{})
+	if !errors.Is(err, embeddings.ErrFingerprintMismatch) {
+		t.Fatalf("expected a fingerprint mismatch, got %v", err)
+	}
+
+	if _, err := svc.Chat(context.Background(), "What is the plan?", chat.Config{AllowEmbeddingMismatch: true}); err != nil {
+		t.Fatalf("expected the override to allow the search, got %v", err)
+	}
+
+	store.fingerprint = embeddings.FingerprintFor(embedCfg)
+	if _, err := svc.Chat(context.Background(), "What is the plan?", chat.Config{}); err != nil {
+		t.Fatalf("expected a matching model to pass, got %v", err)
+	}
+}
+
+type hybridVectorStore struct {
+	vector  []chat.ChunkResult
+	lexical []chat.ChunkResult
+	queries []string
+}
+
+func (s *hybridVectorStore) SimilarChunks(_ context.Context, _ []float32, limit int, _ chat.Filter) ([]chat.ChunkResult, error) {
+	return truncateChunks(s.vector, limit), nil
+}
+
+func (s *hybridVectorStore) LexicalChunks(_ context.Context, query string, limit int, _ chat.Filter) ([]chat.ChunkResult, error) {
+	s.queries = append(s.queries, query)
+	return truncateChunks(s.lexical, limit), nil
+}
+
+func truncateChunks(chunks []chat.ChunkResult, limit int) []chat.ChunkResult {
+	if len(chunks) > limit {
+		return chunks[:limit]
+	}
+	return chunks
+}
+
+var _ chat.LexicalSearcher = (*hybridVectorStore)(nil)
+
+func hybridChunk(id string) chat.ChunkResult {
+	return chat.ChunkResult{ChunkID: id, DocumentID: "doc-" + id, Title: id, Path: id + ".md", Content: "content " + id}
+}
+
+func sourcePaths(sources []chat.Source) []string {
+	paths := make([]string, len(sources))
+	for i, source := range sources {
+		paths[i] = source.Path
+	}
+	return paths
+}
+
+func TestChatServiceHybridFusesRankings(t *testing.T) {
+	store := &hybridVectorStore{
+		vector:  []chat.ChunkResult{hybridChunk("a"), hybridChunk("b"), hybridChunk("c")},
+		lexical: []chat.ChunkResult{hybridChunk("err"), hybridChunk("b")},
+	}
+	svc := chat.NewService(store, &stubGraphStore{}, &stubEmbedder{vectors: [][]float32{{0.1}}}, &stubLLM{answer: "ok"}, log.New(io.Discard, "", 0))
+
+	resp, err := svc.Chat(context.Background(), "What does ERR_42 mean?", chat.Config{SimilarityLimit: 3, Hybrid: true})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if len(store.queries) != 1 || store.queries[0] != "What does ERR_42 mean?" {
+		t.Fatalf("expected the question to drive full-text search, got %q", store.queries)
+	}
+	// b is ranked by both retrievers, so it wins; the lexical-only match ties
+	// with a on rank and pushes c out.
+	got := sourcePaths(resp.Sources)
+	want := []string{"b.md", "a.md", "err.md"}
+	if len(got) != len(want) {
+		t.Fatalf("expected sources %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected sources %v, got %v", want, got)
+		}
+	}
+}
+
+func TestChatServiceHybridWeights(t *testing.T) {
+	store := &hybridVectorStore{
+		vector:  []chat.ChunkResult{hybridChunk("a"), hybridChunk("b")},
+		lexical: []chat.ChunkResult{hybridChunk("err")},
+	}
+	svc := chat.NewService(store, &stubGraphStore{}, &stubEmbedder{vectors: [][]float32{{0.1}}}, &stubLLM{answer: "ok"}, log.New(io.Discard, "", 0))
+
+	resp, err := svc.Chat(context.Background(), "ERR_42", chat.Config{SimilarityLimit: 1, Hybrid: true, Weights: chat.FusionWeights{Vector: 0.2, Lexical: 1}})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if got := sourcePaths(resp.Sources); len(got) != 1 || got[0] != "err.md" {
+		t.Fatalf("expected the heavier lexical ranking to win, got %v", got)
+	}
+
+	resp, err = svc.Chat(context.Background(), "ERR_42", chat.Config{SimilarityLimit: 1})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if got := sourcePaths(resp.Sources); len(got) != 1 || got[0] != "a.md" {
+		t.Fatalf("expected vector-only search without hybrid, got %v", got)
+	}
+
+	if _, err := svc.Chat(context.Background(), "ERR_42", chat.Config{Hybrid: true, Weights: chat.FusionWeights{Vector: 1, Lexical: -1}}); err == nil {
+		t.Fatal("expected negative weights to be rejected")
 	}
 }
@@ -0,0 +1,91 @@
+package unit
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/fabfab/go-agent/chat"
+	"github.com/fabfab/go-agent/llm"
+)
+
+func TestChatServiceCondensesFollowUps(t *testing.T) {
+	history := []llm.Message{
+		{Role: llm.RoleUser, Content: "Question:\nWhich plans do we sell?\nContext (optional, may be incomplete):\nSource 1: pricing.md\nProvide your answer in markdown."},
+		{Role: llm.RoleAssistant, Content: "Basic and Pro."},
+	}
+	store := &variantStore{rankings: map[float32][]chat.ChunkResult{1: {hybridChunk("pro")}}}
+	embedder := &keyedEmbedder{vectors: map[string][]float32{"Pro plan features": {1}}}
+	client := &scriptedLLM{replies: []string{"\"Pro plan features\"\n", "answer"}}
+	svc := chat.NewService(store, &stubGraphStore{}, embedder, client, log.New(io.Discard, "", 0))
+
+	resp, updated, err := svc.ChatStream(context.Background(), "and what about the second one?", chat.Config{}, history, nil)
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if resp.SearchQuery != "Pro plan features" {
+		t.Fatalf("expected the rewritten query, got %q", resp.SearchQuery)
+	}
+	if resp.Timings.Condense <= 0 || resp.Timings.QueryExpansion != 0 {
+		t.Fatalf("expected the rewrite timed as condensing, got %+v", resp.Timings)
+	}
+	if strings.Join(embedder.embedded, ",") != "Pro plan features" || len(resp.Sources) != 1 {
+		t.Fatalf("expected the rewritten query to be searched, got %v", embedder.embedded)
+	}
+
+	rewrite := client.received[0][1].Content
+	if !strings.Contains(rewrite, "User: Which plans do we sell?") || !strings.Contains(rewrite, "Assistant: Basic and Pro.") || strings.Contains(rewrite, "pricing.md") {
+		t.Fatalf("expected prior questions without their context, got %q", rewrite)
+	}
+	// The answer still addresses the question as asked.
+	if last := updated[len(updated)-2].Content; !strings.Contains(last, "and what about the second one?") {
+		t.Fatalf("expected the original question in the history, got %q", last)
+	}
+}
+
+func TestChatServiceCondenseCutsLongTurnsOnRuneBoundaries(t *testing.T) {
+	history := []llm.Message{
+		{Role: llm.RoleUser, Content: "Wie teuer ist der Tarif?"},
+		{Role: llm.RoleAssistant, Content: "a" + strings.Repeat("ü", 400)},
+	}
+	store := &variantStore{rankings: map[float32][]chat.ChunkResult{1: {hybridChunk("pro")}}}
+	embedder := &keyedEmbedder{vectors: map[string][]float32{"Tarifpreise": {1}}}
+	client := &scriptedLLM{replies: []string{"Tarifpreise", "answer"}}
+	svc := chat.NewService(store, &stubGraphStore{}, embedder, client, log.New(io.Discard, "", 0))
+
+	if _, _, err := svc.ChatStream(context.Background(), "und der andere?", chat.Config{}, history, nil); err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if rewrite := client.received[0][1].Content; !utf8.ValidString(rewrite) || !strings.Contains(rewrite, "ü...") {
+		t.Fatalf("expected the long turn to be cut between runes, got %q", rewrite)
+	}
+}
+
+func TestChatServiceSearchesVerbatimWithoutCondensing(t *testing.T) {
+	history := []llm.Message{{Role: llm.RoleUser, Content: "hi"}, {Role: llm.RoleAssistant, Content: "hello"}}
+	for name, tc := range map[string]struct {
+		history []llm.Message
+		cfg     chat.Config
+	}{
+		"first turn":  {},
+		"no condense": {history: history, cfg: chat.Config{NoCondense: true}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := &variantStore{rankings: map[float32][]chat.ChunkResult{1: {hybridChunk("a")}}}
+			embedder := &keyedEmbedder{vectors: map[string][]float32{"what is sso?": {1}}}
+			client := &scriptedLLM{replies: []string{"answer"}}
+			svc := chat.NewService(store, &stubGraphStore{}, embedder, client, log.New(io.Discard, "", 0))
+
+			resp, _, err := svc.ChatStream(context.Background(), "what is sso?", tc.cfg, tc.history, nil)
+			if err != nil {
+				t.Fatalf("chat: %v", err)
+			}
+			if resp.SearchQuery != "what is sso?" || len(client.received) != 1 {
+				t.Fatalf("expected the question to be searched as asked, got %q after %d LLM calls", resp.SearchQuery, len(client.received))
+			}
+		})
+	}
+}
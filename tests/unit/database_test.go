@@ -2,9 +2,12 @@ package unit
 
 import (
 	"context"
+	"strings"
 	"testing"
 
+	"github.com/fabfab/go-agent/config"
 	"github.com/fabfab/go-agent/database"
+	"github.com/fabfab/go-agent/embeddings"
 )
 
 func TestEnsureRAGSchemaRejectsInvalidDimension(t *testing.T) {
@@ -13,3 +16,100 @@ func TestEnsureRAGSchemaRejectsInvalidDimension(t *testing.T) {
 		t.Fatal("expected error when dimension is not positive")
 	}
 }
+
+func TestValidateSpaceName(t *testing.T) {
+	for _, name := range []string{"default", "openai_3_small", "v2"} {
+		if err := database.ValidateSpaceName(name); err != nil {
+			t.Errorf("ValidateSpaceName(%q) = %v, want nil", name, err)
+		}
+	}
+	for _, name := range []string{"", "OpenAI", "nomic-embed", "a; DROP TABLE rag_chunks", strings.Repeat("a", 41)} {
+		if err := database.ValidateSpaceName(name); err == nil {
+			t.Errorf("ValidateSpaceName(%q) = nil, want error", name)
+		}
+	}
+}
+
+func TestEmbeddingSpaceConfig(t *testing.T) {
+	base := config.EmbeddingConfig{
+		Provider:  config.ProviderOllama,
+		Model:     "nomic-embed-text",
+		Dimension: 768,
+		Space:     database.DefaultSpace,
+		BatchSize: 16,
+		Fallbacks: []config.ProviderSpec{{Provider: config.ProviderLocal, Model: "hash"}},
+	}
+
+	space := database.EmbeddingSpace{Name: "openai", Provider: config.ProviderOpenAI, Model: "text-embedding-3-small", Dimension: 1536, QueryTemplate: "q: "}
+	got := space.EmbeddingConfig(base)
+	if got.Space != "openai" || got.Provider != config.ProviderOpenAI || got.Dimension != 1536 || got.QueryTemplate != "q: " {
+		t.Fatalf("unexpected config for space: %+v", got)
+	}
+	if got.BatchSize != 16 {
+		t.Fatalf("expected batching settings to carry over, got %d", got.BatchSize)
+	}
+	if len(got.Fallbacks) != 0 {
+		t.Fatalf("expected fallbacks of another model to be dropped, got %+v", got.Fallbacks)
+	}
+
+	same := database.SpaceFromConfig(base).EmbeddingConfig(base)
+	if len(same.Fallbacks) != 1 {
+		t.Fatalf("expected fallbacks to be kept for the configured model, got %+v", same.Fallbacks)
+	}
+
+	if table := space.Table(); table != "rag_space_openai" {
+		t.Fatalf("unexpected space table %q", table)
+	}
+	if table := database.SpaceFromConfig(base).Table(); table != "rag_chunks" {
+		t.Fatalf("expected the default space to use rag_chunks, got %q", table)
+	}
+}
+
+func TestSpaceFromConfigRecordsResolvedDocumentTemplate(t *testing.T) {
+	cfg := config.EmbeddingConfig{Provider: config.ProviderOllama, Model: "nomic-embed-text", Dimension: 768, Space: "nomic"}
+	space := database.SpaceFromConfig(cfg)
+	if space.DocumentTemplate != "search_document: " {
+		t.Fatalf("expected the model's default document template to be recorded, got %q", space.DocumentTemplate)
+	}
+	if fp := space.Fingerprint(); fp != embeddings.FingerprintFor(cfg) {
+		t.Fatalf("expected the space fingerprint %s to match the embedder's %s", fp, embeddings.FingerprintFor(cfg))
+	}
+
+	// Vectors recorded without a template differ from the model's default.
+	space.DocumentTemplate = "{text}"
+	if space.Fingerprint() == embeddings.FingerprintFor(cfg) {
+		t.Fatal("expected a space embedded without the template to mismatch")
+	}
+}
+
+func TestResolveVectorIndex(t *testing.T) {
+	index, err := database.ResolveVectorIndex(config.VectorIndexConfig{})
+	if err != nil {
+		t.Fatalf("resolve zero index: %v", err)
+	}
+	if index.Type != config.IndexHNSW || index.Metric != config.MetricL2 {
+		t.Fatalf("expected HNSW over L2 by default, got %+v", index)
+	}
+
+	for _, invalid := range []config.VectorIndexConfig{{Type: "btree"}, {Metric: "hamming"}} {
+		if _, err := database.ResolveVectorIndex(invalid); err == nil {
+			t.Errorf("ResolveVectorIndex(%+v) = nil, want error", invalid)
+		}
+	}
+
+	operators := map[string]string{config.MetricL2: "<->", config.MetricCosine: "<=>", config.MetricInnerProduct: "<#>"}
+	for metric, want := range operators {
+		if got, err := database.DistanceOperator(metric); err != nil || got != want {
+			t.Errorf("DistanceOperator(%q) = %q, %v; want %q", metric, got, err, want)
+		}
+	}
+}
+
+func TestIvfflatLists(t *testing.T) {
+	cases := map[int64]int{0: 1, 500: 1, 50_000: 50, 1_000_000: 1000, 4_000_000: 2000}
+	for rows, want := range cases {
+		if got := database.IvfflatLists(rows); got != want {
+			t.Errorf("IvfflatLists(%d) = %d, want %d", rows, got, want)
+		}
+	}
+}
@@ -1,10 +1,21 @@
 package unit
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/fabfab/go-agent/config"
 	"github.com/fabfab/go-agent/embeddings"
+	"github.com/fabfab/go-agent/resilience"
 )
 
 func TestNewEmbedderDefaults(t *testing.T) {
@@ -40,3 +51,222 @@ func TestNewEmbedderOpenAIMissingKey(t *testing.T) {
 		t.Fatal("expected error for missing OPENAI_API_KEY")
 	}
 }
+
+func TestOllamaEmbedderBatchesConcurrently(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		inFlight int32
+		peak     int32
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/embed" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		mu.Lock()
+		requests++
+		if current > peak {
+			peak = current
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+
+		var req struct {
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		// Each vector encodes its text so that ordering can be checked.
+		embeddings := make([][]float32, len(req.Input))
+		for i, text := range req.Input {
+			n, _ := strconv.Atoi(text)
+			embeddings[i] = []float32{float32(n), 0}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"embeddings": embeddings})
+	}))
+	defer server.Close()
+
+	embedder := embeddings.NewOllamaEmbedder(embeddings.Options{
+		Model: "nomic-embed-text", Dimension: 2, OllamaHost: server.URL, BatchSize: 3, Concurrency: 2,
+	})
+	texts := make([]string, 10)
+	for i := range texts {
+		texts[i] = strconv.Itoa(i)
+	}
+
+	vectors, err := embedder.Embed(context.Background(), texts)
+	if err != nil {
+		t.Fatalf("embed: %v", err)
+	}
+	if requests != 4 {
+		t.Fatalf("expected 4 batched requests, got %d", requests)
+	}
+	if peak > 2 {
+		t.Fatalf("expected at most 2 concurrent requests, got %d", peak)
+	}
+	for i, vec := range vectors {
+		if vec[0] != float32(i) {
+			t.Fatalf("vector %d out of order: %v", i, vec)
+		}
+	}
+}
+
+func TestOllamaEmbedderReportsErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":"model \"missing\" not found"}`))
+	}))
+	defer server.Close()
+
+	embedder := embeddings.NewOllamaEmbedder(embeddings.Options{Model: "missing", OllamaHost: server.URL})
+	_, err := embedder.Embed(context.Background(), []string{"hello"})
+	var statusErr *resilience.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 status error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected the API error message, got %v", err)
+	}
+}
+
+func TestOpenAIEmbedderSplitsLargeInputs(t *testing.T) {
+	var sizes []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		sizes = append(sizes, len(req.Input))
+		// Return the data out of order; the embedder must sort by index.
+		data := make([]map[string]any, len(req.Input))
+		for i := range req.Input {
+			data[len(req.Input)-1-i] = map[string]any{"object": "embedding", "index": i, "embedding": []float32{float32(i)}}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": data})
+	}))
+	defer server.Close()
+
+	embedder := embeddings.NewOpenAIEmbedder(embeddings.Options{
+		Model: "text-embedding-3-small", OpenAIAPIKey: "test", OpenAIBaseURL: server.URL + "/v1", Concurrency: 1,
+	})
+	texts := make([]string, 2500)
+	for i := range texts {
+		texts[i] = "chunk"
+	}
+
+	vectors, err := embedder.Embed(context.Background(), texts)
+	if err != nil {
+		t.Fatalf("embed: %v", err)
+	}
+	if len(sizes) != 2 || sizes[0] != 2048 || sizes[1] != 452 {
+		t.Fatalf("expected requests of 2048 and 452 inputs, got %v", sizes)
+	}
+	if len(vectors) != len(texts) || vectors[1][0] != 1 || vectors[2048][0] != 0 {
+		t.Fatalf("unexpected vectors ordering")
+	}
+}
+
+func TestLocalEmbedderIsDeterministicAndNormalised(t *testing.T) {
+	embedder, err := embeddings.NewEmbedder(config.Config{
+		Embeddings: config.EmbeddingConfig{Provider: config.ProviderLocal, Dimension: 256},
+	})
+	if err != nil {
+		t.Fatalf("new local embedder: %v", err)
+	}
+
+	texts := []string{
+		"Our adoption strategy starts with pilot teams.",
+		"Pilot teams drive the adoption strategy.",
+		"Quarterly revenue grew in the retail segment.",
+		"Our adoption strategy starts with pilot teams.",
+	}
+	vectors, err := embedder.Embed(context.Background(), texts)
+	if err != nil {
+		t.Fatalf("embed: %v", err)
+	}
+
+	cosine := func(a, b []float32) float64 {
+		var dot float64
+		for i := range a {
+			dot += float64(a[i]) * float64(b[i])
+		}
+		return dot
+	}
+	for i, vec := range vectors {
+		if len(vec) != 256 {
+			t.Fatalf("vector %d has dimension %d", i, len(vec))
+		}
+		if norm := cosine(vec, vec); norm < 0.999 || norm > 1.001 {
+			t.Fatalf("vector %d is not unit length: %f", i, norm)
+		}
+	}
+	if cosine(vectors[0], vectors[3]) < 0.999 {
+		t.Fatal("expected identical texts to produce identical vectors")
+	}
+	if related, unrelated := cosine(vectors[0], vectors[1]), cosine(vectors[0], vectors[2]); related <= unrelated {
+		t.Fatalf("expected overlapping texts to be closer (%f) than unrelated ones (%f)", related, unrelated)
+	}
+}
+
+func TestLocalEmbedderRequiresDimension(t *testing.T) {
+	if _, err := embeddings.NewEmbedder(config.Config{Embeddings: config.EmbeddingConfig{Provider: config.ProviderLocal}}); err == nil {
+		t.Fatal("expected error without a dimension")
+	}
+}
+
+func TestResolveTemplates(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  config.EmbeddingConfig
+		want embeddings.Templates
+	}{
+		{"nomic default", config.EmbeddingConfig{Provider: config.ProviderOllama, Model: "nomic-embed-text:latest"}, embeddings.Templates{Query: "search_query: ", Document: "search_document: "}},
+		{"e5 variant", config.EmbeddingConfig{Provider: config.ProviderOpenAI, Model: "intfloat/multilingual-e5-large"}, embeddings.Templates{Query: "query: ", Document: "passage: "}},
+		{"no published prefix", config.EmbeddingConfig{Provider: config.ProviderOpenAI, Model: "text-embedding-3-small"}, embeddings.Templates{}},
+		{"local provider", config.EmbeddingConfig{Provider: config.ProviderLocal, Model: "nomic-embed-text"}, embeddings.Templates{}},
+		{"override", config.EmbeddingConfig{Provider: config.ProviderOllama, Model: "nomic-embed-text", QueryTemplate: "Instruct: find passages\nQuery: {text}"}, embeddings.Templates{Query: "Instruct: find passages\nQuery: {text}", Document: "search_document: "}},
+	}
+	for _, tc := range cases {
+		if got := embeddings.ResolveTemplates(tc.cfg); got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestTemplatedEmbedderSeparatesQueriesAndDocuments(t *testing.T) {
+	inner := &textRecordingEmbedder{}
+	embedder := embeddings.NewTemplatedEmbedder(inner, embeddings.Templates{Query: "Query: {text} ?", Document: "search_document: "})
+
+	if _, err := embeddings.EmbedQuery(context.Background(), embedder, []string{"adoption"}); err != nil {
+		t.Fatalf("embed query: %v", err)
+	}
+	if _, err := embeddings.EmbedDocuments(context.Background(), embedder, []string{"chunk one", "chunk two"}); err != nil {
+		t.Fatalf("embed documents: %v", err)
+	}
+	if _, err := embedder.Embed(context.Background(), []string{"raw"}); err != nil {
+		t.Fatalf("embed: %v", err)
+	}
+
+	want := []string{"Query: adoption ?", "search_document: chunk one", "search_document: chunk two", "raw"}
+	if strings.Join(inner.texts, "|") != strings.Join(want, "|") {
+		t.Fatalf("unexpected embedded texts: %q", inner.texts)
+	}
+}
+
+type textRecordingEmbedder struct {
+	texts []string
+}
+
+func (e *textRecordingEmbedder) Embed(_ context.Context, texts []string) ([][]float32, error) {
+	e.texts = append(e.texts, texts...)
+	vectors := make([][]float32, len(texts))
+	for i := range texts {
+		vectors[i] = []float32{1}
+	}
+	return vectors, nil
+}
@@ -0,0 +1,107 @@
+package unit
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/fabfab/go-agent/chat"
+)
+
+// variantStore returns the ranking registered for the first component of the
+// query vector and records the vectors it was asked about.
+type variantStore struct {
+	rankings map[float32][]chat.ChunkResult
+	searched []float32
+}
+
+func (v *variantStore) SimilarChunks(_ context.Context, embedding []float32, limit int, _ chat.Filter) ([]chat.ChunkResult, error) {
+	v.searched = append(v.searched, embedding[0])
+	results := v.rankings[embedding[0]]
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+var _ chat.VectorStore = (*variantStore)(nil)
+
+func TestChatServiceMultiQueryFusesVariants(t *testing.T) {
+	store := &variantStore{rankings: map[float32][]chat.ChunkResult{
+		1: {hybridChunk("a"), hybridChunk("b")},
+		2: {hybridChunk("c"), hybridChunk("b")},
+		3: {hybridChunk("b")},
+	}}
+	embedder := &keyedEmbedder{vectors: map[string][]float32{
+		"reset login":              {1},
+		"how to reset my password": {2},
+		"change account password":  {3},
+	}}
+	client := &scriptedLLM{replies: []string{
+		`{"queries": ["how to reset my password", "Reset login", " ", "change account password", "one too many"]}`,
+		"answer",
+	}}
+	svc := chat.NewService(store, &stubGraphStore{}, embedder, client, log.New(io.Discard, "", 0))
+
+	resp, err := svc.Chat(context.Background(), "reset login", chat.Config{SimilarityLimit: 2, QueryExpansion: chat.QueryExpansionMultiQuery, QueryVariants: 4})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	// The repeat of the question and the blank variant are dropped and the
+	// fifth suggestion exceeds the requested count.
+	if len(store.searched) != 3 {
+		t.Fatalf("expected the question and two variants to be searched, got %v", store.searched)
+	}
+	if got := strings.Join(sourcePaths(resp.Sources), ","); got != "b.md,a.md" {
+		t.Fatalf("expected b, found by every query, to lead, got %s", got)
+	}
+	var prompt strings.Builder
+	for _, message := range client.received[0] {
+		prompt.WriteString(message.Content)
+	}
+	if !strings.Contains(prompt.String(), "Return 4 different phrasings") {
+		t.Fatalf("expected the variant count in the prompt, got %q", prompt.String())
+	}
+}
+
+func TestChatServiceHyDESearchesHypotheticalAnswer(t *testing.T) {
+	store := &variantStore{rankings: map[float32][]chat.ChunkResult{
+		1: {hybridChunk("a")},
+		2: {hybridChunk("b")},
+	}}
+	embedder := &keyedEmbedder{vectors: map[string][]float32{
+		"what is sso?":                           {1},
+		"Single sign-on lets users log in once.": {2},
+	}}
+	client := &scriptedLLM{replies: []string{" Single sign-on lets users log in once. ", "answer"}}
+	svc := chat.NewService(store, &stubGraphStore{}, embedder, client, log.New(io.Discard, "", 0))
+
+	resp, err := svc.Chat(context.Background(), "what is sso?", chat.Config{QueryExpansion: chat.QueryExpansionHyDE})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if len(store.searched) != 2 || len(resp.Sources) != 2 {
+		t.Fatalf("expected the question and the hypothetical answer to be searched, got %v", store.searched)
+	}
+}
+
+func TestChatServiceExpansionFallsBackToQuestion(t *testing.T) {
+	store := &variantStore{rankings: map[float32][]chat.ChunkResult{1: {hybridChunk("a")}}}
+	embedder := &keyedEmbedder{vectors: map[string][]float32{"question": {1}}}
+	client := &scriptedLLM{replies: []string{"not json", "still not json", "answer"}}
+	svc := chat.NewService(store, &stubGraphStore{}, embedder, client, log.New(io.Discard, "", 0))
+
+	resp, err := svc.Chat(context.Background(), "question", chat.Config{QueryExpansion: chat.QueryExpansionMultiQuery})
+	if err != nil {
+		t.Fatalf("expected expansion failures to be tolerated, got %v", err)
+	}
+	if resp.Answer != "answer" || len(store.searched) != 1 {
+		t.Fatalf("expected the question alone to be searched, got %v", store.searched)
+	}
+
+	if _, err := svc.Chat(context.Background(), "question", chat.Config{QueryExpansion: "rewrite"}); err == nil {
+		t.Fatal("expected an unknown strategy to be rejected")
+	}
+}
@@ -0,0 +1,278 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fabfab/go-agent/chat"
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/embeddings"
+	"github.com/fabfab/go-agent/llm"
+)
+
+func TestFallbackClientFailsOverBeforeFirstChunk(t *testing.T) {
+	primary := &flakyStreamLLM{err: errors.New("connection refused")}
+	primaryDown := &stubStreamLLM{err: errors.New("model not loaded")}
+	secondary := &stubStreamLLM{chunks: []string{"Hel", "lo"}}
+	client := llm.NewFallbackClient(
+		llm.NamedClient{Name: "ollama/llama3.1:8b", Client: primaryDown},
+		llm.NamedClient{Name: "openai/gpt-4o-mini", Client: secondary},
+		llm.NamedClient{Name: "unused", Client: primary},
+	).(llm.StreamClient)
+
+	meter := &llm.Meter{}
+	var answer string
+	err := client.GenerateStream(llm.WithMeter(context.Background(), meter), []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}, func(chunk string) error {
+		answer += chunk
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("generate stream: %v", err)
+	}
+	if answer != "Hello" {
+		t.Fatalf("unexpected answer: %q", answer)
+	}
+	if meter.Provider() != "openai/gpt-4o-mini" {
+		t.Fatalf("expected fallback provider to be recorded, got %q", meter.Provider())
+	}
+	if primary.calls != 0 {
+		t.Fatal("expected remaining providers to be skipped after success")
+	}
+}
+
+func TestFallbackClientStopsAfterOutput(t *testing.T) {
+	primary := &flakyStreamLLM{err: errors.New("stream reset")}
+	secondary := &stubStreamLLM{chunks: []string{"unexpected"}}
+	client := llm.NewFallbackClient(
+		llm.NamedClient{Name: "ollama/llama3.1:8b", Client: primary},
+		llm.NamedClient{Name: "openai/gpt-4o-mini", Client: secondary},
+	).(llm.StreamClient)
+
+	var chunks []string
+	err := client.GenerateStream(context.Background(), []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}, func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected mid-stream error to be returned")
+	}
+	if secondary.calls != 0 || len(chunks) != 1 {
+		t.Fatalf("expected no failover after output, got chunks %v and %d fallback calls", chunks, secondary.calls)
+	}
+}
+
+func TestFallbackClientReportsAllFailures(t *testing.T) {
+	client := llm.NewFallbackClient(
+		llm.NamedClient{Name: "ollama/llama3.1:8b", Client: &stubLLM{err: errors.New("down")}},
+		llm.NamedClient{Name: "openai/gpt-4o-mini", Client: &stubLLM{err: errors.New("rate limited")}},
+	)
+
+	_, err := client.Generate(context.Background(), []llm.Message{{Role: llm.RoleUser, Content: "Hi"}})
+	if err == nil {
+		t.Fatal("expected error when every provider fails")
+	}
+	for _, want := range []string{"ollama/llama3.1:8b: down", "openai/gpt-4o-mini: rate limited"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in error, got %v", want, err)
+		}
+	}
+}
+
+func TestNewClientBuildsFallbackChain(t *testing.T) {
+	cfg := config.Config{
+		LLM: config.LLMConfig{
+			Provider:  config.ProviderOllama,
+			Model:     "llama3.1:8b",
+			Fallbacks: []config.ProviderSpec{{Provider: config.ProviderOpenAI, Model: "gpt-4o-mini"}},
+		},
+	}
+	if _, err := llm.NewClient(cfg); err == nil {
+		t.Fatal("expected fallback without OPENAI_API_KEY to be rejected")
+	}
+
+	cfg.OpenAIAPIKey = "test"
+	client, err := llm.NewClient(cfg)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	if _, ok := client.(llm.ToolClient); !ok {
+		t.Fatal("expected fallback chain to support tools")
+	}
+}
+
+func TestFallbackEmbedderRequiresMatchingDimension(t *testing.T) {
+	primary := embeddings.NamedEmbedder{Name: "ollama/nomic-embed-text", Dimension: 3, Embedder: &stubEmbedder{err: errors.New("down")}}
+
+	if _, err := embeddings.NewFallbackEmbedder(primary, embeddings.NamedEmbedder{
+		Name: "openai/text-embedding-3-small", Dimension: 1536, Embedder: &stubEmbedder{},
+	}); err == nil {
+		t.Fatal("expected fallback with a different dimension to be rejected")
+	}
+
+	embedder, err := embeddings.NewFallbackEmbedder(primary, embeddings.NamedEmbedder{
+		Name: "openai/nomic-embed-text", Dimension: 3, Embedder: &stubEmbedder{vectors: [][]float32{{0.1, 0.2, 0.3}}},
+	})
+	if err != nil {
+		t.Fatalf("new fallback embedder: %v", err)
+	}
+	vectors, err := embedder.Embed(context.Background(), []string{"hello"})
+	if err != nil {
+		t.Fatalf("embed: %v", err)
+	}
+	if len(vectors) != 1 || len(vectors[0]) != 3 {
+		t.Fatalf("unexpected vectors: %v", vectors)
+	}
+}
+
+func TestFallbackEmbedderRejectsWrongSizedVectors(t *testing.T) {
+	embedder, err := embeddings.NewFallbackEmbedder(
+		embeddings.NamedEmbedder{Name: "ollama/nomic-embed-text", Dimension: 3, Embedder: &stubEmbedder{err: errors.New("down")}},
+		embeddings.NamedEmbedder{Name: "openai/nomic-embed-text", Dimension: 3, Embedder: &stubEmbedder{vectors: [][]float32{{0.1, 0.2}}}},
+	)
+	if err != nil {
+		t.Fatalf("new fallback embedder: %v", err)
+	}
+	if _, err := embedder.Embed(context.Background(), []string{"hello"}); err == nil {
+		t.Fatal("expected vectors of the wrong dimension to be rejected")
+	}
+}
+
+// modelServer answers Ollama embed requests for every model except down,
+// recording the texts sent per model.
+func modelServer(t *testing.T, down string) (*httptest.Server, map[string][]string) {
+	t.Helper()
+	var mu sync.Mutex
+	received := map[string][]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string   `json:"model"`
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		if req.Model == down {
+			http.Error(w, "model unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		mu.Lock()
+		received[req.Model] = append(received[req.Model], req.Input...)
+		mu.Unlock()
+		vectors := make([][]float32, len(req.Input))
+		for i := range vectors {
+			vectors[i] = []float32{1, 0}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"embeddings": vectors})
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func TestFallbackEmbedderUsesTheServingModelsTemplates(t *testing.T) {
+	server, received := modelServer(t, "nomic-embed-text")
+	embedder, err := embeddings.NewEmbedder(config.Config{
+		OllamaHost: server.URL,
+		Embeddings: config.EmbeddingConfig{
+			Provider:  config.ProviderOllama,
+			Model:     "nomic-embed-text",
+			Dimension: 2,
+			Fallbacks: []config.ProviderSpec{{Provider: config.ProviderOllama, Model: "mxbai-embed-large"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("new embedder: %v", err)
+	}
+
+	if _, err := embeddings.EmbedQuery(context.Background(), embedder, []string{"pricing"}); err != nil {
+		t.Fatalf("embed query: %v", err)
+	}
+	_, served, err := embeddings.EmbedDocumentsServed(context.Background(), embedder, []string{"chunk"})
+	if err != nil {
+		t.Fatalf("embed documents: %v", err)
+	}
+
+	want := []string{"Represent this sentence for searching relevant passages: pricing", "chunk"}
+	if strings.Join(received["mxbai-embed-large"], "|") != strings.Join(want, "|") {
+		t.Fatalf("expected the fallback's own templates, got %q", received["mxbai-embed-large"])
+	}
+	if served.Model != "mxbai-embed-large" {
+		t.Fatalf("expected the fallback to be reported as serving the batch, got %s", served)
+	}
+	if fp, _ := embeddings.FingerprintOf(embedder); fp.Model != "nomic-embed-text" || fp.Template != "search_document: " {
+		t.Fatalf("expected the chain to report the primary fingerprint, got %s", fp)
+	}
+}
+
+func TestChatServiceRefusesQueriesEmbeddedByAFallback(t *testing.T) {
+	server, _ := modelServer(t, "nomic-embed-text")
+	embedCfg := config.EmbeddingConfig{
+		Provider:  config.ProviderOllama,
+		Model:     "nomic-embed-text",
+		Dimension: 2,
+		Fallbacks: []config.ProviderSpec{{Provider: config.ProviderOllama, Model: "mxbai-embed-large"}},
+	}
+	embedder, err := embeddings.NewEmbedder(config.Config{OllamaHost: server.URL, Embeddings: embedCfg})
+	if err != nil {
+		t.Fatalf("new embedder: %v", err)
+	}
+
+	_, served, err := embeddings.EmbedQueryServed(context.Background(), embedder, []string{"pricing"})
+	if err != nil {
+		t.Fatalf("embed query: %v", err)
+	}
+	if served.Model != "mxbai-embed-large" {
+		t.Fatalf("expected the fallback to be reported as serving the query, got %s", served)
+	}
+
+	store := &fingerprintedVectorStore{
+		stubVectorStore: stubVectorStore{results: []chat.ChunkResult{{DocumentID: "doc-1", Title: "Doc", Content: "Content"}}},
+		fingerprint:     embeddings.FingerprintFor(embedCfg),
+	}
+	svc := chat.NewService(store, &stubGraphStore{}, embedder, &stubLLM{answer: "ok"}, log.New(io.Discard, "", 0))
+	if _, err := svc.Chat(context.Background(), "What is the plan?", chat.Config{}); !errors.Is(err, embeddings.ErrFingerprintMismatch) {
+		t.Fatalf("expected a fingerprint mismatch, got %v", err)
+	}
+	if _, err := svc.Chat(context.Background(), "What is the plan?", chat.Config{AllowEmbeddingMismatch: true}); err != nil {
+		t.Fatalf("expected the override to allow the search, got %v", err)
+	}
+}
+
+type stubStreamLLM struct {
+	chunks []string
+	err    error
+	calls  int
+}
+
+func (s *stubStreamLLM) Generate(context.Context, []llm.Message) (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	var answer string
+	for _, chunk := range s.chunks {
+		answer += chunk
+	}
+	return answer, nil
+}
+
+func (s *stubStreamLLM) GenerateStream(_ context.Context, _ []llm.Message, fn func(string) error) error {
+	s.calls++
+	if s.err != nil {
+		return s.err
+	}
+	for _, chunk := range s.chunks {
+		if err := fn(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ llm.StreamClient = (*stubStreamLLM)(nil)
@@ -0,0 +1,136 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/fabfab/go-agent/chat"
+	"github.com/fabfab/go-agent/config"
+)
+
+func scoredChunk(id string, score float64) chat.ChunkResult {
+	chunk := hybridChunk(id)
+	chunk.Score = score
+	return chunk
+}
+
+func TestChatServiceMinScoreDropsWeakChunks(t *testing.T) {
+	store := &stubVectorStore{results: []chat.ChunkResult{scoredChunk("a", 0.9), scoredChunk("b", 0.3)}}
+	svc := chat.NewService(store, &stubGraphStore{}, &stubEmbedder{vectors: [][]float32{{0.1}}}, &stubLLM{answer: "ok"}, log.New(io.Discard, "", 0))
+
+	resp, err := svc.Chat(context.Background(), "question", chat.Config{MinScore: 0.5})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if got := sourcePaths(resp.Sources); len(got) != 1 || got[0] != "a.md" || !resp.Grounded {
+		t.Fatalf("expected only the strong chunk and a grounded answer, got %v (grounded %v)", got, resp.Grounded)
+	}
+
+	resp, err = svc.Chat(context.Background(), "question", chat.Config{MinScore: 0.95})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if len(resp.Sources) != 0 || resp.Answer != "ok" || resp.Grounded {
+		t.Fatalf("expected a lenient, ungrounded answer without context, got %+v", resp)
+	}
+}
+
+func TestChatServiceMinScoreComparesRerankScores(t *testing.T) {
+	var retrieved []chat.ChunkResult
+	for i, id := range []string{"a", "b", "c"} {
+		retrieved = append(retrieved, scoredChunk(id, 0.1*float64(3-i)))
+	}
+	svc := chat.NewService(&stubVectorStore{results: retrieved}, &stubGraphStore{}, &stubEmbedder{vectors: [][]float32{{0.1}}}, &stubLLM{answer: "ok"}, log.New(io.Discard, "", 0), chat.WithReranker(&reversingReranker{}))
+
+	// The reranker scores c 3, b 2 and a 1; retrieval scores are all below 1.
+	resp, err := svc.Chat(context.Background(), "question", chat.Config{Rerank: true, MinScore: 2})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if got := strings.Join(sourcePaths(resp.Sources), ","); got != "c.md,b.md" {
+		t.Fatalf("expected the chunks reranked at 2 or above, got %s", got)
+	}
+}
+
+func TestChatServiceMinScoreComparesSimilarityWithHybrid(t *testing.T) {
+	store := &hybridVectorStore{
+		vector:  []chat.ChunkResult{scoredChunk("a", 0.9), scoredChunk("b", 0.3)},
+		lexical: []chat.ChunkResult{hybridChunk("b"), hybridChunk("c")},
+	}
+	svc := chat.NewService(store, &stubGraphStore{}, &stubEmbedder{vectors: [][]float32{{0.1}}}, &stubLLM{answer: "ok"}, log.New(io.Discard, "", 0))
+
+	// Fusion ranks b first, but its similarity is low and c has none.
+	resp, err := svc.Chat(context.Background(), "question", chat.Config{SimilarityLimit: 3, Hybrid: true, MinScore: 0.5})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if got := strings.Join(sourcePaths(resp.Sources), ","); got != "a.md" {
+		t.Fatalf("expected only the similar chunk, got %s", got)
+	}
+}
+
+func TestChatServiceMinScoreComparesSimilarityWithMultiQuery(t *testing.T) {
+	store := &variantStore{rankings: map[float32][]chat.ChunkResult{
+		1: {scoredChunk("a", 0.9), scoredChunk("b", 0.2)},
+		2: {scoredChunk("b", 0.6), scoredChunk("c", 0.4)},
+	}}
+	embedder := &keyedEmbedder{vectors: map[string][]float32{
+		"reset login":              {1},
+		"how to reset my password": {2},
+	}}
+	client := &scriptedLLM{replies: []string{`{"queries": ["how to reset my password"]}`, "answer"}}
+	svc := chat.NewService(store, &stubGraphStore{}, embedder, client, log.New(io.Discard, "", 0))
+
+	// b keeps its best similarity across the queries.
+	resp, err := svc.Chat(context.Background(), "reset login", chat.Config{SimilarityLimit: 3, QueryExpansion: chat.QueryExpansionMultiQuery, MinScore: 0.5})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if got := strings.Join(sourcePaths(resp.Sources), ","); got != "b.md,a.md" {
+		t.Fatalf("expected the chunks reaching the threshold for some query, got %s", got)
+	}
+}
+
+func TestChatServiceStrictGrounding(t *testing.T) {
+	weak := []chat.ChunkResult{scoredChunk("a", 0.2)}
+
+	client := &scriptedLLM{}
+	svc := chat.NewService(&stubVectorStore{results: weak}, &stubGraphStore{}, &stubEmbedder{vectors: [][]float32{{0.1}}}, client, log.New(io.Discard, "", 0))
+	var streamed strings.Builder
+	resp, _, err := svc.ChatStream(context.Background(), "question", chat.Config{Grounding: config.GroundingNotFound, MinScore: 0.5}, nil, func(chunk string) error {
+		streamed.WriteString(chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if resp.Answer != chat.NotFoundAnswer || streamed.String() != chat.NotFoundAnswer || resp.Grounded || len(client.received) != 0 {
+		t.Fatalf("expected the not-found reply without an LLM call, got %+v after %d calls", resp, len(client.received))
+	}
+
+	_, err = svc.Chat(context.Background(), "question", chat.Config{Grounding: config.GroundingRefuse, MinScore: 0.5})
+	if !errors.Is(err, chat.ErrNotGrounded) {
+		t.Fatalf("expected ErrNotGrounded, got %v", err)
+	}
+
+	client = &scriptedLLM{replies: []string{"Sorry. " + chat.NotFoundAnswer}}
+	svc = chat.NewService(&stubVectorStore{results: weak}, &stubGraphStore{}, &stubEmbedder{vectors: [][]float32{{0.1}}}, client, log.New(io.Discard, "", 0))
+	resp, err = svc.Chat(context.Background(), "question", chat.Config{Grounding: config.GroundingRefuse})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if resp.Grounded || len(resp.Sources) != 1 {
+		t.Fatalf("expected a not-found reply from the model to be ungrounded, got %+v", resp)
+	}
+	if prompt := client.received[0][0].Content; !strings.Contains(prompt, "never general knowledge") {
+		t.Fatalf("expected the strict system prompt, got %q", prompt)
+	}
+
+	if _, err := svc.Chat(context.Background(), "question", chat.Config{Grounding: "loose"}); err == nil {
+		t.Fatal("expected an unknown grounding mode to be rejected")
+	}
+}
@@ -2,13 +2,19 @@ package unit
 
 import (
 	"context"
+	"errors"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/embeddings"
 	"github.com/fabfab/go-agent/ingestion"
 )
 
@@ -152,6 +158,28 @@ func TestIngestDocumentFromBytes(t *testing.T) {
 	}
 }
 
+func TestIngestDocumentRefusesVectorsFromAnotherModel(t *testing.T) {
+	server, _ := modelServer(t, "nomic-embed-text")
+	embedder, err := embeddings.NewEmbedder(config.Config{
+		OllamaHost: server.URL,
+		Embeddings: config.EmbeddingConfig{
+			Provider:  config.ProviderOllama,
+			Model:     "nomic-embed-text",
+			Dimension: 2,
+			Fallbacks: []config.ProviderSpec{{Provider: config.ProviderOllama, Model: "mxbai-embed-large"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("new embedder: %v", err)
+	}
+	svc := ingestion.NewService(nil, nil, embedder, log.New(io.Discard, "", 0), 2)
+
+	_, err = svc.IngestDocument(context.Background(), ingestion.DocumentPayload{Path: "memory/doc.md", Data: []byte("# Doc\n\nBody.")})
+	if !errors.Is(err, embeddings.ErrFingerprintMismatch) {
+		t.Fatalf("expected vectors of the fallback model to be refused, got %v", err)
+	}
+}
+
 func TestIngestDocumentMatchesDiskIngestion(t *testing.T) {
 	t.Parallel()
 
@@ -366,3 +394,90 @@ func TestChunkMarkdownHandlesEmpty(t *testing.T) {
 		t.Fatalf("expected no topics for empty content, got %d", len(topics))
 	}
 }
+
+func TestIngestDocumentReusesCachedEmbeddings(t *testing.T) {
+	t.Parallel()
+
+	paragraph := func(letter string) string { return strings.Repeat(letter, 700) }
+	original := "# Cached\n\n" + paragraph("a") + "\n\n" + paragraph("b") + "\n\n" + paragraph("c")
+	edited := original + "\n\n" + paragraph("d")
+
+	embed := &mockEmbedder{}
+	cache := &memoryEmbeddingCache{entries: map[string][]float32{}}
+	fp := embeddings.Fingerprint{Provider: "ollama", Model: "nomic-embed-text", Dimension: 1}
+	svc := ingestion.NewService(nil, nil, embed, nil, 1, ingestion.WithEmbeddingCache(cache, fp))
+
+	first, err := svc.IngestDocument(context.Background(), ingestion.DocumentPayload{Path: "cached.md", Data: []byte(original)})
+	if err != nil {
+		t.Fatalf("ingest original: %v", err)
+	}
+	if len(embed.lastTexts) != len(first.Fragments) {
+		t.Fatalf("expected every chunk to be embedded on first ingest, got %d of %d", len(embed.lastTexts), len(first.Fragments))
+	}
+
+	second, err := svc.IngestDocument(context.Background(), ingestion.DocumentPayload{Path: "cached.md", Data: []byte(edited)})
+	if err != nil {
+		t.Fatalf("ingest edited: %v", err)
+	}
+	if embed.calls != 2 || len(embed.lastTexts) != len(second.Fragments)-len(first.Fragments) {
+		t.Fatalf("expected only the new chunk to be embedded, got %d texts over %d calls", len(embed.lastTexts), embed.calls)
+	}
+	for i, fragment := range second.Fragments {
+		if got := second.Embeddings[i][0]; got != float32(len(fragment.Text)) {
+			t.Fatalf("embedding %d mismatch: want %d, got %f", i, len(fragment.Text), got)
+		}
+	}
+
+	if _, err := svc.IngestDocument(context.Background(), ingestion.DocumentPayload{Path: "copy.md", Data: []byte(edited)}); err != nil {
+		t.Fatalf("ingest copy: %v", err)
+	}
+	if embed.calls != 2 {
+		t.Fatalf("expected a fully cached document not to call the embedder, got %d calls", embed.calls)
+	}
+}
+
+type memoryEmbeddingCache struct {
+	mu      sync.Mutex
+	entries map[string][]float32
+}
+
+func (c *memoryEmbeddingCache) Get(_ context.Context, fp embeddings.Fingerprint, hashes []string) (map[string][]float32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	found := map[string][]float32{}
+	for _, hash := range hashes {
+		if vector, ok := c.entries[fp.String()+hash]; ok {
+			found[hash] = vector
+		}
+	}
+	return found, nil
+}
+
+func (c *memoryEmbeddingCache) Put(_ context.Context, fp embeddings.Fingerprint, vectors map[string][]float32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for hash, vector := range vectors {
+		c.entries[fp.String()+hash] = vector
+	}
+	return nil
+}
+
+var _ embeddings.Cache = (*memoryEmbeddingCache)(nil)
+
+func TestIngestDocumentEmbedsWithDocumentTemplate(t *testing.T) {
+	t.Parallel()
+
+	inner := &textRecordingEmbedder{}
+	embedder := embeddings.NewTemplatedEmbedder(inner, embeddings.Templates{Query: "search_query: ", Document: "search_document: "})
+	svc := ingestion.NewService(nil, nil, embedder, nil, 1)
+
+	res, err := svc.IngestDocument(context.Background(), ingestion.DocumentPayload{Path: "doc.md", Data: []byte("# Title\n\nBody text.")})
+	if err != nil {
+		t.Fatalf("ingest: %v", err)
+	}
+	for i, fragment := range res.Fragments {
+		if inner.texts[i] != "search_document: "+fragment.Text {
+			t.Fatalf("expected chunk %d to use the document template, got %q", i, inner.texts[i])
+		}
+	}
+}
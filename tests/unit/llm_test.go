@@ -1,6 +1,14 @@
 package unit
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/fabfab/go-agent/config"
@@ -38,3 +46,403 @@ func TestNewClientOpenAIRequiresAPIKey(t *testing.T) {
 		t.Fatal("expected error for missing OPENAI_API_KEY")
 	}
 }
+
+func TestNewClientAnthropicRequiresAPIKey(t *testing.T) {
+	cfg := config.Config{
+		LLM: config.LLMConfig{
+			Provider: config.ProviderAnthropic,
+			Model:    "claude-sonnet-4-5",
+		},
+	}
+
+	if _, err := llm.NewClient(cfg); err == nil {
+		t.Fatal("expected error for missing ANTHROPIC_API_KEY")
+	}
+}
+
+func TestAnthropicClientGenerate(t *testing.T) {
+	var received map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if got := r.Header.Get("x-api-key"); got != "test-key" {
+			t.Errorf("unexpected api key header: %q", got)
+		}
+		if r.Header.Get("anthropic-version") == "" {
+			t.Error("expected anthropic-version header")
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		fmt.Fprint(w, `{"content":[{"type":"text","text":"Hello "},{"type":"text","text":"there"}]}`)
+	}))
+	defer server.Close()
+
+	client := llm.NewAnthropicClient(llm.Options{Model: "claude-sonnet-4-5", AnthropicAPIKey: "test-key", AnthropicBaseURL: server.URL})
+	answer, err := client.Generate(context.Background(), []llm.Message{
+		{Role: llm.RoleSystem, Content: "Be brief."},
+		{Role: llm.RoleUser, Content: "Hi"},
+	})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	if answer != "Hello there" {
+		t.Fatalf("unexpected answer: %q", answer)
+	}
+	if received["system"] != "Be brief." {
+		t.Fatalf("expected system prompt as top-level field, got %#v", received["system"])
+	}
+	messages, _ := received["messages"].([]any)
+	if len(messages) != 1 {
+		t.Fatalf("expected system message to be removed from messages, got %#v", messages)
+	}
+	if _, ok := received["max_tokens"]; !ok {
+		t.Fatal("expected max_tokens to be set")
+	}
+}
+
+func TestAnthropicClientGenerateStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":30,\"output_tokens\":1}}}\n\n")
+		fmt.Fprint(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hel\"}}\n\n")
+		fmt.Fprint(w, "event: ping\ndata: {\"type\":\"ping\"}\n\n")
+		fmt.Fprint(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"lo\"}}\n\n")
+		fmt.Fprint(w, "event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":2}}\n\n")
+		fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+	}))
+	defer server.Close()
+
+	client := llm.NewAnthropicClient(llm.Options{Model: "claude-sonnet-4-5", AnthropicAPIKey: "test-key", AnthropicBaseURL: server.URL}).(llm.StreamClient)
+
+	meter := &llm.Meter{}
+	var chunks []string
+	if err := client.GenerateStream(llm.WithMeter(context.Background(), meter), []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}, func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	}); err != nil {
+		t.Fatalf("generate stream: %v", err)
+	}
+
+	if len(chunks) != 2 || chunks[0]+chunks[1] != "Hello" {
+		t.Fatalf("unexpected streamed chunks: %#v", chunks)
+	}
+	if usage := meter.Usage(); usage.PromptTokens != 30 || usage.CompletionTokens != 2 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+}
+
+func TestAnthropicClientGenerateStreamRejectsTruncatedStreams(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":30,\"output_tokens\":1}}}\n\n")
+		fmt.Fprint(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hel\"}}\n\n")
+	}))
+	defer server.Close()
+
+	client := llm.NewAnthropicClient(llm.Options{Model: "claude-sonnet-4-5", AnthropicAPIKey: "test-key", AnthropicBaseURL: server.URL}).(llm.StreamClient)
+
+	err := client.GenerateStream(context.Background(), []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}, func(string) error { return nil })
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestAnthropicClientSurfacesAPIErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens is too large"}}`)
+	}))
+	defer server.Close()
+
+	client := llm.NewAnthropicClient(llm.Options{Model: "claude-sonnet-4-5", AnthropicAPIKey: "test-key", AnthropicBaseURL: server.URL})
+	_, err := client.Generate(context.Background(), []llm.Message{{Role: llm.RoleUser, Content: "Hi"}})
+	if err == nil || !strings.Contains(err.Error(), "max_tokens is too large") {
+		t.Fatalf("expected API error message, got %v", err)
+	}
+}
+
+var searchTool = llm.Tool{
+	Name:        "search_chunks",
+	Description: "Search the knowledge base",
+	Parameters:  json.RawMessage(`{"type":"object","properties":{"query":{"type":"string"}},"required":["query"]}`),
+}
+
+func TestOllamaClientToolCalls(t *testing.T) {
+	var received map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"search_chunks","arguments":{"query":"adoption"}}}]},"done":true}`)
+	}))
+	defer server.Close()
+
+	client := llm.NewOllamaClient(llm.Options{Model: "llama3.1:8b", OllamaHost: server.URL}).(llm.ToolClient)
+	reply, err := client.GenerateWithTools(context.Background(), []llm.Message{
+		{Role: llm.RoleUser, Content: "What is our adoption strategy?"},
+		{Role: llm.RoleAssistant, ToolCalls: []llm.ToolCall{{ID: "call_0", Name: "search_chunks", Arguments: `{"query":"strategy"}`}}},
+		{Role: llm.RoleTool, Name: "search_chunks", ToolCallID: "call_0", Content: "no results"},
+	}, []llm.Tool{searchTool})
+	if err != nil {
+		t.Fatalf("generate with tools: %v", err)
+	}
+
+	tools, ok := received["tools"].([]any)
+	if !ok || len(tools) != 1 {
+		t.Fatalf("expected one tool in request, got %#v", received["tools"])
+	}
+	messages, _ := received["messages"].([]any)
+	if len(messages) != 3 {
+		t.Fatalf("expected three messages in request, got %d", len(messages))
+	}
+	if toolMsg, _ := messages[2].(map[string]any); toolMsg["tool_name"] != "search_chunks" {
+		t.Fatalf("expected tool_name on tool message, got %#v", toolMsg)
+	}
+
+	if len(reply.ToolCalls) != 1 {
+		t.Fatalf("expected one tool call, got %d", len(reply.ToolCalls))
+	}
+	var args struct {
+		Query string `json:"query"`
+	}
+	if err := reply.ToolCalls[0].DecodeArguments(&args); err != nil {
+		t.Fatalf("decode arguments: %v", err)
+	}
+	if reply.ToolCalls[0].Name != "search_chunks" || args.Query != "adoption" {
+		t.Fatalf("unexpected tool call: %+v", reply.ToolCalls[0])
+	}
+}
+
+func TestOpenAIClientStreamsToolCallDeltas(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		events := []string{
+			`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"search_chunks","arguments":""}}]}}]}`,
+			`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"query\":"}}]}}]}`,
+			`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"adoption\"}"}}]}}]}`,
+			`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+		}
+		for _, event := range events {
+			fmt.Fprintf(w, "data: %s\n\n", event)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	client := llm.NewOpenAIClient(llm.Options{Model: "gpt-4o", OpenAIAPIKey: "test", OpenAIBaseURL: server.URL + "/v1"}).(llm.ToolClient)
+
+	deltas := 0
+	reply, err := client.GenerateWithToolsStream(context.Background(), []llm.Message{{Role: llm.RoleUser, Content: "hi"}}, []llm.Tool{searchTool}, func(delta llm.StreamDelta) error {
+		deltas += len(delta.ToolCalls)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("stream with tools: %v", err)
+	}
+
+	if deltas != 3 {
+		t.Fatalf("expected 3 tool call deltas, got %d", deltas)
+	}
+	if len(reply.ToolCalls) != 1 {
+		t.Fatalf("expected one assembled tool call, got %d", len(reply.ToolCalls))
+	}
+	call := reply.ToolCalls[0]
+	if call.ID != "call_a" || call.Name != "search_chunks" || call.Arguments != `{"query":"adoption"}` {
+		t.Fatalf("unexpected assembled tool call: %+v", call)
+	}
+}
+
+func TestGenerationOptionsMerge(t *testing.T) {
+	lowTemp, highTemp := 0.1, 0.9
+	base := config.GenerationOptions{Temperature: &lowTemp, MaxTokens: 256, NumCtx: 8192}
+	merged := base.Merge(config.GenerationOptions{Temperature: &highTemp, Stop: []string{"END"}})
+
+	if merged.Temperature == nil || *merged.Temperature != highTemp {
+		t.Fatalf("expected override temperature, got %v", merged.Temperature)
+	}
+	if merged.MaxTokens != 256 || merged.NumCtx != 8192 {
+		t.Fatalf("expected unset fields to keep defaults, got %+v", merged)
+	}
+	if len(merged.Stop) != 1 || merged.Stop[0] != "END" {
+		t.Fatalf("unexpected stop sequences: %v", merged.Stop)
+	}
+	if *base.Temperature != lowTemp {
+		t.Fatal("merge must not modify the receiver")
+	}
+}
+
+func TestOllamaClientAppliesGenerationOptions(t *testing.T) {
+	var received map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":"ok"},"done":true}`)
+	}))
+	defer server.Close()
+
+	temperature, seed := 0.0, 42
+	client := llm.NewOllamaClient(llm.Options{
+		Model:      "llama3.1:8b",
+		OllamaHost: server.URL,
+		Generation: config.GenerationOptions{Temperature: &temperature, NumCtx: 16384},
+	})
+	ctx := llm.WithGenerationOptions(context.Background(), config.GenerationOptions{MaxTokens: 128, Seed: &seed, Stop: []string{"###"}})
+	if _, err := client.Generate(ctx, []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	options, ok := received["options"].(map[string]any)
+	if !ok {
+		t.Fatalf("expected options in request, got %#v", received)
+	}
+	if options["temperature"] != 0.0 {
+		t.Fatalf("expected explicit zero temperature to be sent, got %#v", options["temperature"])
+	}
+	if options["num_ctx"] != 16384.0 || options["num_predict"] != 128.0 || options["seed"] != 42.0 {
+		t.Fatalf("unexpected options: %#v", options)
+	}
+	if stop, _ := options["stop"].([]any); len(stop) != 1 || stop[0] != "###" {
+		t.Fatalf("unexpected stop sequences: %#v", options["stop"])
+	}
+}
+
+func TestOpenAIClientSendsExplicitZeroSampling(t *testing.T) {
+	var received map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}]}`)
+	}))
+	defer server.Close()
+
+	temperature := 0.0
+	client := llm.NewOpenAIClient(llm.Options{Model: "gpt-4o", OpenAIAPIKey: "test", OpenAIBaseURL: server.URL + "/v1"})
+	ctx := llm.WithGenerationOptions(context.Background(), config.GenerationOptions{Temperature: &temperature})
+	if _, err := client.Generate(ctx, []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	// go-openai omits zero floats, so an explicit zero travels as the
+	// smallest positive float32.
+	if value, ok := received["temperature"].(float64); !ok || value <= 0 || value > 1e-44 {
+		t.Fatalf("expected explicit zero temperature to be sent as a denormal, got %#v", received["temperature"])
+	}
+	if _, ok := received["top_p"]; ok {
+		t.Fatal("expected unset top_p to be omitted")
+	}
+}
+
+func TestAnthropicClientAppliesGenerationOptions(t *testing.T) {
+	var received map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		fmt.Fprint(w, `{"content":[{"type":"text","text":"ok"}]}`)
+	}))
+	defer server.Close()
+
+	topP := 0.5
+	client := llm.NewAnthropicClient(llm.Options{Model: "claude-sonnet-4-5", AnthropicAPIKey: "test-key", AnthropicBaseURL: server.URL})
+	ctx := llm.WithGenerationOptions(context.Background(), config.GenerationOptions{TopP: &topP, MaxTokens: 64, Stop: []string{"END"}})
+	if _, err := client.Generate(ctx, []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	if received["max_tokens"] != 64.0 || received["top_p"] != 0.5 {
+		t.Fatalf("unexpected sampling fields: %#v", received)
+	}
+	if _, ok := received["temperature"]; ok {
+		t.Fatal("expected unset temperature to be omitted")
+	}
+	if stop, _ := received["stop_sequences"].([]any); len(stop) != 1 || stop[0] != "END" {
+		t.Fatalf("unexpected stop sequences: %#v", received["stop_sequences"])
+	}
+}
+
+func TestOllamaClientReportsUsage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":"Hel"},"done":false}`+"\n")
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":"lo"},"done":true,"prompt_eval_count":120,"eval_count":2}`+"\n")
+	}))
+	defer server.Close()
+
+	meter := &llm.Meter{}
+	ctx := llm.WithMeter(context.Background(), meter)
+	client := llm.NewOllamaClient(llm.Options{Model: "llama3.1:8b", OllamaHost: server.URL}).(llm.StreamClient)
+	if err := client.GenerateStream(ctx, []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}, func(string) error { return nil }); err != nil {
+		t.Fatalf("generate stream: %v", err)
+	}
+
+	usage := meter.Usage()
+	if usage.PromptTokens != 120 || usage.CompletionTokens != 2 || usage.TotalTokens != 122 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+	if meter.Calls() != 1 {
+		t.Fatalf("expected one metered call, got %d", meter.Calls())
+	}
+}
+
+func TestOpenAIClientStreamReportsUsage(t *testing.T) {
+	var received map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		events := []string{
+			`{"choices":[{"index":0,"delta":{"content":"Hello"}}]}`,
+			`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			`{"choices":[],"usage":{"prompt_tokens":50,"completion_tokens":1,"total_tokens":51}}`,
+		}
+		for _, event := range events {
+			fmt.Fprintf(w, "data: %s\n\n", event)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	meter := &llm.Meter{}
+	ctx := llm.WithMeter(context.Background(), meter)
+	client := llm.NewOpenAIClient(llm.Options{Model: "gpt-4o", OpenAIAPIKey: "test", OpenAIBaseURL: server.URL + "/v1"}).(llm.StreamClient)
+	var answer strings.Builder
+	if err := client.GenerateStream(ctx, []llm.Message{{Role: llm.RoleUser, Content: "hi"}}, func(chunk string) error {
+		answer.WriteString(chunk)
+		return nil
+	}); err != nil {
+		t.Fatalf("generate stream: %v", err)
+	}
+
+	if answer.String() != "Hello" {
+		t.Fatalf("unexpected answer: %q", answer.String())
+	}
+	if options, _ := received["stream_options"].(map[string]any); options["include_usage"] != true {
+		t.Fatalf("expected include_usage stream option, got %#v", received["stream_options"])
+	}
+	if usage := meter.Usage(); usage.PromptTokens != 50 || usage.CompletionTokens != 1 || usage.TotalTokens != 51 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+}
+
+func TestLoadParsesProviderFallbacks(t *testing.T) {
+	t.Setenv("LLM_FALLBACKS", "openai:gpt-4o-mini, anthropic:claude-sonnet-4-5")
+	t.Setenv("EMBEDDING_FALLBACKS", "ollama:nomic-embed-text:v1.5@768,invalid")
+	cfg := config.Load()
+
+	chain := cfg.LLM.Chain()
+	if len(chain) != 3 || chain[1].String() != "openai/gpt-4o-mini" || chain[2].Provider != config.ProviderAnthropic {
+		t.Fatalf("unexpected llm chain: %+v", chain)
+	}
+	embeddingChain := cfg.Embeddings.Chain()
+	if len(embeddingChain) != 2 {
+		t.Fatalf("unexpected embedding chain: %+v", embeddingChain)
+	}
+	if fallback := embeddingChain[1]; fallback.Model != "nomic-embed-text:v1.5" || fallback.Dimension != 768 {
+		t.Fatalf("unexpected embedding fallback: %+v", fallback)
+	}
+}
@@ -0,0 +1,90 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/fabfab/go-agent/chat"
+	"github.com/fabfab/go-agent/embeddings"
+)
+
+// keyedEmbedder embeds texts with fixed vectors and records what it embedded.
+type keyedEmbedder struct {
+	vectors  map[string][]float32
+	embedded []string
+}
+
+func (k *keyedEmbedder) Embed(_ context.Context, texts []string) ([][]float32, error) {
+	out := make([][]float32, len(texts))
+	for i, text := range texts {
+		vector, ok := k.vectors[text]
+		if !ok {
+			return nil, fmt.Errorf("no vector for %q", text)
+		}
+		out[i] = vector
+	}
+	k.embedded = append(k.embedded, texts...)
+	return out, nil
+}
+
+var _ embeddings.Embedder = (*keyedEmbedder)(nil)
+
+func TestChatServiceMMRDiversifiesChunks(t *testing.T) {
+	a, b, c := hybridChunk("a"), hybridChunk("b"), hybridChunk("c")
+	a.Score, b.Score, c.Score = 0.9, 0.8, 0.7
+	a.Embedding = []float32{1, 0.1}
+	// b nearly duplicates a; c is less relevant but covers something else and
+	// comes back without an embedding.
+	b.Embedding = []float32{1, 0.12}
+	embedder := &keyedEmbedder{vectors: map[string][]float32{
+		"question":  {1, 0},
+		"content c": {0.6, -0.8},
+	}}
+	svc := chat.NewService(&stubVectorStore{results: []chat.ChunkResult{a, b, c}}, &stubGraphStore{}, embedder, &stubLLM{answer: "ok"}, log.New(io.Discard, "", 0))
+
+	resp, err := svc.Chat(context.Background(), "question", chat.Config{SimilarityLimit: 2, MMR: true})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if got := strings.Join(sourcePaths(resp.Sources), ","); got != "a.md,c.md" {
+		t.Fatalf("expected a and the diverse c, got %s", got)
+	}
+	if strings.Join(embedder.embedded, ",") != "question,content c" {
+		t.Fatalf("expected only the chunk without a vector to be embedded, got %v", embedder.embedded)
+	}
+
+	resp, err = svc.Chat(context.Background(), "question", chat.Config{SimilarityLimit: 2, MMR: true, MMRLambda: 1})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if got := strings.Join(sourcePaths(resp.Sources), ","); got != "a.md,b.md" {
+		t.Fatalf("expected lambda 1 to rank by relevance alone, got %s", got)
+	}
+
+	if _, err := svc.Chat(context.Background(), "question", chat.Config{MMR: true, MMRLambda: 1.5}); err == nil {
+		t.Fatal("expected a lambda above 1 to be rejected")
+	}
+}
+
+func TestChatServiceMMREmbedsMissingChunksAsDocuments(t *testing.T) {
+	a, c := hybridChunk("a"), hybridChunk("c")
+	a.Score, c.Score = 0.9, 0.7
+	a.Embedding = []float32{1, 0.1}
+	inner := &keyedEmbedder{vectors: map[string][]float32{
+		"query: question":    {1, 0},
+		"passage: content c": {0.6, -0.8},
+	}}
+	embedder := embeddings.NewTemplatedEmbedder(inner, embeddings.Templates{Query: "query: ", Document: "passage: "})
+	svc := chat.NewService(&stubVectorStore{results: []chat.ChunkResult{a, c}}, &stubGraphStore{}, embedder, &stubLLM{answer: "ok"}, log.New(io.Discard, "", 0))
+
+	if _, err := svc.Chat(context.Background(), "question", chat.Config{SimilarityLimit: 2, MMR: true}); err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if got := strings.Join(inner.embedded, ","); got != "query: question,passage: content c" {
+		t.Fatalf("expected the chunk to be embedded with the document template, got %s", got)
+	}
+}
@@ -0,0 +1,121 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/fabfab/go-agent/chat"
+)
+
+// documentStore serves one document whose chunks overlap by a paragraph, as
+// ingestion produces them: chunk i holds paragraphs p<i> and p<i+1>.
+type documentStore struct {
+	chunks   []chat.ChunkResult
+	hits     []int
+	ranges   [][2]int
+	sections []int
+}
+
+func newDocumentStore(count int, hits ...int) *documentStore {
+	store := &documentStore{hits: hits}
+	for i := 0; i < count; i++ {
+		chunk := hybridChunk(fmt.Sprintf("c%d", i))
+		chunk.DocumentID = "doc"
+		chunk.Path = "doc.md"
+		chunk.ChunkIndex = i
+		chunk.SectionOrder = i / 3
+		chunk.Content = fmt.Sprintf("p%d\n\np%d", i, i+1)
+		store.chunks = append(store.chunks, chunk)
+	}
+	return store
+}
+
+func (d *documentStore) SimilarChunks(_ context.Context, _ []float32, _ int, _ chat.Filter) ([]chat.ChunkResult, error) {
+	results := make([]chat.ChunkResult, len(d.hits))
+	for i, index := range d.hits {
+		results[i] = d.chunks[index]
+	}
+	return results, nil
+}
+
+func (d *documentStore) ChunkRange(_ context.Context, _ string, first, last int) ([]chat.ChunkResult, error) {
+	d.ranges = append(d.ranges, [2]int{first, last})
+	return d.chunks[first:min(last+1, len(d.chunks))], nil
+}
+
+func (d *documentStore) SectionChunks(_ context.Context, _ string, sectionOrder int) ([]chat.ChunkResult, error) {
+	d.sections = append(d.sections, sectionOrder)
+	var section []chat.ChunkResult
+	for _, chunk := range d.chunks {
+		if chunk.SectionOrder == sectionOrder {
+			section = append(section, chunk)
+		}
+	}
+	return section, nil
+}
+
+var (
+	_ chat.ChunkRangeReader = (*documentStore)(nil)
+	_ chat.SectionReader    = (*documentStore)(nil)
+)
+
+func TestChatServiceExpandsNeighbors(t *testing.T) {
+	store := newDocumentStore(8, 6, 0, 1)
+	client := &scriptedLLM{replies: []string{"answer"}}
+	svc := chat.NewService(store, &stubGraphStore{}, &stubEmbedder{vectors: [][]float32{{0.1}}}, client, log.New(io.Discard, "", 0))
+
+	resp, err := svc.Chat(context.Background(), "question", chat.Config{ContextExpansion: chat.ContextNeighbors})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	// Hits 0 and 1 share a window; hit 6 is read on its own.
+	if fmt.Sprint(store.ranges) != "[[0 2] [5 7]]" {
+		t.Fatalf("expected one read per run of windows, got %v", store.ranges)
+	}
+	want := "p0\n\np1\n\np2\n\np3\n\n[...]\n\np5\n\np6\n\np7\n\np8"
+	if len(resp.Sources) != 1 || resp.Sources[0].Passage != want {
+		t.Fatalf("expected merged passages in document order, got %+v", resp.Sources)
+	}
+	if prompt := client.received[0][len(client.received[0])-1].Content; !strings.Contains(prompt, want) {
+		t.Fatalf("expected the passage in the prompt, got %q", prompt)
+	}
+	if resp.Timings.ContextExpansion <= 0 {
+		t.Fatalf("expected the reads timed as context expansion, got %+v", resp.Timings)
+	}
+}
+
+func TestChatServiceExpandsSections(t *testing.T) {
+	store := newDocumentStore(6, 4, 5)
+	svc := chat.NewService(store, &stubGraphStore{}, &stubEmbedder{vectors: [][]float32{{0.1}}}, &stubLLM{answer: "ok"}, log.New(io.Discard, "", 0))
+
+	resp, err := svc.Chat(context.Background(), "question", chat.Config{ContextExpansion: chat.ContextSection})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if fmt.Sprint(store.sections) != "[1]" {
+		t.Fatalf("expected the shared section to be read once, got %v", store.sections)
+	}
+	if got := resp.Sources[0].Passage; got != "p3\n\np4\n\np5\n\np6" {
+		t.Fatalf("expected the whole section, got %q", got)
+	}
+
+	if _, err := svc.Chat(context.Background(), "question", chat.Config{ContextExpansion: "paragraph"}); err == nil {
+		t.Fatal("expected an unknown mode to be rejected")
+	}
+}
+
+func TestChatServiceContextExpansionNeedsReader(t *testing.T) {
+	svc := chat.NewService(&stubVectorStore{results: []chat.ChunkResult{hybridChunk("a")}}, &stubGraphStore{}, &stubEmbedder{vectors: [][]float32{{0.1}}}, &stubLLM{answer: "ok"}, log.New(io.Discard, "", 0))
+
+	resp, err := svc.Chat(context.Background(), "question", chat.Config{ContextExpansion: chat.ContextNeighbors})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if resp.Sources[0].Passage != "" || resp.Sources[0].Snippet != "content a" {
+		t.Fatalf("expected snippets without a chunk range reader, got %+v", resp.Sources[0])
+	}
+}
@@ -0,0 +1,207 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fabfab/go-agent/chat"
+	"github.com/fabfab/go-agent/config"
+	"github.com/fabfab/go-agent/llm"
+)
+
+func chunkIDs(chunks []chat.ChunkResult) []string {
+	ids := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		ids[i] = chunk.ChunkID
+	}
+	return ids
+}
+
+func TestHTTPRerankerReordersChunks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("expected bearer token, got %q", got)
+		}
+		var req struct {
+			Model     string   `json:"model"`
+			Query     string   `json:"query"`
+			Documents []string `json:"documents"`
+			TopN      int      `json:"top_n"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		if req.Model != "bge-reranker" || req.Query != "reset a password" || len(req.Documents) != 3 || req.TopN != 3 {
+			t.Errorf("unexpected request: %+v", req)
+		}
+		_, _ = w.Write([]byte(`{"results":[{"index":2,"relevance_score":0.9},{"index":0,"relevance_score":0.4},{"index":1,"relevance_score":0.1}]}`))
+	}))
+	defer server.Close()
+
+	reranker := chat.NewHTTPReranker(server.URL, "bge-reranker", "secret")
+	ranked, err := reranker.Rerank(context.Background(), "reset a password", []chat.ChunkResult{hybridChunk("a"), hybridChunk("b"), hybridChunk("c")})
+	if err != nil {
+		t.Fatalf("rerank: %v", err)
+	}
+	if got := strings.Join(chunkIDs(ranked), ","); got != "c,a,b" {
+		t.Fatalf("expected c,a,b, got %s", got)
+	}
+	if ranked[0].RerankScore != 0.9 {
+		t.Fatalf("expected the endpoint's score, got %f", ranked[0].RerankScore)
+	}
+}
+
+func TestHTTPRerankerReportsStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "model not loaded", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	_, err := chat.NewHTTPReranker(server.URL, "", "").Rerank(context.Background(), "q", []chat.ChunkResult{hybridChunk("a")})
+	if err == nil || !strings.Contains(err.Error(), "model not loaded") {
+		t.Fatalf("expected the endpoint error, got %v", err)
+	}
+}
+
+func TestLLMRerankerListwise(t *testing.T) {
+	client := &scriptedLLM{replies: []string{`{"ranking": [3, 1, 3, 9]}`}}
+	reranker, err := chat.NewLLMReranker(client, config.RerankListwise)
+	if err != nil {
+		t.Fatalf("new reranker: %v", err)
+	}
+
+	ranked, err := reranker.Rerank(context.Background(), "q", []chat.ChunkResult{hybridChunk("a"), hybridChunk("b"), hybridChunk("c")})
+	if err != nil {
+		t.Fatalf("rerank: %v", err)
+	}
+	// Duplicates and unknown numbers are ignored; b was left out and follows.
+	if got := strings.Join(chunkIDs(ranked), ","); got != "c,a,b" {
+		t.Fatalf("expected c,a,b, got %s", got)
+	}
+	if ranked[0].RerankScore != 1 || ranked[2].RerankScore >= ranked[1].RerankScore {
+		t.Fatalf("expected falling scores, got %+v", ranked)
+	}
+	if prompt := client.received[0][len(client.received[0])-1].Content; !strings.Contains(prompt, "[2] content b") {
+		t.Fatalf("expected numbered passages in the prompt, got %q", prompt)
+	}
+}
+
+// passageScoringLLM scores pointwise rerank prompts by the passage they
+// contain.
+type passageScoringLLM struct {
+	mu     sync.Mutex
+	scores map[string]string
+	calls  int
+}
+
+func (s *passageScoringLLM) Generate(_ context.Context, messages []llm.Message) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	prompt := messages[len(messages)-1].Content
+	for passage, score := range s.scores {
+		if strings.HasSuffix(prompt, passage) {
+			return `{"score": ` + score + `}`, nil
+		}
+	}
+	return "", errors.New("unexpected prompt")
+}
+
+var _ llm.Client = (*passageScoringLLM)(nil)
+
+func TestLLMRerankerPointwise(t *testing.T) {
+	client := &passageScoringLLM{scores: map[string]string{"content a": "2", "content b": "9", "content c": "5.5"}}
+	reranker, err := chat.NewLLMReranker(client, config.RerankPointwise)
+	if err != nil {
+		t.Fatalf("new reranker: %v", err)
+	}
+
+	ranked, err := reranker.Rerank(context.Background(), "q", []chat.ChunkResult{hybridChunk("a"), hybridChunk("b"), hybridChunk("c")})
+	if err != nil {
+		t.Fatalf("rerank: %v", err)
+	}
+	if got := strings.Join(chunkIDs(ranked), ","); got != "b,c,a" {
+		t.Fatalf("expected b,c,a, got %s", got)
+	}
+	if client.calls != 3 || ranked[0].RerankScore != 0.9 {
+		t.Fatalf("expected one call per chunk and scores scaled to 0..1, got %d calls and %+v", client.calls, ranked)
+	}
+
+	if _, err := chat.NewLLMReranker(client, "bogus"); err == nil {
+		t.Fatal("expected an unknown mode to be rejected")
+	}
+}
+
+// reversingReranker reverses the candidates and records how many it saw.
+type reversingReranker struct {
+	seen int
+	err  error
+}
+
+func (r *reversingReranker) Rerank(_ context.Context, _ string, chunks []chat.ChunkResult) ([]chat.ChunkResult, error) {
+	r.seen = len(chunks)
+	if r.err != nil {
+		return nil, r.err
+	}
+	reversed := make([]chat.ChunkResult, len(chunks))
+	for i, chunk := range chunks {
+		chunk.RerankScore = float64(i + 1)
+		reversed[len(chunks)-1-i] = chunk
+	}
+	return reversed, nil
+}
+
+func TestChatServiceRerank(t *testing.T) {
+	var retrieved []chat.ChunkResult
+	for i, id := range []string{"a", "b", "c", "d", "e"} {
+		chunk := hybridChunk(id)
+		chunk.Score = 1 - float64(i)/10
+		retrieved = append(retrieved, chunk)
+	}
+	store := &hybridVectorStore{vector: retrieved}
+	reranker := &reversingReranker{}
+	svc := chat.NewService(store, &stubGraphStore{}, &stubEmbedder{vectors: [][]float32{{0.1}}}, &stubLLM{answer: "ok"}, log.New(io.Discard, "", 0), chat.WithReranker(reranker))
+
+	resp, err := svc.Chat(context.Background(), "question", chat.Config{SimilarityLimit: 2, Rerank: true, RerankCandidates: 4})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if reranker.seen != 4 {
+		t.Fatalf("expected 4 candidates to be reranked, got %d", reranker.seen)
+	}
+	got := sourcePaths(resp.Sources)
+	if len(got) != 2 || got[0] != "d.md" || got[1] != "c.md" {
+		t.Fatalf("expected the reranked top two, got %v", got)
+	}
+	if resp.Sources[0].RerankScore != 4 {
+		t.Fatalf("expected rerank scores on sources, got %+v", resp.Sources[0])
+	}
+
+	resp, err = svc.Chat(context.Background(), "question", chat.Config{SimilarityLimit: 2})
+	if err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if got := sourcePaths(resp.Sources); len(got) != 2 || got[0] != "a.md" || resp.Sources[0].RerankScore != 0 {
+		t.Fatalf("expected retrieval order without reranking, got %v", got)
+	}
+
+	reranker.err = errors.New("reranker down")
+	resp, err = svc.Chat(context.Background(), "question", chat.Config{SimilarityLimit: 2, Rerank: true})
+	if err != nil {
+		t.Fatalf("expected reranker failures to keep the retrieval order, got %v", err)
+	}
+	if reranker.seen != 5 {
+		t.Fatalf("expected four times the limit to be retrieved, got %d", reranker.seen)
+	}
+	if got := sourcePaths(resp.Sources); len(got) != 2 || got[0] != "a.md" {
+		t.Fatalf("expected retrieval order after a reranker failure, got %v", got)
+	}
+}
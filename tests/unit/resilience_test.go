@@ -0,0 +1,256 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fabfab/go-agent/embeddings"
+	"github.com/fabfab/go-agent/llm"
+	"github.com/fabfab/go-agent/resilience"
+)
+
+func TestRetryableClassifiesErrors(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&resilience.StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&resilience.StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{fmt.Errorf("wrapped: %w", &resilience.StatusError{StatusCode: http.StatusBadGateway}), true},
+		{&resilience.StatusError{StatusCode: http.StatusBadRequest}, false},
+		{context.DeadlineExceeded, true},
+		{context.Canceled, false},
+		{errors.New("invalid request"), false},
+	}
+	for _, tc := range cases {
+		if got := resilience.Retryable(tc.err); got != tc.want {
+			t.Errorf("Retryable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestExecutorRetriesTransientErrors(t *testing.T) {
+	exec := resilience.NewExecutor(resilience.Policy{MaxRetries: 2, BaseDelay: time.Millisecond})
+
+	attempts := 0
+	err := exec.Do(context.Background(), func(context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return &resilience.StatusError{StatusCode: http.StatusServiceUnavailable, Message: "unavailable"}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected success after retries, got %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestExecutorDoesNotRetryClientErrors(t *testing.T) {
+	exec := resilience.NewExecutor(resilience.Policy{MaxRetries: 3, BaseDelay: time.Millisecond})
+
+	attempts := 0
+	err := exec.Do(context.Background(), func(context.Context) error {
+		attempts++
+		return &resilience.StatusError{StatusCode: http.StatusBadRequest, Message: "bad request"}
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf("expected a single failed attempt, got %d attempts and error %v", attempts, err)
+	}
+}
+
+func TestExecutorAppliesPerCallTimeout(t *testing.T) {
+	exec := resilience.NewExecutor(resilience.Policy{MaxRetries: 1, Timeout: 10 * time.Millisecond})
+
+	attempts := 0
+	err := exec.Do(context.Background(), func(ctx context.Context) error {
+		attempts++
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected timed out call to be retried once, got %d attempts", attempts)
+	}
+}
+
+func TestExecutorCircuitBreakerOpensAndRecovers(t *testing.T) {
+	exec := resilience.NewExecutor(resilience.Policy{BreakerThreshold: 2, BreakerCooldown: 20 * time.Millisecond})
+	failing := func(context.Context) error {
+		return &resilience.StatusError{StatusCode: http.StatusInternalServerError, Message: "boom"}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := exec.Do(context.Background(), failing); errors.Is(err, resilience.ErrCircuitOpen) {
+			t.Fatalf("circuit opened too early on call %d", i+1)
+		}
+	}
+
+	called := false
+	err := exec.Do(context.Background(), func(context.Context) error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, resilience.ErrCircuitOpen) || called {
+		t.Fatalf("expected open circuit to reject the call, got %v (called=%v)", err, called)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := exec.Do(context.Background(), func(context.Context) error { return nil }); err != nil {
+		t.Fatalf("expected trial call after cooldown to succeed, got %v", err)
+	}
+	if err := exec.Do(context.Background(), func(context.Context) error { return nil }); err != nil {
+		t.Fatalf("expected closed circuit after successful trial, got %v", err)
+	}
+}
+
+func TestExecutorCircuitBreakerReleasesCancelledTrial(t *testing.T) {
+	exec := resilience.NewExecutor(resilience.Policy{BreakerThreshold: 1, BreakerCooldown: 10 * time.Millisecond})
+	if err := exec.Do(context.Background(), func(context.Context) error {
+		return &resilience.StatusError{StatusCode: http.StatusInternalServerError, Message: "boom"}
+	}); errors.Is(err, resilience.ErrCircuitOpen) {
+		t.Fatalf("circuit opened too early: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := exec.Do(ctx, func(context.Context) error {
+		cancel()
+		return context.Canceled
+	}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled trial to return context.Canceled, got %v", err)
+	}
+
+	if err := exec.Do(context.Background(), func(context.Context) error { return nil }); err != nil {
+		t.Fatalf("expected a new trial after the cancelled one, got %v", err)
+	}
+}
+
+func TestExecutorBoundsStreamsUntilTheFirstChunk(t *testing.T) {
+	exec := resilience.NewExecutor(resilience.Policy{MaxRetries: 1, Timeout: 20 * time.Millisecond})
+
+	attempts := 0
+	err := exec.DoStream(context.Background(), func(ctx context.Context, _ func()) error {
+		attempts++
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || attempts != 2 {
+		t.Fatalf("expected a stalled stream to time out and be retried, got %v after %d attempts", err, attempts)
+	}
+
+	err = exec.DoStream(context.Background(), func(ctx context.Context, started func()) error {
+		started()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(60 * time.Millisecond):
+			return nil
+		}
+	})
+	if err != nil {
+		t.Fatalf("expected a started stream to outlive the timeout, got %v", err)
+	}
+}
+
+func TestResilientClientRetriesStreamBeforeFirstChunk(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "model is loading", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":"Hello"},"done":true}`+"\n")
+	}))
+	defer server.Close()
+
+	exec := resilience.NewExecutor(resilience.Policy{MaxRetries: 2, BaseDelay: time.Millisecond})
+	client := llm.NewResilientClient(llm.NewOllamaClient(llm.Options{Model: "llama3.1:8b", OllamaHost: server.URL}), exec).(llm.StreamClient)
+
+	var answer string
+	if err := client.GenerateStream(context.Background(), []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}, func(chunk string) error {
+		answer += chunk
+		return nil
+	}); err != nil {
+		t.Fatalf("generate stream: %v", err)
+	}
+	if answer != "Hello" || requests.Load() != 2 {
+		t.Fatalf("expected one retry and a single answer, got %q after %d requests", answer, requests.Load())
+	}
+	if _, ok := client.(llm.ToolClient); !ok {
+		t.Fatal("expected wrapper to keep tool support of the ollama client")
+	}
+}
+
+func TestResilientClientDoesNotRetryStreamAfterOutput(t *testing.T) {
+	exec := resilience.NewExecutor(resilience.Policy{MaxRetries: 2, BaseDelay: time.Millisecond})
+	inner := &flakyStreamLLM{err: &resilience.StatusError{StatusCode: http.StatusBadGateway, Message: "connection lost"}}
+	client := llm.NewResilientClient(inner, exec).(llm.StreamClient)
+
+	var chunks []string
+	err := client.GenerateStream(context.Background(), []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}, func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected stream error to be returned")
+	}
+	if inner.calls != 1 || len(chunks) != 1 {
+		t.Fatalf("expected no retry after output, got %d calls and chunks %v", inner.calls, chunks)
+	}
+	if _, ok := client.(llm.ToolClient); ok {
+		t.Fatal("expected wrapper not to advertise tools the inner client lacks")
+	}
+}
+
+func TestResilientEmbedderRetriesTransientErrors(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"embeddings":[[0.1,0.2,0.3]]}`)
+	}))
+	defer server.Close()
+
+	exec := resilience.NewExecutor(resilience.Policy{MaxRetries: 1, BaseDelay: time.Millisecond})
+	embedder := embeddings.NewResilientEmbedder(embeddings.NewOllamaEmbedder(embeddings.Options{Model: "nomic-embed-text", Dimension: 3, OllamaHost: server.URL}), exec)
+
+	vectors, err := embedder.Embed(context.Background(), []string{"hello"})
+	if err != nil {
+		t.Fatalf("embed: %v", err)
+	}
+	if len(vectors) != 1 || len(vectors[0]) != 3 {
+		t.Fatalf("unexpected vectors: %v", vectors)
+	}
+}
+
+type flakyStreamLLM struct {
+	err   error
+	calls int
+}
+
+func (s *flakyStreamLLM) Generate(context.Context, []llm.Message) (string, error) {
+	return "", s.err
+}
+
+func (s *flakyStreamLLM) GenerateStream(_ context.Context, _ []llm.Message, fn func(string) error) error {
+	s.calls++
+	if err := fn("partial"); err != nil {
+		return err
+	}
+	return s.err
+}
+
+var _ llm.StreamClient = (*flakyStreamLLM)(nil)
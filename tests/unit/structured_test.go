@@ -0,0 +1,173 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fabfab/go-agent/chat"
+	"github.com/fabfab/go-agent/llm"
+)
+
+const ownersSchema = `{
+	"type": "object",
+	"properties": {
+		"items": {
+			"type": "array",
+			"minItems": 1,
+			"items": {
+				"type": "object",
+				"properties": {
+					"owner": {"type": "string", "minLength": 1},
+					"deadline": {"type": ["string", "null"]},
+					"priority": {"type": "integer", "minimum": 1, "maximum": 3},
+					"status": {"enum": ["open", "done"]}
+				},
+				"required": ["owner", "deadline"],
+				"additionalProperties": false
+			}
+		}
+	},
+	"required": ["items"]
+}`
+
+func TestValidateJSON(t *testing.T) {
+	cases := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "valid", data: `{"items":[{"owner":"Ana","deadline":null,"priority":2,"status":"open"}]}`},
+		{name: "missing required", data: `{"items":[{"owner":"Ana"}]}`, wantErr: `$.items[0]: missing required property "deadline"`},
+		{name: "wrong type", data: `{"items":[{"owner":5,"deadline":"2025-01-01"}]}`, wantErr: "$.items[0].owner: expected string, got integer"},
+		{name: "unexpected property", data: `{"items":[{"owner":"Ana","deadline":null,"team":"x"}]}`, wantErr: `unexpected property "team"`},
+		{name: "bounds", data: `{"items":[{"owner":"Ana","deadline":null,"priority":7}]}`, wantErr: "$.items[0].priority: expected a value <= 3"},
+		{name: "integer", data: `{"items":[{"owner":"Ana","deadline":null,"priority":1.5}]}`, wantErr: "expected integer, got number"},
+		{name: "enum", data: `{"items":[{"owner":"Ana","deadline":null,"status":"blocked"}]}`, wantErr: "not one of the allowed values"},
+		{name: "min items", data: `{"items":[]}`, wantErr: "expected at least 1 items"},
+		{name: "not json", data: `owners: Ana`, wantErr: "parse json"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := llm.ValidateJSON(json.RawMessage(ownersSchema), json.RawMessage(tc.data))
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected valid, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestGenerateStructuredRepromptsInvalidOutput(t *testing.T) {
+	model := &scriptedLLM{replies: []string{
+		"Here you go: {\"items\":[{\"owner\":\"Ana\"}]}",
+		"```json\n{\"items\":[{\"owner\":\"Ana\",\"deadline\":\"2025-03-01\"}]}\n```",
+	}}
+
+	result, err := llm.GenerateStructured(context.Background(), model, []llm.Message{{Role: llm.RoleUser, Content: "List owners"}}, json.RawMessage(ownersSchema), 3)
+	if err != nil {
+		t.Fatalf("generate structured: %v", err)
+	}
+	if result.Attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", result.Attempts)
+	}
+	if string(result.Data) != `{"items":[{"owner":"Ana","deadline":"2025-03-01"}]}` {
+		t.Fatalf("unexpected data: %s", result.Data)
+	}
+
+	retry := model.received[1]
+	last := retry[len(retry)-1]
+	if last.Role != llm.RoleUser || !strings.Contains(last.Content, `missing required property "deadline"`) {
+		t.Fatalf("expected re-prompt with validation errors, got %+v", last)
+	}
+	if !strings.Contains(retry[0].Content, `"owner"`) {
+		t.Fatal("expected schema to be described in the system prompt")
+	}
+}
+
+func TestGenerateStructuredGivesUp(t *testing.T) {
+	model := &scriptedLLM{replies: []string{"no", "still no"}}
+
+	_, err := llm.GenerateStructured(context.Background(), model, []llm.Message{{Role: llm.RoleUser, Content: "List owners"}}, json.RawMessage(ownersSchema), 2)
+	if !errors.Is(err, llm.ErrInvalidStructuredOutput) {
+		t.Fatalf("expected ErrInvalidStructuredOutput, got %v", err)
+	}
+	if len(model.received) != 2 {
+		t.Fatalf("expected 2 generations, got %d", len(model.received))
+	}
+}
+
+func TestOllamaClientSendsSchemaAsFormat(t *testing.T) {
+	var received map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":"{\"items\":[{\"owner\":\"Ana\",\"deadline\":null}]}"},"done":true}`)
+	}))
+	defer server.Close()
+
+	client := llm.NewOllamaClient(llm.Options{Model: "llama3.1:8b", OllamaHost: server.URL})
+	result, err := llm.GenerateStructured(context.Background(), client, []llm.Message{{Role: llm.RoleUser, Content: "List owners"}}, json.RawMessage(ownersSchema), 1)
+	if err != nil {
+		t.Fatalf("generate structured: %v", err)
+	}
+	if result.Attempts != 1 {
+		t.Fatalf("expected first attempt to validate, got %d", result.Attempts)
+	}
+	format, ok := received["format"].(map[string]any)
+	if !ok || format["type"] != "object" {
+		t.Fatalf("expected schema in format field, got %#v", received["format"])
+	}
+}
+
+func TestChatServiceExtract(t *testing.T) {
+	embed := &stubEmbedder{vectors: [][]float32{{0.1, 0.2}}}
+	vectors := &stubVectorStore{results: []chat.ChunkResult{{DocumentID: "doc-1", Title: "Plan", Path: "plan.md", Content: "Ana owns the rollout, due 2025-03-01."}}}
+	model := &scriptedLLM{replies: []string{`{"items":[{"owner":"Ana","deadline":"2025-03-01"}]}`}}
+	svc := chat.NewService(vectors, nil, embed, model, log.New(io.Discard, "", 0))
+
+	extraction, err := svc.Extract(context.Background(), "Return the owners and deadlines", json.RawMessage(ownersSchema), chat.Config{})
+	if err != nil {
+		t.Fatalf("extract: %v", err)
+	}
+	if extraction.Attempts != 1 || len(extraction.Sources) != 1 {
+		t.Fatalf("unexpected extraction: %+v", extraction)
+	}
+	prompt := model.received[0][len(model.received[0])-1].Content
+	if !strings.Contains(prompt, "Ana owns the rollout") {
+		t.Fatalf("expected retrieved context in prompt, got %q", prompt)
+	}
+
+	if _, err := svc.Extract(context.Background(), "Return owners", json.RawMessage(`[1,2]`), chat.Config{}); err == nil {
+		t.Fatal("expected invalid schema to be rejected")
+	}
+}
+
+// scriptedLLM returns replies in order and records the messages of each call.
+type scriptedLLM struct {
+	replies  []string
+	received [][]llm.Message
+}
+
+func (s *scriptedLLM) Generate(_ context.Context, messages []llm.Message) (string, error) {
+	s.received = append(s.received, append([]llm.Message(nil), messages...))
+	if len(s.received) > len(s.replies) {
+		return "", errors.New("no scripted reply left")
+	}
+	return s.replies[len(s.received)-1], nil
+}
+
+var _ llm.Client = (*scriptedLLM)(nil)